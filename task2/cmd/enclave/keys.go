@@ -0,0 +1,219 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"enclave-task2/pkg/client"
+)
+
+func (c *cli) key(ctx context.Context, args []string) error {
+	sub, args, err := subcommand("key", args)
+	if err != nil {
+		return err
+	}
+
+	fs := flag.NewFlagSet("key "+sub, flag.ContinueOnError)
+	switch sub {
+	case "create":
+		var opts client.KeyOptions
+		fs.StringVar(&opts.Type, "type", "", "type of the key, the default of the server if empty")
+		fs.StringVar(&opts.Size, "size", "", "size of the key, the default of the server if empty")
+		fs.DurationVar(&opts.TTL, "ttl", 0, "ttl of the key, the default of the server if 0")
+		fs.Uint64Var(&opts.MaxEncryptions, "max-encryptions", 0, "encryptions after which the key must be rotated, unlimited if 0")
+		args, err := c.parse(fs, args, 1, 1)
+		if err != nil {
+			return err
+		}
+
+		if err := c.client.CreateKey(ctx, args[0], &opts); err != nil {
+			return err
+		}
+		c.done("created key %s", args[0])
+
+	case "list":
+		if _, err := c.parse(fs, args, 0, 0); err != nil {
+			return err
+		}
+
+		names, err := c.client.ListKeys(ctx)
+		if err != nil {
+			return err
+		}
+		rows := make([][]string, len(names))
+		for i, name := range names {
+			rows[i] = []string{name}
+		}
+		return c.print(names, rows)
+
+	case "info":
+		args, err := c.parse(fs, args, 1, 1)
+		if err != nil {
+			return err
+		}
+
+		key, err := c.client.GetKey(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		return c.print(key, keyRows(key))
+
+	case "delete":
+		args, err := c.parse(fs, args, 1, 1)
+		if err != nil {
+			return err
+		}
+
+		if err := c.client.DeleteKey(ctx, args[0]); err != nil {
+			return err
+		}
+		c.done("deleted key %s", args[0])
+
+	case "rotate":
+		ttl := fs.Duration("ttl", 0, "ttl of the new key, the one of the current key if 0")
+		force := fs.Bool("force", false, "confirm that the ciphertexts of the current key were migrated")
+		args, err := c.parse(fs, args, 1, 1)
+		if err != nil {
+			return err
+		}
+
+		return c.rotate(ctx, args[0], *ttl, *force)
+
+	default:
+		return fmt.Errorf("%w: unknown subcommand key %q", usageError, sub)
+	}
+
+	return nil
+}
+
+// rotate revokes the key and creates it again with the same parameters and
+// new counters. The ciphertexts of the revoked key can not be decrypted
+// anymore.
+func (c *cli) rotate(ctx context.Context, name string, ttl time.Duration, force bool) error {
+	key, err := c.client.GetKey(ctx, name)
+	if err != nil {
+		return err
+	}
+	if !force {
+		return fmt.Errorf("%w: rotating revokes key %s, its ciphertexts can not be decrypted anymore; decrypt them first and pass -force", usageError, name)
+	}
+
+	// a key which does not expire is created with the default ttl
+	if ttl == 0 && !key.ExpireTime.IsZero() {
+		ttl = key.ExpireTime.Sub(key.CreatedAt).Round(time.Second)
+	}
+	opts := &client.KeyOptions{
+		Type:           key.Type,
+		Size:           key.Size,
+		TTL:            ttl,
+		MaxEncryptions: key.Usage.MaxEncryptions,
+	}
+	if err := c.client.DeleteKey(ctx, name); err != nil {
+		return err
+	}
+	if err := c.client.CreateKey(ctx, name, opts); err != nil {
+		return fmt.Errorf("key %s was revoked but not created again: %w", name, err)
+	}
+
+	key, err = c.client.GetKey(ctx, name)
+	if err != nil {
+		return err
+	}
+	return c.print(key, keyRows(key))
+}
+
+// transit encrypts or decrypts the files in a batch, or stdin.
+func (c *cli) transit(ctx context.Context, op string, args []string) error {
+	fs := flag.NewFlagSet(op, flag.ContinueOnError)
+	out := fs.String("out", "", "output file of a single input, stdout for stdin if empty")
+	force := fs.Bool("force", false, "overwrite the existing output files")
+	args, err := c.parse(fs, args, 1, -1)
+	if err != nil {
+		return err
+	}
+	name, files := args[0], args[1:]
+	if *out != "" && len(files) > 1 {
+		return fmt.Errorf("%w: -out requires a single input", usageError)
+	}
+
+	batch := c.client.EncryptBatch
+	if op == "decrypt" {
+		batch = c.client.DecryptBatch
+	}
+
+	if len(files) == 0 {
+		data, err := io.ReadAll(c.stdin)
+		if err != nil {
+			return err
+		}
+		res, err := batch(ctx, name, [][]byte{data})
+		if err != nil {
+			return err
+		}
+		if *out == "" {
+			_, err := c.stdout.Write(res[0])
+			return err
+		}
+		return writeFile(*out, res[0], *force)
+	}
+
+	inputs := make([][]byte, len(files))
+	for i, path := range files {
+		inputs[i], err = os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+	}
+	res, err := batch(ctx, name, inputs)
+	if err != nil {
+		return err
+	}
+	for i, path := range files {
+		target := cmp.Or(*out, outputPath(op, path))
+		if err := writeFile(target, res[i], *force); err != nil {
+			return err
+		}
+		c.done("%sed %s to %s", op, path, target)
+	}
+
+	return nil
+}
+
+// outputPath is FILE.enc for the encryptions and FILE without .enc for the
+// decryptions, or FILE.dec when it has no .enc suffix.
+func outputPath(op, path string) string {
+	if op == "encrypt" {
+		return path + ".enc"
+	}
+	if trimmed, ok := strings.CutSuffix(path, ".enc"); ok && trimmed != "" {
+		return trimmed
+	}
+
+	return path + ".dec"
+}
+
+// writeFile writes the output of a file, the existing files are only
+// overwritten with force.
+func writeFile(path string, data []byte, force bool) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+
+	f, err := os.OpenFile(path, flags, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,180 @@
+// Command enclave administers the keys and the tokens of a server and
+// encrypts the files with its transit api.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"enclave-task2/pkg/client"
+)
+
+const usage = `Usage: enclave [flags] <command> [arguments]
+
+Commands:
+  key create [-type T] [-size S] [-ttl D] [-max-encryptions N] NAME
+  key list
+  key info NAME
+  key delete NAME
+  key rotate [-ttl D] -force NAME
+  encrypt [-out FILE] [-force] NAME [FILE...]
+  decrypt [-out FILE] [-force] NAME [FILE...]
+  token create [-display-name N] [-policy P]... [-ttl D]
+  token lookup
+  token renew [-increment D]
+  token revoke [TOKEN]
+  token login -role-id ID [-secret-id ID]
+  status
+
+The files are encrypted to FILE.enc and decrypted to FILE without .enc,
+stdin is read when no file is given.
+
+Flags:
+`
+
+// usageError is returned for the invalid command lines, they exit with 2.
+var usageError = errors.New("invalid usage")
+
+// cli runs a command with the client of the server.
+type cli struct {
+	client *client.Client
+	output string
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	err := run(ctx, os.Args[1:], os.Getenv, os.Stdin, os.Stdout, os.Stderr)
+	if err == nil || errors.Is(err, flag.ErrHelp) {
+		return
+	}
+
+	fmt.Fprintln(os.Stderr, "Error:", err)
+	if errors.Is(err, usageError) {
+		os.Exit(2)
+	}
+	os.Exit(1)
+}
+
+func run(ctx context.Context, args []string, getenv func(string) string, stdin io.Reader, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("enclave", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprint(stderr, usage)
+		fs.PrintDefaults()
+	}
+	path := fs.String("config", "", "YAML configuration file, $ENCLAVE_CONFIG or enclave/config.yaml in the user configuration directory")
+	addr := fs.String("addr", "", "address of the server, $ENCLAVE_ADDR")
+	token := fs.String("token", "", "token of the requests, $ENCLAVE_TOKEN")
+	output := fs.String("output", "", "output format: table or json, $ENCLAVE_OUTPUT")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("%w: a command is required", usageError)
+	}
+
+	cfg, err := loadSettings(*path, getenv)
+	if err != nil {
+		return err
+	}
+	cfg.override(settings{Addr: *addr, Token: *token, Output: *output})
+	if cfg.Output != outputTable && cfg.Output != outputJSON {
+		return fmt.Errorf("%w: unknown output %q", usageError, cfg.Output)
+	}
+
+	httpClient, err := cfg.httpClient()
+	if err != nil {
+		return err
+	}
+
+	c := &cli{
+		client: client.New(cfg.Addr, client.WithToken(cfg.Token), client.WithHTTPClient(httpClient)),
+		output: cfg.Output,
+		stdin:  stdin,
+		stdout: stdout,
+		stderr: stderr,
+	}
+
+	cmd, args := fs.Arg(0), fs.Args()[1:]
+	switch cmd {
+	case "key":
+		return c.key(ctx, args)
+	case "encrypt":
+		return c.transit(ctx, "encrypt", args)
+	case "decrypt":
+		return c.transit(ctx, "decrypt", args)
+	case "token":
+		return c.token(ctx, args, getenv)
+	case "status":
+		return c.status(ctx, args)
+	default:
+		fs.Usage()
+		return fmt.Errorf("%w: unknown command %q", usageError, cmd)
+	}
+}
+
+// subcommand returns the subcommand of a command and its arguments.
+func subcommand(cmd string, args []string) (string, []string, error) {
+	if len(args) == 0 {
+		return "", nil, fmt.Errorf("%w: %s requires a subcommand", usageError, cmd)
+	}
+
+	return args[0], args[1:], nil
+}
+
+// parse parses the flags of a command, the arguments left must be between
+// min and max, a negative max is unbounded.
+func (c *cli) parse(fs *flag.FlagSet, args []string, min, max int) ([]string, error) {
+	fs.SetOutput(c.stderr)
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %s", usageError, err)
+	}
+
+	n := fs.NArg()
+	if n < min || (max >= 0 && n > max) {
+		fs.Usage()
+		return nil, fmt.Errorf("%w: %s expects %s", usageError, fs.Name(), arity(min, max))
+	}
+
+	return fs.Args(), nil
+}
+
+func arity(min, max int) string {
+	switch {
+	case min == max && min == 0:
+		return "no argument"
+	case min == max:
+		return fmt.Sprintf("%d argument(s)", min)
+	case max < 0:
+		return fmt.Sprintf("at least %d argument(s)", min)
+	default:
+		return fmt.Sprintf("%d to %d arguments", min, max)
+	}
+}
+
+// stringList is a flag set any number of times.
+type stringList []string
+
+func (l *stringList) String() string {
+	return fmt.Sprint(*l)
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
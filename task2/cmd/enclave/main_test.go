@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"enclave-task2/pkg/auth"
+	"enclave-task2/pkg/common"
+	"enclave-task2/pkg/storage"
+	"enclave-task2/services/server"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+var testSecret = []byte("enclave-secret")
+
+func signToken(t *testing.T, policies ...string) string {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub":      "enclave",
+		"policies": policies,
+		"exp":      time.Now().Add(time.Hour).Unix(),
+	}).SignedString(testSecret)
+	assert.NoError(t, err)
+
+	return token
+}
+
+// testEnv serves the api of a real server and returns the environment of
+// the command, its configuration file holds the address of the server.
+func testEnv(t *testing.T, name string, policies ...string) map[string]string {
+	ctx := common.LoggerWithContext(context.Background(), slog.New(slog.NewTextHandler(t.Output(), nil)))
+	verifier, err := auth.NewVerifier(auth.VerifierConfig{HMACSecret: testSecret})
+	assert.NoError(t, err)
+
+	h, err := server.New(
+		server.WithStorage(storage.NewNamedInMemoryCache(name)),
+		server.WithKeyDefaults("kyber", "512", time.Hour),
+		server.WithJWTVerifier(verifier),
+	).Handler(ctx)
+	assert.NoError(t, err)
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte("addr: "+srv.URL+"\n"), 0o600))
+
+	return map[string]string{"ENCLAVE_CONFIG": path, "ENCLAVE_TOKEN": signToken(t, policies...)}
+}
+
+// runCommand runs the command line with the environment and stdin, it
+// returns its stdout and error.
+func runCommand(t *testing.T, env map[string]string, stdin string, args ...string) (string, error) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	getenv := func(key string) string { return env[key] }
+	err := run(context.Background(), args, getenv, strings.NewReader(stdin), &stdout, &stderr)
+
+	return stdout.String(), err
+}
+
+func TestKeyCommands(t *testing.T) {
+	env := testEnv(t, "enclave-keys", auth.RootPolicy)
+
+	out, err := runCommand(t, env, "", "key", "list")
+	assert.NoError(t, err)
+	assert.Empty(t, out)
+
+	out, err = runCommand(t, env, "", "key", "create", "-max-encryptions", "10", "payments")
+	assert.NoError(t, err)
+	assert.Equal(t, "created key payments\n", out)
+	_, err = runCommand(t, env, "", "key", "create", "billing")
+	assert.NoError(t, err)
+
+	out, err = runCommand(t, env, "", "key", "list")
+	assert.NoError(t, err)
+	assert.Equal(t, "billing\npayments\n", out)
+
+	out, err = runCommand(t, env, "", "-output", "json", "key", "list")
+	assert.NoError(t, err)
+	var names []string
+	assert.NoError(t, json.Unmarshal([]byte(out), &names))
+	assert.Equal(t, []string{"billing", "payments"}, names)
+
+	out, err = runCommand(t, env, "", "key", "info", "payments")
+	assert.NoError(t, err)
+	assert.Contains(t, out, "max_encryptions  10\n")
+
+	ciphertext, err := runCommand(t, env, "hello", "encrypt", "payments")
+	assert.NoError(t, err)
+	out, err = runCommand(t, env, ciphertext, "decrypt", "payments")
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", out)
+
+	out, err = runCommand(t, env, "", "key", "delete", "billing")
+	assert.NoError(t, err)
+	assert.Equal(t, "deleted key billing\n", out)
+	out, err = runCommand(t, env, "", "key", "list")
+	assert.NoError(t, err)
+	assert.Equal(t, "payments\n", out)
+
+	// the keys are filtered by the policies of the caller
+	env["ENCLAVE_TOKEN"] = signToken(t, "none")
+	out, err = runCommand(t, env, "", "key", "list")
+	assert.NoError(t, err)
+	assert.Empty(t, out)
+}
+
+func TestUsage(t *testing.T) {
+	env := testEnv(t, "enclave-usage", auth.RootPolicy)
+
+	for _, args := range [][]string{
+		{},
+		{"unknown"},
+		{"key"},
+		{"key", "unknown"},
+		{"key", "list", "extra"},
+		{"key", "info"},
+		{"-output", "yaml", "key", "list"},
+		{"encrypt", "-out", "out.enc", "payments", "a", "b"},
+	} {
+		_, err := runCommand(t, env, "", args...)
+		assert.ErrorIs(t, err, usageError, "%v", args)
+	}
+
+	// the errors of the server are not usage errors
+	_, err := runCommand(t, env, "", "key", "info", "missing")
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, usageError)
+}
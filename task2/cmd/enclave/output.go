@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"enclave-task2/pkg/client"
+)
+
+// print writes v as JSON, or the rows as a table.
+func (c *cli) print(v any, rows [][]string) error {
+	if c.output == outputJSON {
+		enc := json.NewEncoder(c.stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+
+	w := tabwriter.NewWriter(c.stdout, 0, 0, 2, ' ', 0)
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+
+	return w.Flush()
+}
+
+// done reports the commands without result, only in the table output to
+// keep the JSON output parseable.
+func (c *cli) done(format string, args ...any) {
+	if c.output == outputTable {
+		fmt.Fprintf(c.stdout, format+"\n", args...)
+	}
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+
+	return t.Local().Format(time.RFC3339)
+}
+
+func keyRows(key *client.Key) [][]string {
+	maxEncryptions := "unlimited"
+	if key.Usage.MaxEncryptions > 0 {
+		maxEncryptions = fmt.Sprint(key.Usage.MaxEncryptions)
+	}
+
+	return [][]string{
+		{"name", key.Name},
+		{"type", key.Type},
+		{"size", key.Size},
+		{"version", fmt.Sprint(key.Version)},
+		{"creation_time", formatTime(key.CreatedAt)},
+		{"expire_time", formatTime(key.ExpireTime)},
+		{"encryptions", fmt.Sprint(key.Usage.Encryptions)},
+		{"max_encryptions", maxEncryptions},
+		{"decryptions", fmt.Sprint(key.Usage.Decryptions)},
+		{"errors", fmt.Sprint(key.Usage.Errors)},
+		{"bytes_processed", fmt.Sprint(key.Usage.BytesProcessed)},
+		{"last_used", formatTime(key.Usage.LastUsed)},
+	}
+}
+
+func tokenRows(token *client.Token) [][]string {
+	var rows [][]string
+	if token.Token != "" {
+		rows = append(rows, []string{"token", token.Token})
+	}
+
+	return append(rows,
+		[]string{"accessor", token.Accessor},
+		[]string{"display_name", token.DisplayName},
+		[]string{"policies", strings.Join(token.Policies, ",")},
+		[]string{"ttl", token.TTL},
+		[]string{"creation_time", formatTime(token.CreatedAt)},
+		[]string{"expire_time", formatTime(token.ExpireTime)},
+	)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	defaultAddr = "http://localhost:8080"
+
+	outputTable = "table"
+	outputJSON  = "json"
+)
+
+// settings are read from the configuration file, overridden by the
+// environment and then by the flags.
+type settings struct {
+	Addr   string `yaml:"addr"`
+	Token  string `yaml:"token"`
+	Output string `yaml:"output"`
+
+	// CACert verifies the certificate of the server, ClientCert and
+	// ClientKey authenticate the client with the cert auth.
+	CACert     string `yaml:"ca_cert"`
+	ClientCert string `yaml:"client_cert"`
+	ClientKey  string `yaml:"client_key"`
+}
+
+// loadSettings reads the configuration file at path, $ENCLAVE_CONFIG or
+// enclave/config.yaml in the user configuration directory when it exists,
+// then the environment.
+func loadSettings(path string, getenv func(string) string) (settings, error) {
+	cfg := settings{Addr: defaultAddr, Output: outputTable}
+
+	path = cmp.Or(path, getenv("ENCLAVE_CONFIG"))
+	required := path != ""
+	if !required {
+		dir, err := os.UserConfigDir()
+		if err == nil {
+			path = filepath.Join(dir, "enclave", "config.yaml")
+		}
+	}
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		switch {
+		case errors.Is(err, fs.ErrNotExist) && !required:
+		case err != nil:
+			return cfg, err
+		default:
+			dec := yaml.NewDecoder(bytes.NewReader(data))
+			dec.KnownFields(true)
+			if err := dec.Decode(&cfg); err != nil && err != io.EOF {
+				return cfg, fmt.Errorf("%s: %w", path, err)
+			}
+		}
+	}
+
+	cfg.override(settings{
+		Addr:       getenv("ENCLAVE_ADDR"),
+		Token:      getenv("ENCLAVE_TOKEN"),
+		Output:     getenv("ENCLAVE_OUTPUT"),
+		CACert:     getenv("ENCLAVE_CACERT"),
+		ClientCert: getenv("ENCLAVE_CLIENT_CERT"),
+		ClientKey:  getenv("ENCLAVE_CLIENT_KEY"),
+	})
+
+	return cfg, nil
+}
+
+// override replaces the settings by the ones set in o.
+func (s *settings) override(o settings) {
+	s.Addr = cmp.Or(o.Addr, s.Addr)
+	s.Token = cmp.Or(o.Token, s.Token)
+	s.Output = cmp.Or(o.Output, s.Output)
+	s.CACert = cmp.Or(o.CACert, s.CACert)
+	s.ClientCert = cmp.Or(o.ClientCert, s.ClientCert)
+	s.ClientKey = cmp.Or(o.ClientKey, s.ClientKey)
+}
+
+// httpClient returns the client of the requests, with the CA and the client
+// certificate of the settings.
+func (s *settings) httpClient() (*http.Client, error) {
+	if s.CACert == "" && s.ClientCert == "" {
+		return http.DefaultClient, nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if s.CACert != "" {
+		data, err := os.ReadFile(s.CACert)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("%s: no certificate found", s.CACert)
+		}
+	}
+	if s.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(s.ClientCert, s.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	return &http.Client{Transport: transport}, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"slices"
+
+	"enclave-task2/pkg/client"
+)
+
+func (c *cli) token(ctx context.Context, args []string, getenv func(string) string) error {
+	sub, args, err := subcommand("token", args)
+	if err != nil {
+		return err
+	}
+
+	fs := flag.NewFlagSet("token "+sub, flag.ContinueOnError)
+	var token *client.Token
+	switch sub {
+	case "create":
+		var opts client.TokenOptions
+		var policies stringList
+		fs.StringVar(&opts.DisplayName, "display-name", "", "name of the token in the audit log")
+		fs.Var(&policies, "policy", "policy of the token, repeated for each policy; the ones of the caller by default")
+		fs.DurationVar(&opts.TTL, "ttl", 0, "ttl of the token, the default of the server if 0")
+		if _, err := c.parse(fs, args, 0, 0); err != nil {
+			return err
+		}
+		opts.Policies = policies
+
+		token, err = c.client.CreateToken(ctx, opts)
+
+	case "lookup":
+		if _, err := c.parse(fs, args, 0, 0); err != nil {
+			return err
+		}
+
+		token, err = c.client.LookupSelf(ctx)
+
+	case "renew":
+		increment := fs.Duration("increment", 0, "extension of the token, its ttl if 0")
+		if _, err := c.parse(fs, args, 0, 0); err != nil {
+			return err
+		}
+
+		token, err = c.client.RenewSelf(ctx, *increment)
+
+	case "revoke":
+		args, err := c.parse(fs, args, 0, 1)
+		if err != nil {
+			return err
+		}
+
+		if len(args) == 0 {
+			if err := c.client.RevokeSelf(ctx); err != nil {
+				return err
+			}
+			c.done("revoked the token of the client")
+			return nil
+		}
+		if err := c.client.RevokeToken(ctx, args[0]); err != nil {
+			return err
+		}
+		c.done("revoked the token")
+		return nil
+
+	case "login":
+		roleID := fs.String("role-id", getenv("ENCLAVE_ROLE_ID"), "role id of the AppRole, $ENCLAVE_ROLE_ID")
+		secretID := fs.String("secret-id", "", "secret id of the AppRole, $ENCLAVE_SECRET_ID to keep it out of the process list")
+		if _, err := c.parse(fs, args, 0, 0); err != nil {
+			return err
+		}
+		if *secretID == "" {
+			*secretID = getenv("ENCLAVE_SECRET_ID")
+		}
+		if *roleID == "" || *secretID == "" {
+			return fmt.Errorf("%w: token login requires a role id and a secret id", usageError)
+		}
+
+		token, err = c.client.LoginAppRole(ctx, *roleID, *secretID)
+
+	default:
+		return fmt.Errorf("%w: unknown subcommand token %q", usageError, sub)
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.print(token, tokenRows(token))
+}
+
+func (c *cli) status(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("status", flag.ContinueOnError)
+	if _, err := c.parse(fs, args, 0, 0); err != nil {
+		return err
+	}
+
+	status, err := c.client.Status(ctx)
+	if err != nil {
+		return err
+	}
+
+	rows := [][]string{{"CHECK", "STATUS", "ERROR"}, {"server", status.Status, ""}}
+	for _, name := range slices.Sorted(maps.Keys(status.Checks)) {
+		check := status.Checks[name]
+		rows = append(rows, []string{name, check.Status, check.Error})
+	}
+	if err := c.print(status, rows); err != nil {
+		return err
+	}
+
+	if !status.Ready() {
+		return errors.New("the server is not ready")
+	}
+
+	return nil
+}
@@ -2,35 +2,207 @@ package main
 
 import (
 	"context"
+	"crypto"
+	"errors"
+	"flag"
+	"fmt"
 	"log/slog"
+	"maps"
+	"net"
 	"os"
+	"strings"
+	"time"
 
+	"enclave-task2/pkg/audit"
+	"enclave-task2/pkg/auth"
+	"enclave-task2/pkg/cluster"
 	"enclave-task2/pkg/common"
+	"enclave-task2/pkg/config"
+	"enclave-task2/pkg/keys"
+	"enclave-task2/pkg/ratelimit"
 	"enclave-task2/pkg/storage"
+	"enclave-task2/pkg/tracing"
 	"enclave-task2/services/server"
+
+	_ "github.com/jackc/pgx/v5/stdlib" // registers the "pgx" driver of the postgres storage
+	"golang.org/x/time/rate"
 )
 
 func main() {
 	ctx := context.Background()
-	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	cfg, err := config.Load(os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		config.Usage(os.Stdout)
+		return
+	}
+	if err != nil {
+		slog.Error("Invalid configuration", slog.String("error", err.Error()))
+		os.Exit(2)
+	}
+
+	// the level is changed by the reloads
+	level := &slog.LevelVar{}
+	l, _ := cfg.Level()
+	level.Set(l)
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level}))
 
 	ctx = common.LoggerWithContext(ctx, logger)
 
-	if err := run(ctx); err != nil {
+	if err := run(ctx, cfg, level); err != nil {
 		logger.Error("Application error", slog.String("error", err.Error()))
 		os.Exit(1)
 	}
 }
 
-func run(ctx context.Context) error {
+func run(ctx context.Context, cfg config.Config, level *slog.LevelVar) error {
 	logger := common.GetLoggerFromContext(ctx)
 
 	logger.Info("Application started")
 
-	storage := storage.NewInMemoryCache()
+	shutdownTracing, err := tracing.Setup(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		timeoutCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(timeoutCtx); err != nil {
+			logger.Error("failed to flush the spans", "error", err.Error())
+		}
+	}()
+
+	var peerTLS *cluster.PeerTLS
+	if cfg.Cluster.CA != "" {
+		var err error
+		peerTLS, err = cluster.LoadPeerTLS(cfg.Cluster.CA, cfg.Cluster.Cert, cfg.Cluster.Key)
+		if err != nil {
+			return err
+		}
+	}
+
+	var store server.Storage
+	switch driver := cfg.Storage.Driver; driver {
+	case "memory":
+		store = storage.NewInMemoryCacheWithSize(cfg.Storage.CacheBytes)
+	case storage.DialectSQLite, storage.DialectPostgres:
+		sqlStorage, err := storage.NewSQLStorage(ctx, driver, cfg.Storage.DSN)
+		if err != nil {
+			return err
+		}
+		defer sqlStorage.Close()
+
+		go sqlStorage.CheckTTL(ctx)
+		store = sqlStorage
+	case "raft":
+		raftStorage, err := newRaftStorage(cfg, peerTLS)
+		if err != nil {
+			return err
+		}
+		defer raftStorage.Close()
+
+		// the token store is initialized through the leader
+		waitCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		err = raftStorage.WaitForLeader(waitCtx)
+		cancel()
+		if err != nil {
+			return err
+		}
+
+		go raftStorage.CheckTTL(ctx)
+		store = raftStorage
+	default:
+		return fmt.Errorf("unknown storage driver: %s", driver)
+	}
+
+	verifier, err := newJWTVerifier(cfg.Auth.JWT)
+	if err != nil {
+		return err
+	}
+
+	policies, err := loadPolicies(cfg.Auth.PolicyDir)
+	if err != nil {
+		return err
+	}
+	acl := auth.NewACL(policies...)
+
+	reload := &reloader{
+		args:     os.Args[1:],
+		started:  cfg,
+		cfg:      cfg,
+		policies: policies,
+		level:    level,
+		acl:      acl,
+		peerTLS:  peerTLS,
+	}
+
+	opts := []server.Option{
+		server.WithStorage(store),
+		server.WithAddr(cfg.Addr, cfg.PeerAddr),
+		server.WithHTTPLimits(server.HTTPLimits{
+			ReadHeaderTimeout: cfg.HTTP.ReadHeaderTimeout,
+			ReadTimeout:       cfg.HTTP.ReadTimeout,
+			WriteTimeout:      cfg.HTTP.WriteTimeout,
+			IdleTimeout:       cfg.HTTP.IdleTimeout,
+			MaxHeaderBytes:    int(cfg.HTTP.MaxHeaderBytes),
+			MaxBodyBytes:      cfg.HTTP.MaxBodyBytes,
+			ShutdownDelay:     cfg.HTTP.ShutdownDelay,
+			ShutdownTimeout:   cfg.HTTP.ShutdownTimeout,
+		}),
+		server.WithKeyDefaults(cfg.Keys.Type, cfg.Keys.Size, cfg.Keys.TTL),
+		server.WithKeyRateLimit(ratelimit.Limit{Rate: cfg.RateLimit.KeyRate, Burst: int(cfg.RateLimit.KeyBurst)}),
+		server.WithHealthRateLimit(healthLimit(cfg.RateLimit), int(cfg.RateLimit.HealthBurst)),
+		server.WithAuthRateLimit(ratelimit.Limit{Rate: cfg.RateLimit.AuthRate, Burst: int(cfg.RateLimit.AuthBurst)}),
+		server.WithPeerTLS(peerTLS),
+		server.WithJWTVerifier(verifier),
+		server.WithACL(acl),
+		server.WithTokenMaxTTL(cfg.Auth.TokenMaxTTL),
+		server.WithReload(reload.Reload),
+	}
+	if cfg.GRPCAddr != "" {
+		opts = append(opts, server.WithGRPC(cfg.GRPCAddr))
+	}
+	if cfg.Keys.PoolDepth > 0 {
+		opts = append(opts, server.WithKeyPool(keys.NewPool(int(cfg.Keys.PoolDepth), int(cfg.Keys.PoolWorkers), cfg.KeyPool()...)))
+	}
+	if cfg.TLS.CertFile != "" {
+		tlsConfig, err := newTLSConfig(cfg.TLS)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, server.WithTLS(tlsConfig))
+	}
+	if path := cfg.Auth.CertRolesFile; path != "" {
+		roles, err := loadCertRoles(path)
+		if err != nil {
+			return err
+		}
+		reload.certAuth = auth.NewCertAuth(roles...)
+		reload.certRoles = roles
+		opts = append(opts, server.WithCertAuth(reload.certAuth))
+	}
+	auditor, err := newAuditLogger(cfg.Audit)
+	if err != nil {
+		return err
+	}
+	if auditor != nil {
+		defer auditor.Close()
+		opts = append(opts, server.WithAudit(auditor))
+	}
+	if mode := cfg.Cluster.Mode; mode != "" {
+		self := selfURL(cfg, peerTLS)
+
+		discovery, err := cluster.NewDiscoverer(mode, self, cfg.Cluster.Peers, cfg.Cluster.DNSSRV)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, server.WithPeerDiscovery(self, discovery))
+		reload.discovery = discovery
+	}
 
 	// start services
-	err := server.New(storage).Start(ctx)
+	reload.server = server.New(opts...)
+	err = reload.server.Start(ctx)
 	if err != nil {
 		return err
 	}
@@ -38,3 +210,143 @@ func run(ctx context.Context) error {
 	logger.Info("Application stopped")
 	return nil
 }
+
+// healthLimit returns the rate of the health probes, zero disables it.
+func healthLimit(cfg config.RateLimitConfig) rate.Limit {
+	if cfg.HealthRate == 0 {
+		return rate.Inf
+	}
+
+	return rate.Limit(cfg.HealthRate)
+}
+
+// selfURL is the peer URL of this instance as seen by the other peers, it
+// defaults to the peer address on the loopback interface.
+func selfURL(cfg config.Config, peerTLS *cluster.PeerTLS) string {
+	if cfg.Cluster.SelfURL != "" {
+		return cfg.Cluster.SelfURL
+	}
+
+	host, port, err := net.SplitHostPort(cfg.PeerAddr)
+	if err != nil || host == "" {
+		host = "127.0.0.1"
+	}
+	scheme := "http"
+	if peerTLS != nil {
+		scheme = "https"
+	}
+
+	return scheme + "://" + net.JoinHostPort(host, port)
+}
+
+// newRaftStorage configures the raft node. The servers of the initial
+// cluster are listed as peer-url=raft-addr.
+func newRaftStorage(cfg config.Config, peerTLS *cluster.PeerTLS) (*storage.RaftStorage, error) {
+	if peerTLS == nil {
+		return nil, cluster.PeerTLSRequiredError
+	}
+
+	var servers []storage.RaftServer
+	for _, s := range cfg.Raft.Servers {
+		srvID, addr, ok := strings.Cut(s, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid raft server: %s", s)
+		}
+		servers = append(servers, storage.RaftServer{ID: srvID, Address: addr})
+	}
+
+	return storage.NewRaftStorage(storage.RaftOptions{
+		ID:            selfURL(cfg, peerTLS),
+		BindAddr:      cfg.Raft.Bind,
+		AdvertiseAddr: cfg.Raft.Advertise,
+		Servers:       servers,
+		DataDir:       cfg.Raft.Dir,
+		TLSConfig:     peerTLS.Config(),
+	})
+}
+
+// newJWTVerifier configures the api authentication. The public keys are
+// PEM files as kid=path or path for the tokens without kid, the JWKS file
+// is a JSON Web Key Set. It is nil without keys, only the service tokens
+// are accepted then.
+func newJWTVerifier(jwt config.JWTConfig) (*auth.Verifier, error) {
+	cfg := auth.VerifierConfig{
+		Issuer:     jwt.Issuer,
+		Audience:   jwt.Audience,
+		HMACSecret: []byte(jwt.Secret),
+		Leeway:     jwt.Leeway,
+		PublicKeys: make(map[string]crypto.PublicKey),
+	}
+
+	for _, entry := range jwt.PublicKeys {
+		kid, path, ok := strings.Cut(entry, "=")
+		if !ok {
+			kid, path = "", entry
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		key, err := auth.ParsePublicKeyPEM(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		cfg.PublicKeys[kid] = key
+	}
+
+	if path := jwt.JWKSFile; path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		keys, err := auth.ParseJWKS(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		maps.Copy(cfg.PublicKeys, keys)
+	}
+
+	if len(cfg.HMACSecret) == 0 && len(cfg.PublicKeys) == 0 {
+		return nil, nil
+	}
+
+	return auth.NewVerifier(cfg)
+}
+
+// newAuditLogger configures the audit sinks, it is nil without sink. The
+// syslog sink is "local" or network://addr, e.g. udp://localhost:514.
+func newAuditLogger(cfg config.AuditConfig) (*audit.Logger, error) {
+	var sinks []audit.Sink
+	if path := cfg.File; path != "" {
+		sink, err := audit.NewFileSink(path)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	if addr := cfg.Syslog; addr != "" {
+		var network string
+		if addr == "local" {
+			addr = ""
+		} else if n, a, ok := strings.Cut(addr, "://"); ok {
+			network, addr = n, a
+		} else {
+			return nil, fmt.Errorf("invalid audit syslog: %s", addr)
+		}
+
+		sink, err := audit.NewSyslogSink(network, addr, "enclave")
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	if cfg.Stdout {
+		sinks = append(sinks, audit.NewWriterSink(os.Stdout))
+	}
+	if len(sinks) == 0 {
+		return nil, nil
+	}
+
+	return audit.NewLogger([]byte(cfg.HMACKey), sinks...)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"os"
+	"reflect"
+	"strings"
+
+	"enclave-task2/pkg/auth"
+	"enclave-task2/pkg/cluster"
+	"enclave-task2/pkg/config"
+	"enclave-task2/services/server"
+)
+
+// reloader swaps the components which can change without a restart, the
+// keys in memory are kept. The other settings are reported as requiring a
+// restart.
+type reloader struct {
+	args []string
+	// started is the configuration read on startup, cfg the one of the
+	// last reload.
+	started   config.Config
+	cfg       config.Config
+	policies  []*auth.Policy
+	level     *slog.LevelVar
+	acl       *auth.ACL
+	discovery cluster.Discoverer
+	server    *server.Server
+	// peerTLS and certAuth are nil when the cluster tls and the cert auth
+	// are disabled, they can only be enabled with a restart.
+	peerTLS   *cluster.PeerTLS
+	certAuth  *auth.CertAuth
+	certRoles []auth.CertRole
+}
+
+// Reload reads the configuration again. Every component is loaded before
+// any is swapped, the running ones are kept on error.
+func (r *reloader) Reload(ctx context.Context) (server.ReloadResult, error) {
+	var res server.ReloadResult
+
+	cfg, err := config.Load(r.args, os.Getenv)
+	if err != nil {
+		return res, err
+	}
+	level, _ := cfg.Level()
+
+	// TLS can not be enabled nor disabled on a running listener
+	var tlsConfig *tls.Config
+	if cfg.TLS.CertFile != "" && r.started.TLS.CertFile != "" {
+		tlsConfig, err = newTLSConfig(cfg.TLS)
+		if err != nil {
+			return res, err
+		}
+	}
+
+	policies, err := loadPolicies(cfg.Auth.PolicyDir)
+	if err != nil {
+		return res, err
+	}
+
+	// the cluster CA is kept, the peers would not trust each other while
+	// they are reloaded one by one
+	var peerCert *tls.Certificate
+	if r.peerTLS != nil && cfg.Cluster.Cert != "" && cfg.Cluster.Key != "" {
+		cert, err := cluster.LoadPeerCertificate(cfg.Cluster.Cert, cfg.Cluster.Key)
+		if err != nil {
+			return res, err
+		}
+		peerCert = &cert
+	}
+
+	var certRoles []auth.CertRole
+	if r.certAuth != nil && cfg.Auth.CertRolesFile != "" {
+		certRoles, err = loadCertRoles(cfg.Auth.CertRolesFile)
+		if err != nil {
+			return res, err
+		}
+	}
+
+	static, _ := r.discovery.(*cluster.Static)
+
+	for _, name := range config.Diff(r.started, cfg) {
+		switch {
+		case name == "log_level", name == "auth.policy_dir":
+		case name == "cluster.peers" && static != nil:
+		case strings.HasPrefix(name, "tls.") && tlsConfig != nil:
+		case (name == "cluster.tls_cert" || name == "cluster.tls_key") && peerCert != nil:
+		case name == "auth.cert_roles_file" && certRoles != nil:
+		default:
+			res.RestartRequired = append(res.RestartRequired, name)
+		}
+	}
+
+	if cfg.LogLevel != r.cfg.LogLevel {
+		r.level.Set(level)
+		res.Changed = append(res.Changed, "log_level")
+	}
+	if tlsConfig != nil {
+		changed, err := r.server.SetTLSConfig(tlsConfig)
+		if err != nil {
+			return res, err
+		}
+		if changed {
+			res.Changed = append(res.Changed, "tls")
+		}
+	}
+	if !reflect.DeepEqual(policies, r.policies) {
+		r.acl.Set(policies...)
+		r.policies = policies
+		res.Changed = append(res.Changed, "policies")
+	}
+	if static != nil && static.SetPeers(cfg.Cluster.Peers) {
+		res.Changed = append(res.Changed, "peers")
+	}
+	if peerCert != nil && r.peerTLS.SetCertificate(*peerCert) {
+		res.Changed = append(res.Changed, "peer_tls")
+	}
+	if certRoles != nil && !reflect.DeepEqual(certRoles, r.certRoles) {
+		r.certAuth.SetRoles(certRoles...)
+		r.certRoles = certRoles
+		res.Changed = append(res.Changed, "cert_roles")
+	}
+
+	r.cfg = cfg
+
+	return res, nil
+}
+
+// newTLSConfig loads the TLS configuration of the api.
+func newTLSConfig(cfg config.TLSConfig) (*tls.Config, error) {
+	return server.NewTLSConfig(server.TLSOptions{
+		CertFile:     cfg.CertFile,
+		KeyFile:      cfg.KeyFile,
+		ClientCAFile: cfg.ClientCAFile,
+		MinVersion:   cfg.MinVersion,
+		CipherSuites: cfg.CipherSuites,
+	})
+}
+
+// loadCertRoles reads the roles of the cert auth.
+func loadCertRoles(path string) ([]auth.CertRole, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	roles, err := auth.ParseCertRoles(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return roles, nil
+}
+
+// loadPolicies loads the ACL policies, there are none without directory.
+func loadPolicies(dir string) ([]*auth.Policy, error) {
+	if dir == "" {
+		return nil, nil
+	}
+
+	return auth.LoadPolicies(dir)
+}
@@ -0,0 +1,207 @@
+// Package audit records the requests of the api in a hash chained log.
+package audit
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	TypeRequest  = "request"
+	TypeResponse = "response"
+
+	hmacPrefix = "hmac-sha256:"
+)
+
+var (
+	// NoSinkError is returned when the entry could not be written to any
+	// sink, the request must be refused.
+	NoSinkError = errors.New("no audit sink could be written")
+	// NoHMACKeyError is returned when the logger has no key to HMAC the
+	// sensitive fields.
+	NoHMACKeyError = errors.New("audit requires an hmac key")
+	// BrokenChainError is returned when an entry was modified, removed or
+	// inserted.
+	BrokenChainError = errors.New("audit hash chain is broken")
+)
+
+// Entry is a line of the audit log. The entries are chained: the hash of
+// an entry covers its content and the hash of the previous one.
+type Entry struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	Auth     Auth      `json:"auth"`
+	Request  Request   `json:"request"`
+	Response *Response `json:"response,omitempty"`
+
+	PrevHash string `json:"prev_hash"`
+	Hash     string `json:"hash"`
+}
+
+// Auth is the identity of the caller.
+type Auth struct {
+	Subject  string   `json:"subject,omitempty"`
+	Accessor string   `json:"accessor,omitempty"`
+	Policies []string `json:"policies,omitempty"`
+	// Token is HMAC'd, the HMAC of a known token can be computed to find
+	// its entries.
+	Token string `json:"token,omitempty"`
+	// SecretID is the HMAC'd secret id of an AppRole login.
+	SecretID string `json:"secret_id,omitempty"`
+}
+
+// Request describes the request.
+type Request struct {
+	// ID is the X-Request-ID of the request, it is found in the logs too.
+	ID string `json:"id,omitempty"`
+	// Operation is the pattern of the route, e.g. "POST /transit/encrypt/{name}".
+	Operation  string `json:"operation"`
+	Method     string `json:"method"`
+	Path       string `json:"path"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	KeyName    string `json:"key_name,omitempty"`
+	KeyVersion uint64 `json:"key_version,omitempty"`
+}
+
+// Response describes the outcome of the request.
+type Response struct {
+	Status  int    `json:"status"`
+	Latency string `json:"latency"`
+}
+
+// Logger writes the entries to its sinks. It fails only when no sink could
+// be written.
+type Logger struct {
+	key   []byte
+	sinks []Sink
+
+	mu   sync.Mutex
+	prev string
+}
+
+// NewLogger creates a logger HMAC'ing the sensitive fields with the key. The
+// chain is resumed from the last entry of the first sink knowing it.
+func NewLogger(key []byte, sinks ...Sink) (*Logger, error) {
+	if len(key) == 0 {
+		return nil, NoHMACKeyError
+	}
+
+	l := &Logger{key: key, sinks: sinks}
+	for _, s := range sinks {
+		if r, ok := s.(interface{ LastHash() string }); ok && r.LastHash() != "" {
+			l.prev = r.LastHash()
+			break
+		}
+	}
+
+	return l, nil
+}
+
+// HMAC returns the HMAC of the value as written in the entries.
+func (l *Logger) HMAC(value string) string {
+	mac := hmac.New(sha256.New, l.key)
+	mac.Write([]byte(value))
+	return hmacPrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Log HMACs the sensitive fields of the entry, chains it and writes it to
+// the sinks. NoSinkError is returned if none of them could be written.
+func (l *Logger) Log(e Entry) error {
+	if e.Auth.Token != "" {
+		e.Auth.Token = l.HMAC(e.Auth.Token)
+	}
+	if e.Auth.SecretID != "" {
+		e.Auth.SecretID = l.HMAC(e.Auth.SecretID)
+	}
+	e.Time = e.Time.UTC()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e.PrevHash = l.prev
+	hash, err := e.ComputeHash()
+	if err != nil {
+		return err
+	}
+	e.Hash = hash
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	var errs []error
+	for _, s := range l.sinks {
+		if err := s.Write(line); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) == len(l.sinks) {
+		return fmt.Errorf("%w: %w", NoSinkError, errors.Join(errs...))
+	}
+
+	l.prev = e.Hash
+
+	return nil
+}
+
+// Close closes the sinks.
+func (l *Logger) Close() error {
+	var errs []error
+	for _, s := range l.sinks {
+		errs = append(errs, s.Close())
+	}
+
+	return errors.Join(errs...)
+}
+
+// ComputeHash returns the hash of the entry, it covers every field but the
+// hash itself.
+func (e Entry) ComputeHash() (string, error) {
+	e.Hash = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Verify checks the chain of a log written by a Logger. It returns the
+// number of entries and the hash of the last one.
+func Verify(r io.Reader) (int, string, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+
+	var prev string
+	n := 0
+	for scanner.Scan() {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return n, prev, fmt.Errorf("entry %d: %w", n+1, err)
+		}
+
+		hash, err := e.ComputeHash()
+		if err != nil {
+			return n, prev, err
+		}
+		if hash != e.Hash || n > 0 && e.PrevHash != prev {
+			return n, prev, fmt.Errorf("%w at entry %d", BrokenChainError, n+1)
+		}
+
+		prev = e.Hash
+		n++
+	}
+
+	return n, prev, scanner.Err()
+}
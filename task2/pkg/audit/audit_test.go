@@ -0,0 +1,121 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type failingSink struct{}
+
+func (failingSink) Write([]byte) error { return errors.New("disk full") }
+func (failingSink) Close() error       { return nil }
+
+func TestLogger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	file, err := NewFileSink(path)
+	assert.NoError(t, err)
+	var stdout bytes.Buffer
+
+	logger, err := NewLogger([]byte("secret"), file, NewWriterSink(&stdout))
+	assert.NoError(t, err)
+
+	for i := range 3 {
+		err := logger.Log(Entry{
+			Time:    time.Now(),
+			Type:    TypeRequest,
+			Auth:    Auth{Subject: "ci", Token: "ens.token", SecretID: "secret-id"},
+			Request: Request{Operation: "POST /transit/encrypt/{name}", KeyName: "key", KeyVersion: uint64(i)},
+		})
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, logger.Close())
+
+	// every sink receives the same chain
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, stdout.String(), string(data))
+
+	n, last, err := Verify(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	// the token and the secret id are HMAC'd
+	assert.NotContains(t, string(data), "ens.token")
+	assert.Contains(t, string(data), logger.HMAC("ens.token"))
+	assert.NotContains(t, string(data), `"secret-id"`)
+	assert.Contains(t, string(data), logger.HMAC("secret-id"))
+
+	// the chain is resumed from the file
+	file, err = NewFileSink(path)
+	assert.NoError(t, err)
+	assert.Equal(t, last, file.LastHash())
+	logger, err = NewLogger([]byte("secret"), file)
+	assert.NoError(t, err)
+	assert.NoError(t, logger.Log(Entry{Type: TypeRequest}))
+	assert.NoError(t, logger.Close())
+
+	data, err = os.ReadFile(path)
+	assert.NoError(t, err)
+	n, _, err = Verify(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, 4, n)
+}
+
+func TestVerifyTampering(t *testing.T) {
+	var out bytes.Buffer
+	logger, err := NewLogger([]byte("secret"), NewWriterSink(&out))
+	assert.NoError(t, err)
+	for _, key := range []string{"a", "b", "c"} {
+		assert.NoError(t, logger.Log(Entry{Type: TypeRequest, Request: Request{KeyName: key}}))
+	}
+	lines := strings.SplitAfter(strings.TrimSpace(out.String()), "\n")
+
+	// modified entry
+	var e Entry
+	assert.NoError(t, json.Unmarshal([]byte(lines[1]), &e))
+	e.Request.KeyName = "z"
+	modified, err := json.Marshal(e)
+	assert.NoError(t, err)
+	_, _, err = Verify(strings.NewReader(lines[0] + string(modified) + "\n" + lines[2]))
+	assert.ErrorIs(t, err, BrokenChainError)
+
+	// removed entry
+	_, _, err = Verify(strings.NewReader(lines[0] + lines[2]))
+	assert.ErrorIs(t, err, BrokenChainError)
+
+	// rehashed entry still breaks the next link
+	e.Hash, err = e.ComputeHash()
+	assert.NoError(t, err)
+	rehashed, err := json.Marshal(e)
+	assert.NoError(t, err)
+	n, _, err := Verify(strings.NewReader(lines[0] + string(rehashed) + "\n" + lines[2]))
+	assert.ErrorIs(t, err, BrokenChainError)
+	assert.Equal(t, 2, n)
+}
+
+func TestLoggerFailClosed(t *testing.T) {
+	_, err := NewLogger(nil)
+	assert.Equal(t, NoHMACKeyError, err)
+
+	var out bytes.Buffer
+	logger, err := NewLogger([]byte("secret"), failingSink{}, NewWriterSink(&out))
+	assert.NoError(t, err)
+	assert.NoError(t, logger.Log(Entry{Type: TypeRequest}))
+	assert.NotEmpty(t, out.String())
+
+	logger, err = NewLogger([]byte("secret"), failingSink{})
+	assert.NoError(t, err)
+	assert.ErrorIs(t, logger.Log(Entry{Type: TypeRequest}), NoSinkError)
+
+	logger, err = NewLogger([]byte("secret"))
+	assert.NoError(t, err)
+	assert.ErrorIs(t, logger.Log(Entry{Type: TypeRequest}), NoSinkError)
+}
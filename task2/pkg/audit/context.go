@@ -0,0 +1,50 @@
+package audit
+
+import "context"
+
+const RecordContextKey = "audit"
+
+// Record collects what the handlers know about the request, e.g. the
+// identity of the caller once authenticated or the key they used, it
+// completes the response entry.
+type Record struct {
+	Auth       Auth
+	KeyName    string
+	KeyVersion uint64
+}
+
+// WithRecord puts an empty record on the context.
+func WithRecord(ctx context.Context) (context.Context, *Record) {
+	r := &Record{}
+	return context.WithValue(ctx, RecordContextKey, r), r
+}
+
+// SetAuth records the identity of the caller, its credentials are kept.
+func SetAuth(ctx context.Context, auth Auth) {
+	if r, ok := ctx.Value(RecordContextKey).(*Record); ok {
+		r.Auth.Subject = auth.Subject
+		r.Auth.Accessor = auth.Accessor
+		r.Auth.Policies = auth.Policies
+	}
+}
+
+// SetSecretID records the secret id of an AppRole login, it is HMAC'd.
+func SetSecretID(ctx context.Context, secretID string) {
+	if r, ok := ctx.Value(RecordContextKey).(*Record); ok {
+		r.Auth.SecretID = secretID
+	}
+}
+
+// SetKey records the name of the key used by the request.
+func SetKey(ctx context.Context, name string) {
+	if r, ok := ctx.Value(RecordContextKey).(*Record); ok {
+		r.KeyName = name
+	}
+}
+
+// SetKeyVersion records the version of the key used by the request.
+func SetKeyVersion(ctx context.Context, version uint64) {
+	if r, ok := ctx.Value(RecordContextKey).(*Record); ok {
+		r.KeyVersion = version
+	}
+}
@@ -0,0 +1,129 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/syslog"
+	"os"
+	"sync"
+)
+
+// Sink receives the JSON lines of the audit log.
+type Sink interface {
+	Write(line []byte) error
+	Close() error
+}
+
+// FileSink appends the entries to a file.
+type FileSink struct {
+	f    *os.File
+	last string
+}
+
+// NewFileSink opens the file in append mode, creating it if needed. The hash
+// of its last entry is kept to resume the chain.
+func NewFileSink(path string) (*FileSink, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit file: %w", err)
+	}
+
+	last, err := lastHash(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to read audit file: %w", err)
+	}
+
+	return &FileSink{f: f, last: last}, nil
+}
+
+// LastHash is the hash of the last entry of the file when it was opened.
+func (s *FileSink) LastHash() string {
+	return s.last
+}
+
+func (s *FileSink) Write(line []byte) error {
+	_, err := s.f.Write(line)
+	return err
+}
+
+func (s *FileSink) Close() error {
+	return s.f.Close()
+}
+
+// lastHash reads the hash of the last line of the file.
+func lastHash(f *os.File) (string, error) {
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return "", err
+	}
+
+	data = bytes.TrimRight(data, "\n")
+	if len(data) == 0 {
+		return "", nil
+	}
+	if i := bytes.LastIndexByte(data, '\n'); i >= 0 {
+		data = data[i+1:]
+	}
+
+	var e Entry
+	if err := json.Unmarshal(data, &e); err != nil {
+		return "", err
+	}
+
+	return e.Hash, nil
+}
+
+// SyslogSink sends the entries to a syslog daemon.
+type SyslogSink struct {
+	w *syslog.Writer
+}
+
+// NewSyslogSink connects to the syslog daemon at addr over network, e.g.
+// "udp" and "localhost:514". The local socket is used when both are empty.
+func NewSyslogSink(network, addr, tag string) (*SyslogSink, error) {
+	w, err := syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_AUTH, tag)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to syslog: %w", err)
+	}
+
+	return &SyslogSink{w: w}, nil
+}
+
+func (s *SyslogSink) Write(line []byte) error {
+	return s.w.Info(string(bytes.TrimRight(line, "\n")))
+}
+
+func (s *SyslogSink) Close() error {
+	return s.w.Close()
+}
+
+// WriterSink writes the entries to a writer, e.g. os.Stdout.
+type WriterSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{w: w}
+}
+
+func (s *WriterSink) Write(line []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.w.Write(line)
+	return err
+}
+
+// Close closes the writer if it is a closer other than the standard
+// outputs.
+func (s *WriterSink) Close() error {
+	if c, ok := s.w.(io.Closer); ok && s.w != os.Stdout && s.w != os.Stderr {
+		return c.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,413 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"enclave-task2/pkg/storage"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultRoleTokenTTL is the ttl of the tokens issued on login, they
+	// are meant to be short-lived.
+	DefaultRoleTokenTTL = time.Hour
+
+	roleEntryPrefix     = "auth/approle/role/"
+	secretIDEntryPrefix = "auth/approle/secret-id/"
+)
+
+var (
+	RoleNotFoundError       = errors.New("role not found")
+	InvalidRoleError        = errors.New("invalid role")
+	InvalidCredentialsError = errors.New("invalid role id or secret id")
+)
+
+// RoleConfig configures an AppRole.
+type RoleConfig struct {
+	Policies []string
+	// TokenTTL defaults to DefaultRoleTokenTTL.
+	TokenTTL time.Duration
+	// SecretIDTTL and SecretIDNumUses bound the secret ids, zero is
+	// unlimited.
+	SecretIDTTL     time.Duration
+	SecretIDNumUses uint64
+	// BoundCIDRs restricts the addresses the role can login from.
+	BoundCIDRs []string
+}
+
+// Role describes an AppRole.
+type Role struct {
+	Name            string   `json:"name"`
+	RoleID          string   `json:"role_id"`
+	Policies        []string `json:"policies"`
+	TokenTTL        string   `json:"token_ttl"`
+	SecretIDTTL     string   `json:"secret_id_ttl"`
+	SecretIDNumUses uint64   `json:"secret_id_num_uses"`
+	BoundCIDRs      []string `json:"bound_cidrs,omitempty"`
+}
+
+// SecretID describes a secret id, it never holds the secret id itself.
+type SecretID struct {
+	Accessor   string    `json:"secret_id_accessor"`
+	NumUses    uint64    `json:"secret_id_num_uses"`
+	CIDRs      []string  `json:"cidr_list,omitempty"`
+	CreatedAt  time.Time `json:"creation_time"`
+	ExpireTime time.Time `json:"expiration_time,omitzero"`
+}
+
+// roleData is the data of the entry of a role.
+type roleData struct {
+	RoleID   string   `json:"role_id"`
+	Policies []string `json:"policies,omitempty"`
+	// TokenTTL is the ttl of the tokens issued on login.
+	TokenTTL time.Duration `json:"token_ttl"`
+	// SecretIDTTL and SecretIDNumUses bound the secret ids generated for
+	// the role, zero is unlimited.
+	SecretIDTTL     time.Duration `json:"secret_id_ttl,omitempty"`
+	SecretIDNumUses uint64        `json:"secret_id_num_uses,omitempty"`
+	// BoundCIDRs restricts the addresses the role can login from.
+	BoundCIDRs []string `json:"bound_cidrs,omitempty"`
+}
+
+// secretIDData is the data of the entry of a secret id, the entry expires
+// with the secret id.
+type secretIDData struct {
+	RoleName string `json:"role_name"`
+	// RoleID is the id of the role when the secret id was generated, the
+	// secret id is void once the role is recreated.
+	RoleID string `json:"role_id"`
+	// NumUses is the number of logins left, zero is unlimited.
+	NumUses uint64 `json:"num_uses,omitempty"`
+	// CIDRs restricts the addresses the secret id can login from.
+	CIDRs []string `json:"cidrs,omitempty"`
+}
+
+// RolePath is the policy path of the role.
+func RolePath(name string) string {
+	return roleEntryPrefix + name
+}
+
+// AppRoleStore manages the AppRoles, machines login with the id of a role
+// and one of its secret ids to get a token with the policies of the role.
+// The secret ids are kept in the entry storage under their SHA-256 hash.
+type AppRoleStore struct {
+	storage TokenStorage
+	tokens  *TokenStore
+}
+
+func NewAppRoleStore(storage TokenStorage, tokens *TokenStore) *AppRoleStore {
+	return &AppRoleStore{storage: storage, tokens: tokens}
+}
+
+// SetRole creates the role or updates its configuration, the role id is
+// kept on updates.
+func (s *AppRoleStore) SetRole(ctx context.Context, name string, cfg RoleConfig) (*Role, error) {
+	if name == "" || strings.Contains(name, "/") {
+		return nil, fmt.Errorf("%w: invalid name %q", InvalidRoleError, name)
+	}
+	if err := validatePolicies(cfg.Policies); err != nil {
+		return nil, err
+	}
+	cidrs, err := parseCIDRs(cfg.BoundCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.TokenTTL <= 0 {
+		cfg.TokenTTL = DefaultRoleTokenTTL
+	}
+
+	for range maxUpdateAttempts {
+		entry, data, err := s.role(ctx, name)
+		if err == RoleNotFoundError {
+			id, err := randomID()
+			if err != nil {
+				return nil, err
+			}
+			entry, data = storage.NewEntry(RolePath(name), 0), &roleData{RoleID: id}
+		} else if err != nil {
+			return nil, err
+		}
+
+		version := entry.Version
+		data.Policies = cfg.Policies
+		data.TokenTTL = cfg.TokenTTL
+		data.SecretIDTTL = cfg.SecretIDTTL
+		data.SecretIDNumUses = cfg.SecretIDNumUses
+		data.BoundCIDRs = cidrs
+		if err := entry.Encode(data); err != nil {
+			return nil, err
+		}
+
+		if version == 0 {
+			err = s.storage.CreateEntry(ctx, entry)
+		} else {
+			err = s.storage.CompareAndSwapEntry(ctx, entry, version)
+		}
+		if err == storage.AlreadyExistsError || err == storage.VersionMismatchError || err == storage.NotFoundError {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return describeRole(name, data), nil
+	}
+
+	return nil, storage.VersionMismatchError
+}
+
+// Role returns the role, RoleNotFoundError if it does not exist.
+func (s *AppRoleStore) Role(ctx context.Context, name string) (*Role, error) {
+	_, data, err := s.role(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return describeRole(name, data), nil
+}
+
+// DeleteRole deletes the role, its secret ids can not be used anymore.
+func (s *AppRoleStore) DeleteRole(ctx context.Context, name string) error {
+	if _, _, err := s.role(ctx, name); err != nil {
+		return err
+	}
+
+	return s.storage.Delete(ctx, RolePath(name))
+}
+
+// GenerateSecretID issues a secret id for the role. The cidrs restrict the
+// addresses it can login from on top of the ones bound to the role.
+func (s *AppRoleStore) GenerateSecretID(ctx context.Context, name string, cidrs []string) (string, *SecretID, error) {
+	cidrs, err := parseCIDRs(cidrs)
+	if err != nil {
+		return "", nil, err
+	}
+
+	_, role, err := s.role(ctx, name)
+	if err != nil {
+		return "", nil, err
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, err
+	}
+	raw := base64.RawURLEncoding.EncodeToString(secret)
+
+	data := &secretIDData{RoleName: name, RoleID: role.RoleID, NumUses: role.SecretIDNumUses, CIDRs: cidrs}
+	entry := storage.NewEntry(secretIDEntryName(raw), role.SecretIDTTL)
+	if err := entry.Encode(data); err != nil {
+		return "", nil, err
+	}
+	if err := s.storage.CreateEntry(ctx, entry); err != nil {
+		return "", nil, err
+	}
+
+	return raw, describeSecretID(entry, data), nil
+}
+
+// Login exchanges the role id and secret id for a token with the policies
+// of the role. InvalidCredentialsError is returned when the secret id is
+// unknown, expired, exhausted or does not belong to the role, or when addr
+// is outside the bound CIDRs.
+func (s *AppRoleStore) Login(ctx context.Context, roleID, secretID string, addr net.IP) (string, *Token, error) {
+	if roleID == "" || secretID == "" {
+		return "", nil, InvalidCredentialsError
+	}
+
+	_, secret, err := s.secretID(ctx, secretID)
+	if err != nil {
+		return "", nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(secret.RoleID), []byte(roleID)) != 1 {
+		return "", nil, InvalidCredentialsError
+	}
+
+	_, role, err := s.role(ctx, secret.RoleName)
+	if err == RoleNotFoundError || err == nil && role.RoleID != secret.RoleID {
+		return "", nil, InvalidCredentialsError
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	if !containsAddr(role.BoundCIDRs, addr) || !containsAddr(secret.CIDRs, addr) {
+		return "", nil, InvalidCredentialsError
+	}
+
+	// the secret id is only used once the login is valid
+	if err := s.consume(ctx, secretID); err != nil {
+		return "", nil, err
+	}
+
+	return s.tokens.Create(ctx, "approle-"+secret.RoleName, role.Policies, role.TokenTTL)
+}
+
+// consume uses the secret id once. The last use expires the entry in place,
+// concurrent logins can not use it anymore.
+func (s *AppRoleStore) consume(ctx context.Context, raw string) error {
+	for range maxUpdateAttempts {
+		entry, data, err := s.secretID(ctx, raw)
+		if err != nil {
+			return err
+		}
+		if data.NumUses == 0 {
+			return nil
+		}
+
+		version := entry.Version
+		data.NumUses--
+		if data.NumUses == 0 {
+			entry.TTL = time.Since(entry.CreatedAt)
+		}
+		if err := entry.Encode(data); err != nil {
+			return err
+		}
+
+		err = s.storage.CompareAndSwapEntry(ctx, entry, version)
+		if err == storage.VersionMismatchError {
+			continue
+		}
+		if err == storage.NotFoundError {
+			return InvalidCredentialsError
+		}
+		if err != nil {
+			return err
+		}
+		if data.NumUses == 0 {
+			s.storage.Delete(ctx, entry.Name)
+		}
+
+		return nil
+	}
+
+	return storage.VersionMismatchError
+}
+
+// secretID returns the secret id, InvalidCredentialsError if it is unknown
+// or expired.
+func (s *AppRoleStore) secretID(ctx context.Context, raw string) (*storage.Entry, *secretIDData, error) {
+	entry, err := s.storage.GetEntry(ctx, secretIDEntryName(raw))
+	if err == storage.NotFoundError {
+		return nil, nil, InvalidCredentialsError
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if entry.Expired() {
+		return nil, nil, InvalidCredentialsError
+	}
+
+	var data secretIDData
+	if err := entry.Decode(&data); err != nil {
+		return nil, nil, err
+	}
+
+	return entry, &data, nil
+}
+
+func (s *AppRoleStore) role(ctx context.Context, name string) (*storage.Entry, *roleData, error) {
+	entry, err := s.storage.GetEntry(ctx, RolePath(name))
+	if err == storage.NotFoundError {
+		return nil, nil, RoleNotFoundError
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var data roleData
+	if err := entry.Decode(&data); err != nil {
+		return nil, nil, err
+	}
+
+	return entry, &data, nil
+}
+
+func parseCIDRs(cidrs []string) ([]string, error) {
+	var parsed []string
+	for _, c := range cidrs {
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(c))
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid cidr %q", InvalidRoleError, c)
+		}
+		parsed = append(parsed, prefix.Masked().String())
+	}
+
+	return parsed, nil
+}
+
+// containsAddr reports whether addr is in one of the cidrs, any address is
+// allowed without cidrs.
+func containsAddr(cidrs []string, addr net.IP) bool {
+	if len(cidrs) == 0 {
+		return true
+	}
+
+	ip, ok := netip.AddrFromSlice(addr)
+	if !ok {
+		return false
+	}
+	ip = ip.Unmap()
+
+	for _, c := range cidrs {
+		if prefix, err := netip.ParsePrefix(c); err == nil && prefix.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func randomID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(id), nil
+}
+
+func secretIDEntryName(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return secretIDEntryPrefix + hex.EncodeToString(sum[:])
+}
+
+func describeRole(name string, data *roleData) *Role {
+	r := &Role{
+		Name:            name,
+		RoleID:          data.RoleID,
+		Policies:        data.Policies,
+		TokenTTL:        data.TokenTTL.String(),
+		SecretIDTTL:     data.SecretIDTTL.String(),
+		SecretIDNumUses: data.SecretIDNumUses,
+		BoundCIDRs:      data.BoundCIDRs,
+	}
+	if r.Policies == nil {
+		r.Policies = []string{}
+	}
+
+	return r
+}
+
+func describeSecretID(entry *storage.Entry, data *secretIDData) *SecretID {
+	s := &SecretID{
+		Accessor:  strings.TrimPrefix(entry.Name, secretIDEntryPrefix)[:accessorSize],
+		NumUses:   data.NumUses,
+		CIDRs:     data.CIDRs,
+		CreatedAt: entry.CreatedAt,
+	}
+	if entry.TTL > 0 {
+		s.ExpireTime = entry.CreatedAt.Add(entry.TTL)
+	}
+
+	return s
+}
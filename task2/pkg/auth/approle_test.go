@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"context"
+	"enclave-task2/pkg/storage"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAppRoleStore(t *testing.T) {
+	ctx := context.Background()
+	cache := storage.NewNamedInMemoryCache("approle")
+	tokens := NewTokenStore(cache)
+	approles := NewAppRoleStore(cache, tokens)
+	local := net.ParseIP("127.0.0.1")
+
+	_, err := approles.Role(ctx, "ci")
+	assert.Equal(t, RoleNotFoundError, err)
+
+	role, err := approles.SetRole(ctx, "ci", RoleConfig{Policies: []string{"payments"}, TokenTTL: 10 * time.Minute})
+	assert.NoError(t, err)
+	assert.Equal(t, "ci", role.Name)
+	assert.NotEmpty(t, role.RoleID)
+
+	// the role id is kept on updates
+	updated, err := approles.SetRole(ctx, "ci", RoleConfig{Policies: []string{"payments", "billing"}})
+	assert.NoError(t, err)
+	assert.Equal(t, role.RoleID, updated.RoleID)
+	assert.Equal(t, DefaultRoleTokenTTL.String(), updated.TokenTTL)
+
+	secretID, info, err := approles.GenerateSecretID(ctx, "ci", nil)
+	assert.NoError(t, err)
+	assert.Len(t, info.Accessor, accessorSize)
+	assert.True(t, info.ExpireTime.IsZero())
+
+	raw, token, err := approles.Login(ctx, role.RoleID, secretID, local)
+	assert.NoError(t, err)
+	assert.Equal(t, "approle-ci", token.DisplayName)
+	assert.Equal(t, []string{"payments", "billing"}, token.Policies)
+	assert.WithinDuration(t, time.Now().Add(DefaultRoleTokenTTL), token.ExpireTime, time.Second)
+
+	looked, err := tokens.Lookup(ctx, raw)
+	assert.NoError(t, err)
+	assert.Equal(t, token.Accessor, looked.Accessor)
+
+	// invalid credentials
+	_, _, err = approles.Login(ctx, "other-role-id", secretID, local)
+	assert.Equal(t, InvalidCredentialsError, err)
+	_, _, err = approles.Login(ctx, role.RoleID, "unknown", local)
+	assert.Equal(t, InvalidCredentialsError, err)
+	_, _, err = approles.Login(ctx, role.RoleID, "", local)
+	assert.Equal(t, InvalidCredentialsError, err)
+
+	// recreating the role voids its secret ids
+	assert.NoError(t, approles.DeleteRole(ctx, "ci"))
+	assert.Equal(t, RoleNotFoundError, approles.DeleteRole(ctx, "ci"))
+	recreated, err := approles.SetRole(ctx, "ci", RoleConfig{})
+	assert.NoError(t, err)
+	assert.NotEqual(t, role.RoleID, recreated.RoleID)
+	_, _, err = approles.Login(ctx, recreated.RoleID, secretID, local)
+	assert.Equal(t, InvalidCredentialsError, err)
+
+	// invalid roles
+	_, err = approles.SetRole(ctx, "a/b", RoleConfig{})
+	assert.True(t, errors.Is(err, InvalidRoleError))
+	_, err = approles.SetRole(ctx, "ci", RoleConfig{BoundCIDRs: []string{"not-a-cidr"}})
+	assert.True(t, errors.Is(err, InvalidRoleError))
+	_, err = approles.SetRole(ctx, "ci", RoleConfig{Policies: []string{""}})
+	assert.True(t, errors.Is(err, InvalidPoliciesError))
+	_, _, err = approles.GenerateSecretID(ctx, "unknown", nil)
+	assert.Equal(t, RoleNotFoundError, err)
+}
+
+func TestAppRoleSecretIDLimits(t *testing.T) {
+	ctx := context.Background()
+	cache := storage.NewNamedInMemoryCache("approle-limits")
+	tokens := NewTokenStore(cache)
+	approles := NewAppRoleStore(cache, tokens)
+	local := net.ParseIP("127.0.0.1")
+
+	t.Run("uses", func(t *testing.T) {
+		role, err := approles.SetRole(ctx, "uses", RoleConfig{SecretIDNumUses: 3})
+		assert.NoError(t, err)
+		secretID, info, err := approles.GenerateSecretID(ctx, "uses", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(3), info.NumUses)
+
+		// concurrent logins can not exceed the uses
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		var succeeded int
+		for range 10 {
+			wg.Go(func() {
+				if _, _, err := approles.Login(ctx, role.RoleID, secretID, local); err == nil {
+					mu.Lock()
+					succeeded++
+					mu.Unlock()
+				}
+			})
+		}
+		wg.Wait()
+		assert.Equal(t, 3, succeeded)
+
+		_, _, err = approles.Login(ctx, role.RoleID, secretID, local)
+		assert.Equal(t, InvalidCredentialsError, err)
+	})
+
+	t.Run("ttl", func(t *testing.T) {
+		role, err := approles.SetRole(ctx, "ttl", RoleConfig{SecretIDTTL: 50 * time.Millisecond})
+		assert.NoError(t, err)
+		secretID, info, err := approles.GenerateSecretID(ctx, "ttl", nil)
+		assert.NoError(t, err)
+		assert.WithinDuration(t, time.Now().Add(50*time.Millisecond), info.ExpireTime, time.Second)
+
+		_, _, err = approles.Login(ctx, role.RoleID, secretID, local)
+		assert.NoError(t, err)
+
+		time.Sleep(100 * time.Millisecond)
+		_, _, err = approles.Login(ctx, role.RoleID, secretID, local)
+		assert.Equal(t, InvalidCredentialsError, err)
+	})
+
+	t.Run("cidrs", func(t *testing.T) {
+		role, err := approles.SetRole(ctx, "cidrs", RoleConfig{BoundCIDRs: []string{"10.0.0.0/8", "127.0.0.1/32"}})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"10.0.0.0/8", "127.0.0.1/32"}, role.BoundCIDRs)
+
+		secretID, _, err := approles.GenerateSecretID(ctx, "cidrs", []string{"10.1.0.0/16"})
+		assert.NoError(t, err)
+
+		_, _, err = approles.Login(ctx, role.RoleID, secretID, net.ParseIP("10.1.2.3"))
+		assert.NoError(t, err)
+		// bound to the role but not to the secret id
+		_, _, err = approles.Login(ctx, role.RoleID, secretID, local)
+		assert.Equal(t, InvalidCredentialsError, err)
+		_, _, err = approles.Login(ctx, role.RoleID, secretID, net.ParseIP("192.168.1.1"))
+		assert.Equal(t, InvalidCredentialsError, err)
+		_, _, err = approles.Login(ctx, role.RoleID, secretID, nil)
+		assert.Equal(t, InvalidCredentialsError, err)
+
+		_, _, err = approles.GenerateSecretID(ctx, "cidrs", []string{"10.1.0.0/33"})
+		assert.True(t, errors.Is(err, InvalidRoleError))
+	})
+}
@@ -0,0 +1,144 @@
+package auth
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	// InvalidCertificateError is returned when no cert role matches the
+	// client certificate.
+	InvalidCertificateError = errors.New("no cert role matches the certificate")
+	// ClientCAsRequiredError is returned when the cert auth is enabled
+	// without client CAs on the api listener.
+	ClientCAsRequiredError = errors.New("cert auth requires the client CAs of the api listener")
+)
+
+// CertRole grants policies to the client certificates verified by the api
+// listener. The allowed names are globs, a certificate matches the role if
+// it matches every non empty list of the role.
+type CertRole struct {
+	Name     string   `json:"name"`
+	Policies []string `json:"policies"`
+
+	AllowedCommonNames []string `json:"allowed_common_names"`
+	AllowedDNSSANs     []string `json:"allowed_dns_sans"`
+	AllowedEmailSANs   []string `json:"allowed_email_sans"`
+	AllowedURISANs     []string `json:"allowed_uri_sans"`
+}
+
+// ParseCertRoles parses a JSON list of cert roles.
+func ParseCertRoles(data []byte) ([]CertRole, error) {
+	var roles []CertRole
+	if err := json.Unmarshal(data, &roles); err != nil {
+		return nil, fmt.Errorf("invalid cert roles: %w", err)
+	}
+
+	for _, r := range roles {
+		if r.Name == "" {
+			return nil, fmt.Errorf("invalid cert roles: missing name")
+		}
+		if err := validatePolicies(r.Policies); err != nil {
+			return nil, fmt.Errorf("cert role %s: %w", r.Name, err)
+		}
+		for _, globs := range [][]string{r.AllowedCommonNames, r.AllowedDNSSANs, r.AllowedEmailSANs, r.AllowedURISANs} {
+			for _, g := range globs {
+				if _, err := path.Match(g, ""); err != nil {
+					return nil, fmt.Errorf("cert role %s: invalid glob %q", r.Name, g)
+				}
+			}
+		}
+	}
+
+	return roles, nil
+}
+
+// CertAuth maps the client certificates to policies.
+type CertAuth struct {
+	mu    sync.RWMutex
+	roles []CertRole
+}
+
+func NewCertAuth(roles ...CertRole) *CertAuth {
+	return &CertAuth{roles: roles}
+}
+
+// SetRoles replaces the roles, the next requests are granted the policies
+// of the new ones.
+func (a *CertAuth) SetRoles(roles ...CertRole) {
+	a.mu.Lock()
+	a.roles = roles
+	a.mu.Unlock()
+}
+
+// Claims returns the claims of the client certificate, granted the
+// policies of all the matching roles. The certificate must have been
+// verified against the client CAs beforehand.
+func (a *CertAuth) Claims(cert *x509.Certificate) (*Claims, error) {
+	a.mu.RLock()
+	roles := a.roles
+	a.mu.RUnlock()
+
+	var policies []string
+	matched := false
+	for _, r := range roles {
+		if !r.matches(cert) {
+			continue
+		}
+		matched = true
+		for _, p := range r.Policies {
+			if !slices.Contains(policies, p) {
+				policies = append(policies, p)
+			}
+		}
+	}
+	if !matched {
+		return nil, InvalidCertificateError
+	}
+
+	return &Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   cert.Subject.CommonName,
+			ID:        cert.SerialNumber.Text(16),
+			ExpiresAt: jwt.NewNumericDate(cert.NotAfter),
+		},
+		Policies: policies,
+	}, nil
+}
+
+func (r *CertRole) matches(cert *x509.Certificate) bool {
+	var uris []string
+	for _, u := range cert.URIs {
+		uris = append(uris, u.String())
+	}
+
+	return matchAny(r.AllowedCommonNames, []string{cert.Subject.CommonName}) &&
+		matchAny(r.AllowedDNSSANs, cert.DNSNames) &&
+		matchAny(r.AllowedEmailSANs, cert.EmailAddresses) &&
+		matchAny(r.AllowedURISANs, uris)
+}
+
+// matchAny reports whether one of the names matches one of the globs, any
+// name is allowed without globs.
+func matchAny(globs, names []string) bool {
+	if len(globs) == 0 {
+		return true
+	}
+
+	for _, g := range globs {
+		for _, n := range names {
+			if ok, _ := path.Match(g, n); ok && n != "" {
+				return true
+			}
+		}
+	}
+
+	return false
+}
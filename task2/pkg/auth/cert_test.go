@@ -0,0 +1,80 @@
+package auth
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCertAuth(t *testing.T) {
+	roles, err := ParseCertRoles([]byte(`[
+		{"name": "ci", "policies": ["payments"], "allowed_common_names": ["ci-*"], "allowed_dns_sans": ["*.ci.example.com"]},
+		{"name": "billing", "policies": ["billing", "payments"], "allowed_uri_sans": ["spiffe://example.com/billing/*"]},
+		{"name": "any", "policies": ["default"], "allowed_email_sans": ["*@example.com"]}
+	]`))
+	assert.NoError(t, err)
+	certAuth := NewCertAuth(roles...)
+
+	cert := func(cn string, dns []string, emails []string, uris ...string) *x509.Certificate {
+		c := &x509.Certificate{
+			SerialNumber:   big.NewInt(42),
+			Subject:        pkix.Name{CommonName: cn},
+			DNSNames:       dns,
+			EmailAddresses: emails,
+			NotAfter:       time.Now().Add(time.Hour),
+		}
+		for _, u := range uris {
+			parsed, err := url.Parse(u)
+			assert.NoError(t, err)
+			c.URIs = append(c.URIs, parsed)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name     string
+		cert     *x509.Certificate
+		policies []string
+	}{
+		{"common name and dns", cert("ci-runner", []string{"a.ci.example.com"}, nil), []string{"payments"}},
+		{"common name only", cert("ci-runner", []string{"a.example.com"}, nil), nil},
+		{"uri", cert("svc", nil, nil, "spiffe://example.com/billing/api"), []string{"billing", "payments"}},
+		{"uri other path", cert("svc", nil, nil, "spiffe://example.com/billing/api/v2"), nil},
+		{"several roles", cert("ci-runner", []string{"a.ci.example.com"}, []string{"ops@example.com"}), []string{"payments", "default"}},
+		{"no role", cert("unknown", nil, nil), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := certAuth.Claims(tt.cert)
+			if tt.policies == nil {
+				assert.Equal(t, InvalidCertificateError, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.policies, claims.Policies)
+			assert.Equal(t, tt.cert.Subject.CommonName, claims.Subject)
+			assert.Equal(t, "2a", claims.ID)
+		})
+	}
+
+	_, err = ParseCertRoles([]byte(`[{"policies": ["a"]}]`))
+	assert.Error(t, err)
+	_, err = ParseCertRoles([]byte(`[{"name": "bad", "allowed_dns_sans": ["[a-"]}]`))
+	assert.Error(t, err)
+	_, err = ParseCertRoles([]byte(`[{"name": "bad", "policies": ["a,b"]}]`))
+	assert.ErrorIs(t, err, InvalidPoliciesError)
+
+	// the roles are swapped on reload
+	certAuth.SetRoles(CertRole{Name: "ops", Policies: []string{"ops"}, AllowedCommonNames: []string{"unknown"}})
+	claims, err := certAuth.Claims(cert("unknown", nil, nil))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ops"}, claims.Policies)
+	_, err = certAuth.Claims(cert("ci-runner", []string{"a.ci.example.com"}, nil))
+	assert.Equal(t, InvalidCertificateError, err)
+}
@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const ClaimsContextKey = "claims"
+
+var (
+	InvalidTokenError = errors.New("invalid token")
+	NoKeysError       = errors.New("no jwt verification key configured")
+)
+
+// Claims are the validated claims of a caller.
+type Claims struct {
+	jwt.RegisteredClaims
+
+	// Policies are the names of the ACL policies granted to the caller.
+	Policies []string `json:"policies,omitempty"`
+}
+
+// VerifierConfig configures the accepted tokens.
+type VerifierConfig struct {
+	// Issuer and Audience are checked when set.
+	Issuer   string
+	Audience string
+	// Leeway is the clock skew tolerated on exp, nbf and iat.
+	Leeway time.Duration
+
+	// HMACSecret verifies the HS256 tokens.
+	HMACSecret []byte
+	// PublicKeys verify the RS256 and EdDSA tokens by key id. The key
+	// with an empty id verifies the tokens without kid header.
+	PublicKeys map[string]crypto.PublicKey
+}
+
+// Verifier validates the signature and the claims of JWTs.
+type Verifier struct {
+	cfg    VerifierConfig
+	parser *jwt.Parser
+}
+
+func NewVerifier(cfg VerifierConfig) (*Verifier, error) {
+	var methods []string
+	if len(cfg.HMACSecret) > 0 {
+		methods = append(methods, jwt.SigningMethodHS256.Alg())
+	}
+
+	var hasRSA, hasEd25519 bool
+	for kid, key := range cfg.PublicKeys {
+		switch key.(type) {
+		case *rsa.PublicKey:
+			hasRSA = true
+		case ed25519.PublicKey:
+			hasEd25519 = true
+		default:
+			return nil, fmt.Errorf("unsupported public key type %T for kid %q", key, kid)
+		}
+	}
+	if hasRSA {
+		methods = append(methods, jwt.SigningMethodRS256.Alg())
+	}
+	if hasEd25519 {
+		methods = append(methods, jwt.SigningMethodEdDSA.Alg())
+	}
+	if len(methods) == 0 {
+		return nil, NoKeysError
+	}
+
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods(methods),
+		jwt.WithLeeway(cfg.Leeway),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	}
+	if cfg.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(cfg.Issuer))
+	}
+	if cfg.Audience != "" {
+		opts = append(opts, jwt.WithAudience(cfg.Audience))
+	}
+
+	return &Verifier{cfg: cfg, parser: jwt.NewParser(opts...)}, nil
+}
+
+// Verify returns the claims of a valid token. The returned error wraps
+// InvalidTokenError.
+func (v *Verifier) Verify(token string) (*Claims, error) {
+	claims := &Claims{}
+	if _, err := v.parser.ParseWithClaims(token, claims, v.key); err != nil {
+		return nil, fmt.Errorf("%w: %w", InvalidTokenError, err)
+	}
+
+	return claims, nil
+}
+
+func (v *Verifier) key(token *jwt.Token) (any, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		return v.cfg.HMACSecret, nil
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	key, ok := v.cfg.PublicKeys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+
+	switch token.Method.(type) {
+	case *jwt.SigningMethodRSA:
+		if _, ok := key.(*rsa.PublicKey); !ok {
+			return nil, fmt.Errorf("key %q is not an rsa key", kid)
+		}
+	case *jwt.SigningMethodEd25519:
+		if _, ok := key.(ed25519.PublicKey); !ok {
+			return nil, fmt.Errorf("key %q is not an ed25519 key", kid)
+		}
+	}
+
+	return key, nil
+}
+
+func GetClaimsFromContext(ctx context.Context) *Claims {
+	if ctx == nil {
+		return nil
+	}
+
+	claims, _ := ctx.Value(ClaimsContextKey).(*Claims)
+	return claims
+}
+
+func ClaimsWithContext(ctx context.Context, claims *Claims) context.Context {
+	return context.WithValue(ctx, ClaimsContextKey, claims)
+}
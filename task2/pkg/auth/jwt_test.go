@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func sign(t *testing.T, method jwt.SigningMethod, kid string, key any, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	assert.NoError(t, err)
+
+	return signed
+}
+
+func TestVerifier(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	secret := []byte("secret")
+
+	verifier, err := NewVerifier(VerifierConfig{
+		Issuer:     "https://issuer.example",
+		Audience:   "enclave",
+		Leeway:     time.Minute,
+		HMACSecret: secret,
+		PublicKeys: map[string]crypto.PublicKey{
+			"rsa-1": &rsaKey.PublicKey,
+			"ed-1":  edPub,
+		},
+	})
+	assert.NoError(t, err)
+
+	now := time.Now()
+	claims := func(overrides jwt.MapClaims) jwt.MapClaims {
+		c := jwt.MapClaims{
+			"sub":      "service-a",
+			"iss":      "https://issuer.example",
+			"aud":      "enclave",
+			"exp":      now.Add(time.Hour).Unix(),
+			"iat":      now.Unix(),
+			"policies": []string{"payments"},
+		}
+		for k, v := range overrides {
+			if v == nil {
+				delete(c, k)
+				continue
+			}
+			c[k] = v
+		}
+		return c
+	}
+
+	valid := map[string]string{
+		"HS256": sign(t, jwt.SigningMethodHS256, "", secret, claims(nil)),
+		"RS256": sign(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, claims(nil)),
+		"EdDSA": sign(t, jwt.SigningMethodEdDSA, "ed-1", edKey, claims(nil)),
+		// within the clock skew
+		"expired in leeway": sign(t, jwt.SigningMethodHS256, "", secret, claims(jwt.MapClaims{"exp": now.Add(-30 * time.Second).Unix()})),
+		"nbf in leeway":     sign(t, jwt.SigningMethodHS256, "", secret, claims(jwt.MapClaims{"nbf": now.Add(30 * time.Second).Unix()})),
+	}
+	for name, token := range valid {
+		t.Run(name, func(t *testing.T) {
+			c, err := verifier.Verify(token)
+			assert.NoError(t, err)
+			assert.Equal(t, "service-a", c.Subject)
+			assert.Equal(t, []string{"payments"}, c.Policies)
+		})
+	}
+
+	otherRSA, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	invalid := map[string]string{
+		"expired":         sign(t, jwt.SigningMethodHS256, "", secret, claims(jwt.MapClaims{"exp": now.Add(-time.Hour).Unix()})),
+		"no exp":          sign(t, jwt.SigningMethodHS256, "", secret, claims(jwt.MapClaims{"exp": nil})),
+		"not yet valid":   sign(t, jwt.SigningMethodHS256, "", secret, claims(jwt.MapClaims{"nbf": now.Add(time.Hour).Unix()})),
+		"wrong issuer":    sign(t, jwt.SigningMethodHS256, "", secret, claims(jwt.MapClaims{"iss": "https://evil.example"})),
+		"wrong audience":  sign(t, jwt.SigningMethodHS256, "", secret, claims(jwt.MapClaims{"aud": "other"})),
+		"wrong secret":    sign(t, jwt.SigningMethodHS256, "", []byte("other"), claims(nil)),
+		"wrong rsa key":   sign(t, jwt.SigningMethodRS256, "rsa-1", otherRSA, claims(nil)),
+		"unknown kid":     sign(t, jwt.SigningMethodRS256, "rsa-2", rsaKey, claims(nil)),
+		"kid of ed25519":  sign(t, jwt.SigningMethodRS256, "ed-1", rsaKey, claims(nil)),
+		"unsupported alg": sign(t, jwt.SigningMethodHS512, "", secret, claims(nil)),
+		"none alg":        sign(t, jwt.SigningMethodNone, "", jwt.UnsafeAllowNoneSignatureType, claims(nil)),
+		"garbage":         "not.a.jwt",
+	}
+	for name, token := range invalid {
+		t.Run(name, func(t *testing.T) {
+			_, err := verifier.Verify(token)
+			assert.True(t, errors.Is(err, InvalidTokenError), err)
+		})
+	}
+}
+
+func TestNewVerifier(t *testing.T) {
+	_, err := NewVerifier(VerifierConfig{})
+	assert.Equal(t, NoKeysError, err)
+
+	_, err = NewVerifier(VerifierConfig{PublicKeys: map[string]crypto.PublicKey{"": "not a key"}})
+	assert.Error(t, err)
+
+	// only the algorithms of the configured keys are accepted
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	verifier, err := NewVerifier(VerifierConfig{PublicKeys: map[string]crypto.PublicKey{"": edPub}})
+	assert.NoError(t, err)
+
+	claims := jwt.MapClaims{"sub": "a", "exp": time.Now().Add(time.Hour).Unix()}
+	_, err = verifier.Verify(sign(t, jwt.SigningMethodEdDSA, "", edKey, claims))
+	assert.NoError(t, err)
+	_, err = verifier.Verify(sign(t, jwt.SigningMethodHS256, "", []byte(""), claims))
+	assert.Error(t, err)
+}
+
+func TestClaimsContext(t *testing.T) {
+	ctx := context.Background()
+	assert.Nil(t, GetClaimsFromContext(ctx))
+	assert.Nil(t, GetClaimsFromContext(nil))
+
+	claims := &Claims{Policies: []string{"root"}}
+	ctx = ClaimsWithContext(ctx, claims)
+	assert.Equal(t, claims, GetClaimsFromContext(ctx))
+}
@@ -0,0 +1,71 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePublicKeyPEM(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	edPub, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	der, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	assert.NoError(t, err)
+	key, err := ParsePublicKeyPEM(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	assert.NoError(t, err)
+	assert.True(t, rsaKey.PublicKey.Equal(key))
+
+	key, err = ParsePublicKeyPEM(pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&rsaKey.PublicKey)}))
+	assert.NoError(t, err)
+	assert.True(t, rsaKey.PublicKey.Equal(key))
+
+	der, err = x509.MarshalPKIXPublicKey(edPub)
+	assert.NoError(t, err)
+	key, err = ParsePublicKeyPEM(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	assert.NoError(t, err)
+	assert.Equal(t, edPub, key)
+
+	_, err = ParsePublicKeyPEM([]byte("not a pem"))
+	assert.Error(t, err)
+
+	_, err = ParsePublicKeyPEM(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte{1}}))
+	assert.Error(t, err)
+}
+
+func TestParseJWKS(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	edPub, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	b64 := base64.RawURLEncoding.EncodeToString
+	jwks := fmt.Sprintf(`{"keys": [
+		{"kty": "RSA", "kid": "rsa-1", "use": "sig", "alg": "RS256", "n": %q, "e": %q},
+		{"kty": "OKP", "kid": "ed-1", "crv": "Ed25519", "x": %q},
+		{"kty": "RSA", "kid": "enc-1", "use": "enc", "n": %q, "e": "AQAB"},
+		{"kty": "EC", "kid": "ec-1", "crv": "P-256", "x": "", "y": ""}
+	]}`, b64(rsaKey.N.Bytes()), b64(big.NewInt(int64(rsaKey.E)).Bytes()), b64(edPub), b64(rsaKey.N.Bytes()))
+
+	keys, err := ParseJWKS([]byte(jwks))
+	assert.NoError(t, err)
+	assert.Len(t, keys, 2)
+	assert.True(t, rsaKey.PublicKey.Equal(keys["rsa-1"]))
+	assert.Equal(t, edPub, keys["ed-1"])
+
+	_, err = ParseJWKS([]byte("{"))
+	assert.Error(t, err)
+
+	_, err = ParseJWKS([]byte(`{"keys": [{"kty": "OKP", "kid": "bad", "crv": "Ed25519", "x": "AAAA"}]}`))
+	assert.Error(t, err)
+}
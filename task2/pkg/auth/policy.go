@@ -0,0 +1,233 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"enclave-task2/pkg/ratelimit"
+)
+
+// Capability is an operation granted on the paths of a policy.
+type Capability string
+
+const (
+	CapCreate  Capability = "create"
+	CapRead    Capability = "read"
+	CapEncrypt Capability = "encrypt"
+	CapDecrypt Capability = "decrypt"
+	CapDelete  Capability = "delete"
+	// CapDeny overrides every capability granted on the path.
+	CapDeny Capability = "deny"
+
+	// RootPolicy grants every capability on every path.
+	RootPolicy = "root"
+)
+
+var capabilities = []Capability{CapCreate, CapRead, CapEncrypt, CapDecrypt, CapDelete, CapDeny}
+
+// KeyPath is the policy path of a key.
+func KeyPath(name string) string {
+	return "transit/keys/" + name
+}
+
+// PathRule grants capabilities on the paths matching a glob, e.g.
+// "transit/keys/payments-*".
+type PathRule struct {
+	Capabilities []Capability `json:"capabilities"`
+}
+
+// Policy is a named set of path rules, in JSON:
+//
+//	{"path": {"transit/keys/payments-*": {"capabilities": ["create", "encrypt"]}}}
+//
+// The rate limit caps the requests per second of each caller holding it,
+// e.g. "rate_limit": {"rate": 50, "burst": 100}. The key rate limit caps
+// the encryptions and decryptions per second of each key by the callers
+// holding it.
+type Policy struct {
+	Name         string              `json:"name,omitempty"`
+	Paths        map[string]PathRule `json:"path"`
+	RateLimit    *ratelimit.Limit    `json:"rate_limit,omitempty"`
+	KeyRateLimit *ratelimit.Limit    `json:"key_rate_limit,omitempty"`
+}
+
+// ParsePolicy parses a JSON policy, the name defaults to the one of the
+// document.
+func ParsePolicy(name string, data []byte) (*Policy, error) {
+	p := &Policy{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("invalid policy %q: %w", name, err)
+	}
+	if p.Name == "" {
+		p.Name = name
+	}
+	if p.Name == "" || p.Name == RootPolicy {
+		return nil, fmt.Errorf("invalid policy name %q", p.Name)
+	}
+
+	for _, l := range []*ratelimit.Limit{p.RateLimit, p.KeyRateLimit} {
+		if l != nil && (l.Rate <= 0 || l.Burst < 0) {
+			return nil, fmt.Errorf("invalid policy %q: the rate limit must be positive", p.Name)
+		}
+	}
+
+	for glob, rule := range p.Paths {
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("invalid policy %q path %q: %w", p.Name, glob, err)
+		}
+		for _, c := range rule.Capabilities {
+			if !slices.Contains(capabilities, c) {
+				return nil, fmt.Errorf("invalid policy %q path %q: unknown capability %q", p.Name, glob, c)
+			}
+		}
+	}
+
+	return p, nil
+}
+
+// LoadPolicies reads the *.json policies of a directory, named after their
+// file unless the document sets a name.
+func LoadPolicies(dir string) ([]*Policy, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var policies []*Policy
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		p, err := ParsePolicy(strings.TrimSuffix(filepath.Base(file), ".json"), data)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, p)
+	}
+
+	return policies, nil
+}
+
+// ACL evaluates the policies granted to a caller.
+type ACL struct {
+	mu       sync.RWMutex
+	policies map[string]*Policy
+}
+
+func NewACL(policies ...*Policy) *ACL {
+	acl := &ACL{}
+	acl.Set(policies...)
+
+	return acl
+}
+
+// Set replaces the policies.
+func (a *ACL) Set(policies ...*Policy) {
+	m := make(map[string]*Policy, len(policies))
+	for _, p := range policies {
+		m[p.Name] = p
+	}
+
+	a.mu.Lock()
+	a.policies = m
+	a.mu.Unlock()
+}
+
+// Policy returns a policy by name.
+func (a *ACL) Policy(name string) (*Policy, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	p, ok := a.policies[name]
+	return p, ok
+}
+
+// Allowed reports whether one of the named policies grants the capability
+// on the path and none of them denies it. Unknown policies grant nothing,
+// the root policy grants everything.
+func (a *ACL) Allowed(policies []string, p string, c Capability) bool {
+	if slices.Contains(policies, RootPolicy) {
+		return true
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	allowed := false
+	for _, name := range policies {
+		policy, ok := a.policies[name]
+		if !ok {
+			continue
+		}
+		for glob, rule := range policy.Paths {
+			if ok, _ := path.Match(glob, p); !ok {
+				continue
+			}
+			if slices.Contains(rule.Capabilities, CapDeny) {
+				return false
+			}
+			if slices.Contains(rule.Capabilities, c) {
+				allowed = true
+			}
+		}
+	}
+
+	return allowed
+}
+
+// RateLimit returns the rate limit of a caller holding the named policies,
+// the most generous one applies. The callers holding the root policy or a
+// policy without limit are not limited.
+func (a *ACL) RateLimit(policies []string) ratelimit.Limit {
+	if slices.Contains(policies, RootPolicy) {
+		return ratelimit.Limit{}
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	var limit ratelimit.Limit
+	for _, name := range policies {
+		policy, ok := a.policies[name]
+		if !ok {
+			continue
+		}
+		if policy.RateLimit == nil {
+			return ratelimit.Limit{}
+		}
+		limit.Rate = max(limit.Rate, policy.RateLimit.Rate)
+		limit.Burst = max(limit.Burst, policy.RateLimit.Burst)
+	}
+
+	return limit
+}
+
+// KeyRateLimit returns the key rate limit of a caller holding the named
+// policies and the policy it comes from, the most generous one applies.
+// The policy is empty when none of them limits the keys.
+func (a *ACL) KeyRateLimit(policies []string) (string, ratelimit.Limit) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	var name string
+	var limit ratelimit.Limit
+	for _, n := range policies {
+		policy, ok := a.policies[n]
+		if !ok || policy.KeyRateLimit == nil {
+			continue
+		}
+		if name == "" || policy.KeyRateLimit.Rate > limit.Rate {
+			name, limit = n, *policy.KeyRateLimit
+		}
+	}
+
+	return name, limit
+}
@@ -0,0 +1,132 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"enclave-task2/pkg/ratelimit"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestACL(t *testing.T) {
+	payments, err := ParsePolicy("payments", []byte(`{"path": {
+		"transit/keys/payments-*": {"capabilities": ["create", "encrypt", "decrypt", "read"]},
+		"transit/keys/payments-master": {"capabilities": ["deny"]}
+	}}`))
+	assert.NoError(t, err)
+
+	encryptOnly, err := ParsePolicy("", []byte(`{"name": "encrypt-only", "path": {
+		"transit/keys/*": {"capabilities": ["encrypt"]}
+	}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "encrypt-only", encryptOnly.Name)
+
+	acl := NewACL(payments, encryptOnly)
+
+	tests := []struct {
+		policies []string
+		key      string
+		c        Capability
+		allowed  bool
+	}{
+		{[]string{"payments"}, "payments-eu", CapCreate, true},
+		{[]string{"payments"}, "payments-eu", CapDecrypt, true},
+		{[]string{"payments"}, "payments-eu", CapDelete, false},
+		{[]string{"payments"}, "billing", CapEncrypt, false},
+		{[]string{"payments"}, "payments-master", CapEncrypt, false},
+		{[]string{"encrypt-only"}, "billing", CapEncrypt, true},
+		{[]string{"encrypt-only"}, "billing", CapDecrypt, false},
+		{[]string{"payments", "encrypt-only"}, "billing", CapEncrypt, true},
+		// deny wins over the grants of the other policies
+		{[]string{"payments", "encrypt-only"}, "payments-master", CapEncrypt, false},
+		{[]string{"unknown"}, "payments-eu", CapCreate, false},
+		{nil, "payments-eu", CapCreate, false},
+		{[]string{RootPolicy}, "payments-master", CapDelete, true},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.allowed, acl.Allowed(tt.policies, KeyPath(tt.key), tt.c), "%v %s %s", tt.policies, tt.key, tt.c)
+	}
+
+	_, ok := acl.Policy("payments")
+	assert.True(t, ok)
+
+	acl.Set(encryptOnly)
+	assert.False(t, acl.Allowed([]string{"payments"}, KeyPath("payments-eu"), CapCreate))
+}
+
+func TestParsePolicyErrors(t *testing.T) {
+	_, err := ParsePolicy("bad", []byte("{"))
+	assert.Error(t, err)
+
+	_, err = ParsePolicy("", []byte(`{"path": {}}`))
+	assert.Error(t, err)
+
+	_, err = ParsePolicy(RootPolicy, []byte(`{"path": {}}`))
+	assert.Error(t, err)
+
+	_, err = ParsePolicy("bad", []byte(`{"path": {"transit/keys/*": {"capabilities": ["sudo"]}}}`))
+	assert.Error(t, err)
+
+	_, err = ParsePolicy("bad", []byte(`{"path": {"transit/keys/[": {"capabilities": ["read"]}}}`))
+	assert.Error(t, err)
+
+	_, err = ParsePolicy("bad", []byte(`{"path": {}, "rate_limit": {"rate": 0, "burst": 10}}`))
+	assert.Error(t, err)
+}
+
+func TestACLRateLimit(t *testing.T) {
+	slow, err := ParsePolicy("slow", []byte(`{"path": {}, "rate_limit": {"rate": 1, "burst": 5}}`))
+	assert.NoError(t, err)
+	fast, err := ParsePolicy("fast", []byte(`{"path": {}, "rate_limit": {"rate": 10, "burst": 2}}`))
+	assert.NoError(t, err)
+	unlimited, err := ParsePolicy("unlimited", []byte(`{"path": {}}`))
+	assert.NoError(t, err)
+
+	acl := NewACL(slow, fast, unlimited)
+
+	assert.Equal(t, ratelimit.Limit{Rate: 1, Burst: 5}, acl.RateLimit([]string{"slow"}))
+	assert.Equal(t, ratelimit.Limit{Rate: 10, Burst: 5}, acl.RateLimit([]string{"slow", "fast", "unknown"}))
+	assert.True(t, acl.RateLimit([]string{"slow", "unlimited"}).Unlimited())
+	assert.True(t, acl.RateLimit([]string{"slow", RootPolicy}).Unlimited())
+	assert.True(t, acl.RateLimit(nil).Unlimited())
+}
+
+func TestACLKeyRateLimit(t *testing.T) {
+	slow, err := ParsePolicy("slow", []byte(`{"path": {}, "key_rate_limit": {"rate": 1, "burst": 5}}`))
+	assert.NoError(t, err)
+	fast, err := ParsePolicy("fast", []byte(`{"path": {}, "key_rate_limit": {"rate": 10, "burst": 2}}`))
+	assert.NoError(t, err)
+	other, err := ParsePolicy("other", []byte(`{"path": {}}`))
+	assert.NoError(t, err)
+
+	acl := NewACL(slow, fast, other)
+
+	policy, limit := acl.KeyRateLimit([]string{"slow", "other"})
+	assert.Equal(t, "slow", policy)
+	assert.Equal(t, ratelimit.Limit{Rate: 1, Burst: 5}, limit)
+	policy, limit = acl.KeyRateLimit([]string{"slow", "fast", "unknown"})
+	assert.Equal(t, "fast", policy)
+	assert.Equal(t, ratelimit.Limit{Rate: 10, Burst: 2}, limit)
+	policy, _ = acl.KeyRateLimit([]string{"other", RootPolicy})
+	assert.Empty(t, policy)
+
+	_, err = ParsePolicy("bad", []byte(`{"path": {}, "key_rate_limit": {"rate": -1}}`))
+	assert.Error(t, err)
+}
+
+func TestLoadPolicies(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "payments.json"), []byte(`{"path": {"transit/keys/payments-*": {"capabilities": ["create"]}}}`), 0o600))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("ignored"), 0o600))
+
+	policies, err := LoadPolicies(dir)
+	assert.NoError(t, err)
+	assert.Len(t, policies, 1)
+	assert.Equal(t, "payments", policies[0].Name)
+
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "broken.json"), []byte("{"), 0o600))
+	_, err = LoadPolicies(dir)
+	assert.Error(t, err)
+}
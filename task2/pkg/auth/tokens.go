@@ -0,0 +1,306 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"enclave-task2/pkg/storage"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// TokenPrefix distinguishes the service tokens from the JWTs.
+	TokenPrefix = "ens."
+
+	DefaultTokenTTL = 24 * time.Hour
+	// DefaultMaxTokenTTL bounds the ttl of the tokens, renewals included.
+	DefaultMaxTokenTTL = 32 * 24 * time.Hour
+
+	tokenEntryPrefix = "auth/token/"
+	initEntry        = "auth/init"
+	accessorSize     = 16
+
+	// maxUpdateAttempts bounds the compare-and-swap retries of an entry
+	// update.
+	maxUpdateAttempts = 10
+)
+
+var InvalidPoliciesError = errors.New("invalid policies")
+
+// TokenStorage is the subset of the entry storage holding the tokens.
+type TokenStorage interface {
+	GetEntry(ctx context.Context, name string) (*storage.Entry, error)
+	Delete(ctx context.Context, name string) error
+	CreateEntry(ctx context.Context, entry *storage.Entry) error
+	CompareAndSwapEntry(ctx context.Context, entry *storage.Entry, version uint64) error
+}
+
+// Token describes a service token, it never holds the token itself.
+type Token struct {
+	Accessor    string    `json:"accessor"`
+	DisplayName string    `json:"display_name,omitempty"`
+	Policies    []string  `json:"policies"`
+	CreatedAt   time.Time `json:"creation_time"`
+	TTL         string    `json:"ttl"`
+	ExpireTime  time.Time `json:"expire_time,omitzero"`
+}
+
+// Claims returns the claims of the callers authenticated with the token.
+func (t *Token) Claims() *Claims {
+	claims := &Claims{
+		RegisteredClaims: jwt.RegisteredClaims{ID: t.Accessor, Subject: t.DisplayName},
+		Policies:         t.Policies,
+	}
+	if !t.ExpireTime.IsZero() {
+		claims.ExpiresAt = jwt.NewNumericDate(t.ExpireTime)
+	}
+
+	return claims
+}
+
+// tokenData is the data of the entry of a token, the entry expires with
+// the token.
+type tokenData struct {
+	DisplayName string   `json:"display_name,omitempty"`
+	Policies    []string `json:"policies,omitempty"`
+	// IssuedTTL is the ttl the token was created with, the ttl of the entry
+	// grows on renewals.
+	IssuedTTL time.Duration `json:"issued_ttl,omitempty"`
+	// MaxExpireTime is the expiry the renewals can not exceed, it is bound
+	// by the max ttl and by the token of the caller which created it.
+	MaxExpireTime time.Time `json:"max_expire_time,omitzero"`
+}
+
+// TokenStore manages the service tokens. The tokens are kept in the entry
+// storage under their SHA-256 hash, a leaked storage does not leak them.
+type TokenStore struct {
+	storage TokenStorage
+	maxTTL  time.Duration
+}
+
+func NewTokenStore(storage TokenStorage) *TokenStore {
+	return &TokenStore{storage: storage, maxTTL: DefaultMaxTokenTTL}
+}
+
+// SetMaxTTL bounds the ttl of the tokens issued from now on, renewals
+// included. A zero max ttl does not bound them.
+func (s *TokenStore) SetMaxTTL(ttl time.Duration) {
+	s.maxTTL = ttl
+}
+
+// Init generates the root token the first time the storage is used. The
+// returned token is empty once initialized, it is never shown again. The
+// root token is stored before the store is marked initialized, a failed
+// Init can be retried.
+func (s *TokenStore) Init(ctx context.Context) (string, error) {
+	if initialized, err := s.Initialized(ctx); err != nil || initialized {
+		return "", err
+	}
+
+	root, _, err := s.create(ctx, "root", []string{RootPolicy}, 0, time.Time{})
+	if err != nil {
+		return "", err
+	}
+
+	err = s.storage.CreateEntry(ctx, storage.NewEntry(initEntry, 0))
+	if err != nil {
+		// the root token is never shown, another one was generated if the
+		// store was initialized meanwhile
+		s.storage.Delete(ctx, entryName(root))
+		if err == storage.AlreadyExistsError {
+			return "", nil
+		}
+		return "", err
+	}
+
+	return root, nil
+}
+
+// Initialized reports whether Init ran, the error tells the storage could
+// not be read.
+func (s *TokenStore) Initialized(ctx context.Context) (bool, error) {
+	_, err := s.storage.GetEntry(ctx, initEntry)
+	if err == storage.NotFoundError {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// Create issues a token, a zero ttl defaults to DefaultTokenTTL. The ttl is
+// clamped to the max ttl.
+func (s *TokenStore) Create(ctx context.Context, displayName string, policies []string, ttl time.Duration) (string, *Token, error) {
+	return s.CreateChild(ctx, nil, displayName, policies, ttl)
+}
+
+// CreateChild issues a token which does not outlive the token of the
+// caller with the claims, a nil parent bounds it by the max ttl only. The
+// ttl is clamped to the remaining ttl of the parent, InvalidTokenError is
+// returned if it expired.
+func (s *TokenStore) CreateChild(ctx context.Context, parent *Claims, displayName string, policies []string, ttl time.Duration) (string, *Token, error) {
+	if err := validatePolicies(policies); err != nil {
+		return "", nil, err
+	}
+	if ttl <= 0 {
+		ttl = DefaultTokenTTL
+	}
+
+	var maxExpire time.Time
+	if s.maxTTL > 0 {
+		maxExpire = time.Now().Add(s.maxTTL)
+	}
+	if parent != nil && parent.ExpiresAt != nil && (maxExpire.IsZero() || parent.ExpiresAt.Before(maxExpire)) {
+		maxExpire = parent.ExpiresAt.Time
+	}
+	if !maxExpire.IsZero() {
+		ttl = min(ttl, time.Until(maxExpire))
+	}
+	if ttl <= 0 {
+		return "", nil, InvalidTokenError
+	}
+
+	return s.create(ctx, displayName, policies, ttl, maxExpire)
+}
+
+func (s *TokenStore) create(ctx context.Context, displayName string, policies []string, ttl time.Duration, maxExpire time.Time) (string, *Token, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, err
+	}
+	raw := TokenPrefix + base64.RawURLEncoding.EncodeToString(secret)
+
+	data := &tokenData{DisplayName: displayName, Policies: policies, IssuedTTL: ttl, MaxExpireTime: maxExpire}
+	entry := storage.NewEntry(entryName(raw), ttl)
+	if err := entry.Encode(data); err != nil {
+		return "", nil, err
+	}
+	if err := s.storage.CreateEntry(ctx, entry); err != nil {
+		return "", nil, err
+	}
+
+	return raw, describe(entry, data), nil
+}
+
+// Lookup returns the token, InvalidTokenError if it is unknown or expired.
+func (s *TokenStore) Lookup(ctx context.Context, raw string) (*Token, error) {
+	entry, data, err := s.get(ctx, raw)
+	if err != nil {
+		return nil, err
+	}
+
+	return describe(entry, data), nil
+}
+
+// Renew extends the token to expire increment from now. The increment is
+// bounded by the ttl the token was issued with, which is also the default,
+// and the expiry by the max expire time of the token. The root token never
+// expires.
+func (s *TokenStore) Renew(ctx context.Context, raw string, increment time.Duration) (*Token, error) {
+	for range maxUpdateAttempts {
+		entry, data, err := s.get(ctx, raw)
+		if err != nil {
+			return nil, err
+		}
+		if entry.TTL <= 0 {
+			return describe(entry, data), nil
+		}
+
+		if increment <= 0 || increment > data.IssuedTTL {
+			increment = data.IssuedTTL
+		}
+		// the expiry is derived from the creation time by the storages
+		entry.TTL = time.Since(entry.CreatedAt) + increment
+		if !data.MaxExpireTime.IsZero() {
+			entry.TTL = min(entry.TTL, data.MaxExpireTime.Sub(entry.CreatedAt))
+		}
+
+		err = s.storage.CompareAndSwapEntry(ctx, entry, entry.Version)
+		if err == storage.VersionMismatchError {
+			continue
+		}
+		if err == storage.NotFoundError {
+			return nil, InvalidTokenError
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return describe(entry, data), nil
+	}
+
+	return nil, storage.VersionMismatchError
+}
+
+// Revoke deletes the token.
+func (s *TokenStore) Revoke(ctx context.Context, raw string) error {
+	if _, _, err := s.get(ctx, raw); err != nil {
+		return err
+	}
+
+	return s.storage.Delete(ctx, entryName(raw))
+}
+
+func (s *TokenStore) get(ctx context.Context, raw string) (*storage.Entry, *tokenData, error) {
+	if !strings.HasPrefix(raw, TokenPrefix) {
+		return nil, nil, InvalidTokenError
+	}
+
+	entry, err := s.storage.GetEntry(ctx, entryName(raw))
+	if err == storage.NotFoundError {
+		return nil, nil, InvalidTokenError
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if entry.Expired() {
+		return nil, nil, InvalidTokenError
+	}
+
+	var data tokenData
+	if err := entry.Decode(&data); err != nil {
+		return nil, nil, err
+	}
+
+	return entry, &data, nil
+}
+
+func validatePolicies(policies []string) error {
+	for _, p := range policies {
+		if p == "" || strings.Contains(p, ",") {
+			return fmt.Errorf("%w: %q", InvalidPoliciesError, p)
+		}
+	}
+
+	return nil
+}
+
+func entryName(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return tokenEntryPrefix + hex.EncodeToString(sum[:])
+}
+
+func describe(entry *storage.Entry, data *tokenData) *Token {
+	t := &Token{
+		Accessor:    strings.TrimPrefix(entry.Name, tokenEntryPrefix)[:accessorSize],
+		DisplayName: data.DisplayName,
+		Policies:    data.Policies,
+		CreatedAt:   entry.CreatedAt,
+		TTL:         entry.TTL.String(),
+	}
+	if t.Policies == nil {
+		t.Policies = []string{}
+	}
+	if entry.TTL > 0 {
+		t.ExpireTime = entry.CreatedAt.Add(entry.TTL)
+		t.TTL = time.Until(t.ExpireTime).Round(time.Second).String()
+	}
+
+	return t
+}
@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"context"
+	"enclave-task2/pkg/storage"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenStore(t *testing.T) {
+	ctx := context.Background()
+	cache := storage.NewNamedInMemoryCache("tokens")
+	tokens := NewTokenStore(cache)
+
+	initialized, err := tokens.Initialized(ctx)
+	assert.NoError(t, err)
+	assert.False(t, initialized)
+
+	// the root token is only returned once
+	root, err := tokens.Init(ctx)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(root, TokenPrefix))
+
+	again, err := tokens.Init(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, again)
+
+	initialized, err = tokens.Initialized(ctx)
+	assert.NoError(t, err)
+	assert.True(t, initialized)
+
+	info, err := tokens.Lookup(ctx, root)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{RootPolicy}, info.Policies)
+	assert.True(t, info.ExpireTime.IsZero())
+
+	// tokens are stored hashed, in entries which are not keys
+	_, err = cache.GetEntry(ctx, root)
+	assert.Equal(t, storage.NotFoundError, err)
+	_, err = cache.GetEntry(ctx, entryName(root))
+	assert.NoError(t, err)
+	_, err = cache.Get(ctx, entryName(root))
+	assert.Equal(t, storage.NotFoundError, err)
+
+	raw, created, err := tokens.Create(ctx, "ci", []string{"payments"}, time.Hour)
+	assert.NoError(t, err)
+	assert.NotEqual(t, root, raw)
+	assert.Equal(t, "ci", created.DisplayName)
+	assert.Len(t, created.Accessor, accessorSize)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), created.ExpireTime, time.Second)
+
+	claims := created.Claims()
+	assert.Equal(t, []string{"payments"}, claims.Policies)
+	assert.Equal(t, created.Accessor, claims.ID)
+
+	// renewal is bounded by the issued ttl
+	renewed, err := tokens.Renew(ctx, raw, 10*time.Hour)
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), renewed.ExpireTime, time.Second)
+
+	renewed, err = tokens.Renew(ctx, raw, time.Minute)
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), renewed.ExpireTime, time.Second)
+
+	// revoked
+	assert.NoError(t, tokens.Revoke(ctx, raw))
+	_, err = tokens.Lookup(ctx, raw)
+	assert.Equal(t, InvalidTokenError, err)
+	assert.Equal(t, InvalidTokenError, tokens.Revoke(ctx, raw))
+	_, err = tokens.Renew(ctx, raw, 0)
+	assert.Equal(t, InvalidTokenError, err)
+
+	// unknown tokens and invalid policies
+	_, err = tokens.Lookup(ctx, TokenPrefix+"unknown")
+	assert.Equal(t, InvalidTokenError, err)
+	_, err = tokens.Lookup(ctx, "not-a-service-token")
+	assert.Equal(t, InvalidTokenError, err)
+
+	_, _, err = tokens.Create(ctx, "bad", []string{"a,b"}, 0)
+	assert.True(t, errors.Is(err, InvalidPoliciesError))
+
+	raw, created, err = tokens.Create(ctx, "default", nil, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, created.Policies)
+	assert.WithinDuration(t, time.Now().Add(DefaultTokenTTL), created.ExpireTime, time.Second)
+}
+
+func TestTokenStoreExpiry(t *testing.T) {
+	ctx := context.Background()
+	tokens := NewTokenStore(storage.NewNamedInMemoryCache("tokens-expiry"))
+
+	raw, _, err := tokens.Create(ctx, "short", nil, 50*time.Millisecond)
+	assert.NoError(t, err)
+
+	_, err = tokens.Lookup(ctx, raw)
+	assert.NoError(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+	_, err = tokens.Lookup(ctx, raw)
+	assert.Equal(t, InvalidTokenError, err)
+}
+
+func TestTokenStoreMaxTTL(t *testing.T) {
+	ctx := context.Background()
+	tokens := NewTokenStore(storage.NewNamedInMemoryCache("tokens-max-ttl"))
+	tokens.SetMaxTTL(2 * time.Hour)
+
+	// the ttl is clamped to the max ttl
+	_, created, err := tokens.Create(ctx, "long", nil, 10*time.Hour)
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(2*time.Hour), created.ExpireTime, time.Second)
+
+	// and to the remaining ttl of the parent, renewals included
+	parent := created.Claims()
+	parent.ExpiresAt = jwt.NewNumericDate(time.Now().Add(30 * time.Minute))
+	raw, child, err := tokens.CreateChild(ctx, parent, "child", nil, time.Hour)
+	assert.NoError(t, err)
+	assert.WithinDuration(t, parent.ExpiresAt.Time, child.ExpireTime, time.Second)
+
+	renewed, err := tokens.Renew(ctx, raw, time.Hour)
+	assert.NoError(t, err)
+	assert.WithinDuration(t, parent.ExpiresAt.Time, renewed.ExpireTime, time.Second)
+
+	parent.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+	_, _, err = tokens.CreateChild(ctx, parent, "orphan", nil, time.Hour)
+	assert.Equal(t, InvalidTokenError, err)
+
+	// a parent without expiry is bounded by the max ttl
+	_, child, err = tokens.CreateChild(ctx, &Claims{}, "root-child", nil, 0)
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(2*time.Hour), child.ExpireTime, time.Second)
+}
@@ -0,0 +1,97 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Token describes a service token, Token is only set when it is issued.
+type Token struct {
+	Token       string    `json:"token,omitempty"`
+	Accessor    string    `json:"accessor"`
+	DisplayName string    `json:"display_name,omitempty"`
+	Policies    []string  `json:"policies"`
+	CreatedAt   time.Time `json:"creation_time"`
+	TTL         string    `json:"ttl"`
+	ExpireTime  time.Time `json:"expire_time,omitzero"`
+}
+
+// TokenOptions are the parameters of a new service token. The policies
+// default to the ones of the caller and the ttl to the one of the server.
+type TokenOptions struct {
+	DisplayName string
+	Policies    []string
+	TTL         time.Duration
+}
+
+// CreateToken issues a service token, its policies can not exceed the ones
+// of the caller unless the caller is root.
+func (c *Client) CreateToken(ctx context.Context, opts TokenOptions) (*Token, error) {
+	in := map[string]any{"display_name": opts.DisplayName}
+	if opts.Policies != nil {
+		in["policies"] = opts.Policies
+	}
+	if opts.TTL > 0 {
+		in["ttl"] = opts.TTL.String()
+	}
+
+	var token Token
+	if err := c.doJSON(ctx, request{method: http.MethodPost, path: "/auth/token/create"}, in, &token); err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+// RevokeToken revokes a service token.
+func (c *Client) RevokeToken(ctx context.Context, token string) error {
+	in := map[string]string{"token": token}
+	return c.doJSON(ctx, request{method: http.MethodPost, path: "/auth/token/revoke", idempotent: true}, in, nil)
+}
+
+// LoginAppRole logs in with the credentials of an AppRole, the issued token
+// is used by the next requests.
+func (c *Client) LoginAppRole(ctx context.Context, roleID, secretID string) (*Token, error) {
+	in := map[string]string{"role_id": roleID, "secret_id": secretID}
+
+	var token Token
+	if err := c.doJSON(ctx, request{method: http.MethodPost, path: "/auth/approle/login"}, in, &token); err != nil {
+		return nil, err
+	}
+	c.SetToken(token.Token)
+
+	return &token, nil
+}
+
+// LookupSelf describes the service token of the client.
+func (c *Client) LookupSelf(ctx context.Context) (*Token, error) {
+	var token Token
+	if err := c.doJSON(ctx, request{method: http.MethodGet, path: "/auth/token/lookup-self", idempotent: true}, nil, &token); err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+// RenewSelf extends the service token of the client by the increment, or by
+// its ttl when 0.
+func (c *Client) RenewSelf(ctx context.Context, increment time.Duration) (*Token, error) {
+	in := map[string]string{}
+	if increment > 0 {
+		in["increment"] = increment.String()
+	}
+
+	var token Token
+	if err := c.doJSON(ctx, request{method: http.MethodPost, path: "/auth/token/renew-self", idempotent: true}, in, &token); err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+// RevokeSelf revokes the service token of the client.
+func (c *Client) RevokeSelf(ctx context.Context) error {
+	_, err := c.do(ctx, request{method: http.MethodPost, path: "/auth/token/revoke-self"})
+	return err
+}
@@ -0,0 +1,284 @@
+// Package client is the Go client of the transit api. The calls are retried
+// with backoff when the server refuses them or can not be reached, the
+// encryptions only when they were refused before being served.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// RequestIDHeader is the header of the id the server gives the requests.
+	RequestIDHeader = "X-Request-ID"
+
+	defaultRetries          = 3
+	defaultBackoff          = 100 * time.Millisecond
+	maxBackoff              = 5 * time.Second
+	defaultBatchConcurrency = 8
+)
+
+var (
+	UnauthenticatedError  = errors.New("not authenticated")
+	PermissionDeniedError = errors.New("permission denied")
+	NotFoundError         = errors.New("not found")
+	RateLimitedError      = errors.New("rate limited")
+)
+
+// APIError is the error response of the server, it matches the sentinel
+// errors of its status with errors.Is.
+type APIError struct {
+	StatusCode int
+	Message    string
+	RequestID  string
+	// RetryAfter is the delay the server asked for before the next request.
+	RetryAfter time.Duration
+}
+
+func (e *APIError) Error() string {
+	if e.RequestID == "" {
+		return fmt.Sprintf("enclave: %d %s", e.StatusCode, e.Message)
+	}
+
+	return fmt.Sprintf("enclave: %d %s (request %s)", e.StatusCode, e.Message, e.RequestID)
+}
+
+func (e *APIError) Is(target error) bool {
+	switch target {
+	case UnauthenticatedError:
+		return e.StatusCode == http.StatusUnauthorized
+	case PermissionDeniedError:
+		return e.StatusCode == http.StatusForbidden
+	case NotFoundError:
+		return e.StatusCode == http.StatusNotFound
+	case RateLimitedError:
+		return e.StatusCode == http.StatusTooManyRequests
+	}
+
+	return false
+}
+
+// Client calls the transit api of a server, it is safe for concurrent use.
+type Client struct {
+	baseURL string
+	http    *http.Client
+
+	mu        sync.RWMutex
+	token     string
+	tokenFunc func(ctx context.Context) (string, error)
+
+	retries          int
+	backoff          time.Duration
+	batchConcurrency int
+}
+
+type Option func(*Client)
+
+// WithHTTPClient sets the http client of the requests, e.g. for TLS client
+// certificates. It defaults to http.DefaultClient.
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *Client) {
+		c.http = client
+	}
+}
+
+// WithToken sets the token of the requests, a JWT or a service token.
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// WithTokenFunc gets the token of each request from fn, e.g. to refresh a
+// JWT before it expires. It takes precedence over the token of WithToken.
+func WithTokenFunc(fn func(ctx context.Context) (string, error)) Option {
+	return func(c *Client) {
+		c.tokenFunc = fn
+	}
+}
+
+// WithRetries sets the number of retries of a request and the delay before
+// the first one, the delay doubles with each retry. No request is retried
+// with 0 retries.
+func WithRetries(retries int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.retries = retries
+		c.backoff = backoff
+	}
+}
+
+// WithBatchConcurrency sets the number of requests of a batch served at the
+// same time.
+func WithBatchConcurrency(n int) Option {
+	return func(c *Client) {
+		c.batchConcurrency = n
+	}
+}
+
+// New creates a client of the server at baseURL, e.g. https://enclave:8080.
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:          strings.TrimSuffix(baseURL, "/"),
+		http:             http.DefaultClient,
+		retries:          defaultRetries,
+		backoff:          defaultBackoff,
+		batchConcurrency: defaultBatchConcurrency,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+// SetToken replaces the token of the next requests.
+func (c *Client) SetToken(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.token = token
+}
+
+func (c *Client) getToken(ctx context.Context) (string, error) {
+	if c.tokenFunc != nil {
+		return c.tokenFunc(ctx)
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.token, nil
+}
+
+// request is an api call, the body is sent again with each attempt.
+type request struct {
+	method string
+	path   string
+	header http.Header
+	body   []byte
+	// idempotent requests are also retried on network errors and when the
+	// server is unavailable, the others only when rate limited
+	idempotent bool
+}
+
+// do sends the request until it succeeds or the retries are exhausted, the
+// body of the response is returned.
+func (c *Client) do(ctx context.Context, r request) ([]byte, error) {
+	for attempt := 0; ; attempt++ {
+		body, err := c.send(ctx, r)
+		if err == nil {
+			return body, nil
+		}
+		if attempt >= c.retries || !retryable(err, r.idempotent) || ctx.Err() != nil {
+			return nil, err
+		}
+
+		delay := min(c.backoff<<attempt, maxBackoff)
+		delay = delay/2 + rand.N(delay/2+1)
+		if apiErr := (*APIError)(nil); errors.As(err, &apiErr) && apiErr.RetryAfter > delay {
+			delay = apiErr.RetryAfter
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		case <-timer.C:
+		}
+	}
+}
+
+// retryable reports whether a failed request can be sent again.
+func retryable(err error, idempotent bool) bool {
+	apiErr := (*APIError)(nil)
+	if !errors.As(err, &apiErr) {
+		// the request may have been served when the connection failed
+		return idempotent
+	}
+
+	switch apiErr.StatusCode {
+	case http.StatusTooManyRequests:
+		return true
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return idempotent
+	}
+
+	return false
+}
+
+func (c *Client) send(ctx context.Context, r request) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, r.method, c.baseURL+r.path, bytes.NewReader(r.body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range r.header {
+		req.Header[k] = v
+	}
+
+	token, err := c.getToken(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("enclave: failed to get token: %w", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= http.StatusBadRequest {
+		apiErr := &APIError{
+			StatusCode: res.StatusCode,
+			Message:    strings.TrimSpace(string(body)),
+			RequestID:  res.Header.Get(RequestIDHeader),
+		}
+		if seconds, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil {
+			apiErr.RetryAfter = time.Duration(seconds) * time.Second
+		}
+
+		return nil, apiErr
+	}
+
+	return body, nil
+}
+
+func (c *Client) doJSON(ctx context.Context, r request, in, out any) error {
+	if in != nil {
+		body, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		r.body = body
+		r.header = http.Header{"Content-Type": {"application/json"}}
+	}
+
+	body, err := c.do(ctx, r)
+	if err != nil || out == nil {
+		return err
+	}
+
+	return json.Unmarshal(body, out)
+}
+
+func keyPath(route, name string) string {
+	return "/transit/" + route + "/" + url.PathEscape(name)
+}
@@ -0,0 +1,302 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"enclave-task2/pkg/auth"
+	"enclave-task2/pkg/common"
+	"enclave-task2/pkg/storage"
+	"enclave-task2/services/server"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+var testSecret = []byte("client-secret")
+
+func signTestToken(t *testing.T, policies ...string) string {
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub":      "client",
+		"policies": policies,
+		"exp":      time.Now().Add(time.Hour).Unix(),
+	}).SignedString(testSecret)
+	assert.NoError(t, err)
+
+	return signed
+}
+
+// testServer serves the api of a real server, wrap may replace its handler.
+func testServer(t *testing.T, name string, wrap func(http.Handler) http.Handler) *httptest.Server {
+	logger := slog.New(slog.NewTextHandler(t.Output(), nil))
+	ctx := common.LoggerWithContext(context.Background(), logger)
+
+	verifier, err := auth.NewVerifier(auth.VerifierConfig{HMACSecret: testSecret})
+	assert.NoError(t, err)
+
+	h, err := server.New(
+		server.WithStorage(storage.NewNamedInMemoryCache(name)),
+		server.WithKeyDefaults("kyber", "768", time.Hour),
+		server.WithJWTVerifier(verifier),
+	).Handler(ctx)
+	assert.NoError(t, err)
+	if wrap != nil {
+		h = wrap(h)
+	}
+
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestTransit(t *testing.T) {
+	srv := testServer(t, "client-transit", nil)
+	ctx := context.Background()
+	c := New(srv.URL, WithToken(signTestToken(t, auth.RootPolicy)))
+
+	t.Run("key lifecycle", func(t *testing.T) {
+		assert.NoError(t, c.CreateKey(ctx, "payments", &KeyOptions{TTL: 2 * time.Hour, MaxEncryptions: 10}))
+
+		key, err := c.GetKey(ctx, "payments")
+		assert.NoError(t, err)
+		assert.Equal(t, "payments", key.Name)
+		assert.Equal(t, "768", key.Size)
+		assert.Equal(t, uint64(10), key.Usage.MaxEncryptions)
+		assert.WithinDuration(t, key.CreatedAt.Add(2*time.Hour), key.ExpireTime, time.Second)
+
+		names, err := c.ListKeys(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"payments"}, names)
+
+		ciphertext, err := c.Encrypt(ctx, "payments", []byte("hello"))
+		assert.NoError(t, err)
+		plaintext, err := c.Decrypt(ctx, "payments", ciphertext)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(plaintext))
+
+		assert.NoError(t, c.DeleteKey(ctx, "payments"))
+		_, err = c.GetKey(ctx, "payments")
+		assert.ErrorIs(t, err, NotFoundError)
+
+		var apiErr *APIError
+		assert.True(t, errors.As(err, &apiErr))
+		assert.Equal(t, "key not found", apiErr.Message)
+		assert.NotEmpty(t, apiErr.RequestID)
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		assert.NoError(t, c.CreateKey(ctx, "batch", nil))
+
+		var plaintexts [][]byte
+		for i := range 20 {
+			plaintexts = append(plaintexts, fmt.Appendf(nil, "message %d", i))
+		}
+		ciphertexts, err := c.EncryptBatch(ctx, "batch", plaintexts)
+		assert.NoError(t, err)
+		assert.Len(t, ciphertexts, len(plaintexts))
+
+		decrypted, err := c.DecryptBatch(ctx, "batch", ciphertexts)
+		assert.NoError(t, err)
+		assert.Equal(t, plaintexts, decrypted)
+
+		_, err = c.DecryptBatch(ctx, "missing", ciphertexts)
+		assert.ErrorIs(t, err, NotFoundError)
+	})
+
+	t.Run("unauthenticated", func(t *testing.T) {
+		_, err := New(srv.URL).GetKey(ctx, "batch")
+		assert.ErrorIs(t, err, UnauthenticatedError)
+	})
+
+	t.Run("token func", func(t *testing.T) {
+		var calls atomic.Int64
+		c := New(srv.URL, WithTokenFunc(func(ctx context.Context) (string, error) {
+			calls.Add(1)
+			return signTestToken(t, "reader"), nil
+		}))
+
+		_, err := c.GetKey(ctx, "batch")
+		assert.ErrorIs(t, err, PermissionDeniedError)
+		assert.Equal(t, int64(1), calls.Load())
+
+		c = New(srv.URL, WithTokenFunc(func(ctx context.Context) (string, error) {
+			return "", errors.New("no token")
+		}))
+		_, err = c.GetKey(ctx, "batch")
+		assert.ErrorContains(t, err, "no token")
+	})
+}
+
+func TestAppRole(t *testing.T) {
+	srv := testServer(t, "client-approle", nil)
+	ctx := context.Background()
+	root := signTestToken(t, auth.RootPolicy)
+
+	// post sends an admin request, the json response is decoded into out
+	post := func(path, body string, out any) {
+		req, err := http.NewRequest(http.MethodPost, srv.URL+path, strings.NewReader(body))
+		assert.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+root)
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(out))
+	}
+
+	var role struct {
+		RoleID string `json:"role_id"`
+	}
+	post("/auth/approle/role/ci", `{"policies": ["ci"], "token_ttl": "10m"}`, &role)
+	var secret struct {
+		SecretID string `json:"secret_id"`
+	}
+	post("/auth/approle/role/ci/secret-id", "", &secret)
+
+	c := New(srv.URL)
+	_, err := c.LoginAppRole(ctx, role.RoleID, "wrong")
+	assert.ErrorIs(t, err, UnauthenticatedError)
+
+	token, err := c.LoginAppRole(ctx, role.RoleID, secret.SecretID)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, token.Token)
+	assert.Equal(t, []string{"ci"}, token.Policies)
+
+	self, err := c.LookupSelf(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, token.Accessor, self.Accessor)
+	assert.Empty(t, self.Token)
+
+	renewed, err := c.RenewSelf(ctx, 5*time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, token.Accessor, renewed.Accessor)
+
+	assert.NoError(t, c.RevokeSelf(ctx))
+	_, err = c.LookupSelf(ctx)
+	assert.ErrorIs(t, err, UnauthenticatedError)
+}
+
+func TestTokens(t *testing.T) {
+	srv := testServer(t, "client-tokens", nil)
+	ctx := context.Background()
+	c := New(srv.URL, WithToken(signTestToken(t, auth.RootPolicy)))
+
+	token, err := c.CreateToken(ctx, TokenOptions{DisplayName: "ops", Policies: []string{"ops"}, TTL: 30 * time.Minute})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, token.Token)
+	assert.Equal(t, "ops", token.DisplayName)
+	assert.Equal(t, "30m0s", token.TTL)
+
+	self, err := New(srv.URL, WithToken(token.Token)).LookupSelf(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ops"}, self.Policies)
+
+	assert.NoError(t, c.RevokeToken(ctx, token.Token))
+	_, err = New(srv.URL, WithToken(token.Token)).LookupSelf(ctx)
+	assert.ErrorIs(t, err, UnauthenticatedError)
+
+	_, err = New(srv.URL, WithToken(signTestToken(t, "ops"))).CreateToken(ctx, TokenOptions{Policies: []string{"root"}})
+	assert.ErrorIs(t, err, PermissionDeniedError)
+}
+
+func TestStatus(t *testing.T) {
+	srv := testServer(t, "client-status", nil)
+
+	// the token store is only initialized by Start
+	status, err := New(srv.URL).Status(context.Background())
+	assert.NoError(t, err)
+	assert.False(t, status.Ready())
+	assert.Equal(t, "ok", status.Checks["storage"].Status)
+	assert.Equal(t, "unavailable", status.Checks["initialized"].Status)
+}
+
+func TestRetries(t *testing.T) {
+	// refuse makes the server refuse the next requests with the status
+	var refused atomic.Int64
+	var attempts atomic.Int64
+	var refuseStatus atomic.Int64
+	srv := testServer(t, "client-retries", func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			attempts.Add(1)
+			if refused.Add(-1) >= 0 {
+				rw.Header().Set("Retry-After", "0")
+				http.Error(rw, "refused", int(refuseStatus.Load()))
+				return
+			}
+			next.ServeHTTP(rw, req)
+		})
+	})
+	ctx := context.Background()
+	c := New(srv.URL, WithToken(signTestToken(t, auth.RootPolicy)), WithRetries(2, time.Millisecond))
+	assert.NoError(t, c.CreateKey(ctx, "retries", nil))
+
+	refuse := func(status, n int) {
+		refuseStatus.Store(int64(status))
+		refused.Store(int64(n))
+		attempts.Store(0)
+	}
+
+	t.Run("rate limited", func(t *testing.T) {
+		refuse(http.StatusTooManyRequests, 2)
+		ciphertext, err := c.Encrypt(ctx, "retries", []byte("hello"))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(3), attempts.Load())
+
+		refuse(http.StatusTooManyRequests, 2)
+		plaintext, err := c.Decrypt(ctx, "retries", ciphertext)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(plaintext))
+	})
+
+	t.Run("retries exhausted", func(t *testing.T) {
+		refuse(http.StatusTooManyRequests, 3)
+		_, err := c.GetKey(ctx, "retries")
+		assert.ErrorIs(t, err, RateLimitedError)
+		assert.Equal(t, int64(3), attempts.Load())
+	})
+
+	t.Run("unavailable", func(t *testing.T) {
+		refuse(http.StatusServiceUnavailable, 1)
+		_, err := c.GetKey(ctx, "retries")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), attempts.Load())
+
+		refuse(http.StatusServiceUnavailable, 1)
+		_, err = c.Encrypt(ctx, "retries", []byte("hello"))
+		assert.Error(t, err)
+		assert.Equal(t, int64(1), attempts.Load())
+	})
+
+	t.Run("not retried", func(t *testing.T) {
+		refuse(http.StatusBadRequest, 1)
+		err := c.CreateKey(ctx, "retries", nil)
+		assert.Error(t, err)
+		assert.Equal(t, int64(1), attempts.Load())
+	})
+
+	t.Run("network error", func(t *testing.T) {
+		refuse(0, 0)
+		c := New("http://127.0.0.1:1", WithRetries(1, time.Millisecond))
+		_, err := c.GetKey(ctx, "retries")
+		assert.Error(t, err)
+	})
+
+	t.Run("body sent again", func(t *testing.T) {
+		refuse(http.StatusTooManyRequests, 1)
+		ciphertexts, err := c.EncryptBatch(ctx, "retries", [][]byte{[]byte("a"), bytes.Repeat([]byte("b"), 64)})
+		assert.NoError(t, err)
+		plaintexts, err := c.DecryptBatch(ctx, "retries", ciphertexts)
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{[]byte("a"), bytes.Repeat([]byte("b"), 64)}, plaintexts)
+	})
+}
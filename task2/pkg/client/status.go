@@ -0,0 +1,37 @@
+package client
+
+import (
+	"context"
+	"net/http"
+)
+
+// Status is the readiness of the server and its checks, e.g. "storage" or
+// "leader".
+type Status struct {
+	Status string                 `json:"status"`
+	Checks map[string]StatusCheck `json:"checks,omitempty"`
+}
+
+type StatusCheck struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Members is the number of members of the cluster, the server included.
+	Members int `json:"members,omitempty"`
+}
+
+// Ready reports whether the server is "ok", the status of an unavailable
+// server is returned without error.
+func (s *Status) Ready() bool {
+	return s.Status == "ok"
+}
+
+// Status returns the readiness of the server, it is not authenticated.
+func (c *Client) Status(ctx context.Context) (*Status, error) {
+	// the unavailable servers answer 200 too, their checks are in the body
+	var status Status
+	if err := c.doJSON(ctx, request{method: http.MethodGet, path: "/sys/ready?fail_code=200", idempotent: true}, nil, &status); err != nil {
+		return nil, err
+	}
+
+	return &status, nil
+}
@@ -0,0 +1,131 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// KeyOptions are the parameters of a new key, the defaults of the server
+// are used for the zero values.
+type KeyOptions struct {
+	Type string
+	Size string
+	TTL  time.Duration
+	// MaxEncryptions is the number of encryptions after which the key must
+	// be rotated, unlimited when 0.
+	MaxEncryptions uint64
+}
+
+// Key is the metadata and usage of a key, never its material.
+type Key struct {
+	Name       string    `json:"name"`
+	Type       string    `json:"type"`
+	Size       string    `json:"size"`
+	Version    uint64    `json:"version"`
+	CreatedAt  time.Time `json:"creation_time"`
+	ExpireTime time.Time `json:"expire_time,omitzero"`
+	Usage      KeyUsage  `json:"usage"`
+}
+
+type KeyUsage struct {
+	Encryptions    uint64    `json:"encryptions"`
+	Decryptions    uint64    `json:"decryptions"`
+	Errors         uint64    `json:"errors"`
+	BytesProcessed uint64    `json:"bytes_processed"`
+	LastUsed       time.Time `json:"last_used,omitzero"`
+	MaxEncryptions uint64    `json:"max_encryptions,omitempty"`
+}
+
+// CreateKey creates the key, or extends its ttl when it exists. opts may
+// be nil.
+func (c *Client) CreateKey(ctx context.Context, name string, opts *KeyOptions) error {
+	header := http.Header{}
+	if opts != nil {
+		if opts.Type != "" {
+			header.Set("X-Key-Type", opts.Type)
+		}
+		if opts.Size != "" {
+			header.Set("X-Key-Size", opts.Size)
+		}
+		if opts.TTL > 0 {
+			header.Set("X-Key-TTL", opts.TTL.String())
+		}
+		if opts.MaxEncryptions > 0 {
+			header.Set("X-Key-Max-Encryptions", strconv.FormatUint(opts.MaxEncryptions, 10))
+		}
+	}
+
+	_, err := c.do(ctx, request{method: http.MethodPost, path: keyPath("keys", name), header: header, idempotent: true})
+	return err
+}
+
+// ListKeys returns the sorted names of the keys the caller can read.
+func (c *Client) ListKeys(ctx context.Context) ([]string, error) {
+	var res struct {
+		Keys []string `json:"keys"`
+	}
+	if err := c.doJSON(ctx, request{method: http.MethodGet, path: "/transit/keys", idempotent: true}, nil, &res); err != nil {
+		return nil, err
+	}
+
+	return res.Keys, nil
+}
+
+func (c *Client) GetKey(ctx context.Context, name string) (*Key, error) {
+	var key Key
+	if err := c.doJSON(ctx, request{method: http.MethodGet, path: keyPath("keys", name), idempotent: true}, nil, &key); err != nil {
+		return nil, err
+	}
+
+	return &key, nil
+}
+
+func (c *Client) DeleteKey(ctx context.Context, name string) error {
+	_, err := c.do(ctx, request{method: http.MethodDelete, path: keyPath("keys", name), idempotent: true})
+	return err
+}
+
+// Encrypt encrypts the plaintext with the key. It is only retried when
+// rate limited, every encryption counts towards the usage of the key.
+func (c *Client) Encrypt(ctx context.Context, name string, plaintext []byte) ([]byte, error) {
+	return c.do(ctx, request{method: http.MethodPost, path: keyPath("encrypt", name), body: plaintext})
+}
+
+func (c *Client) Decrypt(ctx context.Context, name string, ciphertext []byte) ([]byte, error) {
+	return c.do(ctx, request{method: http.MethodPost, path: keyPath("decrypt", name), body: ciphertext, idempotent: true})
+}
+
+// EncryptBatch encrypts the plaintexts with the key, the ciphertexts are in
+// the same order. It stops at the first error.
+func (c *Client) EncryptBatch(ctx context.Context, name string, plaintexts [][]byte) ([][]byte, error) {
+	return c.batch(ctx, name, plaintexts, c.Encrypt)
+}
+
+// DecryptBatch decrypts the ciphertexts with the key, the plaintexts are in
+// the same order. It stops at the first error.
+func (c *Client) DecryptBatch(ctx context.Context, name string, ciphertexts [][]byte) ([][]byte, error) {
+	return c.batch(ctx, name, ciphertexts, c.Decrypt)
+}
+
+func (c *Client) batch(ctx context.Context, name string, in [][]byte, fn func(context.Context, string, []byte) ([]byte, error)) ([][]byte, error) {
+	out := make([][]byte, len(in))
+
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(max(c.batchConcurrency, 1))
+	for i, data := range in {
+		g.Go(func() error {
+			res, err := fn(ctx, name, data)
+			out[i] = res
+			return err
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
@@ -0,0 +1,173 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ModeStatic = "static"
+	ModeDNSSRV = "dns"
+	ModeGossip = "gossip"
+
+	defaultRefreshInterval = 30 * time.Second
+)
+
+// Discoverer finds the peers of the cluster.
+type Discoverer interface {
+	// Run calls update with the peer base URLs every time the membership
+	// changes, until the context is done.
+	Run(ctx context.Context, update func(peers []string)) error
+}
+
+// Static is a list of peers, it is only changed by SetPeers.
+type Static struct {
+	Peers []string
+
+	mu      sync.Mutex
+	changed chan struct{}
+}
+
+func (s *Static) Run(ctx context.Context, update func(peers []string)) error {
+	for {
+		s.mu.Lock()
+		peers := s.Peers
+		if s.changed == nil {
+			s.changed = make(chan struct{})
+		}
+		changed := s.changed
+		s.mu.Unlock()
+
+		update(normalize(peers))
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-changed:
+		}
+	}
+}
+
+// SetPeers replaces the peers and updates the membership. It reports
+// whether the peers changed.
+func (s *Static) SetPeers(peers []string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if slices.Equal(normalize(s.Peers), normalize(peers)) {
+		return false
+	}
+	s.Peers = peers
+	if s.changed != nil {
+		close(s.changed)
+		s.changed = nil
+	}
+
+	return true
+}
+
+// DNSSRV discovers the peers from the SRV records of a service, e.g.
+// _groupcache._tcp.enclave.svc.cluster.local.
+type DNSSRV struct {
+	Service string
+	Proto   string
+	Name    string
+
+	// Scheme of the peer URLs, defaults to http.
+	Scheme string
+	// Interval between two lookups, defaults to 30s.
+	Interval time.Duration
+
+	// LookupSRV defaults to net.DefaultResolver.LookupSRV.
+	LookupSRV func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+func (d *DNSSRV) Run(ctx context.Context, update func(peers []string)) error {
+	interval := d.Interval
+	if interval <= 0 {
+		interval = defaultRefreshInterval
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	var current []string
+	for {
+		peers, err := d.Lookup(ctx)
+		// keep the last known peers on lookup failures
+		if err == nil && !slices.Equal(peers, current) {
+			current = peers
+			update(peers)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+		}
+	}
+}
+
+// Lookup resolves the SRV records into sorted peer base URLs.
+func (d *DNSSRV) Lookup(ctx context.Context) ([]string, error) {
+	lookup := d.LookupSRV
+	if lookup == nil {
+		lookup = net.DefaultResolver.LookupSRV
+	}
+
+	scheme := d.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+
+	_, records, err := lookup(ctx, d.Service, d.Proto, d.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup srv records: %w", err)
+	}
+
+	peers := make([]string, 0, len(records))
+	for _, r := range records {
+		host := strings.TrimSuffix(r.Target, ".")
+		peers = append(peers, fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(host, fmt.Sprint(r.Port))))
+	}
+
+	return normalize(peers), nil
+}
+
+// normalize sorts and deduplicates the peer URLs.
+func normalize(peers []string) []string {
+	res := make([]string, 0, len(peers))
+	for _, p := range peers {
+		p = strings.TrimSuffix(strings.TrimSpace(p), "/")
+		if p != "" {
+			res = append(res, p)
+		}
+	}
+	sort.Strings(res)
+
+	return slices.Compact(res)
+}
+
+// NewDiscoverer builds the discoverer of the mode. The peers are the static
+// members or the gossip seeds, srv is the SRV record name for the dns mode.
+func NewDiscoverer(mode, self string, peers []string, srv string) (Discoverer, error) {
+	switch mode {
+	case ModeStatic:
+		return &Static{Peers: peers}, nil
+	case ModeDNSSRV:
+		if srv == "" {
+			return nil, fmt.Errorf("dns discovery requires a srv record name")
+		}
+		return &DNSSRV{Name: srv}, nil
+	case ModeGossip:
+		return &Gossip{Self: self, Seeds: peers}, nil
+	default:
+		return nil, fmt.Errorf("unknown discovery mode: %s", mode)
+	}
+}
@@ -0,0 +1,114 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatic(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var got []string
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		err := (&Static{Peers: []string{"http://b:8081/", " http://a:8081", "", "http://b:8081"}}).Run(ctx, func(peers []string) {
+			got = peers
+		})
+		assert.NoError(t, err)
+	}()
+
+	cancel()
+	<-done
+	assert.Equal(t, []string{"http://a:8081", "http://b:8081"}, got)
+}
+
+func TestStaticSetPeers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := &Static{Peers: []string{"http://a:8081"}}
+	updates := make(chan []string, 1)
+	go s.Run(ctx, func(peers []string) { updates <- peers })
+
+	assert.Equal(t, []string{"http://a:8081"}, <-updates)
+
+	assert.False(t, s.SetPeers([]string{"http://a:8081/"}))
+	assert.True(t, s.SetPeers([]string{"http://c:8081", "http://a:8081"}))
+	assert.Equal(t, []string{"http://a:8081", "http://c:8081"}, <-updates)
+}
+
+func TestDNSSRV(t *testing.T) {
+	var mu sync.Mutex
+	records := []*net.SRV{
+		{Target: "node-2.enclave.local.", Port: 8081},
+		{Target: "node-1.enclave.local.", Port: 8081},
+	}
+	var lookupErr error
+
+	d := &DNSSRV{
+		Name:     "_groupcache._tcp.enclave.local",
+		Interval: 10 * time.Millisecond,
+		LookupSRV: func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			assert.Equal(t, "_groupcache._tcp.enclave.local", name)
+			return name, records, lookupErr
+		},
+	}
+
+	peers, err := d.Lookup(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"http://node-1.enclave.local:8081", "http://node-2.enclave.local:8081"}, peers)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	updates := make(chan []string, 10)
+	go d.Run(ctx, func(peers []string) { updates <- peers })
+	defer cancel()
+
+	assert.Len(t, <-updates, 2)
+
+	// lookup failures keep the last known peers
+	mu.Lock()
+	lookupErr = errors.New("timeout")
+	mu.Unlock()
+	time.Sleep(30 * time.Millisecond)
+	assert.Empty(t, updates)
+
+	// a node joins
+	mu.Lock()
+	lookupErr = nil
+	records = append(records, &net.SRV{Target: "node-3.enclave.local.", Port: 8081})
+	mu.Unlock()
+	assert.Equal(t, []string{
+		"http://node-1.enclave.local:8081",
+		"http://node-2.enclave.local:8081",
+		"http://node-3.enclave.local:8081",
+	}, <-updates)
+}
+
+func TestNewDiscoverer(t *testing.T) {
+	d, err := NewDiscoverer(ModeStatic, "http://a", []string{"http://b"}, "")
+	assert.NoError(t, err)
+	assert.IsType(t, &Static{}, d)
+
+	d, err = NewDiscoverer(ModeDNSSRV, "http://a", nil, "_groupcache._tcp.enclave.local")
+	assert.NoError(t, err)
+	assert.IsType(t, &DNSSRV{}, d)
+
+	_, err = NewDiscoverer(ModeDNSSRV, "http://a", nil, "")
+	assert.Error(t, err)
+
+	d, err = NewDiscoverer(ModeGossip, "http://a", []string{"http://b"}, "")
+	assert.NoError(t, err)
+	assert.IsType(t, &Gossip{}, d)
+
+	_, err = NewDiscoverer("consul", "http://a", nil, "")
+	assert.Error(t, err)
+}
@@ -0,0 +1,347 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// GossipPath is the path the membership messages are exchanged on, it is
+	// served next to the groupcache peer requests.
+	GossipPath = "/_cluster/gossip"
+
+	defaultGossipInterval = time.Second
+	defaultGossipFanout   = 3
+	maxGossipMessageSize  = 1 << 20
+)
+
+// Gossip is a push-pull membership protocol in the style of memberlist:
+// every interval each node sends its member list to a few random members,
+// merges the list they answer with and drops the members whose heartbeat
+// did not advance within DeadTimeout. Nodes leaving gracefully broadcast
+// a leave message so the others drop them right away.
+type Gossip struct {
+	// Self is the base URL of the current server.
+	Self string
+	// Seeds are contacted until they are part of the membership.
+	Seeds []string
+
+	// Interval between two gossip rounds, defaults to 1s.
+	Interval time.Duration
+	// DeadTimeout after which silent members are dropped, defaults to
+	// 5 intervals.
+	DeadTimeout time.Duration
+	// Fanout is the number of members contacted each round, defaults to 3.
+	Fanout int
+	// Client used for the gossip requests, defaults to a client with a
+	// timeout of one interval.
+	Client *http.Client
+	// Transport of the default client, defaults to http.DefaultTransport.
+	Transport http.RoundTripper
+
+	once      sync.Once
+	mu        sync.Mutex
+	heartbeat uint64
+	members   map[string]*member
+	left      map[string]tombstone
+	changed   chan struct{}
+}
+
+type member struct {
+	heartbeat uint64
+	seen      time.Time
+}
+
+type tombstone struct {
+	heartbeat uint64
+	at        time.Time
+}
+
+type gossipMessage struct {
+	From    string            `json:"from"`
+	Leave   bool              `json:"leave,omitempty"`
+	Members map[string]uint64 `json:"members"`
+	Left    map[string]uint64 `json:"left,omitempty"`
+}
+
+func (g *Gossip) init() {
+	g.once.Do(func() {
+		if g.Interval <= 0 {
+			g.Interval = defaultGossipInterval
+		}
+		if g.DeadTimeout <= 0 {
+			g.DeadTimeout = 5 * g.Interval
+		}
+		if g.Fanout <= 0 {
+			g.Fanout = defaultGossipFanout
+		}
+		if g.Client == nil {
+			g.Client = &http.Client{Timeout: g.Interval, Transport: g.Transport}
+		}
+
+		g.heartbeat = uint64(time.Now().UnixNano())
+		g.members = map[string]*member{g.Self: {heartbeat: g.heartbeat, seen: time.Now()}}
+		g.left = make(map[string]tombstone)
+		g.changed = make(chan struct{}, 1)
+	})
+}
+
+func (g *Gossip) Run(ctx context.Context, update func(peers []string)) error {
+	g.init()
+
+	t := time.NewTicker(g.Interval)
+	defer t.Stop()
+
+	current := g.Members()
+	update(current)
+
+	for {
+		g.round(ctx)
+
+		if members := g.Members(); !slices.Equal(members, current) {
+			current = members
+			update(current)
+		}
+
+		select {
+		case <-ctx.Done():
+			g.leave()
+			return nil
+		case <-t.C:
+		case <-g.changed:
+		}
+	}
+}
+
+// Members returns the sorted base URLs of the live members.
+func (g *Gossip) Members() []string {
+	g.init()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	res := make([]string, 0, len(g.members))
+	for url := range g.members {
+		res = append(res, url)
+	}
+	sort.Strings(res)
+
+	return res
+}
+
+func (g *Gossip) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	g.init()
+
+	if req.Method != http.MethodPost {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var msg gossipMessage
+	if err := json.NewDecoder(http.MaxBytesReader(rw, req.Body, maxGossipMessageSize)).Decode(&msg); err != nil {
+		http.Error(rw, "invalid gossip message", http.StatusBadRequest)
+		return
+	}
+
+	g.merge(msg)
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(g.message(false))
+}
+
+// round sends the state to a few random members and the seeds that did not
+// join yet, then drops the dead members.
+func (g *Gossip) round(ctx context.Context) {
+	g.mu.Lock()
+	g.heartbeat = max(g.heartbeat+1, uint64(time.Now().UnixNano()))
+	g.members[g.Self] = &member{heartbeat: g.heartbeat, seen: time.Now()}
+
+	var targets []string
+	for url := range g.members {
+		if url != g.Self {
+			targets = append(targets, url)
+		}
+	}
+	rand.Shuffle(len(targets), func(i, j int) { targets[i], targets[j] = targets[j], targets[i] })
+	if len(targets) > g.Fanout {
+		targets = targets[:g.Fanout]
+	}
+	for _, seed := range normalize(g.Seeds) {
+		if _, ok := g.members[seed]; !ok && seed != g.Self {
+			targets = append(targets, seed)
+		}
+	}
+	g.mu.Unlock()
+
+	msg := g.message(false)
+
+	var wg sync.WaitGroup
+	for _, target := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if reply, err := g.send(ctx, target, msg); err == nil {
+				g.merge(reply)
+			}
+		}()
+	}
+	wg.Wait()
+
+	g.reap()
+}
+
+// leave tells every member the current server is going away.
+func (g *Gossip) leave() {
+	ctx, cancel := context.WithTimeout(context.Background(), g.Interval)
+	defer cancel()
+
+	msg := g.message(true)
+
+	var wg sync.WaitGroup
+	for _, target := range g.Members() {
+		if target == g.Self {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			g.send(ctx, target, msg)
+		}()
+	}
+	wg.Wait()
+}
+
+func (g *Gossip) send(ctx context.Context, target string, msg gossipMessage) (gossipMessage, error) {
+	var reply gossipMessage
+
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return reply, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target+GossipPath, bytes.NewReader(body))
+	if err != nil {
+		return reply, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := g.Client.Do(req)
+	if err != nil {
+		return reply, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return reply, fmt.Errorf("gossip with %s failed: %s", target, res.Status)
+	}
+
+	err = json.NewDecoder(http.MaxBytesReader(nil, res.Body, maxGossipMessageSize)).Decode(&reply)
+	return reply, err
+}
+
+func (g *Gossip) message(leave bool) gossipMessage {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	msg := gossipMessage{
+		From:    g.Self,
+		Leave:   leave,
+		Members: make(map[string]uint64, len(g.members)),
+		Left:    make(map[string]uint64, len(g.left)),
+	}
+	for url, m := range g.members {
+		msg.Members[url] = m.heartbeat
+	}
+	for url, t := range g.left {
+		msg.Left[url] = t.heartbeat
+	}
+	if leave {
+		delete(msg.Members, g.Self)
+		msg.Left[g.Self] = g.heartbeat
+	}
+
+	return msg
+}
+
+func (g *Gossip) merge(msg gossipMessage) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	changed := false
+
+	for url, hb := range msg.Left {
+		if url == g.Self {
+			continue
+		}
+		if t, ok := g.left[url]; ok && t.heartbeat >= hb {
+			continue
+		}
+		g.left[url] = tombstone{heartbeat: hb, at: now}
+		if m, ok := g.members[url]; ok && m.heartbeat <= hb {
+			delete(g.members, url)
+			changed = true
+		}
+	}
+
+	for url, hb := range msg.Members {
+		if url == g.Self {
+			continue
+		}
+		if t, ok := g.left[url]; ok {
+			if hb <= t.heartbeat {
+				continue
+			}
+			// the member came back
+			delete(g.left, url)
+		}
+
+		m, ok := g.members[url]
+		if !ok {
+			g.members[url] = &member{heartbeat: hb, seen: now}
+			changed = true
+			continue
+		}
+		if hb > m.heartbeat {
+			m.heartbeat = hb
+			m.seen = now
+		}
+	}
+
+	if changed {
+		select {
+		case g.changed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// reap drops the members that were silent for too long and forgets the
+// old tombstones.
+func (g *Gossip) reap() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	for url, m := range g.members {
+		if url != g.Self && now.Sub(m.seen) > g.DeadTimeout {
+			delete(g.members, url)
+			// members still gossiping the stale heartbeat must not
+			// resurrect it
+			g.left[url] = tombstone{heartbeat: m.heartbeat, at: now}
+		}
+	}
+	for url, t := range g.left {
+		if now.Sub(t.at) > 10*g.DeadTimeout {
+			delete(g.left, url)
+		}
+	}
+}
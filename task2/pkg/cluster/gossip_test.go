@@ -0,0 +1,132 @@
+package cluster
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type gossipNode struct {
+	gossip *Gossip
+	server *httptest.Server
+	cancel context.CancelFunc
+	done   chan struct{}
+	down   atomic.Bool
+
+	mu    sync.Mutex
+	peers []string
+}
+
+func (n *gossipNode) Peers() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.peers
+}
+
+func startGossipNodes(t *testing.T, count int) []*gossipNode {
+	var nodes []*gossipNode
+	for i := 0; i < count; i++ {
+		n := &gossipNode{gossip: &Gossip{Interval: 10 * time.Millisecond}}
+		n.server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if n.down.Load() {
+				http.Error(rw, "down", http.StatusServiceUnavailable)
+				return
+			}
+			n.gossip.ServeHTTP(rw, req)
+		}))
+		n.gossip.Self = n.server.URL
+		nodes = append(nodes, n)
+	}
+
+	for i, n := range nodes {
+		// everyone only knows the first node
+		if i > 0 {
+			n.gossip.Seeds = []string{nodes[0].server.URL}
+		}
+
+		var ctx context.Context
+		ctx, n.cancel = context.WithCancel(context.Background())
+		n.done = make(chan struct{})
+		go func() {
+			defer close(n.done)
+			n.gossip.Run(ctx, func(peers []string) {
+				n.mu.Lock()
+				n.peers = peers
+				n.mu.Unlock()
+			})
+		}()
+	}
+
+	t.Cleanup(func() {
+		for _, n := range nodes {
+			n.cancel()
+			<-n.done
+			n.server.Close()
+		}
+	})
+
+	return nodes
+}
+
+func TestGossipMembership(t *testing.T) {
+	nodes := startGossipNodes(t, 4)
+
+	var all []string
+	for _, n := range nodes {
+		all = append(all, n.server.URL)
+	}
+	slices.Sort(all)
+
+	for _, n := range nodes {
+		assert.Eventually(t, func() bool { return slices.Equal(all, n.Peers()) }, 2*time.Second, 5*time.Millisecond)
+	}
+
+	// graceful leave
+	nodes[3].cancel()
+	<-nodes[3].done
+	nodes[3].server.Close()
+
+	alive := slices.DeleteFunc(slices.Clone(all), func(u string) bool { return u == nodes[3].server.URL })
+	for _, n := range nodes[:3] {
+		assert.Eventually(t, func() bool { return slices.Equal(alive, n.Peers()) }, 2*time.Second, 5*time.Millisecond)
+	}
+}
+
+func TestGossipFailureDetection(t *testing.T) {
+	nodes := startGossipNodes(t, 3)
+
+	for _, n := range nodes {
+		assert.Eventually(t, func() bool { return len(n.Peers()) == 3 }, 2*time.Second, 5*time.Millisecond)
+	}
+
+	// node crashes without leaving
+	crashed := nodes[2]
+	crashed.down.Store(true)
+	crashed.cancel()
+	<-crashed.done
+
+	for _, n := range nodes[:2] {
+		assert.Eventually(t, func() bool {
+			return !slices.Contains(n.Peers(), crashed.server.URL) && len(n.Peers()) == 2
+		}, 2*time.Second, 5*time.Millisecond)
+	}
+}
+
+func TestGossipServeHTTPErrors(t *testing.T) {
+	g := &Gossip{Self: "http://a"}
+
+	rw := httptest.NewRecorder()
+	g.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, GossipPath, nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rw.Code)
+
+	rw = httptest.NewRecorder()
+	g.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, GossipPath, nil))
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+}
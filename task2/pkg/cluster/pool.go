@@ -0,0 +1,378 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"enclave-task2/pkg/tracing"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/mailgun/groupcache/v2"
+	"github.com/mailgun/groupcache/v2/consistenthash"
+	pb "github.com/mailgun/groupcache/v2/groupcachepb"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// BasePath is the path the groupcache peer requests are served on.
+	BasePath = "/_groupcache/"
+
+	// InstanceSeparator separates the group name shared by the peers from
+	// the instance suffix that makes it unique within a process.
+	InstanceSeparator = "@"
+
+	defaultReplicas = 50
+)
+
+var (
+	// pools maps the local group names to the pool of their server
+	pools sync.Map
+)
+
+func init() {
+	// groupcache allows a single registration per process, the pickers
+	// resolve the pool of the group on every call so several servers can
+	// live in the same process and pools can be bound after the groups are
+	// created.
+	groupcache.RegisterPerGroupPeerPicker(func(groupName string) groupcache.PeerPicker {
+		return groupPicker(groupName)
+	})
+}
+
+// PoolOptions are the configurations of a Pool.
+type PoolOptions struct {
+	// Replicas specifies the number of key replicas on the consistent hash.
+	// If blank, it defaults to 50.
+	Replicas int
+
+	// Transport optionally specifies an http.RoundTripper used for the
+	// requests to the peers. If nil, http.DefaultTransport is used.
+	Transport func(context.Context) http.RoundTripper
+}
+
+// Pool is a groupcache peer pool whose members can be changed at runtime.
+// Unlike groupcache.HTTPPool it is not registered globally, the groups
+// served by it are bound with Bind.
+type Pool struct {
+	self string
+	opts PoolOptions
+
+	mu      sync.RWMutex
+	peers   *consistenthash.Map
+	getters map[string]*peerGetter
+	members []string
+	groups  map[string]string // shared group name -> local group name
+
+	handler http.Handler
+}
+
+// NewPool creates a pool. The self argument is the base URL of the current
+// server as seen by the other peers, e.g. "http://10.0.0.1:8081".
+func NewPool(self string, opts *PoolOptions) *Pool {
+	p := &Pool{
+		self:    strings.TrimSuffix(self, "/"),
+		getters: make(map[string]*peerGetter),
+		groups:  make(map[string]string),
+	}
+	if opts != nil {
+		p.opts = *opts
+	}
+	if p.opts.Replicas == 0 {
+		p.opts.Replicas = defaultReplicas
+	}
+	p.peers = consistenthash.New(p.opts.Replicas, nil)
+
+	// a zero HTTPPool serves the requests of any registered group, the
+	// group name in the path is rewritten to the local one by ServeHTTP
+	p.handler = http.StripPrefix(BasePath, &groupcache.HTTPPool{})
+
+	return p
+}
+
+// Self returns the base URL of the current server.
+func (p *Pool) Self() string {
+	return p.self
+}
+
+// Bind attaches a local groupcache group to the pool.
+func (p *Pool) Bind(groupName string) {
+	p.mu.Lock()
+	p.groups[sharedName(groupName)] = groupName
+	p.mu.Unlock()
+
+	pools.Store(groupName, p)
+}
+
+// Unbind detaches a local group from the pool.
+func (p *Pool) Unbind(groupName string) {
+	p.mu.Lock()
+	delete(p.groups, sharedName(groupName))
+	p.mu.Unlock()
+
+	pools.CompareAndDelete(groupName, p)
+}
+
+// Set updates the pool's list of peers. Each peer value should be a base
+// URL, e.g. "http://10.0.0.2:8081". The current server is always a member.
+func (p *Pool) Set(peers ...string) {
+	members := map[string]struct{}{p.self: {}}
+	for _, peer := range peers {
+		members[strings.TrimSuffix(peer, "/")] = struct{}{}
+	}
+
+	list := make([]string, 0, len(members))
+	for peer := range members {
+		list = append(list, peer)
+	}
+	sort.Strings(list)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.peers = consistenthash.New(p.opts.Replicas, nil)
+	p.peers.Add(list...)
+
+	getters := make(map[string]*peerGetter, len(list))
+	for _, peer := range list {
+		if peer == p.self {
+			continue
+		}
+		if g, ok := p.getters[peer]; ok {
+			getters[peer] = g
+			continue
+		}
+		getters[peer] = &peerGetter{
+			baseURL:      peer + BasePath,
+			getTransport: p.opts.Transport,
+		}
+	}
+	p.getters = getters
+	p.members = list
+}
+
+// Members returns the sorted list of peers including the current server.
+func (p *Pool) Members() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if len(p.members) == 0 {
+		return []string{p.self}
+	}
+
+	return append([]string(nil), p.members...)
+}
+
+// Owner returns the base URL of the peer owning the key, the current server
+// included.
+func (p *Pool) Owner(key string) string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.peers.IsEmpty() {
+		return p.self
+	}
+
+	return p.peers.Get(key)
+}
+
+// PickPeer returns the peer owning the key, or false if the key is owned by
+// the current server.
+func (p *Pool) PickPeer(key string) (groupcache.ProtoGetter, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.peers.IsEmpty() {
+		return nil, false
+	}
+	if peer := p.peers.Get(key); peer != p.self {
+		return p.getters[peer], true
+	}
+
+	return nil, false
+}
+
+// GetAll returns all the remote peers of the pool.
+func (p *Pool) GetAll() []groupcache.ProtoGetter {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	res := make([]groupcache.ProtoGetter, 0, len(p.getters))
+	for _, g := range p.getters {
+		res = append(res, g)
+	}
+
+	return res
+}
+
+func (p *Pool) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	rest, ok := strings.CutPrefix(req.URL.Path, BasePath)
+	if !ok {
+		http.Error(rw, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	shared, key, ok := strings.Cut(rest, "/")
+	if !ok {
+		http.Error(rw, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	p.mu.RLock()
+	local, ok := p.groups[shared]
+	p.mu.RUnlock()
+	if !ok {
+		http.Error(rw, "no such group: "+shared, http.StatusNotFound)
+		return
+	}
+
+	ctx, span := otel.Tracer(tracing.TracerName).Start(tracing.Extract(req.Context(), req.Header), "groupcache.serve",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("groupcache.group", shared), attribute.String("http.request.method", req.Method)),
+	)
+	defer span.End()
+
+	req = req.Clone(ctx)
+	req.URL.Path = BasePath + local + "/" + key
+	req.URL.RawPath = ""
+
+	p.handler.ServeHTTP(rw, req)
+}
+
+// groupPicker resolves the pool bound to the group on every call.
+type groupPicker string
+
+func (g groupPicker) PickPeer(key string) (groupcache.ProtoGetter, bool) {
+	if p, ok := pools.Load(string(g)); ok {
+		return p.(*Pool).PickPeer(key)
+	}
+
+	return nil, false
+}
+
+func (g groupPicker) GetAll() []groupcache.ProtoGetter {
+	if p, ok := pools.Load(string(g)); ok {
+		return p.(*Pool).GetAll()
+	}
+
+	return nil
+}
+
+// sharedName strips the instance suffix from a local group name.
+func sharedName(groupName string) string {
+	name, _, _ := strings.Cut(groupName, InstanceSeparator)
+	return name
+}
+
+// peerGetter implements groupcache.ProtoGetter over the groupcache HTTP
+// protocol, addressing the groups by their shared name.
+type peerGetter struct {
+	baseURL      string
+	getTransport func(context.Context) http.RoundTripper
+}
+
+func (g *peerGetter) GetURL() string {
+	return g.baseURL
+}
+
+func (g *peerGetter) do(ctx context.Context, method, group, key string, body io.Reader) (*http.Response, error) {
+	ctx, span := otel.Tracer(tracing.TracerName).Start(ctx, "groupcache.peer",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("groupcache.group", sharedName(group)),
+			attribute.String("http.request.method", method),
+			attribute.String("server.address", g.baseURL),
+		),
+	)
+
+	u := g.baseURL + url.PathEscape(sharedName(group)) + "/" + url.PathEscape(key)
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		tracing.End(span, err)
+		return nil, err
+	}
+	tracing.Inject(ctx, req.Header)
+
+	tr := http.DefaultTransport
+	if g.getTransport != nil {
+		tr = g.getTransport(ctx)
+	}
+
+	res, err := tr.RoundTrip(req)
+	if err == nil {
+		span.SetAttributes(attribute.Int("http.response.status_code", res.StatusCode))
+	}
+	tracing.End(span, err)
+
+	return res, err
+}
+
+func (g *peerGetter) Get(ctx context.Context, in *pb.GetRequest, out *pb.GetResponse) error {
+	res, err := g.do(ctx, http.MethodGet, in.GetGroup(), in.GetKey(), nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, 64<<20))
+	if err != nil {
+		return fmt.Errorf("reading response body: %w", err)
+	}
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return &groupcache.ErrNotFound{Msg: strings.TrimSpace(string(body))}
+	case http.StatusServiceUnavailable:
+		return &groupcache.ErrRemoteCall{Msg: strings.TrimSpace(string(body))}
+	default:
+		return fmt.Errorf("server returned: %v, %s", res.Status, body)
+	}
+
+	if err := proto.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("decoding response body: %w", err)
+	}
+
+	return nil
+}
+
+func (g *peerGetter) Set(ctx context.Context, in *pb.SetRequest) error {
+	body, err := proto.Marshal(in)
+	if err != nil {
+		return fmt.Errorf("while marshaling SetRequest body: %w", err)
+	}
+
+	res, err := g.do(ctx, http.MethodPut, in.GetGroup(), in.GetKey(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	return checkResponse(res)
+}
+
+func (g *peerGetter) Remove(ctx context.Context, in *pb.GetRequest) error {
+	res, err := g.do(ctx, http.MethodDelete, in.GetGroup(), in.GetKey(), nil)
+	if err != nil {
+		return err
+	}
+
+	return checkResponse(res)
+}
+
+func checkResponse(res *http.Response) error {
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+		return fmt.Errorf("server returned status %d: %s", res.StatusCode, body)
+	}
+
+	return nil
+}
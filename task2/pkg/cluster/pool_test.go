@@ -0,0 +1,204 @@
+package cluster
+
+import (
+	"context"
+	"enclave-task2/pkg/tracing"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mailgun/groupcache/v2"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestPoolMembers(t *testing.T) {
+	pool := NewPool("http://node-1:8081/", nil)
+	assert.Equal(t, "http://node-1:8081", pool.Self())
+	assert.Equal(t, []string{"http://node-1:8081"}, pool.Members())
+
+	// no peers -> every key is local
+	_, ok := pool.PickPeer("some-key")
+	assert.False(t, ok)
+
+	pool.Set("http://node-3:8081", "http://node-2:8081/", "http://node-2:8081")
+	assert.Equal(t, []string{"http://node-1:8081", "http://node-2:8081", "http://node-3:8081"}, pool.Members())
+	assert.Len(t, pool.GetAll(), 2)
+
+	remote := 0
+	for i := 0; i < 100; i++ {
+		if peer, ok := pool.PickPeer(fmt.Sprintf("%d-key", i)); ok {
+			assert.Contains(t, []string{"http://node-2:8081" + BasePath, "http://node-3:8081" + BasePath}, peer.GetURL())
+			remote++
+		}
+	}
+	assert.Greater(t, remote, 0)
+
+	pool.Set()
+	assert.Equal(t, []string{"http://node-1:8081"}, pool.Members())
+	assert.Empty(t, pool.GetAll())
+}
+
+func TestPoolPeerRequests(t *testing.T) {
+	ctx := context.Background()
+
+	values := map[string]map[string]string{
+		"pooltest@a": {},
+		"pooltest@b": {"remote-key": "remote-value"},
+	}
+	groups := map[string]*groupcache.Group{}
+	for name, data := range values {
+		groups[name] = groupcache.NewGroup(name, 1<<20, groupcache.GetterFunc(
+			func(ctx context.Context, key string, dest groupcache.Sink) error {
+				v, ok := data[key]
+				if !ok {
+					return &groupcache.ErrNotFound{Msg: "key not found"}
+				}
+				return dest.SetString(v, time.Time{})
+			},
+		))
+		defer groupcache.DeregisterGroup(name)
+	}
+
+	poolA := NewPool("http://a", nil)
+	poolA.Bind("pooltest@a")
+	defer poolA.Unbind("pooltest@a")
+
+	poolB := NewPool("http://b", nil)
+	poolB.Bind("pooltest@b")
+	defer poolB.Unbind("pooltest@b")
+
+	srvA := httptest.NewServer(poolA)
+	defer srvA.Close()
+	srvB := httptest.NewServer(poolB)
+	defer srvB.Close()
+
+	// the pools only know each other by the test server urls
+	poolA.self = srvA.URL
+	poolB.self = srvB.URL
+	poolA.Set(srvB.URL)
+	poolB.Set(srvA.URL)
+
+	// find a key owned by b
+	var key string
+	for i := 0; i < 100; i++ {
+		k := fmt.Sprintf("%d-key", i)
+		if peer, ok := poolA.PickPeer(k); ok && peer.GetURL() == srvB.URL+BasePath {
+			key = k
+			break
+		}
+	}
+	assert.NotEmpty(t, key)
+	values["pooltest@b"][key] = "value-of-b"
+
+	var got string
+	err := groups["pooltest@a"].Get(ctx, key, groupcache.StringSink(&got))
+	assert.NoError(t, err)
+	assert.Equal(t, "value-of-b", got)
+
+	// set on a is stored by the owner b
+	err = groups["pooltest@a"].Set(ctx, key, []byte("new-value"), time.Now().Add(time.Minute), false)
+	assert.NoError(t, err)
+	err = groups["pooltest@b"].Get(ctx, key, groupcache.StringSink(&got))
+	assert.NoError(t, err)
+	assert.Equal(t, "new-value", got)
+
+	// remove on a is forwarded to b, b falls back to its getter
+	delete(values["pooltest@b"], key)
+	err = groups["pooltest@a"].Remove(ctx, key)
+	assert.NoError(t, err)
+	err = groups["pooltest@b"].Get(ctx, key, groupcache.StringSink(&got))
+	assert.True(t, errors.Is(err, &groupcache.ErrNotFound{}))
+
+	// missing on the owner is reported as not found
+	err = groups["pooltest@a"].Get(ctx, key, groupcache.StringSink(&got))
+	assert.True(t, errors.Is(err, &groupcache.ErrNotFound{}))
+}
+
+func TestPoolServeHTTPErrors(t *testing.T) {
+	pool := NewPool("http://a", nil)
+
+	rw := httptest.NewRecorder()
+	pool.ServeHTTP(rw, httptest.NewRequest("GET", "/other/path", nil))
+	assert.Equal(t, 400, rw.Code)
+
+	rw = httptest.NewRecorder()
+	pool.ServeHTTP(rw, httptest.NewRequest("GET", BasePath+"no-key", nil))
+	assert.Equal(t, 400, rw.Code)
+
+	rw = httptest.NewRecorder()
+	pool.ServeHTTP(rw, httptest.NewRequest("GET", BasePath+"unbound/key", nil))
+	assert.Equal(t, 404, rw.Code)
+}
+
+func TestPoolPeerTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider, err := tracing.NewProvider(sdktrace.NewSimpleSpanProcessor(exporter))
+	assert.NoError(t, err)
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	var loaded trace.SpanContext
+	groupA := groupcache.NewGroup("pooltracing@a", 1<<20, groupcache.GetterFunc(
+		func(ctx context.Context, key string, dest groupcache.Sink) error {
+			return &groupcache.ErrNotFound{Msg: "key not found"}
+		},
+	))
+	defer groupcache.DeregisterGroup("pooltracing@a")
+	groupcache.NewGroup("pooltracing@b", 1<<20, groupcache.GetterFunc(
+		func(ctx context.Context, key string, dest groupcache.Sink) error {
+			loaded = trace.SpanContextFromContext(ctx)
+			return dest.SetString("value-of-b", time.Time{})
+		},
+	))
+	defer groupcache.DeregisterGroup("pooltracing@b")
+
+	poolA := NewPool("http://a", nil)
+	poolA.Bind("pooltracing@a")
+	defer poolA.Unbind("pooltracing@a")
+	poolB := NewPool("http://b", nil)
+	poolB.Bind("pooltracing@b")
+	defer poolB.Unbind("pooltracing@b")
+
+	srvA := httptest.NewServer(poolA)
+	defer srvA.Close()
+	srvB := httptest.NewServer(poolB)
+	defer srvB.Close()
+	poolA.self = srvA.URL
+	poolB.self = srvB.URL
+	poolA.Set(srvB.URL)
+	poolB.Set(srvA.URL)
+
+	var key string
+	for i := 0; i < 100; i++ {
+		k := fmt.Sprintf("%d-key", i)
+		if peer, ok := poolA.PickPeer(k); ok && peer.GetURL() == srvB.URL+BasePath {
+			key = k
+			break
+		}
+	}
+	assert.NotEmpty(t, key)
+
+	ctx, span := tracing.Start(context.Background(), "request")
+	var got string
+	assert.NoError(t, groupA.Get(ctx, key, groupcache.StringSink(&got)))
+	span.End()
+	assert.Equal(t, "value-of-b", got)
+
+	// the owner loads the key in the trace of the request
+	assert.Equal(t, span.SpanContext().TraceID(), loaded.TraceID())
+
+	names := []string{}
+	for _, s := range exporter.GetSpans() {
+		assert.Equal(t, span.SpanContext().TraceID(), s.SpanContext.TraceID())
+		names = append(names, s.Name)
+	}
+	assert.Contains(t, names, "groupcache.peer")
+	assert.Contains(t, names, "groupcache.serve")
+}
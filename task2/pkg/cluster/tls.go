@@ -0,0 +1,131 @@
+package cluster
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync/atomic"
+)
+
+// PeerTLSRequiredError is returned when the cluster mode is enabled without
+// mutual TLS on the peer listener.
+var PeerTLSRequiredError = errors.New("cluster mode requires peer mTLS")
+
+// PeerTLS is the mutual TLS configuration of the peer listener. The peers
+// are only trusted if their certificate is signed by the dedicated cluster
+// CA, the system roots are never used. The certificate of this server can
+// be swapped with SetCertificate, the CA can not.
+type PeerTLS struct {
+	ca   *x509.CertPool
+	cert atomic.Pointer[tls.Certificate]
+}
+
+// LoadPeerTLS reads the PEM encoded cluster CA and the certificate and key
+// of this server.
+func LoadPeerTLS(caFile, certFile, keyFile string) (*PeerTLS, error) {
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read peer ca: %w", err)
+	}
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read peer certificate: %w", err)
+	}
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read peer key: %w", err)
+	}
+
+	return NewPeerTLS(caPEM, certPEM, keyPEM)
+}
+
+// LoadPeerCertificate reads the PEM encoded certificate and key of this
+// server, see SetCertificate.
+func LoadPeerCertificate(certFile, keyFile string) (tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return cert, fmt.Errorf("invalid peer certificate: %w", err)
+	}
+
+	return cert, nil
+}
+
+// NewPeerTLS builds the configuration from PEM encoded data.
+func NewPeerTLS(caPEM, certPEM, keyPEM []byte) (*PeerTLS, error) {
+	ca := x509.NewCertPool()
+	if !ca.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("invalid peer ca: no certificate found")
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer certificate: %w", err)
+	}
+
+	t := &PeerTLS{ca: ca}
+	t.cert.Store(&cert)
+
+	return t, nil
+}
+
+// SetCertificate swaps the certificate presented to the peers, the new
+// connections use it. It reports whether the certificate changed.
+func (t *PeerTLS) SetCertificate(cert tls.Certificate) bool {
+	current := t.cert.Swap(&cert)
+	return len(current.Certificate) == 0 || len(cert.Certificate) == 0 ||
+		!bytes.Equal(current.Certificate[0], cert.Certificate[0])
+}
+
+// Config returns a TLS configuration usable by both sides of a peer
+// connection: the server requires and verifies the client certificate, the
+// client verifies the server certificate against the cluster CA.
+func (t *PeerTLS) Config() *tls.Config {
+	cfg := t.config()
+	// like the api, the listener takes the current certificate on every
+	// handshake, see SetCertificate
+	cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		return t.config(), nil
+	}
+
+	return cfg
+}
+
+func (t *PeerTLS) config() *tls.Config {
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS13,
+		Certificates: []tls.Certificate{*t.cert.Load()},
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return t.cert.Load(), nil
+		},
+		RootCAs:    t.ca,
+		ClientCAs:  t.ca,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+	}
+}
+
+// Transport returns an http.RoundTripper presenting the certificate of this
+// server to the peers.
+func (t *PeerTLS) Transport() http.RoundTripper {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = t.Config()
+
+	return tr
+}
+
+// Configure makes the discoverer talk to the peers over mTLS.
+func (t *PeerTLS) Configure(d Discoverer) {
+	switch d := d.(type) {
+	case *Gossip:
+		if d.Client == nil && d.Transport == nil {
+			d.Transport = t.Transport()
+		}
+	case *DNSSRV:
+		if d.Scheme == "" {
+			d.Scheme = "https"
+		}
+	}
+}
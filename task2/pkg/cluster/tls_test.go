@@ -0,0 +1,122 @@
+package cluster_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"enclave-task2/pkg/cluster"
+	"enclave-task2/pkg/cluster/clustertest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadPeerTLS(t *testing.T) {
+	ca := clustertest.NewCA(t)
+	certPEM, keyPEM := ca.Issue(t, "127.0.0.1")
+
+	dir := t.TempDir()
+	files := map[string][]byte{"ca.pem": ca.PEM, "cert.pem": certPEM, "key.pem": keyPEM}
+	for name, data := range files {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), data, 0o600))
+	}
+
+	peerTLS, err := cluster.LoadPeerTLS(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	assert.NoError(t, err)
+	assert.NotNil(t, peerTLS)
+
+	_, err = cluster.LoadPeerTLS(filepath.Join(dir, "missing.pem"), filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	assert.Error(t, err)
+
+	_, err = cluster.NewPeerTLS([]byte("not a pem"), certPEM, keyPEM)
+	assert.Error(t, err)
+
+	_, err = cluster.NewPeerTLS(ca.PEM, certPEM, []byte("not a pem"))
+	assert.Error(t, err)
+}
+
+func TestPeerTLSMutualAuth(t *testing.T) {
+	ca := clustertest.NewCA(t)
+	server := ca.PeerTLS(t)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, req.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	srv.TLS = server.Config()
+	srv.StartTLS()
+	defer srv.Close()
+
+	// a peer of the same CA is accepted
+	client := &http.Client{Transport: ca.PeerTLS(t).Transport()}
+	res, err := client.Get(srv.URL)
+	assert.NoError(t, err)
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, "enclave test peer", string(body))
+
+	// the server of another CA is not trusted
+	other := &http.Client{Transport: clustertest.NewCA(t).PeerTLS(t).Transport()}
+	_, err = other.Get(srv.URL)
+	assert.Error(t, err)
+}
+
+func TestPeerTLSSetCertificate(t *testing.T) {
+	ca := clustertest.NewCA(t)
+	server := ca.PeerTLS(t)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, req.TLS.PeerCertificates[0].SerialNumber.String())
+	}))
+	srv.TLS = server.Config()
+	srv.StartTLS()
+	defer srv.Close()
+
+	client := ca.PeerTLS(t)
+	// get returns the serials of the server and of the client certificates
+	get := func() (string, string) {
+		tr := client.Transport()
+		defer tr.(*http.Transport).CloseIdleConnections()
+		res, err := (&http.Client{Transport: tr}).Get(srv.URL)
+		assert.NoError(t, err)
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		return res.TLS.PeerCertificates[0].SerialNumber.String(), string(body)
+	}
+	serverBefore, clientBefore := get()
+
+	// the new connections present the new certificate on both sides
+	dir := t.TempDir()
+	certPEM, keyPEM := ca.Issue(t, "127.0.0.1")
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "cert.pem"), certPEM, 0o600))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "key.pem"), keyPEM, 0o600))
+	cert, err := cluster.LoadPeerCertificate(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	assert.NoError(t, err)
+
+	assert.True(t, server.SetCertificate(cert))
+	assert.False(t, server.SetCertificate(cert))
+	assert.True(t, client.SetCertificate(cert))
+	serverAfter, clientAfter := get()
+	assert.NotEqual(t, serverBefore, serverAfter)
+	assert.NotEqual(t, clientBefore, clientAfter)
+	assert.Equal(t, serverAfter, clientAfter)
+
+	_, err = cluster.LoadPeerCertificate(filepath.Join(dir, "missing.pem"), filepath.Join(dir, "key.pem"))
+	assert.Error(t, err)
+}
+
+func TestPeerTLSConfigure(t *testing.T) {
+	peerTLS := clustertest.NewCA(t).PeerTLS(t)
+
+	gossip := &cluster.Gossip{Self: "https://a"}
+	peerTLS.Configure(gossip)
+	assert.NotNil(t, gossip.Transport)
+
+	dns := &cluster.DNSSRV{Name: "_groupcache._tcp.enclave.local"}
+	peerTLS.Configure(dns)
+	assert.Equal(t, "https", dns.Scheme)
+
+	peerTLS.Configure(nil)
+}
@@ -6,8 +6,9 @@ import (
 )
 
 const (
-	LoggerContextKey = "logger"
-	SeparatorByte    = byte(0xFF)
+	LoggerContextKey    = "logger"
+	RequestIDContextKey = "request_id"
+	SeparatorByte       = byte(0xFF)
 )
 
 func GetLoggerFromContext(ctx context.Context) *slog.Logger {
@@ -29,3 +30,15 @@ func GetLoggerFromContext(ctx context.Context) *slog.Logger {
 func LoggerWithContext(ctx context.Context, logger *slog.Logger) context.Context {
 	return context.WithValue(ctx, LoggerContextKey, logger)
 }
+
+func GetRequestIDFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(RequestIDContextKey).(string)
+	return id
+}
+
+func RequestIDWithContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, RequestIDContextKey, id)
+}
@@ -22,3 +22,11 @@ func TestLoggerFuncs(t *testing.T) {
 	assert.Nil(t, GetLoggerFromContext(emptyCtx))
 	assert.Nil(t, GetLoggerFromContext(nil))
 }
+
+func TestRequestIDFuncs(t *testing.T) {
+	ctx := RequestIDWithContext(context.Background(), "req-1")
+	assert.Equal(t, "req-1", GetRequestIDFromContext(ctx))
+
+	assert.Empty(t, GetRequestIDFromContext(context.Background()))
+	assert.Empty(t, GetRequestIDFromContext(nil))
+}
@@ -0,0 +1,495 @@
+// Package config loads the configuration of the server from a YAML file,
+// the environment and the command line flags.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"enclave-task2/pkg/auth"
+	"enclave-task2/pkg/keys"
+	"enclave-task2/pkg/keys/kyber"
+	"enclave-task2/pkg/storage"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FileEnv is the environment variable of the configuration file, the
+// -config flag takes precedence.
+const FileEnv = "CONFIG_FILE"
+
+// InvalidConfigError wraps the validation errors of a configuration.
+var InvalidConfigError = errors.New("invalid configuration")
+
+// Config is the configuration of the server. Every setting is read, by
+// increasing precedence, from its default, the YAML file, its environment
+// variable and its flag.
+type Config struct {
+	Addr     string `yaml:"addr" env:"API_ADDR" flag:"addr" usage:"listen address of the api"`
+	PeerAddr string `yaml:"peer_addr" env:"PEER_ADDR" flag:"peer-addr" usage:"listen address of the peer endpoints"`
+	GRPCAddr string `yaml:"grpc_addr" env:"GRPC_ADDR" flag:"grpc-addr" usage:"listen address of the gRPC api, disabled if empty"`
+	LogLevel string `yaml:"log_level" env:"LOG_LEVEL" flag:"log-level" usage:"log level: debug, info, warn or error"`
+
+	HTTP      HTTPConfig      `yaml:"http"`
+	Keys      KeysConfig      `yaml:"keys"`
+	Storage   StorageConfig   `yaml:"storage"`
+	Raft      RaftConfig      `yaml:"raft"`
+	Cluster   ClusterConfig   `yaml:"cluster"`
+	TLS       TLSConfig       `yaml:"tls"`
+	Auth      AuthConfig      `yaml:"auth"`
+	Audit     AuditConfig     `yaml:"audit"`
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
+}
+
+// HTTPConfig are the limits of the api requests and the drain on shutdown,
+// a zero timeout or body size is unlimited.
+type HTTPConfig struct {
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout" env:"HTTP_READ_HEADER_TIMEOUT" flag:"http-read-header-timeout" usage:"timeout to read the request headers"`
+	ReadTimeout       time.Duration `yaml:"read_timeout" env:"HTTP_READ_TIMEOUT" flag:"http-read-timeout" usage:"timeout to read a request"`
+	WriteTimeout      time.Duration `yaml:"write_timeout" env:"HTTP_WRITE_TIMEOUT" flag:"http-write-timeout" usage:"timeout to write a response"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout" env:"HTTP_IDLE_TIMEOUT" flag:"http-idle-timeout" usage:"timeout of the idle keep-alive connections"`
+	MaxHeaderBytes    int64         `yaml:"max_header_bytes" env:"HTTP_MAX_HEADER_BYTES" flag:"http-max-header-bytes" usage:"maximum size of the request headers"`
+	MaxBodyBytes      int64         `yaml:"max_body_bytes" env:"HTTP_MAX_BODY_BYTES" flag:"http-max-body-bytes" usage:"maximum size of the encrypted and decrypted bodies"`
+	ShutdownDelay     time.Duration `yaml:"shutdown_delay" env:"HTTP_SHUTDOWN_DELAY" flag:"http-shutdown-delay" usage:"time the server is not ready before it stops accepting requests"`
+	ShutdownTimeout   time.Duration `yaml:"shutdown_timeout" env:"HTTP_SHUTDOWN_TIMEOUT" flag:"http-shutdown-timeout" usage:"time to drain the requests before they are aborted"`
+}
+
+// KeysConfig are the defaults of the keys created without headers and the
+// pool of pregenerated keys.
+type KeysConfig struct {
+	Type string        `yaml:"type" env:"KEY_TYPE" flag:"key-type" usage:"default key type"`
+	Size string        `yaml:"size" env:"KEY_SIZE" flag:"key-size" usage:"default key size"`
+	TTL  time.Duration `yaml:"ttl" env:"KEY_TTL" flag:"key-ttl" usage:"default key ttl"`
+	// Pool are the type:size of the pregenerated keys, the default type and
+	// size if empty.
+	Pool        []string `yaml:"pool" env:"KEY_POOL" flag:"key-pool" usage:"pregenerated keys as type:size,..."`
+	PoolDepth   int64    `yaml:"pool_depth" env:"KEY_POOL_DEPTH" flag:"key-pool-depth" usage:"pregenerated keys of each type and size, 0 disables the pool"`
+	PoolWorkers int64    `yaml:"pool_workers" env:"KEY_POOL_WORKERS" flag:"key-pool-workers" usage:"workers generating the pooled keys"`
+}
+
+type StorageConfig struct {
+	Driver string `yaml:"driver" env:"STORAGE_DRIVER" flag:"storage-driver" usage:"storage: memory, sqlite, postgres or raft"`
+	DSN    string `yaml:"dsn" env:"STORAGE_DSN" flag:"storage-dsn" usage:"data source name of the sql storages"`
+	// CacheBytes is the size of the groupcache of the memory storage.
+	CacheBytes int64 `yaml:"cache_bytes" env:"CACHE_BYTES" flag:"cache-bytes" usage:"size of the groupcache in bytes"`
+}
+
+type RaftConfig struct {
+	Bind      string `yaml:"bind" env:"RAFT_BIND" flag:"raft-bind" usage:"listen address of the raft transport"`
+	Advertise string `yaml:"advertise" env:"RAFT_ADVERTISE" flag:"raft-advertise" usage:"raft address advertised to the peers"`
+	// Servers are the servers of the initial cluster as peer-url=raft-addr.
+	Servers []string `yaml:"servers" env:"RAFT_SERVERS" flag:"raft-servers" usage:"initial raft servers as peer-url=raft-addr,..."`
+	Dir     string   `yaml:"dir" env:"RAFT_DIR" flag:"raft-dir" usage:"raft data directory of the log, the term and vote and the snapshots"`
+}
+
+type ClusterConfig struct {
+	Mode    string   `yaml:"mode" env:"CLUSTER_MODE" flag:"cluster-mode" usage:"peer discovery: static, gossip or dns"`
+	SelfURL string   `yaml:"self_url" env:"CLUSTER_SELF_URL" flag:"cluster-self-url" usage:"peer url of this instance"`
+	Peers   []string `yaml:"peers" env:"CLUSTER_PEERS" flag:"cluster-peers" usage:"peer urls"`
+	DNSSRV  string   `yaml:"dns_srv" env:"CLUSTER_DNS_SRV" flag:"cluster-dns-srv" usage:"SRV record of the peers"`
+	CA      string   `yaml:"tls_ca" env:"CLUSTER_TLS_CA" flag:"cluster-tls-ca" usage:"CA of the peer certificates"`
+	Cert    string   `yaml:"tls_cert" env:"CLUSTER_TLS_CERT" flag:"cluster-tls-cert" usage:"peer certificate"`
+	Key     string   `yaml:"tls_key" env:"CLUSTER_TLS_KEY" flag:"cluster-tls-key" usage:"peer private key"`
+}
+
+type TLSConfig struct {
+	CertFile     string   `yaml:"cert_file" env:"TLS_CERT_FILE" flag:"tls-cert-file" usage:"certificate of the api"`
+	KeyFile      string   `yaml:"key_file" env:"TLS_KEY_FILE" flag:"tls-key-file" usage:"private key of the api"`
+	ClientCAFile string   `yaml:"client_ca_file" env:"TLS_CLIENT_CA_FILE" flag:"tls-client-ca-file" usage:"CA of the client certificates"`
+	MinVersion   string   `yaml:"min_version" env:"TLS_MIN_VERSION" flag:"tls-min-version" usage:"minimum TLS version"`
+	CipherSuites []string `yaml:"cipher_suites" env:"TLS_CIPHER_SUITES" flag:"tls-cipher-suites" usage:"allowed TLS 1.2 cipher suites"`
+}
+
+type AuthConfig struct {
+	PolicyDir     string        `yaml:"policy_dir" env:"POLICY_DIR" flag:"policy-dir" usage:"directory of the ACL policies"`
+	CertRolesFile string        `yaml:"cert_roles_file" env:"AUTH_CERT_ROLES_FILE" flag:"auth-cert-roles-file" usage:"roles of the client certificates"`
+	TokenMaxTTL   time.Duration `yaml:"token_max_ttl" env:"AUTH_TOKEN_MAX_TTL" flag:"auth-token-max-ttl" usage:"maximum ttl of the service tokens, renewals included"`
+	JWT           JWTConfig     `yaml:"jwt"`
+}
+
+type JWTConfig struct {
+	Issuer   string        `yaml:"issuer" env:"AUTH_JWT_ISSUER" flag:"auth-jwt-issuer" usage:"expected issuer of the JWTs"`
+	Audience string        `yaml:"audience" env:"AUTH_JWT_AUDIENCE" flag:"auth-jwt-audience" usage:"expected audience of the JWTs"`
+	Secret   string        `yaml:"secret" env:"AUTH_JWT_SECRET" usage:"HMAC secret of the JWTs"`
+	Leeway   time.Duration `yaml:"leeway" env:"AUTH_JWT_LEEWAY" flag:"auth-jwt-leeway" usage:"clock skew allowed on the JWTs"`
+	// PublicKeys are PEM files as kid=path or path for the tokens without
+	// kid.
+	PublicKeys []string `yaml:"public_keys" env:"AUTH_JWT_PUBLIC_KEYS" flag:"auth-jwt-public-keys" usage:"PEM public keys as kid=path,..."`
+	JWKSFile   string   `yaml:"jwks_file" env:"AUTH_JWKS_FILE" flag:"auth-jwks-file" usage:"JSON Web Key Set file"`
+}
+
+type AuditConfig struct {
+	File string `yaml:"file" env:"AUDIT_FILE" flag:"audit-file" usage:"audit log file"`
+	// Syslog is "local" or network://addr, e.g. udp://localhost:514.
+	Syslog  string `yaml:"syslog" env:"AUDIT_SYSLOG" flag:"audit-syslog" usage:"audit syslog: local or network://addr"`
+	Stdout  bool   `yaml:"stdout" env:"AUDIT_STDOUT" flag:"audit-stdout" usage:"write the audit log to stdout"`
+	HMACKey string `yaml:"hmac_key" env:"AUDIT_HMAC_KEY" usage:"HMAC key of the audit log"`
+}
+
+// RateLimitConfig are the limits which are not set by the policies, a zero
+// rate disables a limit.
+type RateLimitConfig struct {
+	KeyRate     float64 `yaml:"key_rate" env:"RATE_LIMIT_KEY_RATE" flag:"rate-limit-key-rate" usage:"encryptions and decryptions per second of each key"`
+	KeyBurst    int64   `yaml:"key_burst" env:"RATE_LIMIT_KEY_BURST" flag:"rate-limit-key-burst" usage:"burst of the key rate limit"`
+	HealthRate  float64 `yaml:"health_rate" env:"RATE_LIMIT_HEALTH_RATE" flag:"rate-limit-health-rate" usage:"health probes per second"`
+	HealthBurst int64   `yaml:"health_burst" env:"RATE_LIMIT_HEALTH_BURST" flag:"rate-limit-health-burst" usage:"burst of the health probes"`
+	AuthRate    float64 `yaml:"auth_rate" env:"RATE_LIMIT_AUTH_RATE" flag:"rate-limit-auth-rate" usage:"logins and failed authentications per second of each client address"`
+	AuthBurst   int64   `yaml:"auth_burst" env:"RATE_LIMIT_AUTH_BURST" flag:"rate-limit-auth-burst" usage:"burst of the auth rate limit"`
+}
+
+// Default returns the configuration used when nothing is set.
+func Default() Config {
+	return Config{
+		Addr:     ":8080",
+		PeerAddr: ":8081",
+		LogLevel: "info",
+		HTTP: HTTPConfig{
+			ReadHeaderTimeout: 10 * time.Second,
+			ReadTimeout:       30 * time.Second,
+			WriteTimeout:      time.Minute,
+			IdleTimeout:       2 * time.Minute,
+			MaxHeaderBytes:    1 << 20,
+			MaxBodyBytes:      4 << 20,
+			ShutdownTimeout:   5 * time.Second,
+		},
+		Keys: KeysConfig{
+			Type: kyber.KeyType,
+			Size: kyber.Size1024,
+			TTL:  keys.DefaultKeyTTL,
+
+			// the pool is opted in with pool_depth
+			PoolWorkers: 2,
+		},
+		Storage: StorageConfig{
+			Driver:     "memory",
+			CacheBytes: storage.DefaultCacheBytes,
+		},
+		Raft: RaftConfig{
+			Bind: "127.0.0.1:7000",
+		},
+		Auth: AuthConfig{
+			TokenMaxTTL: auth.DefaultMaxTokenTTL,
+		},
+		RateLimit: RateLimitConfig{
+			HealthRate:  20,
+			HealthBurst: 40,
+			AuthRate:    10,
+			AuthBurst:   20,
+		},
+	}
+}
+
+// Load reads the configuration from the file given by -config or
+// CONFIG_FILE, the environment and the flags in args, then validates it.
+// The secrets have no flag, they would be visible in the process list.
+func Load(args []string, getenv func(string) string) (Config, error) {
+	cfg := Default()
+
+	fs := flag.NewFlagSet("enclave", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	path := fs.String("config", getenv(FileEnv), "YAML configuration file")
+	flags := map[string]*flagValue{}
+	for _, f := range fields(&cfg) {
+		if f.flag != "" {
+			flags[f.flag] = &flagValue{isBool: f.value.Kind() == reflect.Bool}
+			fs.Var(flags[f.flag], f.flag, f.usage)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	if *path != "" {
+		data, err := os.ReadFile(*path)
+		if err != nil {
+			return cfg, err
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(&cfg); err != nil && err != io.EOF {
+			return cfg, fmt.Errorf("%s: %w", *path, err)
+		}
+	}
+
+	for _, f := range fields(&cfg) {
+		if v := getenv(f.env); f.env != "" && v != "" {
+			if err := f.set(v); err != nil {
+				return cfg, fmt.Errorf("%s: %w", f.env, err)
+			}
+		}
+	}
+
+	var err error
+	fs.Visit(func(fl *flag.Flag) {
+		if p, ok := flags[fl.Name]; ok && err == nil {
+			if setErr := fieldByFlag(&cfg, fl.Name).set(p.value); setErr != nil {
+				err = fmt.Errorf("-%s: %w", fl.Name, setErr)
+			}
+		}
+	})
+	if err != nil {
+		return cfg, err
+	}
+
+	return cfg, cfg.Validate()
+}
+
+// Validate checks the settings, every invalid one is reported.
+func (c Config) Validate() error {
+	var errs []error
+	if c.Addr == "" {
+		errs = append(errs, errors.New("addr is required"))
+	}
+	if c.PeerAddr == "" {
+		errs = append(errs, errors.New("peer_addr is required"))
+	}
+	if _, err := c.Level(); err != nil {
+		errs = append(errs, err)
+	}
+	if h := c.HTTP; h.ReadHeaderTimeout < 0 || h.ReadTimeout < 0 || h.WriteTimeout < 0 || h.IdleTimeout < 0 || h.ShutdownDelay < 0 {
+		errs = append(errs, errors.New("the http timeouts must not be negative"))
+	}
+	if c.HTTP.MaxHeaderBytes < 0 || c.HTTP.MaxBodyBytes < 0 {
+		errs = append(errs, errors.New("the http sizes must not be negative"))
+	}
+	if c.HTTP.ShutdownTimeout <= 0 {
+		errs = append(errs, errors.New("http.shutdown_timeout must be positive"))
+	}
+	if err := keys.ValidateParams(c.Keys.Type, c.Keys.Size); err != nil {
+		errs = append(errs, fmt.Errorf("keys: %w", err))
+	}
+	if c.Keys.TTL <= 0 {
+		errs = append(errs, errors.New("keys.ttl must be positive"))
+	}
+	if c.Keys.PoolDepth < 0 {
+		errs = append(errs, errors.New("keys.pool_depth must not be negative"))
+	}
+	if c.Keys.PoolDepth > 0 && c.Keys.PoolWorkers <= 0 {
+		errs = append(errs, errors.New("keys.pool_workers must be positive"))
+	}
+	for _, p := range c.Keys.Pool {
+		if _, err := keys.ParseParams(p); err != nil {
+			errs = append(errs, fmt.Errorf("keys.pool: %w", err))
+		}
+	}
+
+	switch c.Storage.Driver {
+	case "memory":
+		if c.Storage.CacheBytes <= 0 {
+			errs = append(errs, errors.New("storage.cache_bytes must be positive"))
+		}
+	case "sqlite", "postgres":
+		if c.Storage.DSN == "" {
+			errs = append(errs, fmt.Errorf("storage.dsn is required by the %s storage", c.Storage.Driver))
+		}
+	case "raft":
+		if c.Cluster.CA == "" {
+			errs = append(errs, errors.New("the raft storage requires the cluster tls"))
+		}
+		if c.Raft.Dir == "" {
+			// a node which forgets its vote can vote twice in a term
+			errs = append(errs, errors.New("raft.dir is required by the raft storage"))
+		}
+		for _, s := range c.Raft.Servers {
+			if _, _, ok := strings.Cut(s, "="); !ok {
+				errs = append(errs, fmt.Errorf("invalid raft server: %s", s))
+			}
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown storage driver: %s", c.Storage.Driver))
+	}
+
+	if c.Cluster.CA != "" && (c.Cluster.Cert == "" || c.Cluster.Key == "") {
+		errs = append(errs, errors.New("cluster.tls_cert and cluster.tls_key are required with cluster.tls_ca"))
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		errs = append(errs, errors.New("tls.cert_file and tls.key_file go together"))
+	}
+	if c.TLS.CertFile == "" && (c.TLS.ClientCAFile != "" || c.Auth.CertRolesFile != "") {
+		errs = append(errs, errors.New("the client certificates require tls.cert_file"))
+	}
+	if c.Auth.CertRolesFile != "" && c.TLS.ClientCAFile == "" {
+		errs = append(errs, errors.New("auth.cert_roles_file requires tls.client_ca_file"))
+	}
+	if c.Auth.TokenMaxTTL <= 0 {
+		errs = append(errs, errors.New("auth.token_max_ttl must be positive"))
+	}
+
+	auditing := c.Audit.File != "" || c.Audit.Syslog != "" || c.Audit.Stdout
+	if auditing && c.Audit.HMACKey == "" {
+		errs = append(errs, errors.New("audit.hmac_key is required by the audit log"))
+	}
+	if s := c.Audit.Syslog; s != "" && s != "local" && !strings.Contains(s, "://") {
+		errs = append(errs, fmt.Errorf("invalid audit.syslog: %s", s))
+	}
+
+	if r := c.RateLimit; r.KeyRate < 0 || r.KeyBurst < 0 || r.HealthRate < 0 || r.HealthBurst < 0 || r.AuthRate < 0 || r.AuthBurst < 0 {
+		errs = append(errs, errors.New("the rate limits must not be negative"))
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %w", InvalidConfigError, errors.Join(errs...))
+}
+
+// KeyPool returns the params of the pregenerated keys.
+func (c Config) KeyPool() []keys.Params {
+	if len(c.Keys.Pool) == 0 {
+		return []keys.Params{{Type: c.Keys.Type, Size: c.Keys.Size}}
+	}
+
+	var params []keys.Params
+	for _, p := range c.Keys.Pool {
+		if kp, err := keys.ParseParams(p); err == nil {
+			params = append(params, kp)
+		}
+	}
+
+	return params
+}
+
+// Level returns the slog level of LogLevel.
+func (c Config) Level() (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		return level, fmt.Errorf("invalid log_level: %s", c.LogLevel)
+	}
+
+	return level, nil
+}
+
+// Diff returns the names of the settings which differ, e.g. keys.ttl.
+func Diff(a, b Config) []string {
+	var names []string
+	bf := fields(&b)
+	for i, f := range fields(&a) {
+		if !reflect.DeepEqual(f.value.Interface(), bf[i].value.Interface()) {
+			names = append(names, f.name)
+		}
+	}
+
+	return names
+}
+
+// field is a setting of the configuration.
+type field struct {
+	value reflect.Value
+	// name is the path of the setting in the file, e.g. keys.ttl.
+	name  string
+	env   string
+	flag  string
+	usage string
+}
+
+// fields returns the settings of the configuration, the nested structs are
+// walked.
+func fields(cfg *Config) []field {
+	var res []field
+	var walk func(v reflect.Value, prefix string)
+	walk = func(v reflect.Value, prefix string) {
+		for i := range v.NumField() {
+			sf := v.Type().Field(i)
+			name := prefix + sf.Tag.Get("yaml")
+			if sf.Type.Kind() == reflect.Struct {
+				walk(v.Field(i), name+".")
+				continue
+			}
+			res = append(res, field{
+				value: v.Field(i),
+				name:  name,
+				env:   sf.Tag.Get("env"),
+				flag:  sf.Tag.Get("flag"),
+				usage: sf.Tag.Get("usage"),
+			})
+		}
+	}
+	walk(reflect.ValueOf(cfg).Elem(), "")
+
+	return res
+}
+
+func fieldByFlag(cfg *Config, name string) field {
+	for _, f := range fields(cfg) {
+		if f.flag == name {
+			return f
+		}
+	}
+
+	panic("unknown flag: " + name)
+}
+
+// set parses the value of an environment variable or a flag, the lists are
+// comma separated.
+func (f field) set(s string) error {
+	switch f.value.Interface().(type) {
+	case string:
+		f.value.SetString(s)
+	case bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		f.value.SetBool(b)
+	case int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		f.value.SetInt(n)
+	case float64:
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		f.value.SetFloat(n)
+	case time.Duration:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		f.value.SetInt(int64(d))
+	case []string:
+		f.value.Set(reflect.ValueOf(strings.Split(s, ",")))
+	default:
+		return fmt.Errorf("unsupported setting type %s", f.value.Type())
+	}
+
+	return nil
+}
+
+// flagValue holds the value of a flag until the file and the environment
+// are read.
+type flagValue struct {
+	value  string
+	isBool bool
+}
+
+func (v *flagValue) String() string     { return v.value }
+func (v *flagValue) Set(s string) error { v.value = s; return nil }
+func (v *flagValue) IsBoolFlag() bool   { return v.isBool }
+
+// Usage writes the flags and their environment variables.
+func Usage(w io.Writer) {
+	cfg := Default()
+	fmt.Fprintf(w, "Usage of enclave:\n  -config string\n    \tYAML configuration file (env %s)\n", FileEnv)
+	for _, f := range fields(&cfg) {
+		name := f.flag
+		if name == "" {
+			name = "(no flag)"
+		} else {
+			name = "-" + name
+		}
+		fmt.Fprintf(w, "  %s\n    \t%s (env %s)\n", name, f.usage, f.env)
+	}
+}
@@ -0,0 +1,183 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"enclave-task2/pkg/keys"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func env(vars map[string]string) func(string) string {
+	return func(name string) string {
+		return vars[name]
+	}
+}
+
+func TestLoadDefaults(t *testing.T) {
+	cfg, err := Load(nil, env(nil))
+	assert.NoError(t, err)
+	assert.Equal(t, Default(), cfg)
+	assert.Equal(t, ":8080", cfg.Addr)
+	// the gRPC api and the key pool are opted in
+	assert.Empty(t, cfg.GRPCAddr)
+	assert.Equal(t, int64(0), cfg.Keys.PoolDepth)
+	assert.Equal(t, int64(64<<20), cfg.Storage.CacheBytes)
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "enclave.yaml")
+	err := os.WriteFile(path, []byte(`
+addr: ":9000"
+peer_addr: ":9001"
+log_level: debug
+keys:
+  type: rsa
+  size: "2048"
+  ttl: 1h
+cluster:
+  peers: [http://a:8081, http://b:8081]
+`), 0o600)
+	assert.NoError(t, err)
+
+	cfg, err := Load([]string{"-peer-addr", ":7001", "-audit-stdout"}, env(map[string]string{
+		FileEnv:               path,
+		"PEER_ADDR":           ":8001",
+		"KEY_TTL":             "2h",
+		"CLUSTER_PEERS":       "http://c:8081,http://d:8081",
+		"AUDIT_HMAC_KEY":      "secret",
+		"RATE_LIMIT_KEY_RATE": "2.5",
+		"KEY_POOL":            "rsa:4096,kyber:512",
+	}))
+	assert.NoError(t, err)
+
+	// file
+	assert.Equal(t, ":9000", cfg.Addr)
+	assert.Equal(t, "rsa", cfg.Keys.Type)
+	assert.Equal(t, "2048", cfg.Keys.Size)
+	// env over file
+	assert.Equal(t, 2*time.Hour, cfg.Keys.TTL)
+	assert.Equal(t, []string{"http://c:8081", "http://d:8081"}, cfg.Cluster.Peers)
+	// flags over env
+	assert.Equal(t, ":7001", cfg.PeerAddr)
+	assert.True(t, cfg.Audit.Stdout)
+	assert.Equal(t, "secret", cfg.Audit.HMACKey)
+	assert.Equal(t, 2.5, cfg.RateLimit.KeyRate)
+	assert.Equal(t, []keys.Params{{Type: "rsa", Size: "4096"}, {Type: "kyber", Size: "512"}}, cfg.KeyPool())
+	assert.Equal(t, []keys.Params{{Type: "kyber", Size: "1024"}}, Default().KeyPool())
+}
+
+func TestLoadConfigFlag(t *testing.T) {
+	dir := t.TempDir()
+	fromEnv := filepath.Join(dir, "env.yaml")
+	fromFlag := filepath.Join(dir, "flag.yaml")
+	assert.NoError(t, os.WriteFile(fromEnv, []byte("addr: \":1\"\n"), 0o600))
+	assert.NoError(t, os.WriteFile(fromFlag, []byte("addr: \":2\"\n"), 0o600))
+
+	cfg, err := Load([]string{"-config", fromFlag}, env(map[string]string{FileEnv: fromEnv}))
+	assert.NoError(t, err)
+	assert.Equal(t, ":2", cfg.Addr)
+}
+
+func TestLoadErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "enclave.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte("adr: \":1\"\n"), 0o600))
+
+	_, err := Load([]string{"-config", path}, env(nil))
+	assert.ErrorContains(t, err, "field adr not found")
+
+	_, err = Load([]string{"-config", filepath.Join(t.TempDir(), "missing.yaml")}, env(nil))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	_, err = Load(nil, env(map[string]string{"KEY_TTL": "soon"}))
+	assert.ErrorContains(t, err, "KEY_TTL")
+
+	_, err = Load([]string{"-cache-bytes", "lots"}, env(nil))
+	assert.ErrorContains(t, err, "-cache-bytes")
+
+	_, err = Load([]string{"-unknown"}, env(nil))
+	assert.ErrorContains(t, err, "flag provided but not defined")
+
+	_, err = Load([]string{"-h"}, env(nil))
+	assert.ErrorIs(t, err, flag.ErrHelp)
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*Config)
+		errs   []string
+	}{
+		{"default", func(*Config) {}, nil},
+		{"log level", func(c *Config) { c.LogLevel = "loud" }, []string{"invalid log_level: loud"}},
+		{"key type", func(c *Config) { c.Keys.Type = "aes" }, []string{"unknown key type: aes"}},
+		{"key size", func(c *Config) { c.Keys.Size = "2048" }, []string{"unsupported kyber key size: 2048"}},
+		{"key ttl", func(c *Config) { c.Keys.TTL = 0 }, []string{"keys.ttl must be positive"}},
+		{"http", func(c *Config) {
+			c.HTTP.ReadTimeout = -time.Second
+			c.HTTP.MaxBodyBytes = -1
+			c.HTTP.ShutdownTimeout = 0
+		}, []string{"http timeouts must not be negative", "http sizes must not be negative", "http.shutdown_timeout must be positive"}},
+		{"key pool", func(c *Config) {
+			c.Keys.Pool = []string{"rsa:1024"}
+			c.Keys.PoolDepth = 4
+			c.Keys.PoolWorkers = 0
+		}, []string{"keys.pool: unsupported rsa key size: 1024", "keys.pool_workers must be positive"}},
+		{"cache", func(c *Config) { c.Storage.CacheBytes = -1 }, []string{"storage.cache_bytes must be positive"}},
+		{"token max ttl", func(c *Config) { c.Auth.TokenMaxTTL = 0 }, []string{"auth.token_max_ttl must be positive"}},
+		{"driver", func(c *Config) { c.Storage.Driver = "disk" }, []string{"unknown storage driver: disk"}},
+		{"dsn", func(c *Config) { c.Storage.Driver = "postgres" }, []string{"storage.dsn is required"}},
+		{"raft", func(c *Config) {
+			c.Storage.Driver = "raft"
+			c.Raft.Servers = []string{"127.0.0.1:7000"}
+		}, []string{"raft storage requires the cluster tls", "raft.dir is required", "invalid raft server: 127.0.0.1:7000"}},
+		{"rate limit", func(c *Config) { c.RateLimit.KeyRate = -1 }, []string{"the rate limits must not be negative"}},
+		{"tls", func(c *Config) { c.TLS.CertFile = "cert.pem" }, []string{"tls.cert_file and tls.key_file go together"}},
+		{"audit", func(c *Config) { c.Audit.Syslog = "localhost:514" }, []string{
+			"audit.hmac_key is required", "invalid audit.syslog: localhost:514",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Default()
+			tt.modify(&cfg)
+
+			err := cfg.Validate()
+			if tt.errs == nil {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, InvalidConfigError)
+			for _, msg := range tt.errs {
+				assert.ErrorContains(t, err, msg)
+			}
+		})
+	}
+}
+
+func TestUsage(t *testing.T) {
+	var b strings.Builder
+	Usage(&b)
+
+	assert.Contains(t, b.String(), "-key-ttl")
+	assert.Contains(t, b.String(), "(env KEY_TTL)")
+	assert.NotContains(t, b.String(), "-audit-hmac-key")
+}
+
+func TestDiff(t *testing.T) {
+	a := Default()
+	b := Default()
+	assert.Empty(t, Diff(a, b))
+
+	b.LogLevel = "debug"
+	b.Keys.TTL = time.Hour
+	b.Cluster.Peers = []string{"http://a:8081"}
+	b.Auth.JWT.Secret = "secret"
+	assert.Equal(t, []string{"log_level", "keys.ttl", "cluster.peers", "auth.jwt.secret"}, Diff(a, b))
+}
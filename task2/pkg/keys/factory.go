@@ -6,8 +6,13 @@ import (
 	"enclave-task2/pkg/common"
 	"enclave-task2/pkg/keys/kyber"
 	"enclave-task2/pkg/keys/rsa"
+	"enclave-task2/pkg/metrics"
+	"enclave-task2/pkg/tracing"
 	"fmt"
+	"strconv"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type Key interface {
@@ -18,12 +23,17 @@ type Key interface {
 	Decrypt(ciphertext []byte) []byte
 
 	SetTTL(ttl time.Duration)
+	// Rename gives a pregenerated key its name and ttl, it is created now.
+	Rename(name string, ttl time.Duration)
+	// SetVersion is used by the storages to track the key revisions.
+	SetVersion(version uint64)
 
 	GetName() string
 	GetType() string
 	GetSize() string
 	GetCreatedAt() time.Time
 	GetTTL() time.Duration
+	GetVersion() uint64
 }
 
 const (
@@ -32,15 +42,47 @@ const (
 )
 
 func New(ctx context.Context, keyType, size, name string, ttl time.Duration) (Key, error) {
+	ctx, span := tracing.Start(ctx, "keys.New", attribute.String("key.type", keyType), attribute.String("key.size", size))
+	start := time.Now()
+
+	var key Key
+	var err error
 	switch keyType {
 	case kyber.KeyType:
-		return kyber.NewKyberKey(ctx, name, size, ttl)
+		key, err = kyber.NewKyberKey(ctx, name, size, ttl)
 	case rsa.KeyType:
-		return rsa.NewRsaKey(ctx, name, size, ttl)
+		key, err = rsa.NewRsaKey(ctx, name, size, ttl)
+
+	default:
+		err = fmt.Errorf("unknown key type: %s", keyType)
+	}
+	tracing.End(span, err)
+	if err != nil {
+		return nil, err
+	}
+	metrics.KeyGeneration.WithLabelValues(keyType, key.GetSize()).Observe(time.Since(start).Seconds())
+
+	return key, nil
+}
 
+// ValidateParams checks that keys of the type and size can be created
+// without generating one.
+func ValidateParams(keyType, size string) error {
+	switch keyType {
+	case kyber.KeyType:
+		switch size {
+		case kyber.Size512, kyber.Size768, kyber.Size1024:
+			return nil
+		}
+	case rsa.KeyType:
+		if n, err := strconv.Atoi(size); err == nil && n >= 2048 && n <= 4096 {
+			return nil
+		}
 	default:
-		return nil, fmt.Errorf("unknown key type: %s", keyType)
+		return fmt.Errorf("unknown key type: %s", keyType)
 	}
+
+	return fmt.Errorf("unsupported %s key size: %s", keyType, size)
 }
 
 func Unpack(data []byte) (Key, error) {
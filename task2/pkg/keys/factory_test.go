@@ -34,3 +34,13 @@ func TestFactory(t *testing.T) {
 	assert.Equal(t, kyberKey.GetType(), unpackedKey.GetType())
 	assert.Equal(t, kyberKey.GetSize(), unpackedKey.GetSize())
 }
+
+func TestValidateParams(t *testing.T) {
+	assert.NoError(t, ValidateParams("kyber", "512"))
+	assert.NoError(t, ValidateParams("rsa", "3072"))
+
+	assert.EqualError(t, ValidateParams("kyber", "2048"), "unsupported kyber key size: 2048")
+	assert.EqualError(t, ValidateParams("rsa", "1024"), "unsupported rsa key size: 1024")
+	assert.EqualError(t, ValidateParams("rsa", "big"), "unsupported rsa key size: big")
+	assert.EqualError(t, ValidateParams("aes", "256"), "unknown key type: aes")
+}
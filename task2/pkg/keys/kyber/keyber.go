@@ -7,6 +7,7 @@ import (
 	"enclave-task2/pkg/common"
 	"fmt"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/cloudflare/circl/pke/kyber/kyber1024"
@@ -19,7 +20,9 @@ const (
 	Size1024  = "1024"
 	Size512   = "512"
 	Size768   = "768"
-	dataParts = 6 // number of parts in packed key data
+	dataParts = 7 // number of parts in packed key data
+
+	legacyDataParts = 6 // number of parts in packed key data without the version
 )
 
 type kyberPublicKey interface {
@@ -44,6 +47,7 @@ type KyberKey struct {
 
 	CreatedAt time.Time
 	TTL       time.Duration
+	Version   uint64
 }
 
 func NewKyberKey(ctx context.Context, name, size string, ttl time.Duration) (*KyberKey, error) {
@@ -109,6 +113,17 @@ func (k *KyberKey) SetTTL(ttl time.Duration) {
 	k.TTL = ttl
 }
 
+func (k *KyberKey) Rename(name string, ttl time.Duration) {
+	k.Name, k.CreatedAt, k.TTL = name, time.Now(), ttl
+}
+
+func (k *KyberKey) GetVersion() uint64 {
+	return k.Version
+}
+func (k *KyberKey) SetVersion(version uint64) {
+	k.Version = version
+}
+
 func (k *KyberKey) GetType() string {
 	return k.keyType
 }
@@ -188,6 +203,8 @@ func (k *KyberKey) Pack() []byte {
 	packed.WriteByte(common.SeparatorByte)
 	packed.Write([]byte(k.TTL.String()))
 	packed.WriteByte(common.SeparatorByte)
+	packed.Write([]byte(strconv.FormatUint(k.Version, 10)))
+	packed.WriteByte(common.SeparatorByte)
 	packed.Write(k.seed)
 	packed.Write(pubKeyBytes)
 	packed.Write(privKeyBytes)
@@ -201,27 +218,32 @@ func (k *KyberKey) Unpack(data []byte) error {
 	}
 
 	var err error
-	parts := bytes.SplitN(data, []byte{common.SeparatorByte}, dataParts)
+	parts := splitPacked(data)
 	if len(parts) != dataParts {
 		return fmt.Errorf("invalid packed key")
 	}
 
-	k.keyType = string(parts[dataParts-6])
-	k.size = string(parts[dataParts-5])
-	k.Name = string(parts[dataParts-4])
+	k.keyType = string(parts[dataParts-7])
+	k.size = string(parts[dataParts-6])
+	k.Name = string(parts[dataParts-5])
 
 	publicKeySize, privateKeySize := k.getKeyFrames()
 	_, _, encryptionSeedSize := k.getByteFrames()
-	k.CreatedAt, err = time.Parse(time.RFC3339, string(parts[dataParts-3]))
+	k.CreatedAt, err = time.Parse(time.RFC3339, string(parts[dataParts-4]))
 	if err != nil {
 		return fmt.Errorf("invalid created at time: %w", err)
 	}
 
-	k.TTL, err = time.ParseDuration(string(parts[dataParts-2]))
+	k.TTL, err = time.ParseDuration(string(parts[dataParts-3]))
 	if err != nil {
 		return fmt.Errorf("invalid ttl: %w", err)
 	}
 
+	k.Version, err = strconv.ParseUint(string(parts[dataParts-2]), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid version: %w", err)
+	}
+
 	rest := parts[dataParts-1]
 
 	if len(rest) < encryptionSeedSize+publicKeySize+privateKeySize {
@@ -241,6 +263,23 @@ func (k *KyberKey) Unpack(data []byte) error {
 	return nil
 }
 
+// splitPacked splits the packed key data into its parts. Keys packed before
+// the version was added have no version part, they are told apart by the
+// fixed size of their key material and read as version 0.
+func splitPacked(data []byte) [][]byte {
+	legacy := bytes.SplitN(data, []byte{common.SeparatorByte}, legacyDataParts)
+	if len(legacy) == legacyDataParts {
+		frames := &KyberKey{size: string(legacy[1])}
+		publicKeySize, privateKeySize := frames.getKeyFrames()
+		_, _, encryptionSeedSize := frames.getByteFrames()
+		if publicKeySize > 0 && len(legacy[5]) == encryptionSeedSize+publicKeySize+privateKeySize {
+			return append(legacy[:5:5], []byte("0"), legacy[5])
+		}
+	}
+
+	return bytes.SplitN(data, []byte{common.SeparatorByte}, dataParts)
+}
+
 func (k *KyberKey) getByteFrames() (int, int, int) {
 	var plaintextSize, ciphertextSize, seedSize int
 	switch k.size {
@@ -0,0 +1,208 @@
+package keys
+
+import (
+	"context"
+	"enclave-task2/pkg/common"
+	"enclave-task2/pkg/metrics"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// poolRetryDelay is the pause of a worker after a failed generation.
+const poolRetryDelay = time.Second
+
+// Params are the type and size of the keys of a pool.
+type Params struct {
+	Type string
+	Size string
+}
+
+// ParseParams parses type:size, e.g. "rsa:4096".
+func ParseParams(s string) (Params, error) {
+	keyType, size, ok := strings.Cut(s, ":")
+	if !ok {
+		return Params{}, fmt.Errorf("invalid key params, expected type:size: %s", s)
+	}
+	if err := ValidateParams(keyType, size); err != nil {
+		return Params{}, err
+	}
+
+	return Params{Type: keyType, Size: size}, nil
+}
+
+func (p Params) String() string {
+	return p.Type + ":" + p.Size
+}
+
+type pooled struct {
+	keys []Key
+	// pending is the number of keys being generated
+	pending int
+}
+
+// Pool pregenerates keys per type and size so that creating a key does not
+// wait for its generation, e.g. seconds for a 4096 bits RSA key. The keys
+// are generated by the workers started by Run, up to depth keys of each
+// type and size.
+type Pool struct {
+	depth   int
+	workers int
+
+	mu    sync.Mutex
+	ready map[Params]*pooled
+	wake  chan struct{}
+}
+
+// NewPool creates a pool keeping depth keys of each params.
+func NewPool(depth, workers int, params ...Params) *Pool {
+	p := &Pool{
+		depth:   depth,
+		workers: max(workers, 1),
+		ready:   make(map[Params]*pooled, len(params)),
+		wake:    make(chan struct{}, 1),
+	}
+	for _, params := range params {
+		p.ready[params] = &pooled{}
+	}
+
+	return p
+}
+
+// Take returns a pregenerated key with the name and ttl, or false if the
+// pool has none of the type and size. A nil pool has no keys.
+func (p *Pool) Take(keyType, size, name string, ttl time.Duration) (Key, bool) {
+	if p == nil {
+		return nil, false
+	}
+	params := Params{Type: keyType, Size: size}
+
+	p.mu.Lock()
+	pool, ok := p.ready[params]
+	var key Key
+	if ok && len(pool.keys) > 0 {
+		key = pool.keys[0]
+		pool.keys = pool.keys[1:]
+		metrics.KeyPoolReady.WithLabelValues(keyType, size).Set(float64(len(pool.keys)))
+	}
+	p.mu.Unlock()
+
+	if !ok {
+		return nil, false
+	}
+	p.signal()
+	if key == nil {
+		metrics.KeyPoolTakes.WithLabelValues(keyType, size, "miss").Inc()
+		return nil, false
+	}
+	metrics.KeyPoolTakes.WithLabelValues(keyType, size, "hit").Inc()
+
+	// the key is created now, not when it was generated
+	key.Rename(name, ttl)
+
+	return key, true
+}
+
+// Len returns the number of ready keys of the type and size.
+func (p *Pool) Len(keyType, size string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if pool, ok := p.ready[Params{Type: keyType, Size: size}]; ok {
+		return len(pool.keys)
+	}
+
+	return 0
+}
+
+// Run fills the pool until the context is done.
+func (p *Pool) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for range p.workers {
+		wg.Go(func() { p.work(ctx) })
+	}
+	p.signal()
+	wg.Wait()
+
+	return nil
+}
+
+func (p *Pool) work(ctx context.Context) {
+	logger := common.GetLoggerFromContext(ctx)
+	for {
+		params, ok := p.next()
+		if !ok {
+			select {
+			case <-ctx.Done():
+				return
+			case <-p.wake:
+				continue
+			}
+		}
+
+		key, err := New(ctx, params.Type, params.Size, "", 0)
+		p.put(params, key)
+		if err != nil {
+			if logger != nil {
+				logger.Error("failed to pregenerate a key", "type", params.Type, "size", params.Size, "error", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(poolRetryDelay):
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// next reserves the generation of a key for the params with the fewest
+// ready keys, or returns false when the pool is full.
+func (p *Pool) next() (Params, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var next Params
+	missing := 0
+	for params, pool := range p.ready {
+		if n := p.depth - len(pool.keys) - pool.pending; n > missing {
+			next, missing = params, n
+		}
+	}
+	if missing == 0 {
+		return next, false
+	}
+	p.ready[next].pending++
+
+	// another worker may generate the next one
+	if missing > 1 || len(p.ready) > 1 {
+		p.signal()
+	}
+
+	return next, true
+}
+
+// put releases the reservation of next, key is nil when the generation
+// failed.
+func (p *Pool) put(params Params, key Key) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pool := p.ready[params]
+	pool.pending--
+	if key != nil {
+		pool.keys = append(pool.keys, key)
+	}
+	metrics.KeyPoolReady.WithLabelValues(params.Type, params.Size).Set(float64(len(pool.keys)))
+}
+
+// signal wakes up an idle worker.
+func (p *Pool) signal() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,65 @@
+package keys
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/tj/assert"
+)
+
+func TestParseParams(t *testing.T) {
+	params, err := ParseParams("rsa:2048")
+	assert.NoError(t, err)
+	assert.Equal(t, Params{Type: "rsa", Size: "2048"}, params)
+	assert.Equal(t, "rsa:2048", params.String())
+
+	_, err = ParseParams("kyber")
+	assert.Error(t, err)
+	_, err = ParseParams("kyber:2048")
+	assert.Error(t, err)
+}
+
+func TestPool(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	pool := NewPool(3, 2, Params{Type: "kyber", Size: "512"}, Params{Type: "kyber", Size: "768"})
+
+	done := make(chan error)
+	go func() { done <- pool.Run(ctx) }()
+
+	full := func() bool { return pool.Len("kyber", "512") == 3 && pool.Len("kyber", "768") == 3 }
+	assert.Eventually(t, full, 5*time.Second, 10*time.Millisecond)
+
+	key, ok := pool.Take("kyber", "512", "pooled", time.Minute)
+	assert.True(t, ok)
+	assert.Equal(t, "pooled", key.GetName())
+	assert.Equal(t, "512", key.GetSize())
+	assert.Equal(t, time.Minute, key.GetTTL())
+	assert.WithinDuration(t, time.Now(), key.GetCreatedAt(), time.Second)
+
+	// the pool is refilled
+	assert.Eventually(t, full, 5*time.Second, 10*time.Millisecond)
+
+	// the other types and sizes are not pooled
+	_, ok = pool.Take("kyber", "1024", "not-pooled", time.Minute)
+	assert.False(t, ok)
+	_, ok = (*Pool)(nil).Take("kyber", "512", "nil", time.Minute)
+	assert.False(t, ok)
+
+	cancel()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the workers did not stop")
+	}
+}
+
+func TestPoolEmpty(t *testing.T) {
+	pool := NewPool(2, 1, Params{Type: "kyber", Size: "512"})
+
+	// nothing is generated before Run
+	_, ok := pool.Take("kyber", "512", "empty", time.Minute)
+	assert.False(t, ok)
+	assert.Equal(t, 0, pool.Len("kyber", "512"))
+}
@@ -19,7 +19,9 @@ import (
 
 const (
 	KeyType   = "rsa"
-	dataParts = 8 // number of parts in packed key data
+	dataParts = 9 // number of parts in packed key data
+
+	legacyDataParts = 8 // number of parts in packed key data without the version
 )
 
 type RsaKey struct {
@@ -31,6 +33,7 @@ type RsaKey struct {
 
 	CreatedAt time.Time
 	TTL       time.Duration
+	Version   uint64
 
 	logger *slog.Logger
 }
@@ -83,6 +86,17 @@ func (k *RsaKey) SetTTL(ttl time.Duration) {
 	k.TTL = ttl
 }
 
+func (k *RsaKey) Rename(name string, ttl time.Duration) {
+	k.Name, k.CreatedAt, k.TTL = name, time.Now(), ttl
+}
+
+func (k *RsaKey) GetVersion() uint64 {
+	return k.Version
+}
+func (k *RsaKey) SetVersion(version uint64) {
+	k.Version = version
+}
+
 func (k *RsaKey) GetType() string {
 	return k.keyType
 }
@@ -146,6 +160,8 @@ func (k *RsaKey) Pack() []byte {
 	packed.WriteByte(common.SeparatorByte)
 	packed.Write([]byte(k.TTL.String()))
 	packed.WriteByte(common.SeparatorByte)
+	packed.Write([]byte(strconv.FormatUint(k.Version, 10)))
+	packed.WriteByte(common.SeparatorByte)
 	packed.Write([]byte(fmt.Sprint(len(pubBytes))))
 	packed.WriteByte(common.SeparatorByte)
 	packed.Write([]byte(fmt.Sprint(len(privBytes))))
@@ -163,24 +179,34 @@ func (k *RsaKey) Unpack(data []byte) error {
 
 	var err error
 	parts := bytes.SplitN(data, []byte{common.SeparatorByte}, dataParts)
+	if len(parts) == legacyDataParts {
+		// the pem encoded keys hold no separator, keys packed before the
+		// version was added have one part less and are read as version 0
+		parts = append(parts[:5:5], append([][]byte{[]byte("0")}, parts[5:]...)...)
+	}
 	if len(parts) != dataParts {
 		return fmt.Errorf("invalid packed key")
 	}
 
-	k.keyType = string(parts[dataParts-8])
-	k.size = string(parts[dataParts-7])
-	k.Name = string(parts[dataParts-6])
+	k.keyType = string(parts[dataParts-9])
+	k.size = string(parts[dataParts-8])
+	k.Name = string(parts[dataParts-7])
 
-	k.CreatedAt, err = time.Parse(time.RFC3339, string(parts[dataParts-5]))
+	k.CreatedAt, err = time.Parse(time.RFC3339, string(parts[dataParts-6]))
 	if err != nil {
 		return fmt.Errorf("invalid created at time: %w", err)
 	}
 
-	k.TTL, err = time.ParseDuration(string(parts[dataParts-4]))
+	k.TTL, err = time.ParseDuration(string(parts[dataParts-5]))
 	if err != nil {
 		return fmt.Errorf("invalid ttl: %w", err)
 	}
 
+	k.Version, err = strconv.ParseUint(string(parts[dataParts-4]), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid version: %w", err)
+	}
+
 	publicKeySize, err := strconv.Atoi(string(parts[dataParts-3]))
 	if err != nil {
 		return fmt.Errorf("invalid public key size: %w", err)
@@ -1,6 +1,7 @@
 package rsa_test
 
 import (
+	"bytes"
 	"context"
 	"enclave-task2/pkg/common"
 	"enclave-task2/pkg/keys"
@@ -52,6 +53,9 @@ func TestKeys(t *testing.T) {
 			assert.NoError(t, err)
 			assert.NotNil(t, key)
 
+			key.SetVersion(3)
+			assert.Equal(t, uint64(3), key.GetVersion())
+
 			packed := key.Pack()
 			assert.NotEmpty(t, packed)
 
@@ -85,6 +89,7 @@ func TestKeys(t *testing.T) {
 			err = unpackedKey.Unpack(packed)
 			assert.NoError(t, err)
 			assert.NotNil(t, unpackedKey)
+			assert.Equal(t, uint64(3), unpackedKey.GetVersion())
 
 			plaintext = []byte("Hello, World!")
 			ciphertext = unpackedKey.Encrypt(plaintext)
@@ -92,6 +97,23 @@ func TestKeys(t *testing.T) {
 
 			decrypted = unpackedKey.Decrypt(ciphertext)
 			assert.Equal(t, plaintext, decrypted)
+
+			// keys packed without the version are read as version 0
+			parts := bytes.SplitN(packed, []byte{common.SeparatorByte}, 9)
+			legacy := bytes.Join(append(parts[:5:5], parts[6:]...), []byte{common.SeparatorByte})
+			var legacyKey rsa.RsaKey
+			err = legacyKey.Unpack(legacy)
+			assert.NoError(t, err)
+			assert.Equal(t, uint64(0), legacyKey.GetVersion())
+			assert.Equal(t, tc.name, legacyKey.GetName())
+			assert.Equal(t, plaintext, legacyKey.Decrypt(ciphertext))
+
+			// a pregenerated key is created when it is renamed
+			key.CreatedAt = time.Now().Add(-time.Hour)
+			key.Rename("renamed-key", time.Minute)
+			assert.Equal(t, "renamed-key", key.GetName())
+			assert.Equal(t, time.Minute, key.GetTTL())
+			assert.WithinDuration(t, time.Now(), key.GetCreatedAt(), time.Second)
 		})
 	}
 }
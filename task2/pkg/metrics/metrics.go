@@ -0,0 +1,168 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/mailgun/groupcache/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "enclave"
+
+var (
+	// Requests counts the api requests by route pattern, method and status.
+	Requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Number of api requests by route, method and status.",
+	}, []string{"route", "method", "code"})
+
+	// RequestDuration observes the latency of the api requests by route
+	// pattern and method.
+	RequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of the api requests by route and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	// KeyOperations counts the encryptions and decryptions by key type and
+	// size.
+	KeyOperations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "key_operations_total",
+		Help:      "Number of encryptions and decryptions by key type and size.",
+	}, []string{"operation", "type", "size"})
+
+	// KeyGeneration observes the generation time of the keys by type and
+	// size, the large RSA keys take seconds.
+	KeyGeneration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "key_generation_duration_seconds",
+		Help:      "Generation time of the keys by type and size.",
+		Buckets:   []float64{.001, .005, .01, .05, .1, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"type", "size"})
+
+	// KeyExpirations counts the keys removed once their TTL elapsed.
+	KeyExpirations = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "key_expirations_total",
+		Help:      "Number of keys removed once their TTL elapsed.",
+	})
+
+	// RateLimited counts the requests refused by the rate limits, the scope
+	// is "identity" or "key".
+	RateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limited_total",
+		Help:      "Number of requests refused by the rate limits by scope.",
+	}, []string{"scope"})
+
+	// KeyPoolReady is the number of pregenerated keys by type and size.
+	KeyPoolReady = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "key_pool_ready",
+		Help:      "Number of pregenerated keys by type and size.",
+	}, []string{"type", "size"})
+
+	// KeyPoolTakes counts the keys created from the pool, the result is
+	// "hit" or "miss" when the pool was empty.
+	KeyPoolTakes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "key_pool_takes_total",
+		Help:      "Number of keys taken from the pool by type, size and result.",
+	}, []string{"type", "size", "result"})
+)
+
+// NewRegistry returns a registry holding the metrics of this package and
+// the go runtime ones, the collectors are added to it.
+func NewRegistry(cs ...prometheus.Collector) (*prometheus.Registry, error) {
+	registry := prometheus.NewRegistry()
+	cs = append([]prometheus.Collector{
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		Requests,
+		RequestDuration,
+		KeyOperations,
+		KeyGeneration,
+		KeyExpirations,
+		RateLimited,
+		KeyPoolReady,
+		KeyPoolTakes,
+	}, cs...)
+
+	for _, c := range cs {
+		if err := registry.Register(c); err != nil {
+			return nil, err
+		}
+	}
+
+	return registry, nil
+}
+
+// Handler serves the metrics of the registry in the prometheus format.
+func Handler(registry *prometheus.Registry) http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+var (
+	liveKeysDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "cache", "keys"),
+		"Number of live keys held by the cache.",
+		[]string{"group"}, nil,
+	)
+	groupDescs = map[string]*prometheus.Desc{}
+)
+
+// groupStats are the groupcache counters exported by the CacheCollector.
+var groupStats = []struct {
+	name, help string
+	value      func(*groupcache.Stats) int64
+}{
+	{"gets_total", "Number of groupcache gets.", func(s *groupcache.Stats) int64 { return s.Gets.Get() }},
+	{"hits_total", "Number of groupcache gets served by the local cache.", func(s *groupcache.Stats) int64 { return s.CacheHits.Get() }},
+	{"peer_loads_total", "Number of groupcache loads served by a peer.", func(s *groupcache.Stats) int64 { return s.PeerLoads.Get() }},
+	{"peer_errors_total", "Number of groupcache peer load errors.", func(s *groupcache.Stats) int64 { return s.PeerErrors.Get() }},
+	{"loads_total", "Number of groupcache gets not served by the local cache.", func(s *groupcache.Stats) int64 { return s.Loads.Get() }},
+	{"loads_deduped_total", "Number of groupcache loads after the duplicates were removed.", func(s *groupcache.Stats) int64 { return s.LoadsDeduped.Get() }},
+	{"local_loads_total", "Number of groupcache loads served by the local getter.", func(s *groupcache.Stats) int64 { return s.LocalLoads.Get() }},
+	{"local_load_errors_total", "Number of groupcache local getter errors.", func(s *groupcache.Stats) int64 { return s.LocalLoadErrs.Get() }},
+	{"server_requests_total", "Number of groupcache gets received from the peers.", func(s *groupcache.Stats) int64 { return s.ServerRequests.Get() }},
+}
+
+func init() {
+	for _, s := range groupStats {
+		groupDescs[s.name] = prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "groupcache", s.name),
+			s.help, []string{"group"}, nil,
+		)
+	}
+}
+
+// CacheCollector exports the number of live keys of a cache and the stats
+// of its groupcache group.
+type CacheCollector struct {
+	group    *groupcache.Group
+	liveKeys func() int
+}
+
+func NewCacheCollector(group *groupcache.Group, liveKeys func() int) *CacheCollector {
+	return &CacheCollector{group: group, liveKeys: liveKeys}
+}
+
+func (c *CacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- liveKeysDesc
+	for _, desc := range groupDescs {
+		ch <- desc
+	}
+}
+
+func (c *CacheCollector) Collect(ch chan<- prometheus.Metric) {
+	name := c.group.Name()
+	ch <- prometheus.MustNewConstMetric(liveKeysDesc, prometheus.GaugeValue, float64(c.liveKeys()), name)
+	for _, s := range groupStats {
+		ch <- prometheus.MustNewConstMetric(groupDescs[s.name], prometheus.CounterValue, float64(s.value(&c.group.Stats)), name)
+	}
+}
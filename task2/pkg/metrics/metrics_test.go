@@ -0,0 +1,46 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mailgun/groupcache/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheCollector(t *testing.T) {
+	group := groupcache.NewGroup("metrics-test", 1<<20, groupcache.GetterFunc(
+		func(ctx context.Context, key string, dest groupcache.Sink) error {
+			return dest.SetString("value", time.Time{})
+		},
+	))
+	var data string
+	assert.NoError(t, group.Get(context.Background(), "a", groupcache.StringSink(&data)))
+	assert.NoError(t, group.Get(context.Background(), "a", groupcache.StringSink(&data)))
+
+	collector := NewCacheCollector(group, func() int { return 3 })
+	assert.Equal(t, 1+len(groupStats), testutil.CollectAndCount(collector))
+
+	registry, err := NewRegistry(collector)
+	assert.NoError(t, err)
+
+	// the collectors can not be registered twice
+	_, err = NewRegistry(collector, collector)
+	assert.Error(t, err)
+
+	KeyExpirations.Inc()
+	rw := httptest.NewRecorder()
+	Handler(registry).ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	body := rw.Body.String()
+	assert.Contains(t, body, `enclave_cache_keys{group="metrics-test"} 3`)
+	assert.Contains(t, body, `enclave_groupcache_gets_total{group="metrics-test"} 2`)
+	assert.Contains(t, body, `enclave_groupcache_hits_total{group="metrics-test"} 1`)
+	assert.Contains(t, body, `enclave_groupcache_local_loads_total{group="metrics-test"} 1`)
+	assert.Contains(t, body, "enclave_key_expirations_total")
+	assert.Contains(t, body, "go_goroutines")
+}
@@ -0,0 +1,124 @@
+package ratelimit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"enclave-task2/pkg/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// PeerPath is the path the bucket requests of the peers are served on.
+	PeerPath = "/_ratelimit/"
+
+	peerTimeout = 500 * time.Millisecond
+)
+
+type peerRequest struct {
+	Bucket string `json:"bucket"`
+	Limit  Limit  `json:"limit"`
+}
+
+type peerResponse struct {
+	Allowed bool          `json:"allowed"`
+	Delay   time.Duration `json:"delay"`
+}
+
+// Cluster shares the buckets with the peers of a cluster. A bucket is kept
+// by the peer owning its name on the consistent hash of the pool, the other
+// peers take the tokens through it. The local bucket is used when the owner
+// can not be reached, the limit is then per peer until it is back.
+type Cluster struct {
+	local  *Local
+	self   string
+	owner  func(name string) string
+	client *http.Client
+}
+
+// NewCluster creates a limiter for the peer self, owner returns the base
+// URL of the peer owning a bucket.
+func NewCluster(self string, owner func(name string) string, transport http.RoundTripper) *Cluster {
+	return &Cluster{
+		local:  NewLocal(),
+		self:   self,
+		owner:  owner,
+		client: &http.Client{Transport: transport, Timeout: peerTimeout},
+	}
+}
+
+func (c *Cluster) Allow(ctx context.Context, name string, limit Limit) (bool, time.Duration) {
+	if limit.Unlimited() {
+		return true, 0
+	}
+
+	owner := c.owner(name)
+	if owner == "" || owner == c.self {
+		return c.local.Allow(ctx, name, limit)
+	}
+
+	res, err := c.ask(ctx, owner, peerRequest{Bucket: name, Limit: limit})
+	if err != nil {
+		return c.local.Allow(ctx, name, limit)
+	}
+
+	return res.Allowed, res.Delay
+}
+
+// ask takes a token from the bucket of the owner.
+func (c *Cluster) ask(ctx context.Context, owner string, body peerRequest) (res peerResponse, err error) {
+	ctx, span := tracing.Start(ctx, "ratelimit.peer", attribute.String("peer", owner))
+	defer func() { tracing.End(span, err) }()
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return res, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, owner+PeerPath, bytes.NewReader(data))
+	if err != nil {
+		return res, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	tracing.Inject(ctx, req.Header)
+
+	httpRes, err := c.client.Do(req)
+	if err != nil {
+		return res, err
+	}
+	defer httpRes.Body.Close()
+	if httpRes.StatusCode != http.StatusOK {
+		return res, fmt.Errorf("peer %s answered %s", owner, httpRes.Status)
+	}
+
+	err = json.NewDecoder(httpRes.Body).Decode(&res)
+	return res, err
+}
+
+// PeerPath returns the path to serve the peers on.
+func (c *Cluster) PeerPath() string {
+	return PeerPath
+}
+
+// ServeHTTP takes the tokens of the buckets owned by this peer.
+func (c *Cluster) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body peerRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Bucket == "" {
+		http.Error(rw, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	allowed, delay := c.local.Allow(req.Context(), body.Bucket, body.Limit)
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(peerResponse{Allowed: allowed, Delay: delay})
+}
@@ -0,0 +1,113 @@
+// Package ratelimit limits the requests with token buckets identified by
+// name, e.g. the identity of a caller or a key name. The buckets are local
+// to the server or shared by the peers of a cluster.
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// idleTimeout is the time after which an unused bucket is forgotten, it is
+// full again by then for any sensible limit.
+const idleTimeout = 10 * time.Minute
+
+// Limit is the refill rate of a bucket in requests per second and its size.
+type Limit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// Unlimited reports whether the limit lets every request through.
+func (l Limit) Unlimited() bool {
+	return l.Rate <= 0
+}
+
+// Limiter takes tokens from a bucket.
+type Limiter interface {
+	// Allow takes a token from the bucket, it returns the time to wait for
+	// the next token when it is empty.
+	Allow(ctx context.Context, bucket string, limit Limit) (bool, time.Duration)
+}
+
+type bucket struct {
+	limiter *rate.Limiter
+	used    time.Time
+}
+
+// Local keeps the buckets in memory.
+type Local struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+
+	// now is replaced by the tests
+	now func() time.Time
+}
+
+func NewLocal() *Local {
+	return &Local{
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// Allow takes a token from the bucket, the bucket is created full. A change
+// of limit applies to the existing bucket.
+func (l *Local) Allow(_ context.Context, name string, limit Limit) (bool, time.Duration) {
+	if limit.Unlimited() {
+		return true, 0
+	}
+	burst := max(limit.Burst, 1)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[name]
+	if !ok {
+		b = &bucket{limiter: rate.NewLimiter(rate.Limit(limit.Rate), burst)}
+		l.buckets[name] = b
+	}
+	if b.limiter.Limit() != rate.Limit(limit.Rate) {
+		b.limiter.SetLimitAt(now, rate.Limit(limit.Rate))
+	}
+	if b.limiter.Burst() != burst {
+		b.limiter.SetBurstAt(now, burst)
+	}
+	b.used = now
+
+	r := b.limiter.ReserveN(now, 1)
+	if delay := r.DelayFrom(now); delay > 0 {
+		r.CancelAt(now)
+		return false, delay
+	}
+
+	return true, 0
+}
+
+// sweep forgets the idle buckets, at most once per idle timeout.
+func (l *Local) sweep(now time.Time) {
+	if now.Sub(l.swept) < idleTimeout {
+		return
+	}
+	l.swept = now
+
+	for name, b := range l.buckets {
+		if now.Sub(b.used) > idleTimeout {
+			delete(l.buckets, name)
+		}
+	}
+}
+
+// RetryAfter returns the Retry-After header value of a delay, in whole
+// seconds rounded up.
+func RetryAfter(delay time.Duration) int {
+	return max(int(math.Ceil(delay.Seconds())), 1)
+}
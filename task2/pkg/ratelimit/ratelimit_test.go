@@ -0,0 +1,101 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocal(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	l := NewLocal()
+	l.now = func() time.Time { return now }
+
+	limit := Limit{Rate: 2, Burst: 3}
+	for range 3 {
+		ok, _ := l.Allow(ctx, "a", limit)
+		assert.True(t, ok)
+	}
+	ok, delay := l.Allow(ctx, "a", limit)
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, delay)
+
+	// the buckets are independent
+	ok, _ = l.Allow(ctx, "b", limit)
+	assert.True(t, ok)
+
+	// a token is back after 1/rate
+	now = now.Add(500 * time.Millisecond)
+	ok, _ = l.Allow(ctx, "a", limit)
+	assert.True(t, ok)
+	ok, _ = l.Allow(ctx, "a", limit)
+	assert.False(t, ok)
+
+	// a new limit applies to the existing bucket, 0.2 token was refilled
+	now = now.Add(100 * time.Millisecond)
+	ok, delay = l.Allow(ctx, "a", Limit{Rate: 10, Burst: 3})
+	assert.False(t, ok)
+	assert.Equal(t, 80*time.Millisecond, delay)
+
+	ok, _ = l.Allow(ctx, "a", Limit{})
+	assert.True(t, ok)
+
+	// the idle buckets are forgotten
+	now = now.Add(2 * idleTimeout)
+	l.Allow(ctx, "c", limit)
+	assert.Len(t, l.buckets, 1)
+}
+
+func TestRetryAfter(t *testing.T) {
+	assert.Equal(t, 1, RetryAfter(10*time.Millisecond))
+	assert.Equal(t, 1, RetryAfter(time.Second))
+	assert.Equal(t, 2, RetryAfter(1100*time.Millisecond))
+}
+
+func TestCluster(t *testing.T) {
+	ctx := context.Background()
+	limit := Limit{Rate: 0.001, Burst: 2}
+
+	// every bucket is owned by the peer b
+	var owner string
+	a := NewCluster("http://a", func(string) string { return owner }, http.DefaultTransport)
+	b := NewCluster("http://b", func(string) string { return "http://b" }, http.DefaultTransport)
+
+	peer := httptest.NewServer(b)
+	defer peer.Close()
+	owner = peer.URL
+	b.self = peer.URL
+
+	// the tokens taken through a are taken from the bucket of b
+	ok, _ := a.Allow(ctx, "key/shared", limit)
+	assert.True(t, ok)
+	ok, _ = b.Allow(ctx, "key/shared", limit)
+	assert.True(t, ok)
+	ok, delay := a.Allow(ctx, "key/shared", limit)
+	assert.False(t, ok)
+	assert.Greater(t, delay, time.Duration(0))
+	assert.Empty(t, a.local.buckets)
+
+	// the local bucket is used when the owner is unreachable
+	peer.Close()
+	ok, _ = a.Allow(ctx, "key/shared", limit)
+	assert.True(t, ok)
+	assert.Len(t, a.local.buckets, 1)
+}
+
+func TestClusterServeHTTP(t *testing.T) {
+	c := NewCluster("http://a", func(string) string { return "http://a" }, http.DefaultTransport)
+
+	rw := httptest.NewRecorder()
+	c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, PeerPath, nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rw.Code)
+
+	rw = httptest.NewRecorder()
+	c.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, PeerPath, nil))
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+}
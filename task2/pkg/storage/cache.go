@@ -2,17 +2,33 @@ package storage
 
 import (
 	"context"
+	"enclave-task2/pkg/cluster"
 	"enclave-task2/pkg/keys"
+	"enclave-task2/pkg/metrics"
+	"enclave-task2/pkg/tracing"
 	"errors"
 	"log"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/mailgun/groupcache/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// GroupName is the groupcache group shared by the peers.
+	GroupName = "keys"
+	// DefaultCacheBytes is the size of the groupcache of a cache.
+	DefaultCacheBytes = 64 << 20
 )
 
 var (
-	NotFoundError = errors.New("key not found")
-	ticker        = time.NewTicker(1 * time.Minute)
+	NotFoundError        = errors.New("key not found")
+	AlreadyExistsError   = errors.New("key already exists")
+	VersionMismatchError = errors.New("key version mismatch")
+	ticker               = time.NewTicker(1 * time.Minute)
 )
 
 type Cache interface {
@@ -21,25 +37,58 @@ type Cache interface {
 	Has(key string) bool
 }
 
+// InMemoryCache stores the keys in the memory of the process and shares them
+// with the peers through groupcache. The writes are local to the node which
+// handles them: Create and CompareAndSwap are atomic on a node only, two
+// nodes can both create or swap the same key. Use the raft or SQL storage
+// when the writes of several nodes must be serialized.
 type InMemoryCache struct {
 	gc *groupcache.Group
 
-	keys map[string]keys.Key
+	// writeMu serializes the read-modify-write operations of this node, it
+	// is separate from mu because the groupcache getter takes mu while
+	// loading a key.
+	writeMu sync.Mutex
+	mu      sync.RWMutex
+	keys    map[string]record
 }
 
 func NewInMemoryCache() *InMemoryCache {
+	return newInMemoryCache(GroupName, DefaultCacheBytes)
+}
+
+// NewInMemoryCacheWithSize creates a cache whose groupcache holds up to
+// cacheBytes of keys.
+func NewInMemoryCacheWithSize(cacheBytes int64) *InMemoryCache {
+	return newInMemoryCache(GroupName, cacheBytes)
+}
+
+// NewNamedInMemoryCache creates a cache whose groupcache group is unique in
+// the process, it is needed to run several servers in the same process.
+// The peers still address the group by GroupName.
+func NewNamedInMemoryCache(instance string) *InMemoryCache {
+	return newInMemoryCache(GroupName+cluster.InstanceSeparator+instance, DefaultCacheBytes)
+}
+
+func newInMemoryCache(groupName string, cacheBytes int64) *InMemoryCache {
 	mc := InMemoryCache{
-		keys: make(map[string]keys.Key),
+		keys: make(map[string]record),
 	}
 
-	gc := groupcache.NewGroup("keys", 64<<20, groupcache.GetterFunc(
+	gc := groupcache.NewGroup(groupName, cacheBytes, groupcache.GetterFunc(
 		func(ctx context.Context, key string, dest groupcache.Sink) error {
+			_, span := tracing.Start(ctx, "InMemoryCache.load", attribute.String("key.name", key))
+			defer span.End()
+
 			log.Println("looking up", key)
+			mc.mu.RLock()
 			v, ok := mc.keys[key]
+			mc.mu.RUnlock()
 			if !ok {
-				return errors.New("key not found")
+				// tells the peers not to fall back to their own getter
+				return &groupcache.ErrNotFound{Msg: "key not found"}
 			}
-			dest.SetBytes(v.Pack(), time.Now().Add(v.GetTTL()))
+			dest.SetBytes(v.Pack(), expiry(v))
 			return nil
 		},
 	))
@@ -50,25 +99,171 @@ func NewInMemoryCache() *InMemoryCache {
 	return &mc
 }
 
+// GroupName returns the name of the groupcache group holding the keys.
+func (mc *InMemoryCache) GroupName() string {
+	return mc.gc.Name()
+}
+
+// Collector exports the number of live keys and the groupcache stats of
+// the cache.
+func (mc *InMemoryCache) Collector() prometheus.Collector {
+	return metrics.NewCacheCollector(mc.gc, func() int {
+		mc.mu.RLock()
+		defer mc.mu.RUnlock()
+		return len(mc.keys)
+	})
+}
+
 func (mc *InMemoryCache) CheckTTL() {
 	go func() {
 		for range ticker.C {
 			now := time.Now()
+
+			mc.mu.Lock()
+			var expired []string
+			var expiredKeys int
 			for k, v := range mc.keys {
 				if v.GetTTL() > 0 && now.Sub(v.GetCreatedAt()) > v.GetTTL() {
-					mc.gc.Remove(context.Background(), k)
+					delete(mc.keys, k)
+					expired = append(expired, k)
+					if _, ok := v.(*Entry); !ok {
+						expiredKeys++
+					}
 				}
 			}
+			mc.mu.Unlock()
+
+			metrics.KeyExpirations.Add(float64(expiredKeys))
+			for _, k := range expired {
+				mc.gc.Remove(context.Background(), k)
+			}
 		}
 	}()
 }
 
+// Put stores the key unconditionally and bumps its version.
 func (mc *InMemoryCache) Put(ctx context.Context, key keys.Key) error {
-	mc.gc.Set(ctx, key.GetName(), key.Pack(), key.GetCreatedAt().Add(key.GetTTL()), true)
-	return nil
+	return mc.put(ctx, key)
+}
+
+// PutEntry stores the entry unconditionally and bumps its version.
+func (mc *InMemoryCache) PutEntry(ctx context.Context, entry *Entry) error {
+	return mc.put(ctx, entry)
+}
+
+func (mc *InMemoryCache) put(ctx context.Context, r record) error {
+	ctx, span := tracing.Start(ctx, "InMemoryCache.Put", attribute.String("key.name", r.GetName()))
+	defer span.End()
+
+	mc.writeMu.Lock()
+	defer mc.writeMu.Unlock()
+
+	version := uint64(1)
+	if current, err := mc.get(ctx, r.GetName()); err == nil {
+		version = current.GetVersion() + 1
+	}
+	r.SetVersion(version)
+
+	return mc.store(ctx, r)
+}
+
+// Create stores the key with version 1 only if no live key with the same
+// name exists, otherwise AlreadyExistsError is returned. The check is atomic
+// on this node only.
+func (mc *InMemoryCache) Create(ctx context.Context, key keys.Key) error {
+	return mc.create(ctx, key)
+}
+
+// CreateEntry stores the entry like Create.
+func (mc *InMemoryCache) CreateEntry(ctx context.Context, entry *Entry) error {
+	return mc.create(ctx, entry)
+}
+
+func (mc *InMemoryCache) create(ctx context.Context, r record) error {
+	ctx, span := tracing.Start(ctx, "InMemoryCache.Create", attribute.String("key.name", r.GetName()))
+	defer span.End()
+
+	mc.writeMu.Lock()
+	defer mc.writeMu.Unlock()
+
+	_, err := mc.get(ctx, r.GetName())
+	if err == nil {
+		return AlreadyExistsError
+	}
+	if err != NotFoundError {
+		return err
+	}
+
+	r.SetVersion(1)
+
+	return mc.store(ctx, r)
+}
+
+// CompareAndSwap replaces the stored key only if its version is still the
+// given one. On success the version of the key is incremented. The check is
+// atomic on this node only.
+func (mc *InMemoryCache) CompareAndSwap(ctx context.Context, key keys.Key, version uint64) error {
+	return mc.compareAndSwap(ctx, key, version)
+}
+
+// CompareAndSwapEntry replaces the stored entry like CompareAndSwap.
+func (mc *InMemoryCache) CompareAndSwapEntry(ctx context.Context, entry *Entry, version uint64) error {
+	return mc.compareAndSwap(ctx, entry, version)
+}
+
+func (mc *InMemoryCache) compareAndSwap(ctx context.Context, r record, version uint64) error {
+	ctx, span := tracing.Start(ctx, "InMemoryCache.CompareAndSwap", attribute.String("key.name", r.GetName()))
+	defer span.End()
+
+	mc.writeMu.Lock()
+	defer mc.writeMu.Unlock()
+
+	current, err := mc.get(ctx, r.GetName())
+	if err != nil {
+		return err
+	}
+	if current.GetVersion() != version {
+		return VersionMismatchError
+	}
+
+	r.SetVersion(version + 1)
+
+	return mc.store(ctx, r)
+}
+
+func (mc *InMemoryCache) store(ctx context.Context, r record) error {
+	mc.mu.Lock()
+	mc.keys[r.GetName()] = r
+	mc.mu.Unlock()
+
+	return mc.gc.Set(ctx, r.GetName(), r.Pack(), expiry(r), true)
+}
+
+// expiry returns the time groupcache drops the record, zero for the records
+// without ttl which never expire. A past expiry would make the peers reject
+// the record.
+func expiry(r record) time.Time {
+	if r.GetTTL() <= 0 {
+		return time.Time{}
+	}
+
+	return r.GetCreatedAt().Add(r.GetTTL())
 }
 
 func (mc *InMemoryCache) Get(ctx context.Context, keyName string) (keys.Key, error) {
+	return asKey(mc.get(ctx, keyName))
+}
+
+// GetEntry returns the entry, NotFoundError if it does not exist, expired or
+// is a key.
+func (mc *InMemoryCache) GetEntry(ctx context.Context, name string) (*Entry, error) {
+	return asEntry(mc.get(ctx, name))
+}
+
+func (mc *InMemoryCache) get(ctx context.Context, keyName string) (record, error) {
+	ctx, span := tracing.Start(ctx, "InMemoryCache.Get", attribute.String("key.name", keyName))
+	defer span.End()
+
 	var data []byte
 	err := mc.gc.Get(ctx, keyName, groupcache.AllocatingByteSliceSink(&data))
 	if err != nil {
@@ -78,21 +273,63 @@ func (mc *InMemoryCache) Get(ctx context.Context, keyName string) (keys.Key, err
 		return nil, err
 	}
 
-	key, err := keys.Unpack(data)
+	r, err := unpack(data)
 	if err != nil {
 		return nil, err
 	}
 
 	// check if key is expired
-	if key.GetTTL() > 0 && time.Since(key.GetCreatedAt()) > key.GetTTL() {
+	if r.GetTTL() > 0 && time.Since(r.GetCreatedAt()) > r.GetTTL() {
+		mc.mu.Lock()
+		if _, ok := mc.keys[keyName]; ok {
+			delete(mc.keys, keyName)
+			if _, ok := r.(*Entry); !ok {
+				metrics.KeyExpirations.Inc()
+			}
+		}
+		mc.mu.Unlock()
+
 		mc.gc.Remove(ctx, keyName)
 		return nil, NotFoundError
 	}
 
-	return key, nil
+	return r, nil
+}
+
+// List returns the sorted names of the live keys stored through this node,
+// the entries are not listed. In a cluster the keys created through the
+// other nodes are not listed.
+func (mc *InMemoryCache) List(ctx context.Context) ([]string, error) {
+	_, span := tracing.Start(ctx, "InMemoryCache.List")
+	defer span.End()
+
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+
+	now := time.Now()
+	names := []string{}
+	for name, r := range mc.keys {
+		if _, ok := r.(keys.Key); !ok || r.GetTTL() > 0 && now.Sub(r.GetCreatedAt()) > r.GetTTL() {
+			continue
+		}
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	return names, nil
 }
 
 func (mc *InMemoryCache) Delete(ctx context.Context, key string) error {
+	ctx, span := tracing.Start(ctx, "InMemoryCache.Delete", attribute.String("key.name", key))
+	defer span.End()
+
+	mc.writeMu.Lock()
+	defer mc.writeMu.Unlock()
+
+	mc.mu.Lock()
+	delete(mc.keys, key)
+	mc.mu.Unlock()
+
 	if err := mc.gc.Remove(ctx, key); err != nil {
 		return err
 	}
@@ -3,6 +3,8 @@ package storage
 import (
 	"context"
 	"enclave-task2/pkg/keys"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -75,3 +77,98 @@ func TestCache(t *testing.T) {
 	assert.Equal(t, NotFoundError, err)
 
 }
+
+func TestCacheCreateCompareAndSwap(t *testing.T) {
+	ctx := context.Background()
+	if cache == nil {
+		cache = NewInMemoryCache()
+	}
+
+	for _, name := range []string{"cas-key", "cas-concurrent-key"} {
+		assert.NoError(t, cache.Delete(ctx, name))
+	}
+
+	key, err := keys.New(ctx, "kyber", "512", "cas-key", 10*time.Minute)
+	assert.NoError(t, err)
+
+	err = cache.Create(ctx, key)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), key.GetVersion())
+
+	err = cache.Create(ctx, key)
+	assert.Equal(t, AlreadyExistsError, err)
+
+	// stale version is rejected
+	key.SetTTL(20 * time.Minute)
+	err = cache.CompareAndSwap(ctx, key, 0)
+	assert.Equal(t, VersionMismatchError, err)
+
+	err = cache.CompareAndSwap(ctx, key, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), key.GetVersion())
+
+	actualKey, err := cache.Get(ctx, "cas-key")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), actualKey.GetVersion())
+	assert.Equal(t, 20*time.Minute, actualKey.GetTTL())
+
+	// Put bumps the version
+	err = cache.Put(ctx, actualKey)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), actualKey.GetVersion())
+
+	err = cache.CompareAndSwap(ctx, actualKey, 3)
+	assert.NoError(t, err)
+
+	// missing key
+	missing, err := keys.New(ctx, "kyber", "512", "cas-missing-key", 10*time.Minute)
+	assert.NoError(t, err)
+	err = cache.CompareAndSwap(ctx, missing, 1)
+	assert.Equal(t, NotFoundError, err)
+
+	// concurrent creates, exactly one wins
+	var wg sync.WaitGroup
+	var created atomic.Int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			k, err := keys.New(ctx, "kyber", "512", "cas-concurrent-key", 10*time.Minute)
+			assert.NoError(t, err)
+
+			if err := cache.Create(ctx, k); err == nil {
+				created.Add(1)
+			} else {
+				assert.Equal(t, AlreadyExistsError, err)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), created.Load())
+
+	// concurrent swaps of the same version, exactly one wins
+	var swapped atomic.Int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			k, err := cache.Get(ctx, "cas-concurrent-key")
+			assert.NoError(t, err)
+
+			if err := cache.CompareAndSwap(ctx, k, 1); err == nil {
+				swapped.Add(1)
+			} else {
+				assert.Equal(t, VersionMismatchError, err)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), swapped.Load())
+
+	// deleted keys can be created again
+	err = cache.Delete(ctx, "cas-key")
+	assert.NoError(t, err)
+	err = cache.Create(ctx, key)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), key.GetVersion())
+}
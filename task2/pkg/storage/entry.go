@@ -0,0 +1,196 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"enclave-task2/pkg/common"
+	"enclave-task2/pkg/keys"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	// EntryType is the packed type of the entries.
+	EntryType = "entry"
+	// number of parts in packed entry data
+	entryParts = 6
+)
+
+// EntryStorage stores the internal entries of the server next to the keys,
+// it is implemented by the storages of this package.
+type EntryStorage interface {
+	PutEntry(ctx context.Context, entry *Entry) error
+	GetEntry(ctx context.Context, name string) (*Entry, error)
+	Delete(ctx context.Context, name string) error
+	CreateEntry(ctx context.Context, entry *Entry) error
+	CompareAndSwapEntry(ctx context.Context, entry *Entry, version uint64) error
+}
+
+// Entry is an internal record kept next to the keys, e.g. a service token
+// or the usage counters of a key. Its data is opaque to the storages, the
+// entries are never returned as keys and the keys never as entries.
+type Entry struct {
+	Name string
+	Data []byte
+
+	CreatedAt time.Time
+	// TTL is counted from CreatedAt, the entry never expires if 0.
+	TTL     time.Duration
+	Version uint64
+}
+
+func NewEntry(name string, ttl time.Duration) *Entry {
+	return &Entry{
+		Name:      name,
+		CreatedAt: time.Now(),
+		TTL:       ttl,
+	}
+}
+
+// Encode sets the data of the entry to v encoded in JSON.
+func (e *Entry) Encode(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	e.Data = data
+
+	return nil
+}
+
+// Decode decodes the JSON data of the entry into v.
+func (e *Entry) Decode(v any) error {
+	return json.Unmarshal(e.Data, v)
+}
+
+// Expired reports whether the ttl of the entry elapsed.
+func (e *Entry) Expired() bool {
+	return e.TTL > 0 && time.Since(e.CreatedAt) > e.TTL
+}
+
+func (e *Entry) GetName() string {
+	return e.Name
+}
+
+func (e *Entry) GetType() string {
+	return EntryType
+}
+
+func (e *Entry) GetSize() string {
+	return ""
+}
+
+func (e *Entry) GetCreatedAt() time.Time {
+	return e.CreatedAt
+}
+
+func (e *Entry) GetTTL() time.Duration {
+	return e.TTL
+}
+
+func (e *Entry) GetVersion() uint64 {
+	return e.Version
+}
+
+func (e *Entry) SetVersion(version uint64) {
+	e.Version = version
+}
+
+func (e *Entry) Pack() []byte {
+	packed := bytes.NewBuffer([]byte{})
+
+	packed.WriteString(EntryType)
+	packed.WriteByte(common.SeparatorByte)
+	packed.WriteString(e.Name)
+	packed.WriteByte(common.SeparatorByte)
+	packed.WriteString(e.CreatedAt.Format(time.RFC3339Nano))
+	packed.WriteByte(common.SeparatorByte)
+	packed.WriteString(e.TTL.String())
+	packed.WriteByte(common.SeparatorByte)
+	packed.WriteString(strconv.FormatUint(e.Version, 10))
+	packed.WriteByte(common.SeparatorByte)
+	packed.Write(e.Data)
+
+	return packed.Bytes()
+}
+
+func (e *Entry) Unpack(data []byte) error {
+	var err error
+	parts := bytes.SplitN(data, []byte{common.SeparatorByte}, entryParts)
+	if len(parts) != entryParts || string(parts[0]) != EntryType {
+		return fmt.Errorf("invalid packed entry")
+	}
+
+	e.Name = string(parts[1])
+	if e.CreatedAt, err = time.Parse(time.RFC3339Nano, string(parts[2])); err != nil {
+		return fmt.Errorf("invalid packed entry: %w", err)
+	}
+	if e.TTL, err = time.ParseDuration(string(parts[3])); err != nil {
+		return fmt.Errorf("invalid packed entry: %w", err)
+	}
+	if e.Version, err = strconv.ParseUint(string(parts[4]), 10, 64); err != nil {
+		return fmt.Errorf("invalid packed entry: %w", err)
+	}
+	e.Data = bytes.Clone(parts[5])
+
+	return nil
+}
+
+// record is a key or an entry, the storages keep both the same way.
+type record interface {
+	GetName() string
+	GetType() string
+	GetSize() string
+	GetCreatedAt() time.Time
+	GetTTL() time.Duration
+	GetVersion() uint64
+	SetVersion(version uint64)
+	Pack() []byte
+}
+
+// isEntry reports whether data is a packed entry.
+func isEntry(data []byte) bool {
+	return bytes.HasPrefix(data, append([]byte(EntryType), common.SeparatorByte))
+}
+
+// unpack returns the key or the entry packed in data.
+func unpack(data []byte) (record, error) {
+	if isEntry(data) {
+		var entry Entry
+		if err := entry.Unpack(data); err != nil {
+			return nil, err
+		}
+		return &entry, nil
+	}
+
+	return keys.Unpack(data)
+}
+
+// asKey returns the record if it is a key, NotFoundError if it is an entry.
+func asKey(r record, err error) (keys.Key, error) {
+	if err != nil {
+		return nil, err
+	}
+	key, ok := r.(keys.Key)
+	if !ok {
+		return nil, NotFoundError
+	}
+
+	return key, nil
+}
+
+// asEntry returns the record if it is an entry, NotFoundError if it is a
+// key.
+func asEntry(r record, err error) (*Entry, error) {
+	if err != nil {
+		return nil, err
+	}
+	entry, ok := r.(*Entry)
+	if !ok {
+		return nil, NotFoundError
+	}
+
+	return entry, nil
+}
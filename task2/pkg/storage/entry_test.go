@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"context"
+	"enclave-task2/pkg/keys"
+	"testing"
+	"time"
+
+	"github.com/tj/assert"
+)
+
+func TestEntryPack(t *testing.T) {
+	entry := NewEntry("auth/token/abc", time.Hour)
+	entry.Version = 3
+	assert.NoError(t, entry.Encode(map[string]string{"display_name": "ci"}))
+
+	var unpacked Entry
+	assert.NoError(t, unpacked.Unpack(entry.Pack()))
+	assert.Equal(t, entry.Name, unpacked.Name)
+	assert.True(t, entry.CreatedAt.Equal(unpacked.CreatedAt))
+	assert.Equal(t, time.Hour, unpacked.TTL)
+	assert.Equal(t, uint64(3), unpacked.Version)
+
+	var data map[string]string
+	assert.NoError(t, unpacked.Decode(&data))
+	assert.Equal(t, "ci", data["display_name"])
+
+	assert.Error(t, unpacked.Unpack([]byte("kyber")))
+}
+
+type entryTestStorage interface {
+	KeyStorage
+	EntryStorage
+}
+
+func TestEntryStorage(t *testing.T) {
+	ctx := context.Background()
+	storages := map[string]func(t *testing.T) entryTestStorage{
+		"memory": func(t *testing.T) entryTestStorage {
+			return NewNamedInMemoryCache("entries")
+		},
+		"sqlite": func(t *testing.T) entryTestStorage {
+			return newTestSQLStorage(t)
+		},
+		"raft": func(t *testing.T) entryTestStorage {
+			return raftLeader(startRaftCluster(t, 1)).storage
+		},
+	}
+
+	for name, open := range storages {
+		t.Run(name, func(t *testing.T) {
+			s := open(t)
+
+			entry := NewEntry("auth/init", 0)
+			assert.NoError(t, s.CreateEntry(ctx, entry))
+			assert.Equal(t, uint64(1), entry.Version)
+			assert.Equal(t, AlreadyExistsError, s.CreateEntry(ctx, NewEntry("auth/init", 0)))
+
+			stored, err := s.GetEntry(ctx, "auth/init")
+			assert.NoError(t, err)
+			assert.Equal(t, uint64(1), stored.Version)
+			assert.Equal(t, time.Duration(0), stored.TTL)
+
+			assert.NoError(t, stored.Encode([]string{"updated"}))
+			assert.Equal(t, VersionMismatchError, s.CompareAndSwapEntry(ctx, stored, 0))
+			assert.NoError(t, s.CompareAndSwapEntry(ctx, stored, 1))
+			assert.NoError(t, s.PutEntry(ctx, stored))
+			assert.Equal(t, uint64(3), stored.Version)
+
+			var data []string
+			stored, err = s.GetEntry(ctx, "auth/init")
+			assert.NoError(t, err)
+			assert.NoError(t, stored.Decode(&data))
+			assert.Equal(t, []string{"updated"}, data)
+
+			// the entries are not keys and the keys are not entries
+			_, err = s.Get(ctx, "auth/init")
+			assert.Equal(t, NotFoundError, err)
+
+			key, err := keys.New(ctx, "kyber", "512", "entry-key", time.Minute)
+			assert.NoError(t, err)
+			assert.NoError(t, s.Create(ctx, key))
+			_, err = s.GetEntry(ctx, "entry-key")
+			assert.Equal(t, NotFoundError, err)
+
+			// only the keys are listed, sorted by name
+			key, err = keys.New(ctx, "kyber", "512", "another-key", time.Minute)
+			assert.NoError(t, err)
+			assert.NoError(t, s.Create(ctx, key))
+			names, err := s.List(ctx)
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"another-key", "entry-key"}, names)
+
+			// expired entries are not returned
+			expired := NewEntry("usage/expired", time.Second)
+			expired.CreatedAt = time.Now().Add(-time.Minute)
+			assert.NoError(t, s.PutEntry(ctx, expired))
+			_, err = s.GetEntry(ctx, "usage/expired")
+			assert.Equal(t, NotFoundError, err)
+
+			assert.NoError(t, s.Delete(ctx, "auth/init"))
+			_, err = s.GetEntry(ctx, "auth/init")
+			assert.Equal(t, NotFoundError, err)
+		})
+	}
+}
@@ -0,0 +1,746 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"enclave-task2/pkg/keys"
+	"enclave-task2/pkg/metrics"
+	"enclave-task2/pkg/tracing"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	"go.etcd.io/bbolt"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// RaftPath is the path the followers forward their writes to.
+	RaftPath = "/_raft/"
+
+	raftApplyTimeout    = 5 * time.Second
+	raftForwardedHeader = "X-Raft-Forwarded"
+	maxRaftMessageSize  = 64 << 20
+
+	opPut    = "put"
+	opCreate = "create"
+	opCAS    = "cas"
+	opDelete = "delete"
+	opExpire = "expire"
+)
+
+var NoLeaderError = errors.New("no raft leader")
+
+// RaftServer is a voter of the initial cluster configuration.
+type RaftServer struct {
+	// ID is the base URL of the peer listener of the server.
+	ID string
+	// Address of the raft transport of the server.
+	Address string
+}
+
+// RaftOptions are the configurations of a RaftStorage.
+type RaftOptions struct {
+	// ID is the base URL of the peer listener of this server as seen by
+	// the others, e.g. "http://10.0.0.1:8081". Followers forward writes to
+	// the ID of the leader.
+	ID string
+	// BindAddr is the address of the raft transport, e.g. "0.0.0.0:7000".
+	BindAddr string
+	// AdvertiseAddr is the raft address announced to the peers, defaults
+	// to BindAddr.
+	AdvertiseAddr string
+	// Servers bootstraps the cluster when set. All the initial servers must
+	// be configured with the same list.
+	Servers []RaftServer
+	// DataDir stores the log, the term and vote and the snapshots of the
+	// node. They are kept in memory when empty, the node then forgets its
+	// vote when it stops and must not be restarted with the same ID; it is
+	// meant for the tests.
+	DataDir string
+
+	// TLSConfig enables mutual TLS on the raft transport. It must both
+	// present and verify the peer certificates.
+	TLSConfig *tls.Config
+	// Transport of the requests forwarded to the leader, defaults to
+	// http.DefaultTransport.
+	Transport http.RoundTripper
+	// Config overrides the default raft timeouts.
+	Config *raft.Config
+}
+
+// RaftStorage replicates the keys on every node of a raft cluster. Writes
+// are linearizable, they are applied by the leader and forwarded to it when
+// received by a follower. Reads are served from the local replica.
+type RaftStorage struct {
+	opts      RaftOptions
+	raft      *raft.Raft
+	fsm       *raftFSM
+	transport *raft.NetworkTransport
+	store     io.Closer
+	client    *http.Client
+
+	sweepInterval time.Duration
+}
+
+type raftCommand struct {
+	Op      string `json:"op"`
+	Name    string `json:"name,omitempty"`
+	Data    []byte `json:"data,omitempty"`
+	Version uint64 `json:"version,omitempty"`
+	// Now is the time of the leader, it keeps the expiry checks of the
+	// replicas deterministic.
+	Now int64 `json:"now"`
+}
+
+type raftResult struct {
+	Version uint64 `json:"version,omitempty"`
+	// Expired is the number of keys removed by an expire command.
+	Expired int    `json:"expired,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type raftJoinRequest struct {
+	ID      string `json:"id"`
+	Address string `json:"address"`
+}
+
+// NewRaftStorage starts the raft node. The cluster is bootstrapped when
+// opts.Servers is set, otherwise the node waits to be joined.
+func NewRaftStorage(opts RaftOptions) (*RaftStorage, error) {
+	if opts.ID == "" || opts.BindAddr == "" {
+		return nil, fmt.Errorf("raft id and bind address are required")
+	}
+	opts.ID = strings.TrimSuffix(opts.ID, "/")
+
+	config := raft.DefaultConfig()
+	if opts.Config != nil {
+		c := *opts.Config
+		config = &c
+	}
+	config.LocalID = raft.ServerID(opts.ID)
+	if config.Logger == nil {
+		config.Logger = hclog.New(&hclog.LoggerOptions{Name: "raft", Level: hclog.Warn, Output: os.Stderr})
+	}
+
+	advertise := opts.AdvertiseAddr
+	if advertise == "" {
+		advertise = opts.BindAddr
+	}
+	addr, err := net.ResolveTCPAddr("tcp", advertise)
+	if err != nil {
+		return nil, fmt.Errorf("invalid raft advertise address: %w", err)
+	}
+
+	var transport *raft.NetworkTransport
+	if opts.TLSConfig != nil {
+		var stream *tlsStreamLayer
+		stream, err = newTLSStreamLayer(opts.BindAddr, addr, opts.TLSConfig.Clone())
+		if err == nil {
+			transport = raft.NewNetworkTransportWithLogger(stream, 3, 10*time.Second, config.Logger)
+		}
+	} else {
+		transport, err = raft.NewTCPTransportWithLogger(opts.BindAddr, addr, 3, 10*time.Second, config.Logger)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to start raft transport: %w", err)
+	}
+
+	logs, stable, snapshots, store, err := openRaftStores(opts.DataDir, config.Logger)
+	if err != nil {
+		transport.Close()
+		return nil, err
+	}
+	fsm := &raftFSM{entries: make(map[string]raftEntry)}
+
+	r, err := raft.NewRaft(config, fsm, logs, stable, snapshots, transport)
+	if err != nil {
+		transport.Close()
+		store.Close()
+		return nil, fmt.Errorf("failed to start raft: %w", err)
+	}
+
+	if len(opts.Servers) > 0 {
+		configuration := raft.Configuration{}
+		for _, srv := range opts.Servers {
+			configuration.Servers = append(configuration.Servers, raft.Server{
+				Suffrage: raft.Voter,
+				ID:       raft.ServerID(strings.TrimSuffix(srv.ID, "/")),
+				Address:  raft.ServerAddress(srv.Address),
+			})
+		}
+		if err := r.BootstrapCluster(configuration).Error(); err != nil && err != raft.ErrCantBootstrap {
+			r.Shutdown()
+			transport.Close()
+			store.Close()
+			return nil, fmt.Errorf("failed to bootstrap raft cluster: %w", err)
+		}
+	}
+
+	rt := opts.Transport
+	if rt == nil && opts.TLSConfig != nil {
+		tr := http.DefaultTransport.(*http.Transport).Clone()
+		tr.TLSClientConfig = opts.TLSConfig.Clone()
+		rt = tr
+	}
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+
+	return &RaftStorage{
+		opts:          opts,
+		raft:          r,
+		fsm:           fsm,
+		transport:     transport,
+		store:         store,
+		client:        &http.Client{Transport: rt, Timeout: raftApplyTimeout},
+		sweepInterval: time.Minute,
+	}, nil
+}
+
+// Close stops the raft node.
+func (s *RaftStorage) Close() error {
+	err := s.raft.Shutdown().Error()
+	s.transport.Close()
+
+	return errors.Join(err, s.store.Close())
+}
+
+// openRaftStores opens the log, stable and snapshot stores in dir, or in
+// memory when dir is empty. The term and the vote of the node are kept in
+// the stable store, a node must not forget them when it restarts or it could
+// vote twice in the same term.
+func openRaftStores(dir string, logger hclog.Logger) (raft.LogStore, raft.StableStore, raft.SnapshotStore, io.Closer, error) {
+	if dir == "" {
+		store := raft.NewInmemStore()
+		return store, store, raft.NewInmemSnapshotStore(), io.NopCloser(nil), nil
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("failed to create raft directory: %w", err)
+	}
+	snapshots, err := raft.NewFileSnapshotStoreWithLogger(dir, 2, logger)
+	if err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("failed to open snapshot store: %w", err)
+	}
+	// the timeout fails the start of a second node on the same directory
+	store, err := raftboltdb.New(raftboltdb.Options{
+		Path:        filepath.Join(dir, "raft.db"),
+		BoltOptions: &bbolt.Options{Timeout: time.Second},
+	})
+	if err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("failed to open raft log: %w", err)
+	}
+	logs, err := raft.NewLogCache(512, store)
+	if err != nil {
+		store.Close()
+		return nil, nil, nil, nil, fmt.Errorf("failed to open raft log: %w", err)
+	}
+
+	return logs, store, snapshots, store, nil
+}
+
+// Leader returns the ID of the current leader or an empty string.
+func (s *RaftStorage) Leader() string {
+	_, id := s.raft.LeaderWithID()
+	return string(id)
+}
+
+// IsLeader reports whether this node is the leader.
+func (s *RaftStorage) IsLeader() bool {
+	return s.raft.State() == raft.Leader
+}
+
+// WaitForLeader blocks until a leader is elected.
+func (s *RaftStorage) WaitForLeader(ctx context.Context) error {
+	t := time.NewTicker(10 * time.Millisecond)
+	defer t.Stop()
+
+	for s.Leader() == "" {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+
+	return nil
+}
+
+// Join adds a voter to the cluster, the request is forwarded to the leader.
+func (s *RaftStorage) Join(ctx context.Context, id, address string) error {
+	if !s.IsLeader() {
+		body, _ := json.Marshal(raftJoinRequest{ID: id, Address: address})
+		return s.forward(ctx, "join", body, nil)
+	}
+
+	return s.raft.AddVoter(raft.ServerID(strings.TrimSuffix(id, "/")), raft.ServerAddress(address), 0, raftApplyTimeout).Error()
+}
+
+func (s *RaftStorage) Put(ctx context.Context, key keys.Key) error {
+	return s.put(ctx, key)
+}
+
+// PutEntry stores the entry unconditionally and bumps its version.
+func (s *RaftStorage) PutEntry(ctx context.Context, entry *Entry) error {
+	return s.put(ctx, entry)
+}
+
+func (s *RaftStorage) put(ctx context.Context, r record) error {
+	ctx, span := tracing.Start(ctx, "RaftStorage.Put", attribute.String("key.name", r.GetName()))
+	defer span.End()
+
+	res, err := s.apply(ctx, raftCommand{Op: opPut, Name: r.GetName(), Data: r.Pack()})
+	if err != nil {
+		return err
+	}
+	r.SetVersion(res.Version)
+
+	return nil
+}
+
+// Create stores the key with version 1 only if no live key with the same
+// name exists, otherwise AlreadyExistsError is returned.
+func (s *RaftStorage) Create(ctx context.Context, key keys.Key) error {
+	return s.create(ctx, key)
+}
+
+// CreateEntry stores the entry like Create.
+func (s *RaftStorage) CreateEntry(ctx context.Context, entry *Entry) error {
+	return s.create(ctx, entry)
+}
+
+func (s *RaftStorage) create(ctx context.Context, r record) error {
+	ctx, span := tracing.Start(ctx, "RaftStorage.Create", attribute.String("key.name", r.GetName()))
+	defer span.End()
+
+	res, err := s.apply(ctx, raftCommand{Op: opCreate, Name: r.GetName(), Data: r.Pack()})
+	if err != nil {
+		return err
+	}
+	r.SetVersion(res.Version)
+
+	return nil
+}
+
+// CompareAndSwap replaces the stored key only if its version is still the
+// given one. On success the version of the key is incremented.
+func (s *RaftStorage) CompareAndSwap(ctx context.Context, key keys.Key, version uint64) error {
+	return s.compareAndSwap(ctx, key, version)
+}
+
+// CompareAndSwapEntry replaces the stored entry like CompareAndSwap.
+func (s *RaftStorage) CompareAndSwapEntry(ctx context.Context, entry *Entry, version uint64) error {
+	return s.compareAndSwap(ctx, entry, version)
+}
+
+func (s *RaftStorage) compareAndSwap(ctx context.Context, r record, version uint64) error {
+	ctx, span := tracing.Start(ctx, "RaftStorage.CompareAndSwap", attribute.String("key.name", r.GetName()))
+	defer span.End()
+
+	res, err := s.apply(ctx, raftCommand{Op: opCAS, Name: r.GetName(), Data: r.Pack(), Version: version})
+	if err != nil {
+		return err
+	}
+	r.SetVersion(res.Version)
+
+	return nil
+}
+
+func (s *RaftStorage) Delete(ctx context.Context, keyName string) error {
+	ctx, span := tracing.Start(ctx, "RaftStorage.Delete", attribute.String("key.name", keyName))
+	defer span.End()
+
+	_, err := s.apply(ctx, raftCommand{Op: opDelete, Name: keyName})
+	return err
+}
+
+func (s *RaftStorage) Get(ctx context.Context, keyName string) (keys.Key, error) {
+	return asKey(s.get(ctx, keyName))
+}
+
+// GetEntry returns the entry, NotFoundError if it does not exist, expired or
+// is a key.
+func (s *RaftStorage) GetEntry(ctx context.Context, name string) (*Entry, error) {
+	return asEntry(s.get(ctx, name))
+}
+
+func (s *RaftStorage) get(ctx context.Context, keyName string) (record, error) {
+	_, span := tracing.Start(ctx, "RaftStorage.Get", attribute.String("key.name", keyName))
+	defer span.End()
+
+	entry, ok := s.fsm.get(keyName)
+	if !ok || entry.expired(time.Now().UnixNano()) {
+		return nil, NotFoundError
+	}
+
+	return unpack(entry.Data)
+}
+
+// List returns the sorted names of the live keys, the entries are not
+// listed. It reads the state of this node like Get.
+func (s *RaftStorage) List(ctx context.Context) ([]string, error) {
+	_, span := tracing.Start(ctx, "RaftStorage.List")
+	defer span.End()
+
+	return s.fsm.list(time.Now().UnixNano()), nil
+}
+
+// CheckTTL periodically removes the expired keys while this node is the
+// leader, until the context is done. The expirations are counted by the
+// leader, the followers applying the command do not count them again.
+func (s *RaftStorage) CheckTTL(ctx context.Context) {
+	t := time.NewTicker(s.sweepInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if s.IsLeader() {
+				if res, err := s.apply(ctx, raftCommand{Op: opExpire}); err == nil {
+					metrics.KeyExpirations.Add(float64(res.Expired))
+				}
+			}
+		}
+	}
+}
+
+// PeerPath returns the path the storage is served on by the peer listener.
+func (s *RaftStorage) PeerPath() string {
+	return RaftPath
+}
+
+// ServeHTTP handles the writes and joins forwarded by the followers.
+func (s *RaftStorage) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// a forwarded request is not forwarded again, the sender retries
+	// once the leadership settled
+	if !s.IsLeader() {
+		http.Error(rw, NoLeaderError.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	path := strings.TrimPrefix(req.URL.Path, RaftPath)
+	ctx, span := tracing.Start(tracing.Extract(req.Context(), req.Header), "RaftStorage.serve "+path)
+	defer span.End()
+	req = req.WithContext(ctx)
+
+	body := http.MaxBytesReader(rw, req.Body, maxRaftMessageSize)
+
+	switch path {
+	case "apply":
+		var cmd raftCommand
+		if err := json.NewDecoder(body).Decode(&cmd); err != nil {
+			http.Error(rw, "invalid command", http.StatusBadRequest)
+			return
+		}
+
+		res, err := s.apply(req.Context(), cmd)
+		if err != nil && res.Error == "" {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(res)
+	case "join":
+		var join raftJoinRequest
+		if err := json.NewDecoder(body).Decode(&join); err != nil || join.ID == "" || join.Address == "" {
+			http.Error(rw, "invalid join request", http.StatusBadRequest)
+			return
+		}
+
+		if err := s.Join(req.Context(), join.ID, join.Address); err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		rw.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(rw, req)
+	}
+}
+
+// apply replicates the command through the leader. The returned result
+// carries the storage errors, e.g. AlreadyExistsError.
+func (s *RaftStorage) apply(ctx context.Context, cmd raftCommand) (raftResult, error) {
+	var res raftResult
+
+	if !s.IsLeader() {
+		body, err := json.Marshal(cmd)
+		if err != nil {
+			return res, err
+		}
+		if err := s.forward(ctx, "apply", body, &res); err != nil {
+			return res, err
+		}
+
+		return res, resultError(res)
+	}
+
+	cmd.Now = time.Now().UnixNano()
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return res, err
+	}
+
+	f := s.raft.Apply(data, raftApplyTimeout)
+	if err := f.Error(); err != nil {
+		return res, err
+	}
+
+	res = f.Response().(raftResult)
+
+	return res, resultError(res)
+}
+
+func (s *RaftStorage) forward(ctx context.Context, path string, body []byte, out any) error {
+	leader := s.Leader()
+	if leader == "" {
+		return NoLeaderError
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, leader+RaftPath+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(raftForwardedHeader, s.opts.ID)
+	tracing.Inject(ctx, req.Header)
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to forward to leader: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1<<10))
+		return fmt.Errorf("leader returned status %d: %s", res.StatusCode, bytes.TrimSpace(msg))
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+func resultError(res raftResult) error {
+	switch res.Error {
+	case "":
+		return nil
+	case NotFoundError.Error():
+		return NotFoundError
+	case AlreadyExistsError.Error():
+		return AlreadyExistsError
+	case VersionMismatchError.Error():
+		return VersionMismatchError
+	default:
+		return errors.New(res.Error)
+	}
+}
+
+type raftEntry struct {
+	Data      []byte `json:"data"`
+	Version   uint64 `json:"version"`
+	ExpiresAt int64  `json:"expires_at,omitempty"`
+}
+
+func (e raftEntry) expired(now int64) bool {
+	return e.ExpiresAt > 0 && now >= e.ExpiresAt
+}
+
+// raftFSM is the replicated state machine holding the packed keys and
+// entries.
+type raftFSM struct {
+	mu      sync.RWMutex
+	entries map[string]raftEntry
+}
+
+func (f *raftFSM) get(name string) (raftEntry, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	e, ok := f.entries[name]
+	return e, ok
+}
+
+// list returns the sorted names of the keys alive at now.
+func (f *raftFSM) list(now int64) []string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	names := []string{}
+	for name, e := range f.entries {
+		if !e.expired(now) && !isEntry(e.Data) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	return names
+}
+
+func (f *raftFSM) Apply(log *raft.Log) any {
+	var cmd raftCommand
+	if err := json.Unmarshal(log.Data, &cmd); err != nil {
+		return raftResult{Error: fmt.Sprintf("invalid command: %v", err)}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	current, exists := f.entries[cmd.Name]
+	if exists && current.expired(cmd.Now) {
+		exists = false
+	}
+
+	var version uint64
+	switch cmd.Op {
+	case opPut:
+		version = 1
+		if exists {
+			version = current.Version + 1
+		}
+	case opCreate:
+		if exists {
+			return raftResult{Error: AlreadyExistsError.Error()}
+		}
+		version = 1
+	case opCAS:
+		if !exists {
+			return raftResult{Error: NotFoundError.Error()}
+		}
+		if current.Version != cmd.Version {
+			return raftResult{Error: VersionMismatchError.Error()}
+		}
+		version = cmd.Version + 1
+	case opDelete:
+		delete(f.entries, cmd.Name)
+		return raftResult{}
+	case opExpire:
+		var res raftResult
+		for name, e := range f.entries {
+			if e.expired(cmd.Now) {
+				delete(f.entries, name)
+				if !isEntry(e.Data) {
+					res.Expired++
+				}
+			}
+		}
+		return res
+	default:
+		return raftResult{Error: fmt.Sprintf("unknown command: %s", cmd.Op)}
+	}
+
+	r, err := unpack(cmd.Data)
+	if err != nil {
+		return raftResult{Error: err.Error()}
+	}
+	r.SetVersion(version)
+
+	entry := raftEntry{Data: r.Pack(), Version: version}
+	if r.GetTTL() > 0 {
+		entry.ExpiresAt = r.GetCreatedAt().Add(r.GetTTL()).UnixNano()
+	}
+	f.entries[cmd.Name] = entry
+
+	return raftResult{Version: version}
+}
+
+func (f *raftFSM) Snapshot() (raft.FSMSnapshot, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	data, err := json.Marshal(f.entries)
+	if err != nil {
+		return nil, err
+	}
+
+	return raftSnapshot(data), nil
+}
+
+func (f *raftFSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+
+	entries := make(map[string]raftEntry)
+	if err := json.NewDecoder(rc).Decode(&entries); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	f.entries = entries
+	f.mu.Unlock()
+
+	return nil
+}
+
+// tlsStreamLayer is a raft.StreamLayer over mutual TLS.
+type tlsStreamLayer struct {
+	net.Listener
+	advertise net.Addr
+	config    *tls.Config
+}
+
+func newTLSStreamLayer(bind string, advertise *net.TCPAddr, config *tls.Config) (*tlsStreamLayer, error) {
+	if advertise.IP == nil || advertise.IP.IsUnspecified() {
+		return nil, fmt.Errorf("raft address %s is not advertisable", advertise)
+	}
+
+	l, err := tls.Listen("tcp", bind, config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tlsStreamLayer{Listener: l, advertise: advertise, config: config}, nil
+}
+
+func (l *tlsStreamLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	config := l.config.Clone()
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(string(address))
+		if err != nil {
+			return nil, err
+		}
+		config.ServerName = host
+	}
+
+	return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", string(address), config)
+}
+
+func (l *tlsStreamLayer) Addr() net.Addr {
+	return l.advertise
+}
+
+type raftSnapshot []byte
+
+func (s raftSnapshot) Persist(sink raft.SnapshotSink) error {
+	if _, err := sink.Write(s); err != nil {
+		sink.Cancel()
+		return err
+	}
+
+	return sink.Close()
+}
+
+func (s raftSnapshot) Release() {}
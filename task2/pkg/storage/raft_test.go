@@ -0,0 +1,435 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"enclave-task2/pkg/cluster"
+	"enclave-task2/pkg/cluster/clustertest"
+	"enclave-task2/pkg/keys"
+	"enclave-task2/pkg/keys/kyber"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	"github.com/tj/assert"
+)
+
+type raftTestNode struct {
+	storage *RaftStorage
+	server  *httptest.Server
+	addr    string
+	dir     string
+	tls     *tls.Config
+	handler atomic.Value
+}
+
+func raftTestConfig() *raft.Config {
+	c := raft.DefaultConfig()
+	c.HeartbeatTimeout = 200 * time.Millisecond
+	c.ElectionTimeout = 200 * time.Millisecond
+	c.LeaderLeaseTimeout = 100 * time.Millisecond
+	c.CommitTimeout = 5 * time.Millisecond
+	c.Logger = hclog.NewNullLogger()
+
+	return c
+}
+
+func freeRaftAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+
+	return l.Addr().String()
+}
+
+// newRaftTestNode starts the peer listener of a node, its url is the raft
+// id of the node. The peer listener and the raft transport use mTLS when
+// peerTLS is set.
+func newRaftTestNode(t *testing.T, peerTLS *cluster.PeerTLS) *raftTestNode {
+	n := &raftTestNode{addr: freeRaftAddr(t), dir: t.TempDir()}
+	n.server = httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		h, ok := n.handler.Load().(http.Handler)
+		if !ok {
+			http.Error(rw, "not started", http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(rw, req)
+	}))
+	if peerTLS != nil {
+		n.tls = peerTLS.Config()
+		n.server.TLS = peerTLS.Config()
+		n.server.StartTLS()
+	} else {
+		n.server.Start()
+	}
+
+	t.Cleanup(func() {
+		if n.storage != nil {
+			n.storage.Close()
+		}
+		n.server.Close()
+	})
+
+	return n
+}
+
+func (n *raftTestNode) start(t *testing.T, servers []RaftServer) {
+	var err error
+	n.storage, err = NewRaftStorage(RaftOptions{
+		ID:        n.server.URL,
+		BindAddr:  n.addr,
+		Servers:   servers,
+		DataDir:   n.dir,
+		Config:    raftTestConfig(),
+		TLSConfig: n.tls,
+	})
+	assert.NoError(t, err)
+	n.handler.Store(n.storage)
+}
+
+func startRaftCluster(t *testing.T, size int, peerTLS ...*cluster.PeerTLS) []*raftTestNode {
+	var nodes []*raftTestNode
+	var servers []RaftServer
+	for i := 0; i < size; i++ {
+		var nodeTLS *cluster.PeerTLS
+		if i < len(peerTLS) {
+			nodeTLS = peerTLS[i]
+		}
+		n := newRaftTestNode(t, nodeTLS)
+		nodes = append(nodes, n)
+		servers = append(servers, RaftServer{ID: n.server.URL, Address: n.addr})
+	}
+
+	for _, n := range nodes {
+		n.start(t, servers)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, n := range nodes {
+		assert.NoError(t, n.storage.WaitForLeader(ctx))
+	}
+
+	return nodes
+}
+
+func raftFollower(nodes []*raftTestNode) *raftTestNode {
+	for _, n := range nodes {
+		if !n.storage.IsLeader() {
+			return n
+		}
+	}
+	return nil
+}
+
+func raftLeader(nodes []*raftTestNode) *raftTestNode {
+	for _, n := range nodes {
+		if n.storage.IsLeader() {
+			return n
+		}
+	}
+	return nil
+}
+
+func TestRaftStorage(t *testing.T) {
+	ctx := context.Background()
+	nodes := startRaftCluster(t, 3)
+	follower := raftFollower(nodes)
+
+	key, err := keys.New(ctx, "kyber", "512", "raft-key", 10*time.Minute)
+	assert.NoError(t, err)
+
+	// writes on a follower are forwarded to the leader
+	err = follower.storage.Create(ctx, key)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), key.GetVersion())
+
+	err = follower.storage.Create(ctx, key)
+	assert.Equal(t, AlreadyExistsError, err)
+
+	// replicated on every node
+	for _, n := range nodes {
+		assert.Eventually(t, func() bool {
+			k, err := n.storage.Get(ctx, "raft-key")
+			return err == nil && k.GetVersion() == 1
+		}, 2*time.Second, 5*time.Millisecond)
+	}
+
+	// compare and swap
+	key.SetTTL(20 * time.Minute)
+	err = follower.storage.CompareAndSwap(ctx, key, 0)
+	assert.Equal(t, VersionMismatchError, err)
+
+	err = follower.storage.CompareAndSwap(ctx, key, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), key.GetVersion())
+
+	err = follower.storage.Put(ctx, key)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), key.GetVersion())
+
+	leader := raftLeader(nodes)
+	k, err := leader.storage.Get(ctx, "raft-key")
+	assert.NoError(t, err)
+	assert.Equal(t, 20*time.Minute, k.GetTTL())
+	assert.Equal(t, uint64(3), k.GetVersion())
+
+	plaintext := []byte("Hello, World!")
+	assert.Equal(t, plaintext, k.Decrypt(key.Encrypt(plaintext)))
+
+	missing, err := keys.New(ctx, "kyber", "512", "raft-missing-key", 10*time.Minute)
+	assert.NoError(t, err)
+	err = follower.storage.CompareAndSwap(ctx, missing, 1)
+	assert.Equal(t, NotFoundError, err)
+
+	// delete
+	err = follower.storage.Delete(ctx, "raft-key")
+	assert.NoError(t, err)
+	for _, n := range nodes {
+		assert.Eventually(t, func() bool {
+			_, err := n.storage.Get(ctx, "raft-key")
+			return err == NotFoundError
+		}, 2*time.Second, 5*time.Millisecond)
+	}
+
+	// concurrent creates from every node, exactly one wins
+	var wg sync.WaitGroup
+	var created atomic.Int32
+	for _, n := range nodes {
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				k, err := keys.New(ctx, "kyber", "512", "raft-concurrent-key", 10*time.Minute)
+				assert.NoError(t, err)
+
+				if err := n.storage.Create(ctx, k); err == nil {
+					created.Add(1)
+				} else {
+					assert.Equal(t, AlreadyExistsError, err)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), created.Load())
+}
+
+func TestRaftStorageExpiry(t *testing.T) {
+	ctx := context.Background()
+	nodes := startRaftCluster(t, 3)
+	leader := raftLeader(nodes)
+
+	key, err := kyber.NewKyberKey(ctx, "raft-expired-key", "512", time.Second)
+	assert.NoError(t, err)
+	key.CreatedAt = time.Now().Add(-time.Minute)
+
+	err = leader.storage.Put(ctx, key)
+	assert.NoError(t, err)
+
+	_, err = leader.storage.Get(ctx, "raft-expired-key")
+	assert.Equal(t, NotFoundError, err)
+
+	// an expired key does not block the name
+	live, err := keys.New(ctx, "kyber", "512", "raft-expired-key", time.Minute)
+	assert.NoError(t, err)
+	err = leader.storage.Create(ctx, live)
+	assert.NoError(t, err)
+
+	key.Name = "raft-swept-key"
+	err = leader.storage.Put(ctx, key)
+	assert.NoError(t, err)
+
+	res, err := leader.storage.apply(ctx, raftCommand{Op: opExpire})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, res.Expired)
+	_, ok := leader.storage.fsm.get("raft-swept-key")
+	assert.False(t, ok)
+	_, ok = leader.storage.fsm.get("raft-expired-key")
+	assert.True(t, ok)
+}
+
+func TestRaftStorageFailover(t *testing.T) {
+	ctx := context.Background()
+	nodes := startRaftCluster(t, 3)
+
+	key, err := keys.New(ctx, "kyber", "512", "raft-failover-key", 10*time.Minute)
+	assert.NoError(t, err)
+	assert.NoError(t, raftFollower(nodes).storage.Create(ctx, key))
+
+	// stop the leader, the others elect a new one
+	old := raftLeader(nodes)
+	old.storage.Close()
+	old.server.Close()
+
+	var alive []*raftTestNode
+	for _, n := range nodes {
+		if n != old {
+			alive = append(alive, n)
+		}
+	}
+	assert.Eventually(t, func() bool {
+		l := raftLeader(alive)
+		return l != nil && l.storage.Leader() == l.server.URL
+	}, 5*time.Second, 10*time.Millisecond)
+	for _, n := range alive {
+		assert.Eventually(t, func() bool {
+			l := n.storage.Leader()
+			return l != "" && l != old.server.URL
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+
+	var k keys.Key
+	assert.Eventually(t, func() bool {
+		k, err = alive[0].storage.Get(ctx, "raft-failover-key")
+		return err == nil
+	}, 2*time.Second, 5*time.Millisecond)
+
+	k.SetTTL(time.Hour)
+	err = raftFollower(alive).storage.CompareAndSwap(ctx, k, 1)
+	assert.NoError(t, err)
+}
+
+func TestRaftStorageRestart(t *testing.T) {
+	ctx := context.Background()
+	nodes := startRaftCluster(t, 3)
+
+	key, err := keys.New(ctx, "kyber", "512", "raft-restart-key", 10*time.Minute)
+	assert.NoError(t, err)
+	assert.NoError(t, raftLeader(nodes).storage.Create(ctx, key))
+
+	follower := raftFollower(nodes)
+	assert.Eventually(t, func() bool {
+		_, err := follower.storage.Get(ctx, "raft-restart-key")
+		return err == nil
+	}, 2*time.Second, 5*time.Millisecond)
+	term := follower.storage.raft.CurrentTerm()
+	assert.NoError(t, follower.storage.Close())
+
+	// the restarted node keeps its term and replays its log once the
+	// leader tells it the commit index
+	follower.start(t, nil)
+	assert.GreaterOrEqual(t, follower.storage.raft.CurrentTerm(), term)
+	assert.Eventually(t, func() bool {
+		_, err := follower.storage.Get(ctx, "raft-restart-key")
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestRaftStorageJoin(t *testing.T) {
+	ctx := context.Background()
+	nodes := startRaftCluster(t, 3)
+
+	key, err := keys.New(ctx, "kyber", "512", "raft-join-key", 10*time.Minute)
+	assert.NoError(t, err)
+	assert.NoError(t, raftLeader(nodes).storage.Create(ctx, key))
+
+	// a node started without servers joins through a follower
+	joiner := newRaftTestNode(t, nil)
+	joiner.start(t, nil)
+	err = raftFollower(nodes).storage.Join(ctx, joiner.server.URL, joiner.addr)
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		_, err := joiner.storage.Get(ctx, "raft-join-key")
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the new node forwards its writes to the leader
+	other, err := keys.New(ctx, "kyber", "512", "raft-joined-key", 10*time.Minute)
+	assert.NoError(t, err)
+	assert.NoError(t, joiner.storage.Create(ctx, other))
+}
+
+func TestRaftStorageTLS(t *testing.T) {
+	ctx := context.Background()
+	ca := clustertest.NewCA(t)
+	nodes := startRaftCluster(t, 3, ca.PeerTLS(t), ca.PeerTLS(t), ca.PeerTLS(t))
+	assert.True(t, strings.HasPrefix(nodes[0].server.URL, "https://"))
+
+	key, err := keys.New(ctx, "kyber", "512", "raft-tls-key", 10*time.Minute)
+	assert.NoError(t, err)
+	assert.NoError(t, raftFollower(nodes).storage.Create(ctx, key))
+
+	for _, n := range nodes {
+		assert.Eventually(t, func() bool {
+			_, err := n.storage.Get(ctx, "raft-tls-key")
+			return err == nil
+		}, 2*time.Second, 5*time.Millisecond)
+	}
+
+	// the raft transport refuses peers without a certificate of the CA
+	conn, err := tls.Dial("tcp", nodes[0].addr, clustertest.NewCA(t).PeerTLS(t).Config())
+	if err == nil {
+		conn.Close()
+	}
+	assert.Error(t, err)
+}
+
+func TestRaftStorageServeHTTP(t *testing.T) {
+	nodes := startRaftCluster(t, 1)
+	s := nodes[0].storage
+
+	rw := httptest.NewRecorder()
+	s.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, RaftPath+"apply", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rw.Code)
+
+	rw = httptest.NewRecorder()
+	s.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, RaftPath+"apply", bytes.NewReader([]byte("{"))))
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+
+	rw = httptest.NewRecorder()
+	s.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, RaftPath+"join", bytes.NewReader([]byte("{}"))))
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+
+	rw = httptest.NewRecorder()
+	s.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, RaftPath+"unknown", nil))
+	assert.Equal(t, http.StatusNotFound, rw.Code)
+
+	rw = httptest.NewRecorder()
+	s.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, RaftPath+"apply", bytes.NewReader([]byte(`{"op":"bogus"}`))))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	body, _ := io.ReadAll(rw.Body)
+	assert.Contains(t, string(body), "unknown command")
+
+	_, err := NewRaftStorage(RaftOptions{})
+	assert.Error(t, err)
+}
+
+func TestRaftFSMSnapshot(t *testing.T) {
+	ctx := context.Background()
+	fsm := &raftFSM{entries: make(map[string]raftEntry)}
+
+	key, err := keys.New(ctx, "kyber", "512", "snapshot-key", 10*time.Minute)
+	assert.NoError(t, err)
+	data, err := json.Marshal(raftCommand{Op: opCreate, Name: "snapshot-key", Data: key.Pack(), Now: time.Now().UnixNano()})
+	assert.NoError(t, err)
+
+	res := fsm.Apply(&raft.Log{Data: data}).(raftResult)
+	assert.Equal(t, uint64(1), res.Version)
+
+	snapshot, err := fsm.Snapshot()
+	assert.NoError(t, err)
+
+	restored := &raftFSM{}
+	err = restored.Restore(io.NopCloser(bytes.NewReader(snapshot.(raftSnapshot))))
+	assert.NoError(t, err)
+
+	entry, ok := restored.get("snapshot-key")
+	assert.True(t, ok)
+	assert.Equal(t, uint64(1), entry.Version)
+
+	k, err := keys.Unpack(entry.Data)
+	assert.NoError(t, err)
+	assert.Equal(t, "snapshot-key", k.GetName())
+}
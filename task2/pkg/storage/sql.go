@@ -0,0 +1,536 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"enclave-task2/pkg/keys"
+	"enclave-task2/pkg/metrics"
+	"enclave-task2/pkg/tracing"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	_ "modernc.org/sqlite" // registers the "sqlite" driver
+)
+
+const (
+	DialectSQLite   = "sqlite"
+	DialectPostgres = "postgres"
+
+	// key events recorded in the key_events table
+	EventCreated = "created"
+	EventUpdated = "updated"
+	EventDeleted = "deleted"
+	EventExpired = "expired"
+)
+
+// migrations are applied in order, the index+1 being the schema version.
+var migrations = map[string][]string{
+	DialectSQLite: {
+		`CREATE TABLE IF NOT EXISTS keys (
+			name       TEXT PRIMARY KEY,
+			key_type   TEXT NOT NULL,
+			key_size   TEXT NOT NULL,
+			data       BLOB NOT NULL,
+			created_at BIGINT NOT NULL,
+			updated_at BIGINT NOT NULL,
+			expires_at BIGINT
+		)`,
+		`CREATE INDEX IF NOT EXISTS keys_expires_at_idx ON keys (expires_at)`,
+		`CREATE TABLE IF NOT EXISTS key_events (
+			id          INTEGER PRIMARY KEY AUTOINCREMENT,
+			key_name    TEXT NOT NULL,
+			event       TEXT NOT NULL,
+			occurred_at BIGINT NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS key_events_key_name_idx ON key_events (key_name)`,
+		`ALTER TABLE keys ADD COLUMN version BIGINT NOT NULL DEFAULT 0`,
+	},
+	DialectPostgres: {
+		`CREATE TABLE IF NOT EXISTS keys (
+			name       TEXT PRIMARY KEY,
+			key_type   TEXT NOT NULL,
+			key_size   TEXT NOT NULL,
+			data       BYTEA NOT NULL,
+			created_at BIGINT NOT NULL,
+			updated_at BIGINT NOT NULL,
+			expires_at BIGINT
+		)`,
+		`CREATE INDEX IF NOT EXISTS keys_expires_at_idx ON keys (expires_at)`,
+		`CREATE TABLE IF NOT EXISTS key_events (
+			id          BIGSERIAL PRIMARY KEY,
+			key_name    TEXT NOT NULL,
+			event       TEXT NOT NULL,
+			occurred_at BIGINT NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS key_events_key_name_idx ON key_events (key_name)`,
+		`ALTER TABLE keys ADD COLUMN version BIGINT NOT NULL DEFAULT 0`,
+	},
+}
+
+// KeyEvent is a single audit metadata entry of the key_events table.
+type KeyEvent struct {
+	KeyName    string
+	Event      string
+	OccurredAt time.Time
+}
+
+// SQLStorage stores keys in a relational database through database/sql.
+// SQLite and Postgres are supported, the "pgx" driver for Postgres has to
+// be registered by the caller by importing github.com/jackc/pgx/v5/stdlib.
+type SQLStorage struct {
+	db      *sql.DB
+	dialect string
+
+	sweepInterval time.Duration
+}
+
+// NewSQLStorage opens the database and applies the pending migrations.
+func NewSQLStorage(ctx context.Context, dialect, dsn string) (*SQLStorage, error) {
+	driver := dialect
+	switch dialect {
+	case DialectSQLite:
+	case DialectPostgres:
+		driver = "pgx"
+	default:
+		return nil, fmt.Errorf("unsupported sql dialect: %s", dialect)
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	if dialect == DialectSQLite {
+		// sqlite allows a single writer, serialize access instead of
+		// failing with SQLITE_BUSY
+		db.SetMaxOpenConns(1)
+	}
+
+	s := &SQLStorage{
+		db:            db,
+		dialect:       dialect,
+		sweepInterval: time.Minute,
+	}
+
+	if err := s.Migrate(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Migrate applies the migrations that were not applied yet.
+func (s *SQLStorage) Migrate(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at BIGINT NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	var current int
+	row := s.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`)
+	if err := row.Scan(&current); err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	for i, stmt := range migrations[s.dialect] {
+		version := i + 1
+		if version <= current {
+			continue
+		}
+
+		err := s.inTx(ctx, func(tx *sql.Tx) error {
+			if _, err := tx.ExecContext(ctx, stmt); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`),
+				version, time.Now().UnixNano())
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to apply migration %d: %w", version, err)
+		}
+	}
+
+	return nil
+}
+
+// Close closes the underlying database.
+func (s *SQLStorage) Close() error {
+	return s.db.Close()
+}
+
+// Put stores the key unconditionally and bumps its version.
+func (s *SQLStorage) Put(ctx context.Context, key keys.Key) error {
+	return s.put(ctx, key)
+}
+
+// PutEntry stores the entry unconditionally and bumps its version.
+func (s *SQLStorage) PutEntry(ctx context.Context, entry *Entry) error {
+	return s.put(ctx, entry)
+}
+
+// Create stores the key with version 1 only if no live key with the same
+// name exists, otherwise AlreadyExistsError is returned.
+func (s *SQLStorage) Create(ctx context.Context, key keys.Key) error {
+	return s.create(ctx, key)
+}
+
+// CreateEntry stores the entry like Create.
+func (s *SQLStorage) CreateEntry(ctx context.Context, entry *Entry) error {
+	return s.create(ctx, entry)
+}
+
+// CompareAndSwap replaces the stored key only if its version is still the
+// given one. On success the version of the key is incremented.
+func (s *SQLStorage) CompareAndSwap(ctx context.Context, key keys.Key, version uint64) error {
+	return s.compareAndSwap(ctx, key, version)
+}
+
+// CompareAndSwapEntry replaces the stored entry like CompareAndSwap.
+func (s *SQLStorage) CompareAndSwapEntry(ctx context.Context, entry *Entry, version uint64) error {
+	return s.compareAndSwap(ctx, entry, version)
+}
+
+func (s *SQLStorage) Get(ctx context.Context, keyName string) (keys.Key, error) {
+	return asKey(s.get(ctx, keyName))
+}
+
+// GetEntry returns the entry, NotFoundError if it does not exist, expired or
+// is a key.
+func (s *SQLStorage) GetEntry(ctx context.Context, name string) (*Entry, error) {
+	return asEntry(s.get(ctx, name))
+}
+
+func (s *SQLStorage) put(ctx context.Context, key record) error {
+	ctx, span := tracing.Start(ctx, "SQLStorage.Put", attribute.String("key.name", key.GetName()))
+	defer span.End()
+
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		now := time.Now().UnixNano()
+
+		// the upsert bumps the version and locks the row in one statement,
+		// a select for update takes no lock on a missing row in postgres
+		var version uint64
+		row := tx.QueryRowContext(ctx, s.rebind(`
+			INSERT INTO keys (name, key_type, key_size, data, created_at, updated_at, expires_at, version)
+			VALUES (?, ?, ?, ?, ?, ?, ?, 1)
+			ON CONFLICT (name) DO UPDATE SET version = keys.version + 1
+			RETURNING version`),
+			key.GetName(), key.GetType(), key.GetSize(), []byte{},
+			key.GetCreatedAt().UnixNano(), now, expiresAt(key),
+		)
+		if err := row.Scan(&version); err != nil {
+			return err
+		}
+		key.SetVersion(version)
+
+		// the packed data holds the version, it is written once it is known
+		_, err := tx.ExecContext(ctx, s.rebind(`
+			UPDATE keys SET key_type = ?, key_size = ?, data = ?, created_at = ?, updated_at = ?, expires_at = ?
+			WHERE name = ?`),
+			key.GetType(), key.GetSize(), key.Pack(),
+			key.GetCreatedAt().UnixNano(), now, expiresAt(key), key.GetName(),
+		)
+		if err != nil {
+			return err
+		}
+
+		return s.recordEvent(ctx, tx, key.GetName(), EventUpdated)
+	})
+}
+
+func (s *SQLStorage) create(ctx context.Context, key record) error {
+	ctx, span := tracing.Start(ctx, "SQLStorage.Create", attribute.String("key.name", key.GetName()))
+	defer span.End()
+
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		now := time.Now().UnixNano()
+
+		// an expired key does not block the name
+		res, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM keys WHERE name = ? AND expires_at IS NOT NULL AND expires_at <= ?`),
+			key.GetName(), now)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			if err := s.recordEvent(ctx, tx, key.GetName(), EventExpired); err != nil {
+				return err
+			}
+		}
+
+		key.SetVersion(1)
+		res, err = tx.ExecContext(ctx, s.rebind(`
+			INSERT INTO keys (name, key_type, key_size, data, created_at, updated_at, expires_at, version)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (name) DO NOTHING`),
+			key.GetName(), key.GetType(), key.GetSize(), key.Pack(),
+			key.GetCreatedAt().UnixNano(), now, expiresAt(key), key.GetVersion(),
+		)
+		if err != nil {
+			return err
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return AlreadyExistsError
+		}
+
+		return s.recordEvent(ctx, tx, key.GetName(), EventCreated)
+	})
+}
+
+func (s *SQLStorage) compareAndSwap(ctx context.Context, key record, version uint64) error {
+	ctx, span := tracing.Start(ctx, "SQLStorage.CompareAndSwap", attribute.String("key.name", key.GetName()))
+	defer span.End()
+
+	previous := key.GetVersion()
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		now := time.Now().UnixNano()
+
+		key.SetVersion(version + 1)
+		res, err := tx.ExecContext(ctx, s.rebind(`
+			UPDATE keys SET
+				key_type = ?, key_size = ?, data = ?, created_at = ?, updated_at = ?, expires_at = ?, version = ?
+			WHERE name = ? AND version = ? AND (expires_at IS NULL OR expires_at > ?)`),
+			key.GetType(), key.GetSize(), key.Pack(), key.GetCreatedAt().UnixNano(), now, expiresAt(key), key.GetVersion(),
+			key.GetName(), version, now,
+		)
+		if err != nil {
+			return err
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			var current int64
+			row := tx.QueryRowContext(ctx, s.rebind(`SELECT version FROM keys WHERE name = ? AND (expires_at IS NULL OR expires_at > ?)`), key.GetName(), now)
+			if err := row.Scan(&current); err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					return NotFoundError
+				}
+				return err
+			}
+			return VersionMismatchError
+		}
+
+		return s.recordEvent(ctx, tx, key.GetName(), EventUpdated)
+	})
+	if err != nil {
+		key.SetVersion(previous)
+	}
+
+	return err
+}
+
+func (s *SQLStorage) get(ctx context.Context, keyName string) (record, error) {
+	ctx, span := tracing.Start(ctx, "SQLStorage.Get", attribute.String("key.name", keyName))
+	defer span.End()
+
+	var data []byte
+	var expires sql.NullInt64
+
+	row := s.db.QueryRowContext(ctx, s.rebind(`SELECT data, expires_at FROM keys WHERE name = ?`), keyName)
+	if err := row.Scan(&data, &expires); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, NotFoundError
+		}
+		return nil, err
+	}
+
+	// check if key is expired, the sweeper removes it later
+	if expires.Valid && time.Now().UnixNano() >= expires.Int64 {
+		return nil, NotFoundError
+	}
+
+	return unpack(data)
+}
+
+func (s *SQLStorage) Delete(ctx context.Context, keyName string) error {
+	ctx, span := tracing.Start(ctx, "SQLStorage.Delete", attribute.String("key.name", keyName))
+	defer span.End()
+
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM keys WHERE name = ?`), keyName)
+		if err != nil {
+			return err
+		}
+
+		if n, _ := res.RowsAffected(); n == 0 {
+			return nil
+		}
+
+		return s.recordEvent(ctx, tx, keyName, EventDeleted)
+	})
+}
+
+// List returns the sorted names of the live keys, the entries are not
+// listed.
+func (s *SQLStorage) List(ctx context.Context) ([]string, error) {
+	ctx, span := tracing.Start(ctx, "SQLStorage.List")
+	defer span.End()
+
+	rows, err := s.db.QueryContext(ctx, s.rebind(`SELECT name FROM keys WHERE key_type <> ? AND (expires_at IS NULL OR expires_at > ?) ORDER BY name`),
+		EntryType, time.Now().UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+
+	return names, rows.Err()
+}
+
+// Events returns the audit metadata of a key ordered from oldest to newest.
+func (s *SQLStorage) Events(ctx context.Context, keyName string) ([]KeyEvent, error) {
+	rows, err := s.db.QueryContext(ctx, s.rebind(`SELECT key_name, event, occurred_at FROM key_events WHERE key_name = ? ORDER BY id`), keyName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []KeyEvent
+	for rows.Next() {
+		var e KeyEvent
+		var at int64
+		if err := rows.Scan(&e.KeyName, &e.Event, &at); err != nil {
+			return nil, err
+		}
+		e.OccurredAt = time.Unix(0, at)
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
+
+// Sweep deletes the expired keys and entries and returns how many were
+// removed, only the keys are counted by the expiration metric.
+func (s *SQLStorage) Sweep(ctx context.Context) (int, error) {
+	var removed, expiredKeys int
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		now := time.Now().UnixNano()
+
+		rows, err := tx.QueryContext(ctx, s.rebind(`SELECT name, key_type FROM keys WHERE expires_at IS NOT NULL AND expires_at <= ?`), now)
+		if err != nil {
+			return err
+		}
+		var names []string
+		for rows.Next() {
+			var name, keyType string
+			if err := rows.Scan(&name, &keyType); err != nil {
+				rows.Close()
+				return err
+			}
+			names = append(names, name)
+			if keyType != EntryType {
+				expiredKeys++
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			if _, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM keys WHERE name = ?`), name); err != nil {
+				return err
+			}
+			if err := s.recordEvent(ctx, tx, name, EventExpired); err != nil {
+				return err
+			}
+		}
+		removed = len(names)
+
+		return nil
+	})
+	if err == nil {
+		metrics.KeyExpirations.Add(float64(expiredKeys))
+	}
+
+	return removed, err
+}
+
+// CheckTTL periodically sweeps the expired keys until the context is done.
+func (s *SQLStorage) CheckTTL(ctx context.Context) {
+	t := time.NewTicker(s.sweepInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			s.Sweep(ctx)
+		}
+	}
+}
+
+func (s *SQLStorage) recordEvent(ctx context.Context, tx *sql.Tx, keyName, event string) error {
+	_, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO key_events (key_name, event, occurred_at) VALUES (?, ?, ?)`),
+		keyName, event, time.Now().UnixNano())
+	return err
+}
+
+func (s *SQLStorage) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// rebind replaces the ? placeholders with $n for postgres.
+func (s *SQLStorage) rebind(query string) string {
+	if s.dialect != DialectPostgres {
+		return query
+	}
+
+	var sb strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			sb.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		sb.WriteRune(r)
+	}
+
+	return sb.String()
+}
+
+// expiresAt returns the expiry of the key in unix nanoseconds or nil if the
+// key never expires.
+func expiresAt(key record) any {
+	if key.GetTTL() <= 0 {
+		return nil
+	}
+
+	return key.GetCreatedAt().Add(key.GetTTL()).UnixNano()
+}
@@ -0,0 +1,225 @@
+package storage
+
+import (
+	"context"
+	"enclave-task2/pkg/keys"
+	"enclave-task2/pkg/keys/kyber"
+	"enclave-task2/pkg/metrics"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/tj/assert"
+)
+
+func newTestSQLStorage(t *testing.T) *SQLStorage {
+	ctx := context.Background()
+	s, err := NewSQLStorage(ctx, DialectSQLite, filepath.Join(t.TempDir(), "keys.db"))
+	assert.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+
+	return s
+}
+
+func TestSQLStorage(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSQLStorage(t)
+
+	key, err := keys.New(ctx, "kyber", "1024", "test-key", 10*time.Minute)
+	assert.NoError(t, err)
+
+	// Test Put
+	err = s.Put(ctx, key)
+	assert.NoError(t, err)
+
+	// Test Get
+	actualKey, err := s.Get(ctx, key.GetName())
+	assert.NoError(t, err)
+	assert.Equal(t, key.GetName(), actualKey.GetName())
+	assert.Equal(t, key.GetTTL(), actualKey.GetTTL())
+	assert.Equal(t, key.GetCreatedAt().Unix(), actualKey.GetCreatedAt().Unix())
+
+	plaintext := []byte("Hello, World!")
+	assert.Equal(t, plaintext, actualKey.Decrypt(key.Encrypt(plaintext)))
+
+	// Test Put overrides and bumps the version
+	key.SetTTL(20 * time.Minute)
+	err = s.Put(ctx, key)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), key.GetVersion())
+
+	actualKey, err = s.Get(ctx, key.GetName())
+	assert.NoError(t, err)
+	assert.Equal(t, 20*time.Minute, actualKey.GetTTL())
+
+	// Test Delete
+	err = s.Delete(ctx, key.GetName())
+	assert.NoError(t, err)
+
+	_, err = s.Get(ctx, key.GetName())
+	assert.Equal(t, NotFoundError, err)
+
+	// idempotent delete
+	err = s.Delete(ctx, key.GetName())
+	assert.NoError(t, err)
+
+	events, err := s.Events(ctx, key.GetName())
+	assert.NoError(t, err)
+	assert.Len(t, events, 3)
+	assert.Equal(t, EventUpdated, events[0].Event)
+	assert.Equal(t, EventUpdated, events[1].Event)
+	assert.Equal(t, EventDeleted, events[2].Event)
+
+	// concurrent puts of a missing key each get their own version
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			k, err := keys.New(ctx, "kyber", "512", "put-key", 10*time.Minute)
+			assert.NoError(t, err)
+			assert.NoError(t, s.Put(ctx, k))
+		}()
+	}
+	wg.Wait()
+
+	actualKey, err = s.Get(ctx, "put-key")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(10), actualKey.GetVersion())
+}
+
+func TestSQLStorageCreate(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSQLStorage(t)
+
+	key, err := keys.New(ctx, "kyber", "1024", "create-key", 10*time.Minute)
+	assert.NoError(t, err)
+
+	err = s.Create(ctx, key)
+	assert.NoError(t, err)
+
+	err = s.Create(ctx, key)
+	assert.Equal(t, AlreadyExistsError, err)
+
+	// concurrent creates, exactly one wins
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	created := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			k, err := keys.New(ctx, "kyber", "512", "concurrent-key", 10*time.Minute)
+			assert.NoError(t, err)
+
+			if err := s.Create(ctx, k); err == nil {
+				mu.Lock()
+				created++
+				mu.Unlock()
+			} else {
+				assert.Equal(t, AlreadyExistsError, err)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, created)
+
+	// an expired key does not block the name
+	expired, err := kyber.NewKyberKey(ctx, "expired-key", "1024", time.Second)
+	assert.NoError(t, err)
+	expired.CreatedAt = time.Now().Add(-time.Minute)
+	err = s.Create(ctx, expired)
+	assert.NoError(t, err)
+
+	key, err = keys.New(ctx, "kyber", "1024", "expired-key", 10*time.Minute)
+	assert.NoError(t, err)
+	err = s.Create(ctx, key)
+	assert.NoError(t, err)
+
+	// stale version is rejected
+	key.SetTTL(20 * time.Minute)
+	err = s.CompareAndSwap(ctx, key, 0)
+	assert.Equal(t, VersionMismatchError, err)
+	assert.Equal(t, uint64(1), key.GetVersion())
+
+	err = s.CompareAndSwap(ctx, key, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), key.GetVersion())
+
+	actualKey, err := s.Get(ctx, "expired-key")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), actualKey.GetVersion())
+	assert.Equal(t, 20*time.Minute, actualKey.GetTTL())
+
+	// missing key
+	missing, err := keys.New(ctx, "kyber", "512", "missing-key", 10*time.Minute)
+	assert.NoError(t, err)
+	err = s.CompareAndSwap(ctx, missing, 1)
+	assert.Equal(t, NotFoundError, err)
+
+	events, err := s.Events(ctx, "expired-key")
+	assert.NoError(t, err)
+	assert.Len(t, events, 4)
+	assert.Equal(t, EventCreated, events[0].Event)
+	assert.Equal(t, EventExpired, events[1].Event)
+	assert.Equal(t, EventCreated, events[2].Event)
+	assert.Equal(t, EventUpdated, events[3].Event)
+}
+
+func TestSQLStorageSweep(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSQLStorage(t)
+
+	expired, err := kyber.NewKyberKey(ctx, "sweep-expired", "512", time.Second)
+	assert.NoError(t, err)
+	expired.CreatedAt = time.Now().Add(-time.Minute)
+	assert.NoError(t, s.Put(ctx, expired))
+
+	live, err := keys.New(ctx, "kyber", "512", "sweep-live", time.Hour)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Put(ctx, live))
+
+	forever, err := keys.New(ctx, "kyber", "512", "sweep-forever", 0)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Put(ctx, forever))
+
+	entry := NewEntry("sweep-entry", time.Second)
+	entry.CreatedAt = time.Now().Add(-time.Minute)
+	assert.NoError(t, s.PutEntry(ctx, entry))
+
+	// expired keys are hidden before being swept
+	_, err = s.Get(ctx, "sweep-expired")
+	assert.Equal(t, NotFoundError, err)
+
+	// the entries are removed but not counted as expired keys
+	expirations := testutil.ToFloat64(metrics.KeyExpirations)
+	removed, err := s.Sweep(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, removed)
+	assert.Equal(t, expirations+1, testutil.ToFloat64(metrics.KeyExpirations))
+
+	_, err = s.Get(ctx, "sweep-live")
+	assert.NoError(t, err)
+	_, err = s.Get(ctx, "sweep-forever")
+	assert.NoError(t, err)
+}
+
+func TestSQLStorageMigrate(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSQLStorage(t)
+
+	// migrations are idempotent
+	assert.NoError(t, s.Migrate(ctx))
+
+	var version int
+	err := s.db.QueryRowContext(ctx, `SELECT MAX(version) FROM schema_migrations`).Scan(&version)
+	assert.NoError(t, err)
+	assert.Equal(t, len(migrations[DialectSQLite]), version)
+
+	_, err = NewSQLStorage(ctx, "oracle", "")
+	assert.Error(t, err)
+
+	assert.Equal(t, "SELECT a FROM b WHERE c = $1 AND d = $2", (&SQLStorage{dialect: DialectPostgres}).rebind("SELECT a FROM b WHERE c = ? AND d = ?"))
+}
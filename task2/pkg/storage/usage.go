@@ -0,0 +1,234 @@
+package storage
+
+import (
+	"context"
+	"enclave-task2/pkg/keys"
+	"errors"
+	"time"
+)
+
+const (
+	usageEntryPrefix = "usage/"
+
+	// maxUsageAttempts bounds the compare-and-swap retries of a counter
+	// update.
+	maxUsageAttempts = 50
+)
+
+// UsageLimitError is returned when the key reached its max encryptions, it
+// must be rotated.
+var UsageLimitError = errors.New("key usage limit reached")
+
+// Operation is an operation counted by the UsageTracker.
+type Operation int
+
+const (
+	OpEncrypt Operation = iota
+	OpDecrypt
+)
+
+func (o Operation) String() string {
+	switch o {
+	case OpEncrypt:
+		return "encrypt"
+	case OpDecrypt:
+		return "decrypt"
+	default:
+		return "unknown"
+	}
+}
+
+// KeyStorage is implemented by the storages of this package.
+type KeyStorage interface {
+	Put(ctx context.Context, key keys.Key) error
+	Get(ctx context.Context, key string) (keys.Key, error)
+	Delete(ctx context.Context, key string) error
+	Create(ctx context.Context, key keys.Key) error
+	CompareAndSwap(ctx context.Context, key keys.Key, version uint64) error
+	List(ctx context.Context) ([]string, error)
+}
+
+// Usage holds the counters of a transit key.
+type Usage struct {
+	Encryptions    uint64    `json:"encryptions"`
+	Decryptions    uint64    `json:"decryptions"`
+	Errors         uint64    `json:"errors"`
+	BytesProcessed uint64    `json:"bytes_processed"`
+	LastUsed       time.Time `json:"last_used,omitzero"`
+	// MaxEncryptions is the number of encryptions after which the key must
+	// be rotated, zero is unlimited.
+	MaxEncryptions uint64 `json:"max_encryptions,omitempty"`
+}
+
+// UsageTracker counts the operations of the transit keys. The counters are
+// kept in an entry next to the key, they expire with the key and are reset
+// when a key is created again with the same name.
+type UsageTracker struct {
+	storage EntryStorage
+}
+
+func NewUsageTracker(storage EntryStorage) *UsageTracker {
+	return &UsageTracker{storage: storage}
+}
+
+// Init resets the counters of a new key, a zero maxEncryptions is
+// unlimited.
+func (u *UsageTracker) Init(ctx context.Context, key keys.Key, maxEncryptions uint64) error {
+	entry := usageEntry(key)
+	if err := entry.Encode(Usage{MaxEncryptions: maxEncryptions}); err != nil {
+		return err
+	}
+
+	return u.storage.PutEntry(ctx, entry)
+}
+
+// Use counts an operation processing n bytes. UsageLimitError is returned
+// without counting when the key reached its max encryptions, the
+// decryptions are always allowed so the data can be migrated to a new key.
+func (u *UsageTracker) Use(ctx context.Context, key keys.Key, op Operation, n int) error {
+	_, err := u.update(ctx, key, func(counters *Usage) error {
+		switch op {
+		case OpEncrypt:
+			if counters.MaxEncryptions > 0 && counters.Encryptions >= counters.MaxEncryptions {
+				return UsageLimitError
+			}
+			counters.Encryptions++
+		case OpDecrypt:
+			counters.Decryptions++
+		}
+		counters.BytesProcessed += uint64(n)
+		counters.LastUsed = time.Now()
+
+		return nil
+	})
+
+	return err
+}
+
+// Fail counts a failed operation.
+func (u *UsageTracker) Fail(ctx context.Context, key keys.Key) error {
+	_, err := u.update(ctx, key, func(counters *Usage) error {
+		counters.Errors++
+		return nil
+	})
+
+	return err
+}
+
+// SetMaxEncryptions sets the max encryptions of an existing key and aligns
+// the expiry of its counters, a zero maxEncryptions is unlimited. The
+// counters are kept, the key is refused at once if it is already above.
+func (u *UsageTracker) SetMaxEncryptions(ctx context.Context, key keys.Key, maxEncryptions uint64) error {
+	_, err := u.update(ctx, key, func(counters *Usage) error {
+		counters.MaxEncryptions = maxEncryptions
+		return nil
+	})
+
+	return err
+}
+
+// SetTTL aligns the expiry of the counters with the one of the key.
+func (u *UsageTracker) SetTTL(ctx context.Context, key keys.Key) error {
+	_, err := u.update(ctx, key, func(*Usage) error { return nil })
+	return err
+}
+
+// Usage returns the counters of the key.
+func (u *UsageTracker) Usage(ctx context.Context, key keys.Key) (*Usage, error) {
+	counters, err := u.get(ctx, key)
+	if err == NotFoundError {
+		return &Usage{}, nil
+	}
+
+	return counters, err
+}
+
+// Delete removes the counters of the key.
+func (u *UsageTracker) Delete(ctx context.Context, name string) error {
+	return u.storage.Delete(ctx, usageEntryName(name))
+}
+
+// get returns the counters of the key, NotFoundError if they belong to a
+// previous key with the same name.
+func (u *UsageTracker) get(ctx context.Context, key keys.Key) (*Usage, error) {
+	entry, err := u.storage.GetEntry(ctx, usageEntryName(key.GetName()))
+	if err != nil {
+		return nil, err
+	}
+	if !sameKey(entry, key) {
+		return nil, NotFoundError
+	}
+
+	var counters Usage
+	if err := entry.Decode(&counters); err != nil {
+		return nil, err
+	}
+
+	return &counters, nil
+}
+
+func (u *UsageTracker) update(ctx context.Context, key keys.Key, fn func(*Usage) error) (*Usage, error) {
+	for range maxUsageAttempts {
+		stored, err := u.storage.GetEntry(ctx, usageEntryName(key.GetName()))
+		if err != nil && err != NotFoundError {
+			return nil, err
+		}
+
+		var counters Usage
+		entry := stored
+		if entry == nil || !sameKey(entry, key) {
+			// counters of a previous key with the same name are reset
+			entry = usageEntry(key)
+			if stored != nil {
+				entry.Version = stored.Version
+			}
+		} else if err := entry.Decode(&counters); err != nil {
+			return nil, err
+		}
+
+		version := entry.Version
+		entry.TTL = key.GetTTL()
+		if err := fn(&counters); err != nil {
+			return nil, err
+		}
+		if err := entry.Encode(counters); err != nil {
+			return nil, err
+		}
+
+		if err == NotFoundError {
+			err = u.storage.CreateEntry(ctx, entry)
+		} else {
+			err = u.storage.CompareAndSwapEntry(ctx, entry, version)
+		}
+		if err == AlreadyExistsError || err == VersionMismatchError || err == NotFoundError {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return &counters, nil
+	}
+
+	return nil, VersionMismatchError
+}
+
+// usageEntry returns an entry of the counters of the key, it is created and
+// expires with the key.
+func usageEntry(key keys.Key) *Entry {
+	return &Entry{
+		Name:      usageEntryName(key.GetName()),
+		CreatedAt: key.GetCreatedAt(),
+		TTL:       key.GetTTL(),
+	}
+}
+
+// sameKey reports whether the counters belong to the key, the transit keys
+// are packed with their creation time truncated to the second.
+func sameKey(entry *Entry, key keys.Key) bool {
+	return entry.CreatedAt.Unix() == key.GetCreatedAt().Unix()
+}
+
+func usageEntryName(name string) string {
+	return usageEntryPrefix + name
+}
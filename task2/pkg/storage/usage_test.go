@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"context"
+	"enclave-task2/pkg/keys"
+	"enclave-task2/pkg/keys/kyber"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tj/assert"
+)
+
+func TestUsageTracker(t *testing.T) {
+	ctx := context.Background()
+	cache := NewNamedInMemoryCache("usage")
+	tracker := NewUsageTracker(cache)
+
+	key, err := keys.New(ctx, "kyber", "512", "usage-key", 10*time.Minute)
+	assert.NoError(t, err)
+	assert.NoError(t, cache.Create(ctx, key))
+
+	// keys created before the tracking have empty counters
+	counters, err := tracker.Usage(ctx, key)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), counters.Encryptions)
+	assert.True(t, counters.LastUsed.IsZero())
+
+	assert.NoError(t, tracker.Init(ctx, key, 3))
+	assert.NoError(t, tracker.Use(ctx, key, OpEncrypt, 10))
+	assert.NoError(t, tracker.Use(ctx, key, OpDecrypt, 20))
+	assert.NoError(t, tracker.Fail(ctx, key))
+
+	counters, err = tracker.Usage(ctx, key)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), counters.Encryptions)
+	assert.Equal(t, uint64(1), counters.Decryptions)
+	assert.Equal(t, uint64(1), counters.Errors)
+	assert.Equal(t, uint64(30), counters.BytesProcessed)
+	assert.Equal(t, uint64(3), counters.MaxEncryptions)
+	assert.WithinDuration(t, time.Now(), counters.LastUsed, time.Second)
+
+	entry, err := cache.GetEntry(ctx, usageEntryName("usage-key"))
+	assert.NoError(t, err)
+	assert.Equal(t, key.GetTTL(), entry.TTL)
+
+	// the limit applies to the encryptions only
+	assert.NoError(t, tracker.Use(ctx, key, OpEncrypt, 1))
+	assert.NoError(t, tracker.Use(ctx, key, OpEncrypt, 1))
+	assert.Equal(t, UsageLimitError, tracker.Use(ctx, key, OpEncrypt, 1))
+	assert.NoError(t, tracker.Use(ctx, key, OpDecrypt, 1))
+
+	counters, err = tracker.Usage(ctx, key)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), counters.Encryptions)
+
+	// the limit of an existing key can change
+	assert.NoError(t, tracker.SetMaxEncryptions(ctx, key, 4))
+	assert.NoError(t, tracker.Use(ctx, key, OpEncrypt, 1))
+	assert.Equal(t, UsageLimitError, tracker.Use(ctx, key, OpEncrypt, 1))
+	assert.NoError(t, tracker.SetMaxEncryptions(ctx, key, 0))
+	assert.NoError(t, tracker.Use(ctx, key, OpEncrypt, 1))
+
+	counters, err = tracker.Usage(ctx, key)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(5), counters.Encryptions)
+
+	// the counters follow the ttl of the key
+	key.SetTTL(time.Hour)
+	assert.NoError(t, tracker.SetTTL(ctx, key))
+	entry, err = cache.GetEntry(ctx, usageEntryName("usage-key"))
+	assert.NoError(t, err)
+	assert.Equal(t, time.Hour, entry.TTL)
+
+	// a new key with the same name starts from zero
+	recreated, err := keys.New(ctx, "kyber", "512", "usage-key", 10*time.Minute)
+	assert.NoError(t, err)
+	recreated.(*kyber.KyberKey).CreatedAt = key.GetCreatedAt().Add(time.Second)
+	assert.NoError(t, tracker.Use(ctx, recreated, OpEncrypt, 5))
+	counters, err = tracker.Usage(ctx, recreated)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), counters.Encryptions)
+	assert.Equal(t, uint64(0), counters.MaxEncryptions)
+
+	assert.NoError(t, tracker.Delete(ctx, "usage-key"))
+	counters, err = tracker.Usage(ctx, recreated)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), counters.Encryptions)
+}
+
+func TestUsageTrackerConcurrentLimit(t *testing.T) {
+	ctx := context.Background()
+	cache := NewNamedInMemoryCache("usage-concurrent")
+	tracker := NewUsageTracker(cache)
+
+	key, err := keys.New(ctx, "kyber", "512", "usage-concurrent-key", 10*time.Minute)
+	assert.NoError(t, err)
+	assert.NoError(t, tracker.Init(ctx, key, 5))
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	allowed := 0
+	for range 20 {
+		wg.Go(func() {
+			if err := tracker.Use(ctx, key, OpEncrypt, 1); err == nil {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		})
+	}
+	wg.Wait()
+
+	assert.Equal(t, 5, allowed)
+	counters, err := tracker.Usage(ctx, key)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(5), counters.Encryptions)
+}
@@ -0,0 +1,74 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestSetupWithoutEndpoint(t *testing.T) {
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+
+	shutdown, err := Setup(context.Background())
+	assert.NoError(t, err)
+	assert.NoError(t, shutdown(context.Background()))
+}
+
+func TestSetupWithEndpoint(t *testing.T) {
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://127.0.0.1:4318")
+	previous := otel.GetTracerProvider()
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	shutdown, err := Setup(context.Background())
+	assert.NoError(t, err)
+	_, ok := otel.GetTracerProvider().(*sdktrace.TracerProvider)
+	assert.True(t, ok)
+
+	// nothing was recorded, the shutdown does not reach the collector
+	assert.NoError(t, shutdown(context.Background()))
+}
+
+func TestSpans(t *testing.T) {
+	t.Setenv("OTEL_SERVICE_NAME", "enclave-test")
+	exporter := tracetest.NewInMemoryExporter()
+	provider, err := NewProvider(sdktrace.NewSimpleSpanProcessor(exporter))
+	assert.NoError(t, err)
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	ctx, parent := Start(context.Background(), "parent")
+	_, child := Start(ctx, "child", attribute.String("key.name", "payments"))
+	End(child, errors.New("boom"))
+	End(parent, nil)
+
+	spans := exporter.GetSpans()
+	assert.Len(t, spans, 2)
+	assert.Equal(t, "child", spans[0].Name)
+	assert.Equal(t, parent.SpanContext().SpanID(), spans[0].Parent.SpanID())
+	assert.Equal(t, codes.Error, spans[0].Status.Code)
+	assert.Contains(t, spans[0].Attributes, attribute.String("key.name", "payments"))
+	assert.Equal(t, codes.Unset, spans[1].Status.Code)
+
+	service, ok := spans[1].Resource.Set().Value("service.name")
+	assert.True(t, ok)
+	assert.Equal(t, "enclave-test", service.AsString())
+
+	// the trace context crosses the http requests
+	header := http.Header{}
+	Inject(ctx, header)
+	assert.NotEmpty(t, header.Get("traceparent"))
+	remote := trace.SpanContextFromContext(Extract(context.Background(), header))
+	assert.True(t, remote.IsRemote())
+	assert.Equal(t, parent.SpanContext().TraceID(), remote.TraceID())
+}
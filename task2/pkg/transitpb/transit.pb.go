@@ -0,0 +1,767 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.8
+// 	protoc        (unknown)
+// source: pkg/transitpb/transit.proto
+
+// The transit api over gRPC, it mirrors the /transit routes of the http api.
+// The callers authenticate with the "authorization: Bearer <token>" metadata
+// or their client certificate, like on the http api.
+
+package transitpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	durationpb "google.golang.org/protobuf/types/known/durationpb"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type CreateKeyRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Name  string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	// The defaults of the server are used when empty.
+	Type string               `protobuf:"bytes,2,opt,name=type,proto3" json:"type,omitempty"`
+	Size string               `protobuf:"bytes,3,opt,name=size,proto3" json:"size,omitempty"`
+	Ttl  *durationpb.Duration `protobuf:"bytes,4,opt,name=ttl,proto3" json:"ttl,omitempty"`
+	// Number of encryptions after which the key must be rotated, unlimited
+	// when 0.
+	MaxEncryptions uint64 `protobuf:"varint,5,opt,name=max_encryptions,json=maxEncryptions,proto3" json:"max_encryptions,omitempty"`
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
+}
+
+func (x *CreateKeyRequest) Reset() {
+	*x = CreateKeyRequest{}
+	mi := &file_pkg_transitpb_transit_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CreateKeyRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CreateKeyRequest) ProtoMessage() {}
+
+func (x *CreateKeyRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_transitpb_transit_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CreateKeyRequest.ProtoReflect.Descriptor instead.
+func (*CreateKeyRequest) Descriptor() ([]byte, []int) {
+	return file_pkg_transitpb_transit_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *CreateKeyRequest) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *CreateKeyRequest) GetType() string {
+	if x != nil {
+		return x.Type
+	}
+	return ""
+}
+
+func (x *CreateKeyRequest) GetSize() string {
+	if x != nil {
+		return x.Size
+	}
+	return ""
+}
+
+func (x *CreateKeyRequest) GetTtl() *durationpb.Duration {
+	if x != nil {
+		return x.Ttl
+	}
+	return nil
+}
+
+func (x *CreateKeyRequest) GetMaxEncryptions() uint64 {
+	if x != nil {
+		return x.MaxEncryptions
+	}
+	return 0
+}
+
+type CreateKeyResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CreateKeyResponse) Reset() {
+	*x = CreateKeyResponse{}
+	mi := &file_pkg_transitpb_transit_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CreateKeyResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CreateKeyResponse) ProtoMessage() {}
+
+func (x *CreateKeyResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_transitpb_transit_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CreateKeyResponse.ProtoReflect.Descriptor instead.
+func (*CreateKeyResponse) Descriptor() ([]byte, []int) {
+	return file_pkg_transitpb_transit_proto_rawDescGZIP(), []int{1}
+}
+
+type GetKeyRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Name          string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetKeyRequest) Reset() {
+	*x = GetKeyRequest{}
+	mi := &file_pkg_transitpb_transit_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetKeyRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetKeyRequest) ProtoMessage() {}
+
+func (x *GetKeyRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_transitpb_transit_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetKeyRequest.ProtoReflect.Descriptor instead.
+func (*GetKeyRequest) Descriptor() ([]byte, []int) {
+	return file_pkg_transitpb_transit_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *GetKeyRequest) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+type Key struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Name          string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Type          string                 `protobuf:"bytes,2,opt,name=type,proto3" json:"type,omitempty"`
+	Size          string                 `protobuf:"bytes,3,opt,name=size,proto3" json:"size,omitempty"`
+	Version       uint64                 `protobuf:"varint,4,opt,name=version,proto3" json:"version,omitempty"`
+	CreationTime  *timestamppb.Timestamp `protobuf:"bytes,5,opt,name=creation_time,json=creationTime,proto3" json:"creation_time,omitempty"`
+	ExpireTime    *timestamppb.Timestamp `protobuf:"bytes,6,opt,name=expire_time,json=expireTime,proto3" json:"expire_time,omitempty"`
+	Usage         *KeyUsage              `protobuf:"bytes,7,opt,name=usage,proto3" json:"usage,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Key) Reset() {
+	*x = Key{}
+	mi := &file_pkg_transitpb_transit_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Key) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Key) ProtoMessage() {}
+
+func (x *Key) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_transitpb_transit_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Key.ProtoReflect.Descriptor instead.
+func (*Key) Descriptor() ([]byte, []int) {
+	return file_pkg_transitpb_transit_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *Key) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *Key) GetType() string {
+	if x != nil {
+		return x.Type
+	}
+	return ""
+}
+
+func (x *Key) GetSize() string {
+	if x != nil {
+		return x.Size
+	}
+	return ""
+}
+
+func (x *Key) GetVersion() uint64 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *Key) GetCreationTime() *timestamppb.Timestamp {
+	if x != nil {
+		return x.CreationTime
+	}
+	return nil
+}
+
+func (x *Key) GetExpireTime() *timestamppb.Timestamp {
+	if x != nil {
+		return x.ExpireTime
+	}
+	return nil
+}
+
+func (x *Key) GetUsage() *KeyUsage {
+	if x != nil {
+		return x.Usage
+	}
+	return nil
+}
+
+type KeyUsage struct {
+	state          protoimpl.MessageState `protogen:"open.v1"`
+	Encryptions    uint64                 `protobuf:"varint,1,opt,name=encryptions,proto3" json:"encryptions,omitempty"`
+	Decryptions    uint64                 `protobuf:"varint,2,opt,name=decryptions,proto3" json:"decryptions,omitempty"`
+	Errors         uint64                 `protobuf:"varint,3,opt,name=errors,proto3" json:"errors,omitempty"`
+	BytesProcessed uint64                 `protobuf:"varint,4,opt,name=bytes_processed,json=bytesProcessed,proto3" json:"bytes_processed,omitempty"`
+	LastUsed       *timestamppb.Timestamp `protobuf:"bytes,5,opt,name=last_used,json=lastUsed,proto3" json:"last_used,omitempty"`
+	MaxEncryptions uint64                 `protobuf:"varint,6,opt,name=max_encryptions,json=maxEncryptions,proto3" json:"max_encryptions,omitempty"`
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
+}
+
+func (x *KeyUsage) Reset() {
+	*x = KeyUsage{}
+	mi := &file_pkg_transitpb_transit_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *KeyUsage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*KeyUsage) ProtoMessage() {}
+
+func (x *KeyUsage) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_transitpb_transit_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use KeyUsage.ProtoReflect.Descriptor instead.
+func (*KeyUsage) Descriptor() ([]byte, []int) {
+	return file_pkg_transitpb_transit_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *KeyUsage) GetEncryptions() uint64 {
+	if x != nil {
+		return x.Encryptions
+	}
+	return 0
+}
+
+func (x *KeyUsage) GetDecryptions() uint64 {
+	if x != nil {
+		return x.Decryptions
+	}
+	return 0
+}
+
+func (x *KeyUsage) GetErrors() uint64 {
+	if x != nil {
+		return x.Errors
+	}
+	return 0
+}
+
+func (x *KeyUsage) GetBytesProcessed() uint64 {
+	if x != nil {
+		return x.BytesProcessed
+	}
+	return 0
+}
+
+func (x *KeyUsage) GetLastUsed() *timestamppb.Timestamp {
+	if x != nil {
+		return x.LastUsed
+	}
+	return nil
+}
+
+func (x *KeyUsage) GetMaxEncryptions() uint64 {
+	if x != nil {
+		return x.MaxEncryptions
+	}
+	return 0
+}
+
+type DeleteKeyRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Name          string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DeleteKeyRequest) Reset() {
+	*x = DeleteKeyRequest{}
+	mi := &file_pkg_transitpb_transit_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DeleteKeyRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeleteKeyRequest) ProtoMessage() {}
+
+func (x *DeleteKeyRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_transitpb_transit_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeleteKeyRequest.ProtoReflect.Descriptor instead.
+func (*DeleteKeyRequest) Descriptor() ([]byte, []int) {
+	return file_pkg_transitpb_transit_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *DeleteKeyRequest) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+type DeleteKeyResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DeleteKeyResponse) Reset() {
+	*x = DeleteKeyResponse{}
+	mi := &file_pkg_transitpb_transit_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DeleteKeyResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeleteKeyResponse) ProtoMessage() {}
+
+func (x *DeleteKeyResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_transitpb_transit_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeleteKeyResponse.ProtoReflect.Descriptor instead.
+func (*DeleteKeyResponse) Descriptor() ([]byte, []int) {
+	return file_pkg_transitpb_transit_proto_rawDescGZIP(), []int{6}
+}
+
+type EncryptRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Name          string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Plaintext     []byte                 `protobuf:"bytes,2,opt,name=plaintext,proto3" json:"plaintext,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *EncryptRequest) Reset() {
+	*x = EncryptRequest{}
+	mi := &file_pkg_transitpb_transit_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *EncryptRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*EncryptRequest) ProtoMessage() {}
+
+func (x *EncryptRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_transitpb_transit_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use EncryptRequest.ProtoReflect.Descriptor instead.
+func (*EncryptRequest) Descriptor() ([]byte, []int) {
+	return file_pkg_transitpb_transit_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *EncryptRequest) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *EncryptRequest) GetPlaintext() []byte {
+	if x != nil {
+		return x.Plaintext
+	}
+	return nil
+}
+
+type EncryptResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Ciphertext    []byte                 `protobuf:"bytes,1,opt,name=ciphertext,proto3" json:"ciphertext,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *EncryptResponse) Reset() {
+	*x = EncryptResponse{}
+	mi := &file_pkg_transitpb_transit_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *EncryptResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*EncryptResponse) ProtoMessage() {}
+
+func (x *EncryptResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_transitpb_transit_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use EncryptResponse.ProtoReflect.Descriptor instead.
+func (*EncryptResponse) Descriptor() ([]byte, []int) {
+	return file_pkg_transitpb_transit_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *EncryptResponse) GetCiphertext() []byte {
+	if x != nil {
+		return x.Ciphertext
+	}
+	return nil
+}
+
+type DecryptRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Name          string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Ciphertext    []byte                 `protobuf:"bytes,2,opt,name=ciphertext,proto3" json:"ciphertext,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DecryptRequest) Reset() {
+	*x = DecryptRequest{}
+	mi := &file_pkg_transitpb_transit_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DecryptRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DecryptRequest) ProtoMessage() {}
+
+func (x *DecryptRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_transitpb_transit_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DecryptRequest.ProtoReflect.Descriptor instead.
+func (*DecryptRequest) Descriptor() ([]byte, []int) {
+	return file_pkg_transitpb_transit_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *DecryptRequest) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *DecryptRequest) GetCiphertext() []byte {
+	if x != nil {
+		return x.Ciphertext
+	}
+	return nil
+}
+
+type DecryptResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Plaintext     []byte                 `protobuf:"bytes,1,opt,name=plaintext,proto3" json:"plaintext,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DecryptResponse) Reset() {
+	*x = DecryptResponse{}
+	mi := &file_pkg_transitpb_transit_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DecryptResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DecryptResponse) ProtoMessage() {}
+
+func (x *DecryptResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_transitpb_transit_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DecryptResponse.ProtoReflect.Descriptor instead.
+func (*DecryptResponse) Descriptor() ([]byte, []int) {
+	return file_pkg_transitpb_transit_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *DecryptResponse) GetPlaintext() []byte {
+	if x != nil {
+		return x.Plaintext
+	}
+	return nil
+}
+
+var File_pkg_transitpb_transit_proto protoreflect.FileDescriptor
+
+const file_pkg_transitpb_transit_proto_rawDesc = "" +
+	"\n" +
+	"\x1bpkg/transitpb/transit.proto\x12\x12enclave.transit.v1\x1a\x1egoogle/protobuf/duration.proto\x1a\x1fgoogle/protobuf/timestamp.proto\"\xa4\x01\n" +
+	"\x10CreateKeyRequest\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12\x12\n" +
+	"\x04type\x18\x02 \x01(\tR\x04type\x12\x12\n" +
+	"\x04size\x18\x03 \x01(\tR\x04size\x12+\n" +
+	"\x03ttl\x18\x04 \x01(\v2\x19.google.protobuf.DurationR\x03ttl\x12'\n" +
+	"\x0fmax_encryptions\x18\x05 \x01(\x04R\x0emaxEncryptions\"\x13\n" +
+	"\x11CreateKeyResponse\"#\n" +
+	"\rGetKeyRequest\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\"\x8d\x02\n" +
+	"\x03Key\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12\x12\n" +
+	"\x04type\x18\x02 \x01(\tR\x04type\x12\x12\n" +
+	"\x04size\x18\x03 \x01(\tR\x04size\x12\x18\n" +
+	"\aversion\x18\x04 \x01(\x04R\aversion\x12?\n" +
+	"\rcreation_time\x18\x05 \x01(\v2\x1a.google.protobuf.TimestampR\fcreationTime\x12;\n" +
+	"\vexpire_time\x18\x06 \x01(\v2\x1a.google.protobuf.TimestampR\n" +
+	"expireTime\x122\n" +
+	"\x05usage\x18\a \x01(\v2\x1c.enclave.transit.v1.KeyUsageR\x05usage\"\xf1\x01\n" +
+	"\bKeyUsage\x12 \n" +
+	"\vencryptions\x18\x01 \x01(\x04R\vencryptions\x12 \n" +
+	"\vdecryptions\x18\x02 \x01(\x04R\vdecryptions\x12\x16\n" +
+	"\x06errors\x18\x03 \x01(\x04R\x06errors\x12'\n" +
+	"\x0fbytes_processed\x18\x04 \x01(\x04R\x0ebytesProcessed\x127\n" +
+	"\tlast_used\x18\x05 \x01(\v2\x1a.google.protobuf.TimestampR\blastUsed\x12'\n" +
+	"\x0fmax_encryptions\x18\x06 \x01(\x04R\x0emaxEncryptions\"&\n" +
+	"\x10DeleteKeyRequest\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\"\x13\n" +
+	"\x11DeleteKeyResponse\"B\n" +
+	"\x0eEncryptRequest\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12\x1c\n" +
+	"\tplaintext\x18\x02 \x01(\fR\tplaintext\"1\n" +
+	"\x0fEncryptResponse\x12\x1e\n" +
+	"\n" +
+	"ciphertext\x18\x01 \x01(\fR\n" +
+	"ciphertext\"D\n" +
+	"\x0eDecryptRequest\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12\x1e\n" +
+	"\n" +
+	"ciphertext\x18\x02 \x01(\fR\n" +
+	"ciphertext\"/\n" +
+	"\x0fDecryptResponse\x12\x1c\n" +
+	"\tplaintext\x18\x01 \x01(\fR\tplaintext2\x89\x04\n" +
+	"\aTransit\x12X\n" +
+	"\tCreateKey\x12$.enclave.transit.v1.CreateKeyRequest\x1a%.enclave.transit.v1.CreateKeyResponse\x12D\n" +
+	"\x06GetKey\x12!.enclave.transit.v1.GetKeyRequest\x1a\x17.enclave.transit.v1.Key\x12X\n" +
+	"\tDeleteKey\x12$.enclave.transit.v1.DeleteKeyRequest\x1a%.enclave.transit.v1.DeleteKeyResponse\x12R\n" +
+	"\aEncrypt\x12\".enclave.transit.v1.EncryptRequest\x1a#.enclave.transit.v1.EncryptResponse\x12R\n" +
+	"\aDecrypt\x12\".enclave.transit.v1.DecryptRequest\x1a#.enclave.transit.v1.DecryptResponse\x12\\\n" +
+	"\rEncryptStream\x12\".enclave.transit.v1.EncryptRequest\x1a#.enclave.transit.v1.EncryptResponse(\x010\x01B\x1dZ\x1benclave-task2/pkg/transitpbb\x06proto3"
+
+var (
+	file_pkg_transitpb_transit_proto_rawDescOnce sync.Once
+	file_pkg_transitpb_transit_proto_rawDescData []byte
+)
+
+func file_pkg_transitpb_transit_proto_rawDescGZIP() []byte {
+	file_pkg_transitpb_transit_proto_rawDescOnce.Do(func() {
+		file_pkg_transitpb_transit_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_pkg_transitpb_transit_proto_rawDesc), len(file_pkg_transitpb_transit_proto_rawDesc)))
+	})
+	return file_pkg_transitpb_transit_proto_rawDescData
+}
+
+var file_pkg_transitpb_transit_proto_msgTypes = make([]protoimpl.MessageInfo, 11)
+var file_pkg_transitpb_transit_proto_goTypes = []any{
+	(*CreateKeyRequest)(nil),      // 0: enclave.transit.v1.CreateKeyRequest
+	(*CreateKeyResponse)(nil),     // 1: enclave.transit.v1.CreateKeyResponse
+	(*GetKeyRequest)(nil),         // 2: enclave.transit.v1.GetKeyRequest
+	(*Key)(nil),                   // 3: enclave.transit.v1.Key
+	(*KeyUsage)(nil),              // 4: enclave.transit.v1.KeyUsage
+	(*DeleteKeyRequest)(nil),      // 5: enclave.transit.v1.DeleteKeyRequest
+	(*DeleteKeyResponse)(nil),     // 6: enclave.transit.v1.DeleteKeyResponse
+	(*EncryptRequest)(nil),        // 7: enclave.transit.v1.EncryptRequest
+	(*EncryptResponse)(nil),       // 8: enclave.transit.v1.EncryptResponse
+	(*DecryptRequest)(nil),        // 9: enclave.transit.v1.DecryptRequest
+	(*DecryptResponse)(nil),       // 10: enclave.transit.v1.DecryptResponse
+	(*durationpb.Duration)(nil),   // 11: google.protobuf.Duration
+	(*timestamppb.Timestamp)(nil), // 12: google.protobuf.Timestamp
+}
+var file_pkg_transitpb_transit_proto_depIdxs = []int32{
+	11, // 0: enclave.transit.v1.CreateKeyRequest.ttl:type_name -> google.protobuf.Duration
+	12, // 1: enclave.transit.v1.Key.creation_time:type_name -> google.protobuf.Timestamp
+	12, // 2: enclave.transit.v1.Key.expire_time:type_name -> google.protobuf.Timestamp
+	4,  // 3: enclave.transit.v1.Key.usage:type_name -> enclave.transit.v1.KeyUsage
+	12, // 4: enclave.transit.v1.KeyUsage.last_used:type_name -> google.protobuf.Timestamp
+	0,  // 5: enclave.transit.v1.Transit.CreateKey:input_type -> enclave.transit.v1.CreateKeyRequest
+	2,  // 6: enclave.transit.v1.Transit.GetKey:input_type -> enclave.transit.v1.GetKeyRequest
+	5,  // 7: enclave.transit.v1.Transit.DeleteKey:input_type -> enclave.transit.v1.DeleteKeyRequest
+	7,  // 8: enclave.transit.v1.Transit.Encrypt:input_type -> enclave.transit.v1.EncryptRequest
+	9,  // 9: enclave.transit.v1.Transit.Decrypt:input_type -> enclave.transit.v1.DecryptRequest
+	7,  // 10: enclave.transit.v1.Transit.EncryptStream:input_type -> enclave.transit.v1.EncryptRequest
+	1,  // 11: enclave.transit.v1.Transit.CreateKey:output_type -> enclave.transit.v1.CreateKeyResponse
+	3,  // 12: enclave.transit.v1.Transit.GetKey:output_type -> enclave.transit.v1.Key
+	6,  // 13: enclave.transit.v1.Transit.DeleteKey:output_type -> enclave.transit.v1.DeleteKeyResponse
+	8,  // 14: enclave.transit.v1.Transit.Encrypt:output_type -> enclave.transit.v1.EncryptResponse
+	10, // 15: enclave.transit.v1.Transit.Decrypt:output_type -> enclave.transit.v1.DecryptResponse
+	8,  // 16: enclave.transit.v1.Transit.EncryptStream:output_type -> enclave.transit.v1.EncryptResponse
+	11, // [11:17] is the sub-list for method output_type
+	5,  // [5:11] is the sub-list for method input_type
+	5,  // [5:5] is the sub-list for extension type_name
+	5,  // [5:5] is the sub-list for extension extendee
+	0,  // [0:5] is the sub-list for field type_name
+}
+
+func init() { file_pkg_transitpb_transit_proto_init() }
+func file_pkg_transitpb_transit_proto_init() {
+	if File_pkg_transitpb_transit_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_pkg_transitpb_transit_proto_rawDesc), len(file_pkg_transitpb_transit_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   11,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_pkg_transitpb_transit_proto_goTypes,
+		DependencyIndexes: file_pkg_transitpb_transit_proto_depIdxs,
+		MessageInfos:      file_pkg_transitpb_transit_proto_msgTypes,
+	}.Build()
+	File_pkg_transitpb_transit_proto = out.File
+	file_pkg_transitpb_transit_proto_goTypes = nil
+	file_pkg_transitpb_transit_proto_depIdxs = nil
+}
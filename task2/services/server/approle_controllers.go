@@ -0,0 +1,184 @@
+package server
+
+import (
+	"enclave-task2/pkg/audit"
+	"enclave-task2/pkg/auth"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+type setAppRoleRequest struct {
+	Policies        []string `json:"policies"`
+	TokenTTL        string   `json:"token_ttl"`
+	SecretIDTTL     string   `json:"secret_id_ttl"`
+	SecretIDNumUses uint64   `json:"secret_id_num_uses"`
+	BoundCIDRs      []string `json:"bound_cidrs"`
+}
+
+type secretIDRequest struct {
+	CIDRs []string `json:"cidr_list"`
+}
+
+type secretIDResponse struct {
+	Secret string `json:"secret_id"`
+	*auth.SecretID
+}
+
+type appRoleLoginRequest struct {
+	RoleID   string `json:"role_id"`
+	SecretID string `json:"secret_id"`
+}
+
+// SetAppRole creates or updates a role. Its policies can not exceed the ones
+// of the caller unless the caller is root.
+func (s *Server) SetAppRole(rw http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	var body setAppRoleRequest
+	if err := decodeBody(req, &body); err != nil {
+		http.Error(rw, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	cfg := auth.RoleConfig{
+		Policies:        body.Policies,
+		SecretIDNumUses: body.SecretIDNumUses,
+		BoundCIDRs:      body.BoundCIDRs,
+	}
+	for _, d := range []struct {
+		value string
+		dest  *time.Duration
+	}{{body.TokenTTL, &cfg.TokenTTL}, {body.SecretIDTTL, &cfg.SecretIDTTL}} {
+		if d.value == "" {
+			continue
+		}
+		ttl, err := time.ParseDuration(d.value)
+		if err != nil || ttl < 0 {
+			http.Error(rw, "invalid ttl", http.StatusBadRequest)
+			return
+		}
+		*d.dest = ttl
+	}
+
+	if exceedsPolicies(auth.GetClaimsFromContext(ctx), cfg.Policies) {
+		http.Error(rw, "policies exceed the ones of the caller", http.StatusForbidden)
+		return
+	}
+
+	role, err := s.approles.SetRole(ctx, req.PathValue("name"), cfg)
+	if errors.Is(err, auth.InvalidRoleError) || errors.Is(err, auth.InvalidPoliciesError) {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		s.log(ctx).Error("failed to set role", "error", err)
+		http.Error(rw, "failed to set role", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(rw, http.StatusOK, role)
+}
+
+// GetAppRole describes a role, including its role id.
+func (s *Server) GetAppRole(rw http.ResponseWriter, req *http.Request) {
+	role, err := s.approles.Role(req.Context(), req.PathValue("name"))
+	if err == auth.RoleNotFoundError {
+		http.Error(rw, "role not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.log(req.Context()).Error("failed to get role", "error", err)
+		http.Error(rw, "failed to get role", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(rw, http.StatusOK, role)
+}
+
+// DeleteAppRole deletes a role and voids its secret ids.
+func (s *Server) DeleteAppRole(rw http.ResponseWriter, req *http.Request) {
+	err := s.approles.DeleteRole(req.Context(), req.PathValue("name"))
+	if err == auth.RoleNotFoundError {
+		http.Error(rw, "role not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.log(req.Context()).Error("failed to delete role", "error", err)
+		http.Error(rw, "failed to delete role", http.StatusInternalServerError)
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// GenerateAppRoleSecretID issues a secret id for a role.
+func (s *Server) GenerateAppRoleSecretID(rw http.ResponseWriter, req *http.Request) {
+	var body secretIDRequest
+	if err := decodeBody(req, &body); err != nil {
+		http.Error(rw, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	secretID, info, err := s.approles.GenerateSecretID(req.Context(), req.PathValue("name"), body.CIDRs)
+	if err == auth.RoleNotFoundError {
+		http.Error(rw, "role not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, auth.InvalidRoleError) {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		s.log(req.Context()).Error("failed to generate secret id", "error", err)
+		http.Error(rw, "failed to generate secret id", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(rw, http.StatusOK, secretIDResponse{Secret: secretID, SecretID: info})
+}
+
+// AppRoleLogin exchanges a role id and a secret id for a service token, it
+// is served without authentication.
+func (s *Server) AppRoleLogin(rw http.ResponseWriter, req *http.Request) {
+	var body appRoleLoginRequest
+	if err := decodeBody(req, &body); err != nil {
+		http.Error(rw, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	audit.SetSecretID(req.Context(), body.SecretID)
+
+	token, info, err := s.approles.Login(req.Context(), body.RoleID, body.SecretID, remoteIP(req))
+	if err == auth.InvalidCredentialsError {
+		http.Error(rw, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		s.log(req.Context()).Error("failed to login", "error", err)
+		http.Error(rw, "failed to login", http.StatusInternalServerError)
+		return
+	}
+	audit.SetAuth(req.Context(), audit.Auth{Subject: info.DisplayName, Accessor: info.Accessor, Policies: info.Policies})
+
+	writeJSON(rw, http.StatusOK, createTokenResponse{ClientToken: token, Token: info})
+}
+
+// remoteIP is the address of the client of the request.
+func remoteIP(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+
+	return net.ParseIP(host)
+}
+
+// remoteAddr is the address of the client of the request, without port.
+func remoteAddr(req *http.Request) string {
+	if ip := remoteIP(req); ip != nil {
+		return ip.String()
+	}
+
+	return req.RemoteAddr
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"enclave-task2/pkg/auth"
+	"enclave-task2/pkg/common"
+	"enclave-task2/pkg/storage"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAppRoleControllers(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(t.Output(), &slog.HandlerOptions{Level: slog.LevelDebug}))
+	ctx := common.LoggerWithContext(context.Background(), logger)
+	server := New(WithStorage(storage.NewNamedInMemoryCache("approle-controllers")))
+	server.logger = logger
+
+	// request runs the handler as a caller with the policies
+	request := func(handler http.HandlerFunc, method, target, name, body string, policies ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.SetPathValue("name", name)
+		req = req.WithContext(auth.ClaimsWithContext(ctx, &auth.Claims{Policies: policies}))
+		rw := httptest.NewRecorder()
+		handler(rw, req)
+
+		return rw
+	}
+
+	var role auth.Role
+	t.Run("set role", func(t *testing.T) {
+		rw := request(server.SetAppRole, http.MethodPost, "/auth/approle/role/ci", "ci",
+			`{"policies": ["payments"], "token_ttl": "10m", "secret_id_num_uses": 1, "bound_cidrs": ["192.0.2.0/24"]}`, auth.RootPolicy)
+
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.NoError(t, json.NewDecoder(rw.Body).Decode(&role))
+		assert.NotEmpty(t, role.RoleID)
+		assert.Equal(t, "10m0s", role.TokenTTL)
+	})
+
+	t.Run("set role exceeding the caller policies", func(t *testing.T) {
+		rw := request(server.SetAppRole, http.MethodPost, "/auth/approle/role/ci", "ci", `{"policies": ["root"]}`, "payments")
+		assert.Equal(t, http.StatusForbidden, rw.Code)
+	})
+
+	t.Run("set invalid role", func(t *testing.T) {
+		rw := request(server.SetAppRole, http.MethodPost, "/auth/approle/role/ci", "ci", `{"bound_cidrs": ["nope"]}`, auth.RootPolicy)
+		assert.Equal(t, http.StatusBadRequest, rw.Code)
+
+		rw = request(server.SetAppRole, http.MethodPost, "/auth/approle/role/ci", "ci", `{"token_ttl": "soon"}`, auth.RootPolicy)
+		assert.Equal(t, http.StatusBadRequest, rw.Code)
+	})
+
+	t.Run("get role", func(t *testing.T) {
+		rw := request(server.GetAppRole, http.MethodGet, "/auth/approle/role/ci", "ci", "")
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.Contains(t, rw.Body.String(), role.RoleID)
+
+		rw = request(server.GetAppRole, http.MethodGet, "/auth/approle/role/unknown", "unknown", "")
+		assert.Equal(t, http.StatusNotFound, rw.Code)
+	})
+
+	var secret secretIDResponse
+	t.Run("generate secret id", func(t *testing.T) {
+		rw := request(server.GenerateAppRoleSecretID, http.MethodPost, "/auth/approle/role/ci/secret-id", "ci", "")
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.NoError(t, json.NewDecoder(rw.Body).Decode(&secret))
+		assert.NotEmpty(t, secret.Secret)
+		assert.Equal(t, uint64(1), secret.NumUses)
+
+		rw = request(server.GenerateAppRoleSecretID, http.MethodPost, "/auth/approle/role/unknown/secret-id", "unknown", "")
+		assert.Equal(t, http.StatusNotFound, rw.Code)
+	})
+
+	t.Run("login without bearer token", func(t *testing.T) {
+		public := http.NewServeMux()
+		public.HandleFunc("POST /auth/approle/login", server.AppRoleLogin)
+		mw := initMiddlewares(ctx, public, server.mux, nil, server.tokens, nil, nil, authFailures{}, server.mux)
+
+		login := func(remoteAddr string) *httptest.ResponseRecorder {
+			body := `{"role_id": "` + role.RoleID + `", "secret_id": "` + secret.Secret + `"}`
+			req := httptest.NewRequest(http.MethodPost, "/auth/approle/login", strings.NewReader(body))
+			req.RemoteAddr = remoteAddr
+			rw := httptest.NewRecorder()
+			mw.ServeHTTP(rw, req)
+
+			return rw
+		}
+
+		// outside the bound cidrs
+		rw := login("198.51.100.1:1234")
+		assert.Equal(t, http.StatusUnauthorized, rw.Code)
+
+		rw = login("192.0.2.10:1234")
+		assert.Equal(t, http.StatusOK, rw.Code)
+		var token createTokenResponse
+		assert.NoError(t, json.NewDecoder(rw.Body).Decode(&token))
+		assert.Equal(t, []string{"payments"}, token.Policies)
+
+		_, err := server.tokens.Lookup(ctx, token.ClientToken)
+		assert.NoError(t, err)
+
+		// the secret id was good for one use
+		rw = login("192.0.2.10:1234")
+		assert.Equal(t, http.StatusUnauthorized, rw.Code)
+	})
+
+	t.Run("delete role", func(t *testing.T) {
+		rw := request(server.DeleteAppRole, http.MethodDelete, "/auth/approle/role/ci", "ci", "")
+		assert.Equal(t, http.StatusNoContent, rw.Code)
+
+		rw = request(server.DeleteAppRole, http.MethodDelete, "/auth/approle/role/ci", "ci", "")
+		assert.Equal(t, http.StatusNotFound, rw.Code)
+	})
+}
@@ -0,0 +1,318 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"enclave-task2/pkg/auth"
+	"enclave-task2/pkg/cluster"
+	"enclave-task2/pkg/cluster/clustertest"
+	"enclave-task2/pkg/common"
+	"enclave-task2/pkg/storage"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var instances atomic.Int32
+
+type testNode struct {
+	server  *Server
+	apiURL  string
+	peerURL string
+	cancel  context.CancelFunc
+	done    chan error
+	// roots receives the root tokens generated by the nodes of the cluster
+	roots chan string
+}
+
+// rootRecorder sends the root tokens logged by a node to a channel.
+type rootRecorder struct {
+	slog.Handler
+	roots chan<- string
+}
+
+func (h *rootRecorder) Handle(ctx context.Context, r slog.Record) error {
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key == "token" {
+			h.roots <- a.Value.String()
+		}
+		return true
+	})
+
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *rootRecorder) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &rootRecorder{Handler: h.Handler.WithAttrs(attrs), roots: h.roots}
+}
+
+func (h *rootRecorder) WithGroup(name string) slog.Handler {
+	return &rootRecorder{Handler: h.Handler.WithGroup(name), roots: h.roots}
+}
+
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+
+	return l.Addr().String()
+}
+
+// startCluster runs several servers in the same process, discovery builds
+// the discoverer of each node from its peer url and the peer urls of all
+// nodes.
+func startCluster(t *testing.T, count int, discovery func(self string, all []string) cluster.Discoverer) []*testNode {
+	// each node generates at most one root token
+	roots := make(chan string, count)
+	logger := slog.New(&rootRecorder{
+		Handler: slog.NewTextHandler(t.Output(), &slog.HandlerOptions{Level: slog.LevelDebug}),
+		roots:   roots,
+	})
+
+	apiAddrs := make([]string, count)
+	peerAddrs := make([]string, count)
+	peerURLs := make([]string, count)
+	for i := range count {
+		apiAddrs[i] = freeAddr(t)
+		peerAddrs[i] = freeAddr(t)
+		peerURLs[i] = "https://" + peerAddrs[i]
+	}
+
+	ca := clustertest.NewCA(t)
+
+	var nodes []*testNode
+	for i := range count {
+		cache := storage.NewNamedInMemoryCache(fmt.Sprintf("node-%d", instances.Add(1)))
+		n := &testNode{
+			server: New(WithStorage(cache),
+				WithAddr(apiAddrs[i], peerAddrs[i]),
+				WithPeerDiscovery(peerURLs[i], discovery(peerURLs[i], peerURLs)),
+				WithPeerTLS(ca.PeerTLS(t)),
+				WithJWTVerifier(testVerifier(t)),
+			),
+			apiURL:  "http://" + apiAddrs[i],
+			peerURL: peerURLs[i],
+			done:    make(chan error, 1),
+			roots:   roots,
+		}
+
+		ctx, cancel := context.WithCancel(common.LoggerWithContext(context.Background(), logger.With("node", i)))
+		n.cancel = cancel
+		go func() { n.done <- n.server.Start(ctx) }()
+
+		nodes = append(nodes, n)
+	}
+
+	t.Cleanup(func() {
+		for _, n := range nodes {
+			n.stop(t)
+		}
+	})
+
+	for _, n := range nodes {
+		assert.Eventually(t, func() bool {
+			res, err := http.Get(n.apiURL)
+			if err == nil {
+				res.Body.Close()
+			}
+			return err == nil
+		}, 2*time.Second, 5*time.Millisecond)
+	}
+
+	return nodes
+}
+
+func (n *testNode) stop(t *testing.T) {
+	if n.cancel == nil {
+		return
+	}
+	// idle keep-alive connections would delay the shutdown
+	http.DefaultClient.CloseIdleConnections()
+	n.cancel()
+	n.cancel = nil
+	assert.NoError(t, <-n.done)
+}
+
+func (n *testNode) call(t *testing.T, path string, body []byte) (int, []byte) {
+	req, err := http.NewRequest(http.MethodPost, n.apiURL+path, bytes.NewReader(body))
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+
+	data, err := io.ReadAll(res.Body)
+	assert.NoError(t, err)
+
+	return res.StatusCode, data
+}
+
+func TestClusterStaticPeers(t *testing.T) {
+	nodes := startCluster(t, 3, func(self string, all []string) cluster.Discoverer {
+		return &cluster.Static{Peers: all}
+	})
+
+	for _, n := range nodes {
+		assert.Eventually(t, func() bool { return len(n.server.pool.Members()) == 3 }, 2*time.Second, 5*time.Millisecond)
+	}
+
+	// the probes are served without token
+	for _, n := range nodes {
+		assert.Eventually(t, func() bool {
+			res, err := http.Get(n.apiURL + "/sys/ready")
+			if err != nil {
+				return false
+			}
+			defer res.Body.Close()
+			return res.StatusCode == http.StatusOK
+		}, 2*time.Second, 5*time.Millisecond)
+	}
+
+	// keys created on any node are usable on every node
+	for i := range 10 {
+		name := fmt.Sprintf("cluster-key-%d", i)
+		status, _ := nodes[i%3].call(t, "/transit/keys/"+name, nil)
+		assert.Equal(t, http.StatusNoContent, status)
+
+		status, ciphertext := nodes[(i+1)%3].call(t, "/transit/encrypt/"+name, []byte("Hello, World!"))
+		assert.Equal(t, http.StatusOK, status)
+
+		status, plaintext := nodes[(i+2)%3].call(t, "/transit/decrypt/"+name, ciphertext)
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "Hello, World!", string(plaintext))
+	}
+
+	status, _ := nodes[1].call(t, "/transit/encrypt/missing-key", []byte("Hello, World!"))
+	assert.Equal(t, http.StatusNotFound, status)
+
+	// each node only knows the keys created through it, the list is refused
+	req, err := http.NewRequest(http.MethodGet, nodes[0].apiURL+"/transit/keys", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotImplemented, res.StatusCode)
+}
+
+func TestClusterRootToken(t *testing.T) {
+	nodes := startCluster(t, 3, func(self string, all []string) cluster.Discoverer {
+		return &cluster.Static{Peers: all}
+	})
+
+	var root string
+	select {
+	case root = <-nodes[0].roots:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no root token generated")
+	}
+
+	// the root token never expires, it is resolved by every node
+	for _, n := range nodes {
+		req, err := http.NewRequest(http.MethodGet, n.apiURL+"/auth/token/lookup-self", nil)
+		assert.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+root)
+
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		var info auth.Token
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(&info))
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, []string{auth.RootPolicy}, info.Policies)
+		assert.True(t, info.ExpireTime.IsZero())
+	}
+}
+
+func TestClusterGossip(t *testing.T) {
+	nodes := startCluster(t, 3, func(self string, all []string) cluster.Discoverer {
+		return &cluster.Gossip{Self: self, Seeds: all[:1], Interval: 20 * time.Millisecond}
+	})
+
+	var all []string
+	for _, n := range nodes {
+		all = append(all, n.peerURL)
+	}
+	slices.Sort(all)
+
+	for _, n := range nodes {
+		assert.Eventually(t, func() bool { return slices.Equal(all, n.server.pool.Members()) }, 3*time.Second, 10*time.Millisecond)
+	}
+
+	status, _ := nodes[0].call(t, "/transit/keys/gossip-key", nil)
+	assert.Equal(t, http.StatusNoContent, status)
+	status, _ = nodes[2].call(t, "/transit/encrypt/gossip-key", []byte("Hello, World!"))
+	assert.Equal(t, http.StatusOK, status)
+
+	// a node leaving is removed from the pools of the others
+	nodes[2].stop(t)
+	alive := slices.DeleteFunc(slices.Clone(all), func(u string) bool { return u == nodes[2].peerURL })
+	for _, n := range nodes[:2] {
+		assert.Eventually(t, func() bool { return slices.Equal(alive, n.server.pool.Members()) }, 3*time.Second, 10*time.Millisecond)
+	}
+}
+
+func TestClusterRequiresPeerTLS(t *testing.T) {
+	ctx := common.LoggerWithContext(context.Background(), slog.New(slog.NewTextHandler(t.Output(), nil)))
+
+	srv := New(WithStorage(storage.NewNamedInMemoryCache(fmt.Sprintf("node-%d", instances.Add(1)))),
+		WithAddr(freeAddr(t), freeAddr(t)),
+		WithPeerDiscovery("https://127.0.0.1:8081", &cluster.Static{}),
+		WithJWTVerifier(testVerifier(t)),
+	)
+	assert.Equal(t, cluster.PeerTLSRequiredError, srv.Start(ctx))
+}
+
+func TestClusterPeerListenerRequiresClientCert(t *testing.T) {
+	nodes := startCluster(t, 1, func(self string, all []string) cluster.Discoverer {
+		return &cluster.Static{Peers: all}
+	})
+
+	status, _ := nodes[0].call(t, "/transit/keys/mtls-key", nil)
+	assert.Equal(t, http.StatusNoContent, status)
+
+	// plain http is refused
+	res, err := http.Get("http://" + strings.TrimPrefix(nodes[0].peerURL, "https://") + cluster.BasePath + "keys/mtls-key")
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	// a client without certificate is rejected
+	err = peerRequest(t, nodes[0].peerURL, &tls.Config{InsecureSkipVerify: true})
+	assert.ErrorContains(t, err, "certificate")
+
+	// a certificate of another CA is rejected as well
+	config := clustertest.NewCA(t).PeerTLS(t).Config()
+	config.InsecureSkipVerify = true
+	err = peerRequest(t, nodes[0].peerURL, config)
+	assert.ErrorContains(t, err, "certificate")
+}
+
+// peerRequest sends a raw request to the peer listener. With TLS 1.3 the
+// client certificate is verified after the client handshake completed, the
+// rejection is reported on the first read.
+func peerRequest(t *testing.T, peerURL string, config *tls.Config) error {
+	conn, err := tls.Dial("tcp", strings.TrimPrefix(peerURL, "https://"), config)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("GET " + cluster.BasePath + "keys/mtls-key HTTP/1.1\r\nHost: peer\r\n\r\n"))
+	assert.NoError(t, err)
+
+	_, err = conn.Read(make([]byte, 1))
+	return err
+}
@@ -1,96 +1,228 @@
 package server
 
 import (
+	"context"
+	"enclave-task2/pkg/audit"
+	"enclave-task2/pkg/auth"
 	"enclave-task2/pkg/keys"
-	"enclave-task2/pkg/keys/kyber"
+	"enclave-task2/pkg/metrics"
 	"enclave-task2/pkg/storage"
-	"io"
+	"enclave-task2/pkg/tracing"
+	"errors"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
-func (s *Server) CreateKyberKey(rw http.ResponseWriter, req *http.Request) {
-	ctx := req.Context()
+// maxUpdateAttempts bounds the compare-and-swap retries of a key update.
+const maxUpdateAttempts = 10
+
+// TooManyUpdatesError is returned when a key kept changing during
+// maxUpdateAttempts updates.
+var TooManyUpdatesError = errors.New("too many concurrent updates")
+
+// transitKeyName returns the key name of a transit route. The names with a
+// slash are reserved for the internal entries of the storage, e.g. tokens.
+func transitKeyName(rw http.ResponseWriter, req *http.Request) (string, bool) {
 	keyName := req.PathValue("name")
 	if keyName == "" {
 		http.Error(rw, "key name is required", http.StatusBadRequest)
+		return "", false
+	}
+	if strings.Contains(keyName, "/") {
+		http.Error(rw, "invalid key name", http.StatusBadRequest)
+		return "", false
+	}
+	audit.SetKey(req.Context(), keyName)
+
+	return keyName, true
+}
+
+func (s *Server) CreateKyberKey(rw http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	keyName, ok := transitKeyName(rw, req)
+	if !ok {
 		return
 	}
 
-	ttl := keys.DefaultKeyTTL
+	ttl := s.keyTTL
 	ttlParam := req.Header.Get("X-Key-TTL")
 	if ttlParam != "" {
 		var err error
 		ttl, err = time.ParseDuration(ttlParam)
 		if err != nil {
-			s.logger.Error("invalid ttl", "error", err)
+			s.log(ctx).Error("invalid ttl", "error", err)
 			http.Error(rw, "invalid ttl", http.StatusBadRequest)
 			return
 		}
 	}
 
+	// nil when the header is absent, the limit of an existing key is kept
+	var maxEncryptions *uint64
+	if param := req.Header.Get("X-Key-Max-Encryptions"); param != "" {
+		limit, err := strconv.ParseUint(param, 10, 64)
+		if err != nil {
+			http.Error(rw, "invalid max encryptions", http.StatusBadRequest)
+			return
+		}
+		maxEncryptions = &limit
+	}
+
 	// check if key already exists
-	key, err := s.storage.Get(ctx, keyName)
+	_, err := s.storage.Get(ctx, keyName)
 	if err != nil {
 		if err != storage.NotFoundError {
-			s.logger.Error("failed to check key existence", "error", err)
+			s.log(ctx).Error("failed to check key existence", "error", err)
 			http.Error(rw, "failed to check key existence", http.StatusInternalServerError)
 			return
 		}
 	} else {
 		// key already exists -> extend TTL
-		key.SetTTL(ttl)
-		s.storage.Put(ctx, key)
-
-		rw.WriteHeader(http.StatusNoContent)
+		s.extendKeyTTL(rw, req, keyName, ttl, maxEncryptions)
 		return
 	}
 
 	keyType := req.Header.Get("X-Key-Type")
 	if keyType == "" {
-		keyType = kyber.KeyType
+		keyType = s.keyType
 	}
 
 	keySize := req.Header.Get("X-Key-Size")
 	if keySize == "" {
-		keySize = kyber.Size1024
+		keySize = s.keySize
 	}
 
-	key, err = keys.New(ctx, keyType, keySize, keyName, ttl)
+	var async bool
+	if param := req.Header.Get("X-Key-Async"); param != "" {
+		async, err = strconv.ParseBool(param)
+		if err != nil {
+			http.Error(rw, "invalid async", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// a pregenerated key is used when the pool has one, otherwise the key
+	// is generated by the request or by a job with X-Key-Async
+	key, ok := s.keyPool.Take(keyType, keySize, keyName, ttl)
+	if !ok && async {
+		s.createKeyJob(rw, req, keyName, keyType, keySize, ttl, maxEncryptions)
+		return
+	}
+	if !ok {
+		key, err = keys.New(ctx, keyType, keySize, keyName, ttl)
+		if err != nil {
+			s.log(ctx).Error("failed to create key", "error", err)
+			http.Error(rw, "failed to create key", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err = s.storage.Create(ctx, key)
+	if err == storage.AlreadyExistsError {
+		// a concurrent request created the key first -> extend TTL
+		s.extendKeyTTL(rw, req, keyName, ttl, maxEncryptions)
+		return
+	}
 	if err != nil {
-		s.logger.Error("failed to create key", "error", err)
-		http.Error(rw, "failed to create key", http.StatusInternalServerError)
+		s.log(ctx).Error("failed to store key", "error", err)
+		http.Error(rw, "failed to store key", http.StatusInternalServerError)
 		return
 	}
+	audit.SetKeyVersion(ctx, key.GetVersion())
 
-	s.storage.Put(ctx, key)
+	if err := s.usage.Init(ctx, key, valueOrZero(maxEncryptions)); err != nil {
+		s.log(ctx).Error("failed to initialize key usage", "error", err)
+		http.Error(rw, "failed to initialize key usage", http.StatusInternalServerError)
+		return
+	}
 
 	rw.WriteHeader(http.StatusNoContent)
 }
 
+// extendKeyTTL sets the TTL of an existing key, and its max encryptions
+// when not nil, retrying when a concurrent update changed the key in
+// between.
+func (s *Server) extendKeyTTL(rw http.ResponseWriter, req *http.Request, keyName string, ttl time.Duration, maxEncryptions *uint64) {
+	ctx := req.Context()
+
+	key, err := s.updateKeyTTL(ctx, keyName, ttl, maxEncryptions)
+	switch {
+	case err == storage.NotFoundError:
+		http.Error(rw, "key not found", http.StatusNotFound)
+		return
+	case err == TooManyUpdatesError:
+		s.log(ctx).Error("failed to update key", "error", err)
+		http.Error(rw, "too many concurrent updates", http.StatusConflict)
+		return
+	case err != nil:
+		s.log(ctx).Error("failed to update key", "error", err)
+		http.Error(rw, "failed to update key", http.StatusInternalServerError)
+		return
+	}
+	audit.SetKeyVersion(ctx, key.GetVersion())
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// updateKeyTTL sets the ttl of an existing key, and its max encryptions
+// when not nil, it retries when the key is updated concurrently.
+func (s *Server) updateKeyTTL(ctx context.Context, keyName string, ttl time.Duration, maxEncryptions *uint64) (keys.Key, error) {
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		key, err := s.storage.Get(ctx, keyName)
+		if err != nil {
+			return nil, err
+		}
+
+		key.SetTTL(ttl)
+		err = s.storage.CompareAndSwap(ctx, key, key.GetVersion())
+		if err == storage.VersionMismatchError {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if maxEncryptions != nil {
+			if err := s.usage.SetMaxEncryptions(ctx, key, *maxEncryptions); err != nil {
+				return nil, err
+			}
+		} else if err := s.usage.SetTTL(ctx, key); err != nil {
+			s.log(ctx).Error("failed to update key usage ttl", "error", err)
+		}
+
+		return key, nil
+	}
+
+	return nil, TooManyUpdatesError
+}
+
 func (s *Server) RevokeKyberKey(rw http.ResponseWriter, req *http.Request) {
 	ctx := req.Context()
-	keyName := req.PathValue("name")
-	if keyName == "" {
-		http.Error(rw, "key name is required", http.StatusBadRequest)
+	keyName, ok := transitKeyName(rw, req)
+	if !ok {
 		return
 	}
 
 	err := s.storage.Delete(ctx, keyName)
 	if err != nil {
-		s.logger.Error("failed to delete key", "error", err)
+		s.log(ctx).Error("failed to delete key", "error", err)
 		http.Error(rw, "failed to delete key", http.StatusInternalServerError)
 		return
 	}
+	if err := s.usage.Delete(ctx, keyName); err != nil && err != storage.NotFoundError {
+		s.log(ctx).Error("failed to delete key usage", "error", err)
+	}
 
 	rw.WriteHeader(http.StatusNoContent)
 }
 
 func (s *Server) Encrypt(rw http.ResponseWriter, req *http.Request) {
 	ctx := req.Context()
-	keyName := req.PathValue("name")
-	if keyName == "" {
-		http.Error(rw, "key name is required", http.StatusBadRequest)
+	keyName, ok := transitKeyName(rw, req)
+	if !ok {
 		return
 	}
 
@@ -100,29 +232,37 @@ func (s *Server) Encrypt(rw http.ResponseWriter, req *http.Request) {
 			http.Error(rw, "key not found", http.StatusNotFound)
 			return
 		}
-		s.logger.Error("failed to get key", "error", err)
+		s.log(ctx).Error("failed to get key", "error", err)
 		http.Error(rw, "failed to get key", http.StatusInternalServerError)
 		return
 	}
+	audit.SetKeyVersion(ctx, key.GetVersion())
 
 	// read plaintext from request body
-	plaintext, err := io.ReadAll(req.Body)
-	if err != nil {
-		s.logger.Error("failed to read request body", "error", err)
-		http.Error(rw, "failed to read request body", http.StatusBadRequest)
+	plaintext, ok := s.readBody(rw, req)
+	if !ok {
 		return
 	}
 
+	// the encryption is counted once it succeeded, the ciphertext is
+	// discarded when the key reached its max encryptions meanwhile
+	_, span := tracing.Start(ctx, "Key.Encrypt", keyAttributes(key)...)
 	ciphertext := key.Encrypt(plaintext)
+	span.End()
+	if len(ciphertext) == 0 && len(plaintext) > 0 {
+		s.failKey(ctx, key)
+	} else if !s.useKey(rw, req, key, storage.OpEncrypt, len(plaintext)) {
+		return
+	}
+	rw.Header().Set("Content-Type", "application/octet-stream")
 	rw.WriteHeader(http.StatusOK)
 	rw.Write(ciphertext)
 }
 
 func (s *Server) Decrypt(rw http.ResponseWriter, req *http.Request) {
 	ctx := req.Context()
-	keyName := req.PathValue("name")
-	if keyName == "" {
-		http.Error(rw, "key name is required", http.StatusBadRequest)
+	keyName, ok := transitKeyName(rw, req)
+	if !ok {
 		return
 	}
 
@@ -132,22 +272,176 @@ func (s *Server) Decrypt(rw http.ResponseWriter, req *http.Request) {
 			http.Error(rw, "key not found", http.StatusNotFound)
 			return
 		}
-		s.logger.Error("failed to get key", "error", err)
+		s.log(ctx).Error("failed to get key", "error", err)
 		http.Error(rw, "failed to get key", http.StatusInternalServerError)
 		return
 	}
+	audit.SetKeyVersion(ctx, key.GetVersion())
 
 	// read ciphertext from request body
-	ciphertext, err := io.ReadAll(req.Body)
-	if err != nil {
-		s.logger.Error("failed to read request body", "error", err)
-		http.Error(rw, "failed to read request body", http.StatusBadRequest)
+	ciphertext, ok := s.readBody(rw, req)
+	if !ok {
 		return
 	}
 
+	_, span := tracing.Start(ctx, "Key.Decrypt", keyAttributes(key)...)
 	plaintext := key.Decrypt(ciphertext)
+	span.End()
+	if len(plaintext) == 0 && len(ciphertext) > 0 {
+		s.failKey(ctx, key)
+	} else if !s.useKey(rw, req, key, storage.OpDecrypt, len(ciphertext)) {
+		return
+	}
 
+	rw.Header().Set("Content-Type", "application/octet-stream")
 	rw.WriteHeader(http.StatusOK)
-	rw.Header().Set("Content-Type", "application/text")
 	rw.Write(plaintext)
 }
+
+// useKey counts the succeeded operation on the key, it is refused once the
+// key reached its max encryptions.
+func (s *Server) useKey(rw http.ResponseWriter, req *http.Request, key keys.Key, op storage.Operation, n int) bool {
+	err := s.usage.Use(req.Context(), key, op, n)
+	if err == storage.UsageLimitError {
+		http.Error(rw, "key usage limit reached, rotate the key", http.StatusConflict)
+		return false
+	}
+	if err != nil {
+		s.log(req.Context()).Error("failed to count key usage", "error", err)
+		http.Error(rw, "failed to count key usage", http.StatusInternalServerError)
+		return false
+	}
+	metrics.KeyOperations.WithLabelValues(op.String(), key.GetType(), key.GetSize()).Inc()
+
+	return true
+}
+
+// keyAttributes describe the key on the spans of its operations.
+func keyAttributes(key keys.Key) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("key.name", key.GetName()),
+		attribute.String("key.type", key.GetType()),
+		attribute.String("key.size", key.GetSize()),
+		attribute.Int64("key.version", int64(key.GetVersion())),
+	}
+}
+
+// failKey counts a failed operation, it is not counted as an encryption nor
+// a decryption.
+func (s *Server) failKey(ctx context.Context, key keys.Key) {
+	if err := s.usage.Fail(ctx, key); err != nil {
+		s.log(ctx).Error("failed to count key error", "error", err)
+	}
+}
+
+// valueOrZero returns the value of v, zero if nil.
+func valueOrZero[T any](v *T) T {
+	var zero T
+	if v == nil {
+		return zero
+	}
+
+	return *v
+}
+
+type keyUsage struct {
+	Encryptions    uint64    `json:"encryptions"`
+	Decryptions    uint64    `json:"decryptions"`
+	Errors         uint64    `json:"errors"`
+	BytesProcessed uint64    `json:"bytes_processed"`
+	LastUsed       time.Time `json:"last_used,omitzero"`
+	MaxEncryptions uint64    `json:"max_encryptions,omitempty"`
+}
+
+type keyMetadata struct {
+	Name       string    `json:"name"`
+	Type       string    `json:"type"`
+	Size       string    `json:"size"`
+	Version    uint64    `json:"version"`
+	CreatedAt  time.Time `json:"creation_time"`
+	ExpireTime time.Time `json:"expire_time,omitzero"`
+	Usage      keyUsage  `json:"usage"`
+}
+
+type keyList struct {
+	Keys []string `json:"keys"`
+}
+
+// ListKeys lists the names of the keys the caller can read, the route
+// requires no capability of its own. The in memory storage of a cluster
+// only knows the keys created through this node, a partial list is refused.
+func (s *Server) ListKeys(rw http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	if _, ok := s.storage.(groupStorage); ok && s.discovery != nil {
+		http.Error(rw, "listing the keys requires the raft or SQL storage in a cluster", http.StatusNotImplemented)
+		return
+	}
+
+	names, err := s.storage.List(ctx)
+	if err != nil {
+		s.log(ctx).Error("failed to list keys", "error", err)
+		http.Error(rw, "failed to list keys", http.StatusInternalServerError)
+		return
+	}
+
+	readable := []string{}
+	if claims := auth.GetClaimsFromContext(ctx); claims != nil {
+		for _, name := range names {
+			if s.acl.Allowed(claims.Policies, auth.KeyPath(name), auth.CapRead) {
+				readable = append(readable, name)
+			}
+		}
+	}
+
+	writeJSON(rw, http.StatusOK, keyList{Keys: readable})
+}
+
+// ReadKey describes a key and its usage, never its material.
+func (s *Server) ReadKey(rw http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	keyName, ok := transitKeyName(rw, req)
+	if !ok {
+		return
+	}
+
+	key, err := s.storage.Get(ctx, keyName)
+	if err != nil {
+		if err == storage.NotFoundError {
+			http.Error(rw, "key not found", http.StatusNotFound)
+			return
+		}
+		s.log(ctx).Error("failed to get key", "error", err)
+		http.Error(rw, "failed to get key", http.StatusInternalServerError)
+		return
+	}
+	audit.SetKeyVersion(ctx, key.GetVersion())
+
+	counters, err := s.usage.Usage(ctx, key)
+	if err != nil {
+		s.log(ctx).Error("failed to get key usage", "error", err)
+		http.Error(rw, "failed to get key usage", http.StatusInternalServerError)
+		return
+	}
+
+	metadata := keyMetadata{
+		Name:      key.GetName(),
+		Type:      key.GetType(),
+		Size:      key.GetSize(),
+		Version:   key.GetVersion(),
+		CreatedAt: key.GetCreatedAt(),
+		Usage: keyUsage{
+			Encryptions:    counters.Encryptions,
+			Decryptions:    counters.Decryptions,
+			Errors:         counters.Errors,
+			BytesProcessed: counters.BytesProcessed,
+			LastUsed:       counters.LastUsed,
+			MaxEncryptions: counters.MaxEncryptions,
+		},
+	}
+	// the keys without ttl do not expire
+	if key.GetTTL() > 0 {
+		metadata.ExpireTime = key.GetCreatedAt().Add(key.GetTTL())
+	}
+
+	writeJSON(rw, http.StatusOK, metadata)
+}
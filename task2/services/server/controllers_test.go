@@ -6,11 +6,13 @@ import (
 	"enclave-task2/pkg/keys"
 	"enclave-task2/pkg/keys/kyber"
 	"enclave-task2/pkg/storage"
+	"encoding/json"
 	"io"
 	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -25,7 +27,7 @@ func TestCreateKyberKey(t *testing.T) {
 		cache = storage.NewInMemoryCache()
 	}
 
-	server := New(cache)
+	server := New(WithStorage(cache))
 	server.logger = slog.New(slog.NewTextHandler(t.Output(), &slog.HandlerOptions{Level: slog.LevelDebug}))
 
 	t.Run("key name missing", func(t *testing.T) {
@@ -118,7 +120,7 @@ func TestRevokeKyberKey(t *testing.T) {
 	if cache == nil {
 		cache = storage.NewInMemoryCache()
 	}
-	server := New(cache)
+	server := New(WithStorage(cache))
 	server.logger = slog.New(slog.NewTextHandler(t.Output(), &slog.HandlerOptions{Level: slog.LevelDebug}))
 
 	key, err := keys.New(ctx, kyber.KeyType, kyber.Size1024, "test-key", keys.DefaultKeyTTL)
@@ -176,7 +178,7 @@ func TestEncrypt(t *testing.T) {
 		cache = storage.NewInMemoryCache()
 	}
 
-	server := New(cache)
+	server := New(WithStorage(cache))
 	server.logger = slog.New(slog.NewTextHandler(t.Output(), &slog.HandlerOptions{Level: slog.LevelDebug}))
 
 	key, err := keys.New(ctx, kyber.KeyType, kyber.Size1024, "test-key", keys.DefaultKeyTTL)
@@ -244,7 +246,7 @@ func TestDecrypt(t *testing.T) {
 		cache = storage.NewInMemoryCache()
 	}
 
-	server := New(cache)
+	server := New(WithStorage(cache))
 	server.logger = slog.New(slog.NewTextHandler(t.Output(), &slog.HandlerOptions{Level: slog.LevelDebug}))
 
 	key, err := keys.New(ctx, kyber.KeyType, kyber.Size1024, "test-key", keys.DefaultKeyTTL)
@@ -313,7 +315,7 @@ func TestEncryptDecryptLargeData(t *testing.T) {
 		cache = storage.NewInMemoryCache()
 	}
 
-	server := New(cache)
+	server := New(WithStorage(cache))
 	server.logger = slog.New(slog.NewTextHandler(t.Output(), &slog.HandlerOptions{Level: slog.LevelDebug}))
 
 	key, err := keys.New(ctx, kyber.KeyType, kyber.Size1024, "test-key", keys.DefaultKeyTTL)
@@ -359,3 +361,281 @@ func TestEncryptDecryptLargeData(t *testing.T) {
 
 	t.Log(decryptedText)
 }
+
+func TestCreateKyberKeySQLStorage(t *testing.T) {
+	ctx := context.Background()
+	sqlStorage, err := storage.NewSQLStorage(ctx, storage.DialectSQLite, t.TempDir()+"/keys.db")
+	assert.NoError(t, err)
+	defer sqlStorage.Close()
+
+	server := New(WithStorage(sqlStorage))
+	server.logger = slog.New(slog.NewTextHandler(t.Output(), &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	for _, ttl := range []string{"10m", "20m"} {
+		req := httptest.NewRequest(http.MethodPost, "/transit/keys/sql-key", nil)
+		req.SetPathValue("name", "sql-key")
+		req.Header.Set("X-Key-TTL", ttl)
+		rw := httptest.NewRecorder()
+
+		server.CreateKyberKey(rw, req)
+
+		assert.Equal(t, http.StatusNoContent, rw.Result().StatusCode)
+	}
+
+	k, err := sqlStorage.Get(ctx, "sql-key")
+	assert.NoError(t, err)
+	assert.Equal(t, 20*time.Minute, k.GetTTL())
+}
+
+func TestCreateKyberKeyDefaults(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewNamedInMemoryCache("key-defaults")
+
+	server := New(WithStorage(store), WithKeyDefaults(kyber.KeyType, kyber.Size512, time.Hour))
+	server.logger = slog.New(slog.NewTextHandler(t.Output(), &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	req := httptest.NewRequest(http.MethodPost, "/transit/keys/default-key", nil)
+	req.SetPathValue("name", "default-key")
+	rw := httptest.NewRecorder()
+
+	server.CreateKyberKey(rw, req)
+
+	assert.Equal(t, http.StatusNoContent, rw.Result().StatusCode)
+
+	k, err := store.Get(ctx, "default-key")
+	assert.NoError(t, err)
+	assert.Equal(t, kyber.KeyType, k.GetType())
+	assert.Equal(t, kyber.Size512, k.GetSize())
+	assert.Equal(t, time.Hour, k.GetTTL())
+}
+
+func TestCreateKyberKeyConcurrent(t *testing.T) {
+	ctx := context.Background()
+	if cache == nil {
+		cache = storage.NewInMemoryCache()
+	}
+
+	server := New(WithStorage(cache))
+	server.logger = slog.New(slog.NewTextHandler(t.Output(), &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	err := cache.Delete(ctx, "concurrent-key")
+	assert.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodPost, "/transit/keys/concurrent-key", nil)
+			req.SetPathValue("name", "concurrent-key")
+			req.Header.Set("X-Key-Size", kyber.Size512)
+			rw := httptest.NewRecorder()
+
+			server.CreateKyberKey(rw, req)
+
+			assert.Equal(t, http.StatusNoContent, rw.Result().StatusCode)
+		}()
+	}
+	wg.Wait()
+
+	// a single key was created, every other request extended its TTL
+	k, err := cache.Get(ctx, "concurrent-key")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(10), k.GetVersion())
+}
+
+func TestReadKey(t *testing.T) {
+	ctx := context.Background()
+	if cache == nil {
+		cache = storage.NewInMemoryCache()
+	}
+
+	server := New(WithStorage(cache))
+	server.logger = slog.New(slog.NewTextHandler(t.Output(), &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	err := cache.Delete(ctx, "read-key")
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/transit/keys/read-key", nil)
+	req.SetPathValue("name", "read-key")
+	req.Header.Set("X-Key-Size", kyber.Size512)
+	rw := httptest.NewRecorder()
+	server.CreateKyberKey(rw, req)
+	assert.Equal(t, http.StatusNoContent, rw.Result().StatusCode)
+
+	req = httptest.NewRequest(http.MethodPost, "/transit/encrypt/read-key", strings.NewReader("Hello, World!"))
+	req.SetPathValue("name", "read-key")
+	rw = httptest.NewRecorder()
+	server.Encrypt(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Result().StatusCode)
+
+	req = httptest.NewRequest(http.MethodPost, "/transit/decrypt/read-key", strings.NewReader("not a ciphertext"))
+	req.SetPathValue("name", "read-key")
+	rw = httptest.NewRecorder()
+	server.Decrypt(rw, req)
+
+	t.Run("metadata and usage", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/transit/keys/read-key", nil)
+		req.SetPathValue("name", "read-key")
+		rw := httptest.NewRecorder()
+
+		server.ReadKey(rw, req)
+
+		assert.Equal(t, http.StatusOK, rw.Result().StatusCode)
+		var metadata keyMetadata
+		assert.NoError(t, json.Unmarshal(rw.Body.Bytes(), &metadata))
+		assert.Equal(t, "read-key", metadata.Name)
+		assert.Equal(t, kyber.KeyType, metadata.Type)
+		assert.Equal(t, kyber.Size512, metadata.Size)
+		assert.Equal(t, metadata.CreatedAt.Add(keys.DefaultKeyTTL), metadata.ExpireTime)
+		// the failed decryption is only counted as an error
+		assert.Equal(t, uint64(1), metadata.Usage.Encryptions)
+		assert.Equal(t, uint64(0), metadata.Usage.Decryptions)
+		assert.Equal(t, uint64(1), metadata.Usage.Errors)
+		assert.Equal(t, uint64(len("Hello, World!")), metadata.Usage.BytesProcessed)
+		assert.WithinDuration(t, time.Now(), metadata.Usage.LastUsed, time.Minute)
+		assert.NotContains(t, rw.Body.String(), "max_encryptions")
+	})
+
+	t.Run("key not found", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/transit/keys/non-existing-key", nil)
+		req.SetPathValue("name", "non-existing-key")
+		rw := httptest.NewRecorder()
+
+		server.ReadKey(rw, req)
+
+		assert.Equal(t, http.StatusNotFound, rw.Result().StatusCode)
+	})
+
+	t.Run("key without ttl", func(t *testing.T) {
+		key, err := keys.New(ctx, kyber.KeyType, kyber.Size512, "eternal-key", 0)
+		assert.NoError(t, err)
+		assert.NoError(t, cache.Put(ctx, key))
+		t.Cleanup(func() { cache.Delete(ctx, "eternal-key") })
+
+		req := httptest.NewRequest(http.MethodGet, "/transit/keys/eternal-key", nil)
+		req.SetPathValue("name", "eternal-key")
+		rw := httptest.NewRecorder()
+
+		server.ReadKey(rw, req)
+
+		assert.Equal(t, http.StatusOK, rw.Result().StatusCode)
+		assert.NotContains(t, rw.Body.String(), "expire_time")
+	})
+
+	t.Run("revoke resets the usage", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodDelete, "/transit/keys/read-key", nil)
+		req.SetPathValue("name", "read-key")
+		rw := httptest.NewRecorder()
+		server.RevokeKyberKey(rw, req)
+		assert.Equal(t, http.StatusNoContent, rw.Result().StatusCode)
+
+		_, err := cache.Get(ctx, "usage/read-key")
+		assert.Equal(t, storage.NotFoundError, err)
+	})
+}
+
+func TestKeyUsageLimit(t *testing.T) {
+	ctx := context.Background()
+	if cache == nil {
+		cache = storage.NewInMemoryCache()
+	}
+
+	server := New(WithStorage(cache))
+	server.logger = slog.New(slog.NewTextHandler(t.Output(), &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	err := cache.Delete(ctx, "limited-key")
+	assert.NoError(t, err)
+
+	t.Run("invalid max encryptions", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/transit/keys/limited-key", nil)
+		req.SetPathValue("name", "limited-key")
+		req.Header.Set("X-Key-Max-Encryptions", "-1")
+		rw := httptest.NewRecorder()
+
+		server.CreateKyberKey(rw, req)
+
+		assert.Equal(t, http.StatusBadRequest, rw.Result().StatusCode)
+		assert.Equal(t, "invalid max encryptions\n", rw.Body.String())
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/transit/keys/limited-key", nil)
+	req.SetPathValue("name", "limited-key")
+	req.Header.Set("X-Key-Size", kyber.Size512)
+	req.Header.Set("X-Key-Max-Encryptions", "2")
+	rw := httptest.NewRecorder()
+	server.CreateKyberKey(rw, req)
+	assert.Equal(t, http.StatusNoContent, rw.Result().StatusCode)
+
+	encrypt := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/transit/encrypt/limited-key", strings.NewReader("Hello, World!"))
+		req.SetPathValue("name", "limited-key")
+		rw := httptest.NewRecorder()
+		server.Encrypt(rw, req)
+		return rw
+	}
+
+	var ciphertext []byte
+	for range 2 {
+		rw := encrypt()
+		assert.Equal(t, http.StatusOK, rw.Result().StatusCode)
+		ciphertext = rw.Body.Bytes()
+	}
+
+	t.Run("limit reached", func(t *testing.T) {
+		rw := encrypt()
+
+		assert.Equal(t, http.StatusConflict, rw.Result().StatusCode)
+		assert.Equal(t, "key usage limit reached, rotate the key\n", rw.Body.String())
+	})
+
+	t.Run("decrypt still allowed", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/transit/decrypt/limited-key", bytes.NewReader(ciphertext))
+		req.SetPathValue("name", "limited-key")
+		rw := httptest.NewRecorder()
+
+		server.Decrypt(rw, req)
+
+		assert.Equal(t, http.StatusOK, rw.Result().StatusCode)
+		assert.Equal(t, "Hello, World!", rw.Body.String())
+	})
+
+	t.Run("existing key", func(t *testing.T) {
+		update := func(header map[string]string) {
+			req := httptest.NewRequest(http.MethodPost, "/transit/keys/limited-key", nil)
+			req.SetPathValue("name", "limited-key")
+			for k, v := range header {
+				req.Header.Set(k, v)
+			}
+			rw := httptest.NewRecorder()
+			server.CreateKyberKey(rw, req)
+			assert.Equal(t, http.StatusNoContent, rw.Result().StatusCode)
+		}
+
+		// the limit is raised, the counters are kept
+		update(map[string]string{"X-Key-Max-Encryptions": "3"})
+		assert.Equal(t, http.StatusOK, encrypt().Result().StatusCode)
+		assert.Equal(t, http.StatusConflict, encrypt().Result().StatusCode)
+
+		// and kept without the header
+		update(nil)
+		assert.Equal(t, http.StatusConflict, encrypt().Result().StatusCode)
+	})
+
+	t.Run("rotation resets the counters", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodDelete, "/transit/keys/limited-key", nil)
+		req.SetPathValue("name", "limited-key")
+		rw := httptest.NewRecorder()
+		server.RevokeKyberKey(rw, req)
+		assert.Equal(t, http.StatusNoContent, rw.Result().StatusCode)
+
+		req = httptest.NewRequest(http.MethodPost, "/transit/keys/limited-key", nil)
+		req.SetPathValue("name", "limited-key")
+		req.Header.Set("X-Key-Size", kyber.Size512)
+		rw = httptest.NewRecorder()
+		server.CreateKyberKey(rw, req)
+		assert.Equal(t, http.StatusNoContent, rw.Result().StatusCode)
+
+		assert.Equal(t, http.StatusOK, encrypt().Result().StatusCode)
+	})
+}
@@ -0,0 +1,278 @@
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"enclave-task2/pkg/transitpb"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// grpcMessageOverhead is added to MaxBodyBytes for the other fields of the
+// messages.
+const grpcMessageOverhead = 1 << 10
+
+// grpcHeaders are the metadata passed to the api as headers.
+var grpcHeaders = []string{"authorization", "x-request-id", "traceparent", "tracestate"}
+
+// WithGRPC serves the transit api over gRPC on addr, see transitpb. It is
+// served over TLS with the configuration of the api.
+func WithGRPC(addr string) Option {
+	return func(s *Server) {
+		s.grpcAddr = addr
+	}
+}
+
+// newGRPCServer creates the gRPC server of the transit api.
+func (s *Server) newGRPCServer() *grpc.Server {
+	var opts []grpc.ServerOption
+	if s.api.TLSConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(s.api.TLSConfig)))
+	}
+	if s.limits.MaxBodyBytes > 0 {
+		opts = append(opts, grpc.MaxRecvMsgSize(int(s.limits.MaxBodyBytes)+grpcMessageOverhead))
+	}
+	if s.limits.ReadHeaderTimeout > 0 {
+		opts = append(opts, grpc.ConnectionTimeout(s.limits.ReadHeaderTimeout))
+	}
+	if s.limits.IdleTimeout > 0 {
+		opts = append(opts, grpc.KeepaliveParams(keepalive.ServerParameters{MaxConnectionIdle: s.limits.IdleTimeout}))
+	}
+
+	srv := grpc.NewServer(opts...)
+	transitpb.RegisterTransitServer(srv, &transitService{server: s})
+
+	return srv
+}
+
+// transitService serves the RPCs with the routes of the api, they go through
+// the same authentication, policies, rate limits and audit log.
+type transitService struct {
+	transitpb.UnimplementedTransitServer
+	server *Server
+}
+
+// call serves an api request on behalf of an RPC, the errors are mapped to
+// their gRPC status.
+func (t *transitService) call(ctx context.Context, method, path string, header http.Header, body []byte) (*bufferedResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, method, path, bytes.NewReader(body))
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, name := range grpcHeaders {
+		for _, v := range md.Get(name) {
+			req.Header.Add(name, v)
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		req.RemoteAddr = p.Addr.String()
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			req.TLS = &info.State
+		}
+	}
+
+	rw := &bufferedResponse{header: make(http.Header), status: http.StatusOK}
+	t.server.api.Handler.ServeHTTP(rw, req)
+
+	if id := rw.header.Get(RequestIDHeader); id != "" {
+		grpc.SetHeader(ctx, metadata.Pairs("x-request-id", id))
+	}
+	if rw.status >= http.StatusBadRequest {
+		return nil, status.Error(grpcCode(rw.status), strings.TrimSpace(rw.body.String()))
+	}
+
+	return rw, nil
+}
+
+// grpcCode maps the status of an api response to its gRPC code.
+func grpcCode(httpStatus int) codes.Code {
+	switch httpStatus {
+	case http.StatusBadRequest:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusConflict:
+		return codes.FailedPrecondition
+	case http.StatusRequestEntityTooLarge, http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusNotImplemented:
+		return codes.Unimplemented
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+	default:
+		return codes.Internal
+	}
+}
+
+// transitPath returns the api path of the key of an RPC.
+func transitPath(route, name string) (string, error) {
+	if name == "" {
+		return "", status.Error(codes.InvalidArgument, "key name is required")
+	}
+
+	return "/transit/" + route + "/" + url.PathEscape(name), nil
+}
+
+func (t *transitService) CreateKey(ctx context.Context, in *transitpb.CreateKeyRequest) (*transitpb.CreateKeyResponse, error) {
+	path, err := transitPath("keys", in.GetName())
+	if err != nil {
+		return nil, err
+	}
+
+	header := http.Header{}
+	if in.GetType() != "" {
+		header.Set("X-Key-Type", in.GetType())
+	}
+	if in.GetSize() != "" {
+		header.Set("X-Key-Size", in.GetSize())
+	}
+	if in.GetTtl() != nil {
+		header.Set("X-Key-TTL", in.GetTtl().AsDuration().String())
+	}
+	if in.GetMaxEncryptions() > 0 {
+		header.Set("X-Key-Max-Encryptions", strconv.FormatUint(in.GetMaxEncryptions(), 10))
+	}
+
+	if _, err := t.call(ctx, http.MethodPost, path, header, nil); err != nil {
+		return nil, err
+	}
+
+	return &transitpb.CreateKeyResponse{}, nil
+}
+
+func (t *transitService) GetKey(ctx context.Context, in *transitpb.GetKeyRequest) (*transitpb.Key, error) {
+	path, err := transitPath("keys", in.GetName())
+	if err != nil {
+		return nil, err
+	}
+
+	rw, err := t.call(ctx, http.MethodGet, path, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var key keyMetadata
+	if err := json.Unmarshal(rw.body.Bytes(), &key); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &transitpb.Key{
+		Name:         key.Name,
+		Type:         key.Type,
+		Size:         key.Size,
+		Version:      key.Version,
+		CreationTime: timestamp(key.CreatedAt),
+		ExpireTime:   timestamp(key.ExpireTime),
+		Usage: &transitpb.KeyUsage{
+			Encryptions:    key.Usage.Encryptions,
+			Decryptions:    key.Usage.Decryptions,
+			Errors:         key.Usage.Errors,
+			BytesProcessed: key.Usage.BytesProcessed,
+			LastUsed:       timestamp(key.Usage.LastUsed),
+			MaxEncryptions: key.Usage.MaxEncryptions,
+		},
+	}, nil
+}
+
+// timestamp returns nil for the zero time.
+func timestamp(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+
+	return timestamppb.New(t)
+}
+
+func (t *transitService) DeleteKey(ctx context.Context, in *transitpb.DeleteKeyRequest) (*transitpb.DeleteKeyResponse, error) {
+	path, err := transitPath("keys", in.GetName())
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := t.call(ctx, http.MethodDelete, path, nil, nil); err != nil {
+		return nil, err
+	}
+
+	return &transitpb.DeleteKeyResponse{}, nil
+}
+
+func (t *transitService) Encrypt(ctx context.Context, in *transitpb.EncryptRequest) (*transitpb.EncryptResponse, error) {
+	path, err := transitPath("encrypt", in.GetName())
+	if err != nil {
+		return nil, err
+	}
+
+	rw, err := t.call(ctx, http.MethodPost, path, nil, in.GetPlaintext())
+	if err != nil {
+		return nil, err
+	}
+
+	return &transitpb.EncryptResponse{Ciphertext: rw.body.Bytes()}, nil
+}
+
+func (t *transitService) Decrypt(ctx context.Context, in *transitpb.DecryptRequest) (*transitpb.DecryptResponse, error) {
+	path, err := transitPath("decrypt", in.GetName())
+	if err != nil {
+		return nil, err
+	}
+
+	rw, err := t.call(ctx, http.MethodPost, path, nil, in.GetCiphertext())
+	if err != nil {
+		return nil, err
+	}
+
+	return &transitpb.DecryptResponse{Plaintext: rw.body.Bytes()}, nil
+}
+
+// EncryptStream encrypts the messages in order, each one is a request of
+// the api. The stream stops at the first error.
+func (t *transitService) EncryptStream(stream grpc.BidiStreamingServer[transitpb.EncryptRequest, transitpb.EncryptResponse]) error {
+	var name string
+	for {
+		in, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name = cmp.Or(in.GetName(), name)
+		path, err := transitPath("encrypt", name)
+		if err != nil {
+			return err
+		}
+
+		rw, err := t.call(stream.Context(), http.MethodPost, path, nil, in.GetPlaintext())
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(&transitpb.EncryptResponse{Ciphertext: rw.body.Bytes()}); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"context"
+	"enclave-task2/pkg/auth"
+	"enclave-task2/pkg/common"
+	"enclave-task2/pkg/storage"
+	"enclave-task2/pkg/transitpb"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+func TestGRPC(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(t.Output(), nil))
+	ctx, cancel := context.WithCancel(common.LoggerWithContext(context.Background(), logger))
+	defer cancel()
+
+	reader, err := auth.ParsePolicy("reader", []byte(`{"path": {"transit/keys/*": {"capabilities": ["read"]}}}`))
+	assert.NoError(t, err)
+
+	addr := freeAddr(t)
+	server := New(WithStorage(storage.NewNamedInMemoryCache("grpc")), WithAddr(freeAddr(t), freeAddr(t)), WithGRPC(addr),
+		WithJWTVerifier(testVerifier(t)), WithACL(auth.NewACL(reader)),
+	)
+	done := make(chan error, 1)
+	go func() { done <- server.Start(ctx) }()
+	assert.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	}, 2*time.Second, 5*time.Millisecond)
+
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.NoError(t, err)
+	defer conn.Close()
+	client := transitpb.NewTransitClient(conn)
+
+	withToken := func(policies ...string) context.Context {
+		token := signTestToken(jwt.MapClaims{"sub": "grpc", "policies": policies})
+		return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+	}
+	root := withToken("root")
+
+	t.Run("unauthenticated", func(t *testing.T) {
+		_, err := client.GetKey(ctx, &transitpb.GetKeyRequest{Name: "grpc-key"})
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	})
+
+	t.Run("key lifecycle", func(t *testing.T) {
+		_, err := client.CreateKey(root, &transitpb.CreateKeyRequest{Name: "grpc-key", Size: "768", Ttl: durationpb.New(time.Hour), MaxEncryptions: 10})
+		assert.NoError(t, err)
+
+		var header metadata.MD
+		key, err := client.GetKey(root, &transitpb.GetKeyRequest{Name: "grpc-key"}, grpc.Header(&header))
+		assert.NoError(t, err)
+		assert.Equal(t, "grpc-key", key.GetName())
+		assert.Equal(t, "768", key.GetSize())
+		assert.Equal(t, uint64(10), key.GetUsage().GetMaxEncryptions())
+		assert.WithinDuration(t, key.GetCreationTime().AsTime().Add(time.Hour), key.GetExpireTime().AsTime(), time.Second)
+		assert.Nil(t, key.GetUsage().GetLastUsed())
+		assert.NotEmpty(t, header.Get("x-request-id"))
+
+		encrypted, err := client.Encrypt(root, &transitpb.EncryptRequest{Name: "grpc-key", Plaintext: []byte("hello")})
+		assert.NoError(t, err)
+		decrypted, err := client.Decrypt(root, &transitpb.DecryptRequest{Name: "grpc-key", Ciphertext: encrypted.GetCiphertext()})
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(decrypted.GetPlaintext()))
+
+		stream, err := client.EncryptStream(root)
+		assert.NoError(t, err)
+		for i, msg := range []*transitpb.EncryptRequest{{Name: "grpc-key", Plaintext: []byte("a")}, {Plaintext: []byte("b")}} {
+			assert.NoError(t, stream.Send(msg))
+			res, err := stream.Recv()
+			assert.NoError(t, err)
+			decrypted, err := client.Decrypt(root, &transitpb.DecryptRequest{Name: "grpc-key", Ciphertext: res.GetCiphertext()})
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"a", "b"}[i], string(decrypted.GetPlaintext()))
+		}
+		assert.NoError(t, stream.CloseSend())
+
+		key, err = client.GetKey(root, &transitpb.GetKeyRequest{Name: "grpc-key"})
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(3), key.GetUsage().GetEncryptions())
+
+		_, err = client.DeleteKey(root, &transitpb.DeleteKeyRequest{Name: "grpc-key"})
+		assert.NoError(t, err)
+		_, err = client.GetKey(root, &transitpb.GetKeyRequest{Name: "grpc-key"})
+		assert.Equal(t, codes.NotFound, status.Code(err))
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		_, err := client.CreateKey(root, &transitpb.CreateKeyRequest{})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+		_, err = client.Encrypt(withToken("reader"), &transitpb.EncryptRequest{Name: "grpc-key", Plaintext: []byte("a")})
+		assert.Equal(t, codes.PermissionDenied, status.Code(err))
+		assert.Equal(t, "permission denied", status.Convert(err).Message())
+
+		_, err = client.CreateKey(root, &transitpb.CreateKeyRequest{Name: "a/b"})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+
+	cancel()
+	assert.NoError(t, <-done)
+}
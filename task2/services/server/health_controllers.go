@@ -0,0 +1,149 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	healthOK          = "ok"
+	healthUnavailable = "unavailable"
+
+	// the probes are unauthenticated, they are limited to keep them cheap
+	defaultHealthRate  = 20
+	defaultHealthBurst = 40
+
+	readyTimeout = 2 * time.Second
+)
+
+type healthCheck struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Members is the number of members of the cluster, the server included.
+	Members int `json:"members,omitempty"`
+}
+
+type healthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]healthCheck `json:"checks,omitempty"`
+}
+
+// WithHealthRateLimit limits the requests per second to the health routes,
+// they are served without authentication. The default is 20 per second
+// with bursts of 40.
+func WithHealthRateLimit(limit rate.Limit, burst int) Option {
+	return func(s *Server) {
+		s.healthLimiter = rate.NewLimiter(limit, burst)
+	}
+}
+
+// limitHealth refuses the probes beyond the rate limit.
+func (s *Server) limitHealth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !s.healthLimiter.Allow() {
+			http.Error(rw, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// Health is the liveness probe, the server is alive as long as it answers.
+func (s *Server) Health(rw http.ResponseWriter, req *http.Request) {
+	writeHealth(rw, req, healthResponse{Status: healthOK})
+}
+
+// Ready is the readiness probe. The server is ready when it is not shutting
+// down, the storage can be read, the token store is initialized and, for the
+// clustered servers, the raft leader is known, the peers were discovered and
+// the peer listener is up.
+func (s *Server) Ready(rw http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithTimeout(req.Context(), readyTimeout)
+	defer cancel()
+
+	checks := map[string]healthCheck{}
+
+	if s.draining.Load() {
+		checks["shutdown"] = newHealthCheck(fmt.Errorf("the server is shutting down"))
+	}
+
+	initialized, err := s.tokens.Initialized(ctx)
+	checks["storage"] = newHealthCheck(err)
+	if err == nil && !initialized {
+		err = fmt.Errorf("the token store is not initialized")
+	}
+	checks["initialized"] = newHealthCheck(err)
+
+	if ls, ok := s.storage.(leaderStorage); ok {
+		err = nil
+		if ls.Leader() == "" {
+			err = fmt.Errorf("no raft leader")
+		}
+		checks["leader"] = newHealthCheck(err)
+	}
+
+	if s.discovery != nil {
+		err = nil
+		if !s.peersJoined.Load() {
+			err = fmt.Errorf("the peers are not discovered yet")
+		}
+		check := newHealthCheck(err)
+		check.Members = len(s.pool.Members())
+		checks["peers"] = check
+	}
+
+	if s.clustered() {
+		err = nil
+		if !s.peerListening.Load() {
+			err = fmt.Errorf("the peer listener is not started")
+		}
+		checks["peer_listener"] = newHealthCheck(err)
+	}
+
+	res := healthResponse{Status: healthOK, Checks: checks}
+	for _, check := range checks {
+		if check.Status != healthOK {
+			res.Status = healthUnavailable
+		}
+	}
+	if res.Status != healthOK {
+		s.log(ctx).Warn("server not ready", "checks", checks)
+	}
+
+	writeHealth(rw, req, res)
+}
+
+func newHealthCheck(err error) healthCheck {
+	if err != nil {
+		return healthCheck{Status: healthUnavailable, Error: err.Error()}
+	}
+
+	return healthCheck{Status: healthOK}
+}
+
+// writeHealth writes the response of a probe. The status codes default to
+// 200 and 503, they are overridden by the ok_code and fail_code query
+// parameters, e.g. for the orchestrators only accepting 2xx as success.
+func writeHealth(rw http.ResponseWriter, req *http.Request, res healthResponse) {
+	param, status := "ok_code", http.StatusOK
+	if res.Status != healthOK {
+		param, status = "fail_code", http.StatusServiceUnavailable
+	}
+
+	if v := req.URL.Query().Get(param); v != "" {
+		code, err := strconv.Atoi(v)
+		if err != nil || code < 100 || code > 599 {
+			http.Error(rw, "invalid "+param, http.StatusBadRequest)
+			return
+		}
+		status = code
+	}
+
+	writeJSON(rw, status, res)
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"context"
+	"enclave-task2/pkg/cluster"
+	"enclave-task2/pkg/cluster/clustertest"
+	"enclave-task2/pkg/keys"
+	"enclave-task2/pkg/storage"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// unreachableStorage fails every read like a database which is down.
+type unreachableStorage struct {
+	Storage
+}
+
+func (unreachableStorage) Get(ctx context.Context, key string) (keys.Key, error) {
+	return nil, errors.New("connection refused")
+}
+
+func (unreachableStorage) GetEntry(ctx context.Context, name string) (*storage.Entry, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestHealth(t *testing.T) {
+	server := New(WithStorage(storage.NewNamedInMemoryCache("health")))
+
+	tests := []struct {
+		name   string
+		query  string
+		status int
+	}{
+		{"default", "", http.StatusOK},
+		{"ok code", "?ok_code=204", http.StatusNoContent},
+		{"invalid ok code", "?ok_code=ok", http.StatusBadRequest},
+		{"out of range ok code", "?ok_code=999", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			server.Health(rw, httptest.NewRequest(http.MethodGet, "/sys/health"+tt.query, nil))
+
+			assert.Equal(t, tt.status, rw.Code)
+			if tt.status < http.StatusBadRequest {
+				assert.JSONEq(t, `{"status": "ok"}`, rw.Body.String())
+			}
+		})
+	}
+}
+
+func TestReady(t *testing.T) {
+	ctx := context.Background()
+	ready := func(t *testing.T, server *Server, query string) (int, healthResponse) {
+		rw := httptest.NewRecorder()
+		server.Ready(rw, httptest.NewRequest(http.MethodGet, "/sys/ready"+query, nil))
+
+		var res healthResponse
+		assert.NoError(t, json.Unmarshal(rw.Body.Bytes(), &res))
+		return rw.Code, res
+	}
+
+	t.Run("single node", func(t *testing.T) {
+		server := New(WithStorage(storage.NewNamedInMemoryCache("ready")))
+		server.logger = slog.New(slog.NewTextHandler(t.Output(), nil))
+
+		status, res := ready(t, server, "")
+		assert.Equal(t, http.StatusServiceUnavailable, status)
+		assert.Equal(t, healthUnavailable, res.Status)
+		assert.Equal(t, healthOK, res.Checks["storage"].Status)
+		assert.Equal(t, "the token store is not initialized", res.Checks["initialized"].Error)
+
+		status, _ = ready(t, server, "?fail_code=429")
+		assert.Equal(t, http.StatusTooManyRequests, status)
+
+		_, err := server.tokens.Init(ctx)
+		assert.NoError(t, err)
+
+		status, res = ready(t, server, "")
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, healthResponse{Status: healthOK, Checks: map[string]healthCheck{
+			"storage":     {Status: healthOK},
+			"initialized": {Status: healthOK},
+		}}, res)
+	})
+
+	t.Run("storage unreachable", func(t *testing.T) {
+		server := New(WithStorage(unreachableStorage{storage.NewNamedInMemoryCache("ready-unreachable")}))
+		server.logger = slog.New(slog.NewTextHandler(t.Output(), nil))
+
+		status, res := ready(t, server, "")
+		assert.Equal(t, http.StatusServiceUnavailable, status)
+		assert.Equal(t, "connection refused", res.Checks["storage"].Error)
+	})
+
+	t.Run("cluster", func(t *testing.T) {
+		server := New(WithStorage(storage.NewNamedInMemoryCache("ready-cluster")),
+			WithPeerDiscovery("https://127.0.0.1:8081", &cluster.Static{}),
+			WithPeerTLS(clustertest.NewCA(t).PeerTLS(t)),
+		)
+		server.logger = slog.New(slog.NewTextHandler(t.Output(), nil))
+		_, err := server.tokens.Init(ctx)
+		assert.NoError(t, err)
+
+		status, res := ready(t, server, "")
+		assert.Equal(t, http.StatusServiceUnavailable, status)
+		assert.Equal(t, healthUnavailable, res.Checks["peers"].Status)
+		assert.Equal(t, healthUnavailable, res.Checks["peer_listener"].Status)
+
+		server.peersJoined.Store(true)
+		server.peerListening.Store(true)
+
+		status, res = ready(t, server, "")
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, healthCheck{Status: healthOK, Members: 1}, res.Checks["peers"])
+	})
+}
+
+func TestHealthRateLimit(t *testing.T) {
+	server := New(WithStorage(storage.NewNamedInMemoryCache("health-rate")), WithHealthRateLimit(0, 2))
+	handler := server.limitHealth(http.HandlerFunc(server.Health))
+
+	for _, status := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/sys/health", nil))
+		assert.Equal(t, status, rw.Code)
+	}
+}
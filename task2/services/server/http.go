@@ -0,0 +1,152 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// HTTPLimits are the timeouts and sizes of the api requests and the drain
+// of the requests on shutdown. A zero timeout or body size is unlimited.
+type HTTPLimits struct {
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	// MaxHeaderBytes defaults to http.DefaultMaxHeaderBytes.
+	MaxHeaderBytes int
+	// MaxBodyBytes bounds the plaintexts and ciphertexts of the transit
+	// routes.
+	MaxBodyBytes int64
+
+	// ShutdownDelay is the time the server is not ready before it stops
+	// accepting requests, for the load balancers to take it out.
+	ShutdownDelay time.Duration
+	// ShutdownTimeout bounds the drain of the in-flight requests, the ones
+	// left are aborted.
+	ShutdownTimeout time.Duration
+}
+
+// DefaultHTTPLimits are the limits of the servers created without
+// WithHTTPLimits.
+var DefaultHTTPLimits = HTTPLimits{
+	ReadHeaderTimeout: 10 * time.Second,
+	ReadTimeout:       30 * time.Second,
+	WriteTimeout:      60 * time.Second,
+	IdleTimeout:       2 * time.Minute,
+	MaxHeaderBytes:    http.DefaultMaxHeaderBytes,
+	MaxBodyBytes:      4 << 20,
+	ShutdownTimeout:   5 * time.Second,
+}
+
+// WithHTTPLimits sets the timeouts and sizes of the api requests and the
+// drain on shutdown, see DefaultHTTPLimits.
+func WithHTTPLimits(limits HTTPLimits) Option {
+	return func(s *Server) {
+		s.limits = limits
+	}
+}
+
+// applyLimits configures the listeners, the peers get the same header and
+// idle limits. Their requests carry whole groupcache values and are not
+// bounded.
+func (s *Server) applyLimits() {
+	for _, srv := range []*http.Server{s.api, s.gc} {
+		srv.ReadHeaderTimeout = s.limits.ReadHeaderTimeout
+		srv.IdleTimeout = s.limits.IdleTimeout
+		srv.MaxHeaderBytes = s.limits.MaxHeaderBytes
+	}
+	s.api.ReadTimeout = s.limits.ReadTimeout
+	s.api.WriteTimeout = s.limits.WriteTimeout
+}
+
+// readBody reads the body of a transit request up to MaxBodyBytes, the
+// larger bodies are refused with 413.
+func (s *Server) readBody(rw http.ResponseWriter, req *http.Request) ([]byte, bool) {
+	body := req.Body
+	if s.limits.MaxBodyBytes > 0 {
+		body = http.MaxBytesReader(rw, req.Body, s.limits.MaxBodyBytes)
+	}
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		if maxErr := (*http.MaxBytesError)(nil); errors.As(err, &maxErr) {
+			http.Error(rw, "request body too large", http.StatusRequestEntityTooLarge)
+			return nil, false
+		}
+		s.log(req.Context()).Error("failed to read request body", "error", err)
+		http.Error(rw, "failed to read request body", http.StatusBadRequest)
+		return nil, false
+	}
+
+	return data, true
+}
+
+// inFlightMiddleware counts the requests being served.
+func inFlightMiddleware(inFlight *atomic.Int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		inFlight.Add(1)
+		defer inFlight.Add(-1)
+
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// shutdown drains the listeners. The server first reports that it is not
+// ready during ShutdownDelay while serving the requests, then stops
+// accepting connections and waits for the in-flight requests and the key
+// generations up to ShutdownTimeout. The requests left are aborted.
+func (s *Server) shutdown() {
+	s.draining.Store(true)
+	s.logger.Info("draining the server", "delay", s.limits.ShutdownDelay, "in_flight", s.inFlight.Load())
+	time.Sleep(s.limits.ShutdownDelay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.limits.ShutdownTimeout)
+	defer cancel()
+
+	if s.grpc != nil {
+		stopped := make(chan struct{})
+		go func() {
+			s.grpc.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			s.logger.Warn("failed to drain the requests, closing the connections", "listener", "grpc", "error", ctx.Err().Error(), "aborted_requests", s.inFlight.Load())
+			s.grpc.Stop()
+		}
+	}
+
+	for _, srv := range []struct {
+		name     string
+		server   *http.Server
+		inFlight func() int64
+	}{
+		{"api", s.api, s.inFlight.Load},
+		{"peer", s.gc, nil},
+	} {
+		err := srv.server.Shutdown(ctx)
+		if err == nil {
+			continue
+		}
+
+		attrs := []any{"listener", srv.name, "error", err.Error()}
+		if srv.inFlight != nil {
+			attrs = append(attrs, "aborted_requests", srv.inFlight())
+		}
+		s.logger.Warn("failed to drain the requests, closing the connections", attrs...)
+		if err := srv.server.Close(); err != nil {
+			s.logger.Error("failed to close the listener", "listener", srv.name, "error", err.Error())
+		}
+	}
+
+	// the keys generated in the background are stored before the storage
+	// is closed
+	if err := s.jobs.wait(ctx); err != nil {
+		s.logger.Warn("failed to wait for the key generations", "error", err.Error(), "pending_jobs", s.jobs.pendingJobs())
+	}
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"enclave-task2/pkg/storage"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPLimits(t *testing.T) {
+	server := New(WithStorage(storage.NewNamedInMemoryCache("http-limits")))
+	assert.Equal(t, 30*time.Second, server.api.ReadTimeout)
+	assert.Equal(t, time.Minute, server.api.WriteTimeout)
+	assert.Equal(t, 10*time.Second, server.gc.ReadHeaderTimeout)
+	assert.Zero(t, server.gc.WriteTimeout)
+
+	server = New(WithStorage(storage.NewNamedInMemoryCache("http-limits-body")), WithHTTPLimits(HTTPLimits{
+		IdleTimeout:  time.Second,
+		MaxBodyBytes: 8,
+	}))
+	server.logger = slog.New(slog.NewTextHandler(t.Output(), nil))
+	assert.Equal(t, time.Second, server.api.IdleTimeout)
+	assert.Zero(t, server.api.ReadTimeout)
+
+	assert.Equal(t, http.StatusNoContent, createKey(server, "body-limit", nil).Code)
+
+	for _, tt := range []struct {
+		body   string
+		status int
+	}{
+		{"12345678", http.StatusOK},
+		{"123456789", http.StatusRequestEntityTooLarge},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/transit/encrypt/body-limit", strings.NewReader(tt.body))
+		req.SetPathValue("name", "body-limit")
+		rw := httptest.NewRecorder()
+		server.Encrypt(rw, req)
+		assert.Equal(t, tt.status, rw.Code, tt.body)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	var logs bytes.Buffer
+	server := New(WithStorage(storage.NewNamedInMemoryCache("http-shutdown")), WithHTTPLimits(HTTPLimits{
+		ShutdownDelay:   100 * time.Millisecond,
+		ShutdownTimeout: 100 * time.Millisecond,
+	}))
+	server.logger = slog.New(slog.NewTextHandler(&logs, nil))
+	_, err := server.tokens.Init(context.Background())
+	assert.NoError(t, err)
+
+	// the request is stuck until its connection is closed
+	server.api.Handler = inFlightMiddleware(&server.inFlight, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		<-req.Context().Done()
+	}))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go server.api.Serve(l)
+
+	aborted := make(chan error)
+	go func() {
+		_, err := http.Get("http://" + l.Addr().String())
+		aborted <- err
+	}()
+	assert.Eventually(t, func() bool { return server.inFlight.Load() == 1 }, time.Second, time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		server.shutdown()
+		close(done)
+	}()
+
+	// the server is not ready while it drains
+	assert.Eventually(t, server.draining.Load, time.Second, time.Millisecond)
+	rw := httptest.NewRecorder()
+	server.Ready(rw, httptest.NewRequest(http.MethodGet, "/sys/ready", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+	assert.Contains(t, rw.Body.String(), "the server is shutting down")
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the shutdown did not return")
+	}
+	assert.Error(t, <-aborted)
+	assert.Contains(t, logs.String(), "listener=api")
+	assert.Contains(t, logs.String(), "aborted_requests=1")
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"enclave-task2/pkg/keys"
+	"enclave-task2/pkg/storage"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	jobPending = "pending"
+	jobDone    = "done"
+	jobFailed  = "failed"
+
+	// jobRetention is how long the status of a finished job is kept.
+	jobRetention = 10 * time.Minute
+	// maxPendingJobs bounds the keys generated in the background.
+	maxPendingJobs = 64
+)
+
+// keyJob is the generation of a key requested with X-Key-Async.
+type keyJob struct {
+	ID        string    `json:"id"`
+	Key       string    `json:"key"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"creation_time"`
+	DoneAt    time.Time `json:"done_time,omitzero"`
+}
+
+// jobStore keeps the jobs of this server in memory, the status of a job is
+// only known by the server which accepted it. running tracks the
+// goroutines of the jobs, they are waited for on shutdown.
+type jobStore struct {
+	mu      sync.Mutex
+	jobs    map[string]*keyJob
+	pending int
+	running sync.WaitGroup
+}
+
+func newJobStore() *jobStore {
+	return &jobStore{jobs: make(map[string]*keyJob)}
+}
+
+// add registers a pending job for the key, or returns false when too many
+// jobs are pending.
+func (j *jobStore) add(keyName string) (keyJob, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.pending >= maxPendingJobs {
+		return keyJob{}, false
+	}
+
+	now := time.Now()
+	for id, job := range j.jobs {
+		if job.Status != jobPending && now.Sub(job.DoneAt) > jobRetention {
+			delete(j.jobs, id)
+		}
+	}
+
+	job := &keyJob{ID: rand.Text(), Key: keyName, Status: jobPending, CreatedAt: now}
+	j.jobs[job.ID] = job
+	j.pending++
+
+	return *job, true
+}
+
+// finish records the outcome of a job, msg is the error shown to the caller.
+func (j *jobStore) finish(id string, msg string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	job, ok := j.jobs[id]
+	if !ok {
+		return
+	}
+	job.Status = jobDone
+	if msg != "" {
+		job.Status, job.Error = jobFailed, msg
+	}
+	job.DoneAt = time.Now()
+	j.pending--
+}
+
+// run runs the job in the background.
+func (j *jobStore) run(fn func()) {
+	j.running.Go(fn)
+}
+
+// wait waits for the running jobs until ctx is done.
+func (j *jobStore) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		j.running.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// pendingJobs returns the number of jobs not finished yet.
+func (j *jobStore) pendingJobs() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.pending
+}
+
+func (j *jobStore) get(id string) (keyJob, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if job, ok := j.jobs[id]; ok {
+		return *job, true
+	}
+
+	return keyJob{}, false
+}
+
+// createKeyJob generates the key in the background and answers 202 with the
+// status URL of the job.
+func (s *Server) createKeyJob(rw http.ResponseWriter, req *http.Request, keyName, keyType, keySize string, ttl time.Duration, maxEncryptions *uint64) {
+	ctx := req.Context()
+	if err := keys.ValidateParams(keyType, keySize); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	job, ok := s.jobs.add(keyName)
+	if !ok {
+		rw.Header().Set("Retry-After", "1")
+		http.Error(rw, "too many pending key generations", http.StatusServiceUnavailable)
+		return
+	}
+	s.log(ctx).Info("key generation queued", "job", job.ID, "type", keyType, "size", keySize)
+
+	// the job outlives the request, it keeps its logger and trace
+	jobCtx := context.WithoutCancel(ctx)
+	s.jobs.run(func() {
+		s.jobs.finish(job.ID, s.generateKey(jobCtx, keyName, keyType, keySize, ttl, maxEncryptions))
+	})
+
+	rw.Header().Set("Location", "/transit/keys/"+keyName+"/jobs/"+job.ID)
+	writeJSON(rw, http.StatusAccepted, job)
+}
+
+// generateKey creates the key of a job like CreateKyberKey, it returns the
+// error shown to the caller.
+func (s *Server) generateKey(ctx context.Context, keyName, keyType, keySize string, ttl time.Duration, maxEncryptions *uint64) string {
+	key, err := keys.New(ctx, keyType, keySize, keyName, ttl)
+	if err != nil {
+		s.log(ctx).Error("failed to create key", "error", err)
+		return "failed to create key"
+	}
+
+	err = s.storage.Create(ctx, key)
+	if err == storage.AlreadyExistsError {
+		// the key was created meanwhile -> extend TTL
+		if _, err := s.updateKeyTTL(ctx, keyName, ttl, maxEncryptions); err != nil {
+			s.log(ctx).Error("failed to update key", "error", err)
+			return "failed to update key"
+		}
+		return ""
+	}
+	if err != nil {
+		s.log(ctx).Error("failed to store key", "error", err)
+		return "failed to store key"
+	}
+
+	if err := s.usage.Init(ctx, key, valueOrZero(maxEncryptions)); err != nil {
+		s.log(ctx).Error("failed to initialize key usage", "error", err)
+		return "failed to initialize key usage"
+	}
+	s.log(ctx).Info("key generated", "version", key.GetVersion())
+
+	return ""
+}
+
+// KeyJob returns the status of a key generation.
+func (s *Server) KeyJob(rw http.ResponseWriter, req *http.Request) {
+	keyName, ok := transitKeyName(rw, req)
+	if !ok {
+		return
+	}
+
+	job, ok := s.jobs.get(req.PathValue("id"))
+	if !ok || job.Key != keyName {
+		http.Error(rw, "job not found", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(rw, http.StatusOK, job)
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"enclave-task2/pkg/keys"
+	"enclave-task2/pkg/metrics"
+	"enclave-task2/pkg/storage"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func createKey(server *Server, name string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/transit/keys/"+name, nil)
+	req.SetPathValue("name", name)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	rw := httptest.NewRecorder()
+	server.CreateKyberKey(rw, req)
+
+	return rw
+}
+
+func TestCreateKeyFromPool(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cache := storage.NewNamedInMemoryCache("key-pool")
+
+	pool := keys.NewPool(1, 1, keys.Params{Type: "kyber", Size: "512"})
+	go pool.Run(ctx)
+	assert.Eventually(t, func() bool { return pool.Len("kyber", "512") == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	server := New(WithStorage(cache), WithKeyPool(pool), WithKeyDefaults("kyber", "512", time.Hour))
+	server.logger = slog.New(slog.NewTextHandler(t.Output(), nil))
+
+	// the pool is refilled in the background, the take is counted instead
+	hits := testutil.ToFloat64(metrics.KeyPoolTakes.WithLabelValues("kyber", "512", "hit"))
+	rw := createKey(server, "pooled", nil)
+	assert.Equal(t, http.StatusNoContent, rw.Code)
+	assert.Equal(t, hits+1, testutil.ToFloat64(metrics.KeyPoolTakes.WithLabelValues("kyber", "512", "hit")))
+
+	key, err := cache.Get(ctx, "pooled")
+	assert.NoError(t, err)
+	assert.Equal(t, "pooled", key.GetName())
+	assert.Equal(t, time.Hour, key.GetTTL())
+	assert.WithinDuration(t, time.Now(), key.GetCreatedAt(), time.Second)
+
+	// the keys which are not pooled are generated by the request
+	rw = createKey(server, "not-pooled", map[string]string{"X-Key-Size": "768"})
+	assert.Equal(t, http.StatusNoContent, rw.Code)
+	_, err = cache.Get(ctx, "not-pooled")
+	assert.NoError(t, err)
+}
+
+func TestCreateKeyAsync(t *testing.T) {
+	ctx := context.Background()
+	cache := storage.NewNamedInMemoryCache("key-async")
+	server := New(WithStorage(cache))
+	server.logger = slog.New(slog.NewTextHandler(t.Output(), nil))
+
+	job := func(t *testing.T, name, id string) (int, keyJob) {
+		req := httptest.NewRequest(http.MethodGet, "/transit/keys/"+name+"/jobs/"+id, nil)
+		req.SetPathValue("name", name)
+		req.SetPathValue("id", id)
+		rw := httptest.NewRecorder()
+		server.KeyJob(rw, req)
+
+		var res keyJob
+		if rw.Code == http.StatusOK {
+			assert.NoError(t, json.Unmarshal(rw.Body.Bytes(), &res))
+		}
+		return rw.Code, res
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		rw := createKey(server, "async", map[string]string{"X-Key-Async": "maybe"})
+		assert.Equal(t, http.StatusBadRequest, rw.Code)
+
+		rw = createKey(server, "async", map[string]string{"X-Key-Async": "true", "X-Key-Size": "2048"})
+		assert.Equal(t, http.StatusBadRequest, rw.Code)
+		assert.Equal(t, "unsupported kyber key size: 2048\n", rw.Body.String())
+	})
+
+	t.Run("accepted", func(t *testing.T) {
+		rw := createKey(server, "async", map[string]string{"X-Key-Async": "true", "X-Key-Max-Encryptions": "10"})
+		assert.Equal(t, http.StatusAccepted, rw.Code)
+
+		var accepted keyJob
+		assert.NoError(t, json.Unmarshal(rw.Body.Bytes(), &accepted))
+		assert.Equal(t, "async", accepted.Key)
+		assert.Equal(t, jobPending, accepted.Status)
+		assert.Equal(t, "/transit/keys/async/jobs/"+accepted.ID, rw.Header().Get("Location"))
+
+		assert.Eventually(t, func() bool {
+			_, res := job(t, "async", accepted.ID)
+			return res.Status == jobDone
+		}, 5*time.Second, 10*time.Millisecond)
+
+		key, err := cache.Get(ctx, "async")
+		assert.NoError(t, err)
+		counters, err := server.usage.Usage(ctx, key)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(10), counters.MaxEncryptions)
+
+		// the job is only visible through its key
+		status, _ := job(t, "other", accepted.ID)
+		assert.Equal(t, http.StatusNotFound, status)
+		status, _ = job(t, "async", "unknown")
+		assert.Equal(t, http.StatusNotFound, status)
+	})
+
+	t.Run("existing key", func(t *testing.T) {
+		rw := createKey(server, "async", map[string]string{"X-Key-Async": "true", "X-Key-TTL": "2h"})
+		assert.Equal(t, http.StatusNoContent, rw.Code)
+
+		key, err := cache.Get(ctx, "async")
+		assert.NoError(t, err)
+		assert.Equal(t, 2*time.Hour, key.GetTTL())
+	})
+
+	t.Run("too many jobs", func(t *testing.T) {
+		server.jobs.pending = maxPendingJobs
+		defer func() { server.jobs.pending = 0 }()
+
+		rw := createKey(server, "async-busy", map[string]string{"X-Key-Async": "true"})
+		assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+		assert.Equal(t, "1", rw.Header().Get("Retry-After"))
+	})
+}
+
+// blockingStorage blocks the creation of the keys until release is closed.
+type blockingStorage struct {
+	Storage
+	release chan struct{}
+}
+
+func (b blockingStorage) Create(ctx context.Context, key keys.Key) error {
+	<-b.release
+	return b.Storage.Create(ctx, key)
+}
+
+func TestShutdownWaitsForJobs(t *testing.T) {
+	var logs bytes.Buffer
+	blocking := blockingStorage{Storage: storage.NewNamedInMemoryCache("jobs-shutdown"), release: make(chan struct{})}
+	server := New(WithStorage(blocking), WithHTTPLimits(HTTPLimits{ShutdownTimeout: 100 * time.Millisecond}))
+	server.logger = slog.New(slog.NewTextHandler(&logs, nil))
+
+	// the job left is logged after the timeout
+	assert.Equal(t, http.StatusAccepted, createKey(server, "blocked", map[string]string{"X-Key-Async": "true"}).Code)
+	server.shutdown()
+	assert.Contains(t, logs.String(), "pending_jobs=1")
+
+	// the job is waited for until it is stored
+	server.limits.ShutdownTimeout = 5 * time.Second
+	done := make(chan struct{})
+	go func() {
+		server.shutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("the shutdown did not wait for the job")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(blocking.release)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the shutdown did not return")
+	}
+	_, err := blocking.Get(context.Background(), "blocked")
+	assert.NoError(t, err)
+}
@@ -1,42 +1,495 @@
 package server
 
 import (
+	"bytes"
+	"cmp"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"enclave-task2/pkg/audit"
+	"enclave-task2/pkg/auth"
+	"enclave-task2/pkg/common"
+	"enclave-task2/pkg/metrics"
+	"enclave-task2/pkg/ratelimit"
+	"enclave-task2/pkg/tracing"
+	"encoding/hex"
+	"log/slog"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
-var token = "I6IkpvaG4gRG9lIiwiYWRtaW4iOnRydWUsImlhdCI6MTUxNjIzOTAyMn0.KMUFsIDTnFmyG3nMiGM6H9FNFUROf3wh7SmqJp-QV30" // Should be replaced with a secure token management system
+// RequestIDHeader carries the id of a request, it is generated when the
+// caller does not send a valid one and echoed back in the response.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds the request ids accepted from the callers.
+const maxRequestIDLength = 128
 
-func initMiddlewares(ctx context.Context, next http.Handler) http.Handler {
-	return authMiddleware(
-		insertContextMiddleware(ctx, next),
+// the logins and the failed authentications of each client address are
+// limited to slow down the guessing of the credentials
+const (
+	defaultAuthRate  = 10
+	defaultAuthBurst = 20
+)
+
+func initMiddlewares(ctx context.Context, public, mux *http.ServeMux, verifier *auth.Verifier, tokens *auth.TokenStore, certAuth *auth.CertAuth, auditor *audit.Logger, failures authFailures, next http.Handler) http.Handler {
+	return requestContextMiddleware(common.GetLoggerFromContext(ctx), []*http.ServeMux{public, mux},
+		auditMiddleware(auditor, public, mux,
+			publicMiddleware(public,
+				authMiddleware(verifier, tokens, certAuth, failures, next),
+			),
+		),
 	)
 }
 
-func insertContextMiddleware(ctx context.Context, next http.Handler) http.Handler {
+// requestContextMiddleware keeps the context of the request, it is
+// cancelled when the client goes away, and attaches the logger of the
+// server enriched with the request id, the remote address and the route.
+func requestContextMiddleware(logger *slog.Logger, muxes []*http.ServeMux, next http.Handler) http.Handler {
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		id := requestID(req)
+		rw.Header().Set(RequestIDHeader, id)
+		trace.SpanFromContext(req.Context()).SetAttributes(attribute.String("request.id", id))
+
+		ctx := common.RequestIDWithContext(req.Context(), id)
+		ctx = common.LoggerWithContext(ctx, logger.With(
+			"request_id", id,
+			"remote_addr", req.RemoteAddr,
+			"route", routePattern(muxes, req),
+		))
+
+		next.ServeHTTP(rw, req.WithContext(ctx))
+	})
+}
+
+// requestID returns the id sent by the caller or a random one.
+func requestID(req *http.Request) string {
+	if id := req.Header.Get(RequestIDHeader); validRequestID(id) {
+		return id
+	}
+
+	return rand.Text()
+}
+
+// validRequestID accepts the printable ids, they end up in the logs.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// withIdentity puts the claims of the caller on the context and its
+// identity on the logger and the audit record of the request.
+func withIdentity(ctx context.Context, claims *auth.Claims) context.Context {
+	audit.SetAuth(ctx, audit.Auth{Subject: claims.Subject, Accessor: claims.ID, Policies: claims.Policies})
+	if logger := common.GetLoggerFromContext(ctx); logger != nil {
+		ctx = common.LoggerWithContext(ctx, logger.With("subject", claims.Subject, "accessor", claims.ID))
+	}
+
+	return auth.ClaimsWithContext(ctx, claims)
+}
+
+// publicMiddleware serves the routes of public without authentication, e.g.
+// the logins, the other requests are passed to next.
+func publicMiddleware(public *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if h, pattern := public.Handler(req); pattern != "" {
+			h.ServeHTTP(rw, req)
+			return
+		}
+
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// bearerToken returns the bearer token of the request.
+func bearerToken(req *http.Request) (string, bool) {
+	authHeader := req.Header["Authorization"]
+	if len(authHeader) == 0 || !strings.HasPrefix(authHeader[0], "Bearer ") {
+		return "", false
+	}
+
+	return strings.TrimPrefix(authHeader[0], "Bearer "), true
+}
+
+// authFailures limits the failed authentications of each client address,
+// the limited clients are answered 429 instead of 401.
+type authFailures struct {
+	limiter ratelimit.Limiter
+	limit   ratelimit.Limit
+}
+
+// reject answers a failed authentication.
+func (f authFailures) reject(rw http.ResponseWriter, req *http.Request, msg string) {
+	if f.limiter != nil {
+		if ok, delay := f.limiter.Allow(req.Context(), "auth/"+remoteAddr(req), f.limit); !ok {
+			tooManyRequests(rw, req, "auth", delay)
+			return
+		}
+	}
+
+	http.Error(rw, msg, http.StatusUnauthorized)
+}
+
+// authMiddleware validates the bearer service token or JWT and puts its
+// claims on the request context. Without bearer token the client
+// certificate verified by the TLS listener is used when certAuth is set.
+func authMiddleware(verifier *auth.Verifier, tokens *auth.TokenStore, certAuth *auth.CertAuth, failures authFailures, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
-		req = req.WithContext(ctx)
+		bearer, ok := bearerToken(req)
+		if !ok && certAuth != nil && req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+			claims, err := certAuth.Claims(req.TLS.VerifiedChains[0][0])
+			if err != nil {
+				if logger := common.GetLoggerFromContext(req.Context()); logger != nil {
+					logger.Debug("rejected certificate", "error", err.Error())
+				}
+				failures.reject(rw, req, "invalid certificate")
+				return
+			}
+
+			next.ServeHTTP(rw, req.WithContext(withIdentity(req.Context(), claims)))
+			return
+		}
+		if !ok {
+			failures.reject(rw, req, "missing or invalid authorization header")
+			return
+		}
+
+		var claims *auth.Claims
+		var err error
+		switch {
+		case strings.HasPrefix(bearer, auth.TokenPrefix):
+			var t *auth.Token
+			if t, err = tokens.Lookup(req.Context(), bearer); err == nil {
+				claims = t.Claims()
+			}
+		case verifier != nil:
+			claims, err = verifier.Verify(bearer)
+		default:
+			err = auth.NoKeysError
+		}
+		if err != nil {
+			if logger := common.GetLoggerFromContext(req.Context()); logger != nil {
+				logger.Debug("rejected token", "error", err.Error())
+			}
+			failures.reject(rw, req, "invalid token")
+			return
+		}
+
+		req = req.WithContext(withIdentity(req.Context(), claims))
 
 		next.ServeHTTP(rw, req)
 	})
 }
 
-func authMiddleware(next http.Handler) http.Handler {
+// keyPath is the policy path of the key of a transit route.
+func keyPath(req *http.Request) string {
+	return auth.KeyPath(req.PathValue("name"))
+}
+
+// rolePath is the policy path of the role of an AppRole route.
+func rolePath(req *http.Request) string {
+	return auth.RolePath(req.PathValue("name"))
+}
+
+// secretIDPath is the policy path of the secret ids of a role.
+func secretIDPath(req *http.Request) string {
+	return rolePath(req) + "/secret-id"
+}
+
+// fixedPath returns a policy path resolver for the routes without key.
+func fixedPath(p string) func(*http.Request) string {
+	return func(*http.Request) string { return p }
+}
+
+// requireCapability allows the request only if the policies of the caller
+// grant the capability on the policy path of the route.
+func requireCapability(acl *auth.ACL, c auth.Capability, path func(*http.Request) string, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		claims := auth.GetClaimsFromContext(req.Context())
+		if claims == nil || !acl.Allowed(claims.Policies, path(req), c) {
+			http.Error(rw, "permission denied", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// limitCaller applies the rate limit of the policies of the caller, the
+// callers are identified by their subject, see callerBucket.
+func limitCaller(limiter ratelimit.Limiter, acl *auth.ACL, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		claims := auth.GetClaimsFromContext(req.Context())
+		if claims != nil {
+			if ok, delay := limiter.Allow(req.Context(), callerBucket(req, claims), acl.RateLimit(claims.Policies)); !ok {
+				tooManyRequests(rw, req, "identity", delay)
+				return
+			}
+		}
+
+		next.ServeHTTP(rw, req)
+	})
+}
 
-		authHeader := req.Header["Authorization"]
-		if len(authHeader) == 0 || !strings.HasPrefix(authHeader[0], "Bearer ") {
-			http.Error(rw, "missing or invalid authorization header", http.StatusUnauthorized)
+// callerBucket names the bucket of a caller after its subject or token id.
+// The JWTs may have neither, their callers are told apart by their token,
+// hashed to keep it out of the peer requests, or by their address.
+func callerBucket(req *http.Request, claims *auth.Claims) string {
+	if identity := cmp.Or(claims.Subject, claims.ID); identity != "" {
+		return "identity/" + identity
+	}
+	if bearer, ok := bearerToken(req); ok {
+		sum := sha256.Sum256([]byte(bearer))
+		return "token/" + hex.EncodeToString(sum[:16])
+	}
+
+	return "addr/" + remoteAddr(req)
+}
+
+// limitAddr limits the requests of each client address, e.g. the logins
+// which are served without authentication.
+func limitAddr(limiter ratelimit.Limiter, limit ratelimit.Limit, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if ok, delay := limiter.Allow(req.Context(), "auth/"+remoteAddr(req), limit); !ok {
+			tooManyRequests(rw, req, "auth", delay)
 			return
 		}
 
-		jwtToken := strings.TrimPrefix(authHeader[0], "Bearer ")
-		if jwtToken != token {
-			http.Error(rw, "invalid token", http.StatusUnauthorized)
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// limitKey applies the key rate limit of the policies of the caller to the
+// key of the route, the callers holding the policy share it. The callers
+// without such a policy share the default limit.
+func limitKey(limiter ratelimit.Limiter, acl *auth.ACL, fallback ratelimit.Limit, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		bucket, limit := "key/"+req.PathValue("name"), fallback
+		if claims := auth.GetClaimsFromContext(req.Context()); claims != nil {
+			if policy, l := acl.KeyRateLimit(claims.Policies); policy != "" {
+				bucket = "policy/" + policy + "/" + bucket
+				limit = l
+			}
+		}
+
+		if ok, delay := limiter.Allow(req.Context(), bucket, limit); !ok {
+			tooManyRequests(rw, req, "key", delay)
 			return
 		}
 
 		next.ServeHTTP(rw, req)
 	})
 }
+
+func tooManyRequests(rw http.ResponseWriter, req *http.Request, scope string, delay time.Duration) {
+	metrics.RateLimited.WithLabelValues(scope).Inc()
+	if logger := common.GetLoggerFromContext(req.Context()); logger != nil {
+		logger.Warn("rate limit exceeded", "scope", scope, "retry_after", delay)
+	}
+
+	rw.Header().Set("Retry-After", strconv.Itoa(ratelimit.RetryAfter(delay)))
+	http.Error(rw, "rate limit exceeded", http.StatusTooManyRequests)
+}
+
+// auditMiddleware records the requests before serving them and their
+// response before sending it. It runs before the authentication, the
+// rejected credentials and rate limited callers are recorded too, the
+// identity of the caller is only known by the response entry. The public
+// routes are recorded only for the logins.
+//
+// The request entry is the gate: a request which can not be recorded is
+// refused before it is served. The response entry is written once the
+// handler ran, its side effects (a created key, an issued token) are then
+// already applied. The buffered response is withheld with a 503 telling
+// the operation may have been applied, the caller reads the state again
+// rather than retrying blindly.
+func auditMiddleware(auditor *audit.Logger, public, mux *http.ServeMux, next http.Handler) http.Handler {
+	if auditor == nil {
+		return next
+	}
+	muxes := []*http.ServeMux{public, mux}
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !audited(public, req) {
+			next.ServeHTTP(rw, req)
+			return
+		}
+
+		start := time.Now()
+		logger := common.GetLoggerFromContext(req.Context())
+
+		entry := audit.Entry{
+			Time: start,
+			Type: audit.TypeRequest,
+			Request: audit.Request{
+				ID:         common.GetRequestIDFromContext(req.Context()),
+				Operation:  routePattern(muxes, req),
+				Method:     req.Method,
+				Path:       req.URL.Path,
+				RemoteAddr: req.RemoteAddr,
+			},
+		}
+		entry.Auth.Token, _ = bearerToken(req)
+
+		if err := auditor.Log(entry); err != nil {
+			logger.Error("failed to audit request", "error", err.Error())
+			http.Error(rw, "audit log unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		ctx, record := audit.WithRecord(req.Context())
+		buffered := &bufferedResponse{header: make(http.Header), status: http.StatusOK}
+		next.ServeHTTP(buffered, req.WithContext(ctx))
+
+		entry.Time = time.Now()
+		entry.Type = audit.TypeResponse
+		record.Auth.Token = entry.Auth.Token
+		entry.Auth = record.Auth
+		entry.Request.KeyName = record.KeyName
+		entry.Request.KeyVersion = record.KeyVersion
+		entry.Response = &audit.Response{Status: buffered.status, Latency: time.Since(start).String()}
+
+		if err := auditor.Log(entry); err != nil {
+			logger.Error("failed to audit response", "error", err.Error(), "status", buffered.status)
+			http.Error(rw, "audit log unavailable, the operation may have been applied", http.StatusServiceUnavailable)
+			return
+		}
+
+		buffered.flush(rw)
+	})
+}
+
+// audited reports whether the request is recorded: the health checks, the
+// metrics and the docs are public and carry no credentials.
+func audited(public *http.ServeMux, req *http.Request) bool {
+	_, pattern := public.Handler(req)
+	return pattern == "" || strings.HasPrefix(req.URL.Path, "/auth/")
+}
+
+// bufferedResponse holds a response until it is flushed.
+type bufferedResponse struct {
+	header      http.Header
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.wroteHeader {
+		return
+	}
+	b.status = status
+	b.wroteHeader = true
+}
+
+func (b *bufferedResponse) Write(data []byte) (int, error) {
+	b.wroteHeader = true
+	return b.body.Write(data)
+}
+
+func (b *bufferedResponse) flush(rw http.ResponseWriter) {
+	for k, v := range b.header {
+		rw.Header()[k] = v
+	}
+	rw.WriteHeader(b.status)
+	rw.Write(b.body.Bytes())
+}
+
+// metricsMiddleware counts the requests and observes their latency by the
+// route pattern of the muxes, the paths would hold the key names.
+func metricsMiddleware(muxes []*http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		route := routePattern(muxes, req)
+
+		recorder := &statusResponse{ResponseWriter: rw, status: http.StatusOK}
+		next.ServeHTTP(recorder, req)
+
+		metrics.Requests.WithLabelValues(route, req.Method, strconv.Itoa(recorder.status)).Inc()
+		metrics.RequestDuration.WithLabelValues(route, req.Method).Observe(time.Since(start).Seconds())
+	})
+}
+
+// tracingMiddleware starts the span of the request named by its route
+// pattern, it continues the trace propagated by the W3C trace context
+// headers of the caller.
+func tracingMiddleware(muxes []*http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		route := routePattern(muxes, req)
+		ctx, span := otel.Tracer(tracing.TracerName).Start(tracing.Extract(req.Context(), req.Header), route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", req.Method),
+				attribute.String("http.route", route),
+				attribute.String("url.path", req.URL.Path),
+			),
+		)
+		defer span.End()
+
+		recorder := &statusResponse{ResponseWriter: rw, status: http.StatusOK}
+		next.ServeHTTP(recorder, req.WithContext(ctx))
+
+		span.SetAttributes(attribute.Int("http.response.status_code", recorder.status))
+		if recorder.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(recorder.status))
+		}
+	})
+}
+
+// routePattern returns the pattern of the first mux matching the request.
+func routePattern(muxes []*http.ServeMux, req *http.Request) string {
+	for _, mux := range muxes {
+		if _, pattern := mux.Handler(req); pattern != "" {
+			return pattern
+		}
+	}
+
+	return "unmatched"
+}
+
+// statusResponse records the status of a response.
+type statusResponse struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (s *statusResponse) WriteHeader(status int) {
+	if !s.wroteHeader {
+		s.status = status
+		s.wroteHeader = true
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusResponse) Write(data []byte) (int, error) {
+	s.wroteHeader = true
+	return s.ResponseWriter.Write(data)
+}
+
+func (s *statusResponse) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
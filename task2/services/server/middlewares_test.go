@@ -1,17 +1,63 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"enclave-task2/pkg/audit"
+	"enclave-task2/pkg/auth"
 	"enclave-task2/pkg/common"
+	"enclave-task2/pkg/keys"
+	"enclave-task2/pkg/keys/kyber"
+	"enclave-task2/pkg/metrics"
+	"enclave-task2/pkg/ratelimit"
+	"enclave-task2/pkg/storage"
+	"enclave-task2/pkg/tracing"
+	"encoding/json"
+	"errors"
 	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
+var (
+	testSecret = []byte("test-secret")
+	token      = signTestToken(jwt.MapClaims{"sub": "test", "policies": []string{"root"}})
+)
+
+// signTestToken signs HS256 claims with the test secret, exp defaults to an
+// hour from now.
+func signTestToken(claims jwt.MapClaims) string {
+	if _, ok := claims["exp"]; !ok {
+		claims["exp"] = time.Now().Add(time.Hour).Unix()
+	}
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(testSecret)
+	if err != nil {
+		panic(err)
+	}
+
+	return signed
+}
+
+func testVerifier(t *testing.T) *auth.Verifier {
+	verifier, err := auth.NewVerifier(auth.VerifierConfig{HMACSecret: testSecret})
+	assert.NoError(t, err)
+
+	return verifier
+}
+
 func TestInitMiddlewares(t *testing.T) {
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo}))
 	ctx := context.Background()
@@ -24,6 +70,10 @@ func TestInitMiddlewares(t *testing.T) {
 
 		assert.NotNil(t, logger)
 
+		claims := auth.GetClaimsFromContext(r.Context())
+		assert.NotNil(t, claims)
+		assert.Equal(t, "test", claims.Subject)
+
 		// Simulate some processing
 		logger.Info("Processing request")
 		// Respond with a simple message
@@ -31,7 +81,8 @@ func TestInitMiddlewares(t *testing.T) {
 		w.Write([]byte("ok"))
 	}))
 
-	mw := initMiddlewares(ctx, mux)
+	tokens := auth.NewTokenStore(storage.NewNamedInMemoryCache("middlewares"))
+	mw := initMiddlewares(ctx, http.NewServeMux(), mux, testVerifier(t), tokens, nil, nil, authFailures{}, mux)
 	assert.NotNil(t, mw)
 
 	req, err := http.NewRequest("GET", "/test", nil)
@@ -49,10 +100,441 @@ func TestInitMiddlewares(t *testing.T) {
 
 	assert.Equal(t, http.StatusUnauthorized, rr.Result().StatusCode)
 
+	// expired
+	req.Header.Set("Authorization", "Bearer "+signTestToken(jwt.MapClaims{"sub": "test", "exp": time.Now().Add(-time.Hour).Unix()}))
+	rr = httptest.NewRecorder()
+	mw.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusUnauthorized, rr.Result().StatusCode)
+
 	req.Header.Set("Authorization", "Bearer "+token)
 	rr = httptest.NewRecorder()
 	mw.ServeHTTP(rr, req)
 
 	assert.Equal(t, http.StatusOK, rr.Result().StatusCode)
 	assert.Equal(t, "ok", rr.Body.String())
+
+	// service tokens
+	raw, _, err := tokens.Create(ctx, "test", []string{"root"}, time.Hour)
+	assert.NoError(t, err)
+
+	req.Header.Set("Authorization", "Bearer "+raw)
+	rr = httptest.NewRecorder()
+	mw.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Result().StatusCode)
+
+	assert.NoError(t, tokens.Revoke(ctx, raw))
+	rr = httptest.NewRecorder()
+	mw.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusUnauthorized, rr.Result().StatusCode)
+
+	// JWTs are rejected without verifier
+	mw = initMiddlewares(ctx, http.NewServeMux(), mux, nil, tokens, nil, nil, authFailures{}, mux)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr = httptest.NewRecorder()
+	mw.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusUnauthorized, rr.Result().StatusCode)
+}
+
+func TestRequireCapability(t *testing.T) {
+	ctx := common.LoggerWithContext(context.Background(), slog.New(slog.NewTextHandler(t.Output(), nil)))
+
+	payments, err := auth.ParsePolicy("payments", []byte(`{"path": {"transit/keys/payments-*": {"capabilities": ["encrypt"]}}}`))
+	assert.NoError(t, err)
+
+	mux := http.NewServeMux()
+	mux.Handle("POST /transit/encrypt/{name}", requireCapability(auth.NewACL(payments), auth.CapEncrypt, keyPath, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})))
+	mw := initMiddlewares(ctx, http.NewServeMux(), mux, testVerifier(t), auth.NewTokenStore(storage.NewNamedInMemoryCache("capability")), nil, nil, authFailures{}, mux)
+
+	tests := []struct {
+		policies []string
+		key      string
+		status   int
+	}{
+		{[]string{"payments"}, "payments-eu", http.StatusOK},
+		{[]string{"payments"}, "billing", http.StatusForbidden},
+		{nil, "payments-eu", http.StatusForbidden},
+		{[]string{"root"}, "billing", http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/transit/encrypt/"+tt.key, nil)
+		req.Header.Set("Authorization", "Bearer "+signTestToken(jwt.MapClaims{"sub": "test", "policies": tt.policies}))
+		rr := httptest.NewRecorder()
+		mw.ServeHTTP(rr, req)
+
+		assert.Equal(t, tt.status, rr.Code, "%v %s", tt.policies, tt.key)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	ctx := common.LoggerWithContext(context.Background(), slog.New(slog.NewTextHandler(t.Output(), nil)))
+
+	limited, err := auth.ParsePolicy("limited", []byte(`{"path": {"transit/keys/*": {"capabilities": ["encrypt"]}}, "rate_limit": {"rate": 0.001, "burst": 2}}`))
+	assert.NoError(t, err)
+	batch, err := auth.ParsePolicy("batch", []byte(`{"path": {"transit/keys/*": {"capabilities": ["encrypt"]}}, "key_rate_limit": {"rate": 0.001, "burst": 1}}`))
+	assert.NoError(t, err)
+	acl := auth.NewACL(limited, batch)
+	limiter := ratelimit.NewLocal()
+
+	mux := http.NewServeMux()
+	mux.Handle("POST /transit/encrypt/{name}", requireCapability(acl, auth.CapEncrypt, keyPath, limitKey(limiter, acl, ratelimit.Limit{Rate: 0.001, Burst: 3}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))))
+	mw := initMiddlewares(ctx, http.NewServeMux(), mux, testVerifier(t), auth.NewTokenStore(storage.NewNamedInMemoryCache("rate-limit")), nil, nil, authFailures{}, limitCaller(limiter, acl, mux))
+
+	before := testutil.ToFloat64(metrics.RateLimited.WithLabelValues("identity"))
+	call := func(sub string, policies []string, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/transit/encrypt/"+key, nil)
+		req.Header.Set("Authorization", "Bearer "+signTestToken(jwt.MapClaims{"sub": sub, "policies": policies}))
+		rr := httptest.NewRecorder()
+		mw.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// the callers have their own bucket
+	for _, sub := range []string{"alice", "alice", "bob"} {
+		assert.Equal(t, http.StatusOK, call(sub, []string{"limited"}, "rate-a").Code)
+	}
+	rr := call("alice", []string{"limited"}, "rate-b")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "1000", rr.Header().Get("Retry-After"))
+	assert.Equal(t, before+1, testutil.ToFloat64(metrics.RateLimited.WithLabelValues("identity")))
+
+	// the key bucket is shared by the callers, root is only limited by it
+	assert.Equal(t, http.StatusTooManyRequests, call("bob", []string{"limited"}, "rate-a").Code)
+	assert.Equal(t, http.StatusTooManyRequests, call("root", []string{"root"}, "rate-a").Code)
+	assert.Equal(t, http.StatusOK, call("root", []string{"root"}, "rate-b").Code)
+
+	// the callers of a policy with a key rate limit share their own bucket
+	assert.Equal(t, http.StatusOK, call("carol", []string{"batch"}, "rate-a").Code)
+	assert.Equal(t, http.StatusTooManyRequests, call("dave", []string{"batch"}, "rate-a").Code)
+	assert.Equal(t, http.StatusOK, call("dave", []string{"batch"}, "rate-c").Code)
+
+	// the callers without subject nor token id are told apart by their token
+	exp := time.Now().Add(time.Hour).Unix()
+	anonymous := func(policies ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/transit/encrypt/rate-d", nil)
+		req.Header.Set("Authorization", "Bearer "+signTestToken(jwt.MapClaims{"policies": policies, "exp": exp}))
+		rr := httptest.NewRecorder()
+		mw.ServeHTTP(rr, req)
+		return rr
+	}
+	assert.Equal(t, http.StatusOK, anonymous("limited").Code)
+	assert.Equal(t, http.StatusOK, anonymous("limited", "other").Code)
+	assert.Equal(t, http.StatusOK, anonymous("limited").Code)
+	assert.Equal(t, http.StatusTooManyRequests, anonymous("limited").Code)
+}
+
+func TestAuthRateLimit(t *testing.T) {
+	ctx := common.LoggerWithContext(context.Background(), slog.New(slog.NewTextHandler(t.Output(), nil)))
+	limiter := ratelimit.NewLocal()
+	limit := ratelimit.Limit{Rate: 0.001, Burst: 2}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /transit/keys", func(w http.ResponseWriter, r *http.Request) {})
+	public := http.NewServeMux()
+	public.Handle("POST /auth/approle/login", limitAddr(limiter, limit, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, auth.InvalidCredentialsError.Error(), http.StatusUnauthorized)
+	})))
+	mw := initMiddlewares(ctx, public, mux, testVerifier(t), auth.NewTokenStore(storage.NewNamedInMemoryCache("auth-rate-limit")), nil, nil, authFailures{limiter, limit}, mux)
+
+	request := func(method, path, bearer, addr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.RemoteAddr = addr
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		rr := httptest.NewRecorder()
+		mw.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// the failed authentications of an address are limited, not the others
+	before := testutil.ToFloat64(metrics.RateLimited.WithLabelValues("auth"))
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodGet, "/transit/keys", "wrong", "10.0.0.1:1000").Code)
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodGet, "/transit/keys", "", "10.0.0.1:1001").Code)
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, "/transit/keys", signTestToken(jwt.MapClaims{"sub": "alice"}), "10.0.0.1:1002").Code)
+	rr := request(http.MethodGet, "/transit/keys", "wrong", "10.0.0.1:1003")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "1000", rr.Header().Get("Retry-After"))
+	assert.Equal(t, before+1, testutil.ToFloat64(metrics.RateLimited.WithLabelValues("auth")))
+
+	// the logins share the bucket of the address
+	assert.Equal(t, http.StatusTooManyRequests, request(http.MethodPost, "/auth/approle/login", "", "10.0.0.1:1004").Code)
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodPost, "/auth/approle/login", "", "10.0.0.2:1000").Code)
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodPost, "/auth/approle/login", "", "10.0.0.2:1001").Code)
+	assert.Equal(t, http.StatusTooManyRequests, request(http.MethodPost, "/auth/approle/login", "", "10.0.0.2:1002").Code)
+}
+
+type failingAuditSink struct{ failAfter int }
+
+func (s *failingAuditSink) Write([]byte) error {
+	if s.failAfter == 0 {
+		return errors.New("disk full")
+	}
+	s.failAfter--
+	return nil
+}
+func (s *failingAuditSink) Close() error { return nil }
+
+func TestAuditMiddleware(t *testing.T) {
+	ctx := common.LoggerWithContext(context.Background(), slog.New(slog.NewTextHandler(t.Output(), nil)))
+
+	limited, err := auth.ParsePolicy("payments", []byte(`{"path": {"transit/keys/*": {"capabilities": ["encrypt"]}}, "rate_limit": {"rate": 0.001, "burst": 1}}`))
+	assert.NoError(t, err)
+	acl := auth.NewACL(limited)
+	tokens := auth.NewTokenStore(storage.NewNamedInMemoryCache("audit"))
+	raw, info, err := tokens.Create(ctx, "ci", []string{"payments"}, time.Hour)
+	assert.NoError(t, err)
+
+	served := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /transit/encrypt/{name}", func(w http.ResponseWriter, r *http.Request) {
+		served++
+		audit.SetKey(r.Context(), r.PathValue("name"))
+		audit.SetKeyVersion(r.Context(), 3)
+		w.Header().Set("X-Test", "yes")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("ciphertext"))
+	})
+	public := http.NewServeMux()
+	public.HandleFunc("POST /auth/approle/login", func(w http.ResponseWriter, r *http.Request) {
+		audit.SetSecretID(r.Context(), "secret-id")
+		http.Error(w, auth.InvalidCredentialsError.Error(), http.StatusUnauthorized)
+	})
+	public.HandleFunc("GET /sys/health", func(w http.ResponseWriter, r *http.Request) {})
+
+	handler := func(auditor *audit.Logger) http.Handler {
+		return initMiddlewares(ctx, public, mux, nil, tokens, nil, auditor, authFailures{}, limitCaller(ratelimit.NewLocal(), acl, mux))
+	}
+	request := func(h http.Handler, method, path, bearer string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+
+		return rw
+	}
+	responses := func(out *bytes.Buffer) []audit.Entry {
+		n, _, err := audit.Verify(bytes.NewReader(out.Bytes()))
+		assert.NoError(t, err)
+
+		var entries []audit.Entry
+		for line := range strings.Lines(out.String()) {
+			var entry audit.Entry
+			assert.NoError(t, json.Unmarshal([]byte(line), &entry))
+			if entry.Type == audit.TypeResponse {
+				entries = append(entries, entry)
+			}
+		}
+		assert.Equal(t, n, 2*len(entries))
+		out.Reset()
+
+		return entries
+	}
+
+	var out bytes.Buffer
+	auditor, err := audit.NewLogger([]byte("key"), audit.NewWriterSink(&out))
+	assert.NoError(t, err)
+	h := handler(auditor)
+
+	rw := request(h, http.MethodPost, "/transit/encrypt/payments", raw)
+	assert.Equal(t, http.StatusAccepted, rw.Code)
+	assert.Equal(t, "ciphertext", rw.Body.String())
+	assert.Equal(t, "yes", rw.Header().Get("X-Test"))
+	assert.NotContains(t, out.String(), raw)
+
+	entries := responses(&out)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "ci", entries[0].Auth.Subject)
+	assert.Equal(t, info.Accessor, entries[0].Auth.Accessor)
+	assert.Equal(t, []string{"payments"}, entries[0].Auth.Policies)
+	assert.Equal(t, auditor.HMAC(raw), entries[0].Auth.Token)
+	assert.Equal(t, "POST /transit/encrypt/{name}", entries[0].Request.Operation)
+	assert.Equal(t, "payments", entries[0].Request.KeyName)
+	assert.Equal(t, uint64(3), entries[0].Request.KeyVersion)
+	assert.Equal(t, http.StatusAccepted, entries[0].Response.Status)
+
+	// the rate limited callers, the rejected tokens and the logins are
+	// recorded, the health checks are not
+	assert.Equal(t, http.StatusTooManyRequests, request(h, http.MethodPost, "/transit/encrypt/payments", raw).Code)
+	assert.Equal(t, http.StatusUnauthorized, request(h, http.MethodPost, "/transit/encrypt/payments", "ens.unknown").Code)
+	assert.Equal(t, http.StatusUnauthorized, request(h, http.MethodPost, "/auth/approle/login", "").Code)
+	assert.Equal(t, http.StatusOK, request(h, http.MethodGet, "/sys/health", "").Code)
+
+	entries = responses(&out)
+	assert.Len(t, entries, 3)
+	assert.Equal(t, http.StatusTooManyRequests, entries[0].Response.Status)
+	assert.Equal(t, "ci", entries[0].Auth.Subject)
+	assert.Equal(t, http.StatusUnauthorized, entries[1].Response.Status)
+	assert.Empty(t, entries[1].Auth.Subject)
+	assert.Equal(t, auditor.HMAC("ens.unknown"), entries[1].Auth.Token)
+	assert.Equal(t, http.StatusUnauthorized, entries[2].Response.Status)
+	assert.Equal(t, "POST /auth/approle/login", entries[2].Request.Operation)
+	assert.Equal(t, auditor.HMAC("secret-id"), entries[2].Auth.SecretID)
+
+	// the request is not served when it can not be recorded
+	served = 0
+	auditor, err = audit.NewLogger([]byte("key"), &failingAuditSink{})
+	assert.NoError(t, err)
+	rw = request(handler(auditor), http.MethodPost, "/transit/encrypt/payments", raw)
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+	assert.Equal(t, 0, served)
+
+	// the response is discarded when it can not be recorded, the request
+	// was served
+	auditor, err = audit.NewLogger([]byte("key"), &failingAuditSink{failAfter: 1})
+	assert.NoError(t, err)
+	rw = request(handler(auditor), http.MethodPost, "/transit/encrypt/payments", raw)
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+	assert.Equal(t, 1, served)
+	assert.NotContains(t, rw.Body.String(), "ciphertext")
+	assert.Contains(t, rw.Body.String(), "may have been applied")
+}
+
+func TestMetricsMiddleware(t *testing.T) {
+	public := http.NewServeMux()
+	public.HandleFunc("POST /auth/approle/login", func(w http.ResponseWriter, r *http.Request) {})
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /transit/encrypt/{name}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusConflict)
+	})
+	handler := metricsMiddleware([]*http.ServeMux{public, mux}, mux)
+
+	requests := func(route, method, code string) float64 {
+		return testutil.ToFloat64(metrics.Requests.WithLabelValues(route, method, code))
+	}
+	encrypt := requests("POST /transit/encrypt/{name}", http.MethodPost, "409")
+	unmatched := requests("unmatched", http.MethodGet, "404")
+
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/transit/encrypt/payments", nil))
+	assert.Equal(t, http.StatusConflict, rw.Code)
+
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/transit/unknown", nil))
+	assert.Equal(t, http.StatusNotFound, rw.Code)
+
+	// the route pattern is used, never the key name
+	assert.Equal(t, encrypt+1, requests("POST /transit/encrypt/{name}", http.MethodPost, "409"))
+	assert.Equal(t, unmatched+1, requests("unmatched", http.MethodGet, "404"))
+}
+
+func TestTracingMiddleware(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider, err := tracing.NewProvider(sdktrace.NewSimpleSpanProcessor(exporter))
+	assert.NoError(t, err)
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	ctx := common.LoggerWithContext(context.Background(), slog.New(slog.NewTextHandler(t.Output(), nil)))
+	cache := storage.NewNamedInMemoryCache("tracing")
+	server := New(WithStorage(cache))
+	server.logger = common.GetLoggerFromContext(ctx)
+
+	key, err := keys.New(ctx, kyber.KeyType, kyber.Size512, "traced-key", keys.DefaultKeyTTL)
+	assert.NoError(t, err)
+	assert.NoError(t, cache.Create(ctx, key))
+	exporter.Reset()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /transit/encrypt/{name}", server.Encrypt)
+	handler := tracingMiddleware([]*http.ServeMux{mux}, requestContextMiddleware(server.logger, []*http.ServeMux{mux}, mux))
+
+	// the trace of the caller is continued
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest(http.MethodPost, "/transit/encrypt/traced-key", strings.NewReader("Hello, World!"))
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+
+	spans := exporter.GetSpans()
+	names := map[string]tracetest.SpanStub{}
+	for _, span := range spans {
+		assert.Equal(t, traceID, span.SpanContext.TraceID().String())
+		// the usage entry of the key is read and written too
+		if !slices.Contains(span.Attributes, attribute.String("key.name", "usage/traced-key")) {
+			names[span.Name] = span
+		}
+	}
+	root, ok := names["POST /transit/encrypt/{name}"]
+	assert.True(t, ok)
+	assert.Equal(t, "00f067aa0ba902b7", root.Parent.SpanID().String())
+	assert.Contains(t, root.Attributes, attribute.Int("http.response.status_code", http.StatusOK))
+	for _, name := range []string{"InMemoryCache.Get", "Key.Encrypt"} {
+		span, ok := names[name]
+		assert.True(t, ok, name)
+		assert.Equal(t, root.SpanContext.SpanID(), span.Parent.SpanID(), name)
+	}
+}
+
+func TestRequestContextMiddleware(t *testing.T) {
+	var out bytes.Buffer
+	ctx := common.LoggerWithContext(context.Background(), slog.New(slog.NewJSONHandler(&out, nil)))
+
+	type ctxKey struct{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /transit/keys/{name}", func(w http.ResponseWriter, r *http.Request) {
+		// the context of the request is kept
+		assert.Equal(t, "caller", r.Context().Value(ctxKey{}))
+		assert.Equal(t, w.Header().Get(RequestIDHeader), common.GetRequestIDFromContext(r.Context()))
+
+		common.GetLoggerFromContext(r.Context()).Info("served")
+		if r.Context().Err() != nil {
+			w.WriteHeader(http.StatusRequestTimeout)
+		}
+	})
+	tokens := auth.NewTokenStore(storage.NewNamedInMemoryCache("request-context"))
+	mw := initMiddlewares(ctx, http.NewServeMux(), mux, testVerifier(t), tokens, nil, nil, authFailures{}, mux)
+
+	request := func(reqCtx context.Context, id string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/transit/keys/payments", nil).WithContext(context.WithValue(reqCtx, ctxKey{}, "caller"))
+		req.Header.Set("Authorization", "Bearer "+token)
+		if id != "" {
+			req.Header.Set(RequestIDHeader, id)
+		}
+		rw := httptest.NewRecorder()
+		mw.ServeHTTP(rw, req)
+
+		return rw
+	}
+
+	t.Run("request id echoed", func(t *testing.T) {
+		out.Reset()
+		rw := request(context.Background(), "req-42")
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.Equal(t, "req-42", rw.Header().Get(RequestIDHeader))
+
+		var line map[string]any
+		assert.NoError(t, json.Unmarshal(out.Bytes(), &line))
+		assert.Equal(t, "req-42", line["request_id"])
+		assert.Equal(t, "GET /transit/keys/{name}", line["route"])
+		assert.Equal(t, "192.0.2.1:1234", line["remote_addr"])
+		assert.Equal(t, "test", line["subject"])
+	})
+
+	t.Run("request id generated", func(t *testing.T) {
+		for _, id := range []string{"", "bad id", strings.Repeat("a", maxRequestIDLength+1)} {
+			rw := request(context.Background(), id)
+			assert.NotEmpty(t, rw.Header().Get(RequestIDHeader))
+			assert.NotEqual(t, id, rw.Header().Get(RequestIDHeader))
+		}
+		assert.NotEqual(t, request(context.Background(), "").Header().Get(RequestIDHeader), request(context.Background(), "").Header().Get(RequestIDHeader))
+	})
+
+	t.Run("client gone", func(t *testing.T) {
+		reqCtx, cancel := context.WithCancel(context.Background())
+		cancel()
+		rw := request(reqCtx, "")
+		assert.Equal(t, http.StatusRequestTimeout, rw.Code)
+	})
 }
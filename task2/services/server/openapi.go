@@ -0,0 +1,20 @@
+package server
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// openAPIDocument describes the routes of the api. It is written by hand,
+// TestOpenAPI checks it against the routes and the responses of the
+// handlers.
+//
+//go:embed openapi.json
+var openAPIDocument []byte
+
+// OpenAPI serves the OpenAPI 3 document of the api.
+func (s *Server) OpenAPI(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(openAPIDocument)
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"enclave-task2/pkg/auth"
+	"enclave-task2/pkg/common"
+	"enclave-task2/pkg/storage"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenAPI(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(t.Output(), nil))
+	ctx := common.LoggerWithContext(context.Background(), logger)
+
+	limits := DefaultHTTPLimits
+	limits.MaxBodyBytes = 1 << 10
+	server := New(WithStorage(storage.NewNamedInMemoryCache("openapi")), WithKeyDefaults("kyber", "512", time.Hour),
+		WithJWTVerifier(testVerifier(t)), WithHTTPLimits(limits))
+	h, err := server.Handler(ctx)
+	assert.NoError(t, err)
+
+	doc, err := openapi3.NewLoader().LoadFromData(openAPIDocument)
+	assert.NoError(t, err)
+	assert.NoError(t, doc.Validate(ctx))
+	router, err := gorillamux.NewRouter(doc)
+	assert.NoError(t, err)
+
+	t.Run("routes", func(t *testing.T) {
+		var documented []string
+		for path, item := range doc.Paths.Map() {
+			for method := range item.Operations() {
+				documented = append(documented, method+" "+path)
+			}
+		}
+
+		assert.ElementsMatch(t, server.routes, documented)
+	})
+
+	// call serves the request and validates it and its response against
+	// the document. The requests the document refuses must be refused with
+	// 400 by the server too.
+	covered := map[string]bool{}
+	call := func(method, target, token string, header http.Header, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		rw := httptest.NewRecorder()
+		route, params, err := router.FindRoute(httptest.NewRequest(method, target, nil))
+		if !assert.NoError(t, err, "%s %s", method, target) {
+			return rw
+		}
+		covered[route.Method+" "+route.Path] = true
+
+		// the body is sent with the content type of the document
+		newRequest := func() *http.Request {
+			req := httptest.NewRequest(method, target, strings.NewReader(body))
+			for k, v := range header {
+				req.Header[k] = v
+			}
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+			if reqBody := route.Operation.RequestBody; body != "" && reqBody != nil {
+				for contentType := range reqBody.Value.Content {
+					req.Header.Set("Content-Type", contentType)
+				}
+			}
+			return req
+		}
+		h.ServeHTTP(rw, newRequest())
+
+		req := newRequest()
+		input := &openapi3filter.RequestValidationInput{
+			Request:    req,
+			PathParams: params,
+			Route:      route,
+			Options:    &openapi3filter.Options{AuthenticationFunc: openapi3filter.NoopAuthenticationFunc},
+		}
+		if err := openapi3filter.ValidateRequest(ctx, input); err != nil {
+			assert.Equal(t, http.StatusBadRequest, rw.Code, "%s %s: %v", method, target, err)
+		}
+
+		err = openapi3filter.ValidateResponse(ctx, &openapi3filter.ResponseValidationInput{
+			RequestValidationInput: input,
+			Status:                 rw.Code,
+			Header:                 rw.Header(),
+			Body:                   io.NopCloser(bytes.NewReader(rw.Body.Bytes())),
+			Options:                &openapi3filter.Options{IncludeResponseStatus: true},
+		})
+		assert.NoError(t, err, "%s %s: %d %s", method, target, rw.Code, rw.Body.String())
+
+		return rw
+	}
+	root := signTestToken(jwt.MapClaims{"sub": "openapi", "policies": []string{auth.RootPolicy}})
+	none := signTestToken(jwt.MapClaims{"sub": "openapi", "policies": []string{"none"}})
+	decode := func(rw *httptest.ResponseRecorder, v any) {
+		t.Helper()
+		assert.NoError(t, json.Unmarshal(rw.Body.Bytes(), v))
+	}
+
+	t.Run("keys", func(t *testing.T) {
+		header := http.Header{"X-Key-Ttl": {"1h"}, "X-Key-Max-Encryptions": {"1"}}
+		assert.Equal(t, http.StatusNoContent, call(http.MethodPost, "/transit/keys/openapi", root, header, "").Code)
+		assert.Equal(t, http.StatusNoContent, call(http.MethodPost, "/transit/keys/openapi", root, header, "").Code)
+		assert.Equal(t, http.StatusBadRequest, call(http.MethodPost, "/transit/keys/invalid", root, http.Header{"X-Key-Ttl": {"soon"}}, "").Code)
+		assert.Equal(t, http.StatusBadRequest, call(http.MethodPost, "/transit/keys/invalid", root, http.Header{"X-Key-Async": {"maybe"}}, "").Code)
+
+		assert.Equal(t, http.StatusOK, call(http.MethodGet, "/transit/keys/openapi", root, nil, "").Code)
+		assert.Equal(t, http.StatusNotFound, call(http.MethodGet, "/transit/keys/missing", root, nil, "").Code)
+		assert.Equal(t, http.StatusUnauthorized, call(http.MethodGet, "/transit/keys/openapi", "", nil, "").Code)
+		assert.Equal(t, http.StatusForbidden, call(http.MethodGet, "/transit/keys/openapi", none, nil, "").Code)
+
+		// the keys are filtered by the read capability of the caller
+		var list keyList
+		decode(call(http.MethodGet, "/transit/keys", root, nil, ""), &list)
+		assert.Equal(t, []string{"openapi"}, list.Keys)
+		decode(call(http.MethodGet, "/transit/keys", none, nil, ""), &list)
+		assert.Empty(t, list.Keys)
+		assert.Equal(t, http.StatusUnauthorized, call(http.MethodGet, "/transit/keys", "", nil, "").Code)
+
+		rw := call(http.MethodPost, "/transit/keys/async", root, http.Header{"X-Key-Async": {"true"}}, "")
+		assert.Equal(t, http.StatusAccepted, rw.Code)
+		var job keyJob
+		decode(rw, &job)
+		assert.Eventually(t, func() bool {
+			job, _ := server.jobs.get(job.ID)
+			return job.Status != jobPending
+		}, 5*time.Second, 10*time.Millisecond)
+		assert.Equal(t, http.StatusOK, call(http.MethodGet, rw.Header().Get("Location"), root, nil, "").Code)
+		assert.Equal(t, http.StatusNotFound, call(http.MethodGet, "/transit/keys/async/jobs/missing", root, nil, "").Code)
+	})
+
+	t.Run("transit", func(t *testing.T) {
+		rw := call(http.MethodPost, "/transit/encrypt/openapi", root, nil, "hello")
+		assert.Equal(t, http.StatusOK, rw.Code)
+		ciphertext := rw.Body.String()
+		assert.Equal(t, http.StatusConflict, call(http.MethodPost, "/transit/encrypt/openapi", root, nil, "hello").Code)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, call(http.MethodPost, "/transit/encrypt/openapi", root, nil, strings.Repeat("a", 2<<10)).Code)
+
+		rw = call(http.MethodPost, "/transit/decrypt/openapi", root, nil, ciphertext)
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.Equal(t, "hello", rw.Body.String())
+		assert.Equal(t, http.StatusNotFound, call(http.MethodPost, "/transit/decrypt/missing", root, nil, ciphertext).Code)
+
+		assert.Equal(t, http.StatusNoContent, call(http.MethodDelete, "/transit/keys/openapi", root, nil, "").Code)
+	})
+
+	t.Run("tokens", func(t *testing.T) {
+		rw := call(http.MethodPost, "/auth/token/create", root, nil, `{"display_name": "openapi", "policies": ["ops"], "ttl": "1h"}`)
+		assert.Equal(t, http.StatusOK, rw.Code)
+		var token createTokenResponse
+		decode(rw, &token)
+		assert.Equal(t, http.StatusBadRequest, call(http.MethodPost, "/auth/token/create", root, nil, `{"ttl": "soon"}`).Code)
+		assert.Equal(t, http.StatusForbidden, call(http.MethodPost, "/auth/token/create", none, nil, `{"policies": ["root"]}`).Code)
+
+		assert.Equal(t, http.StatusOK, call(http.MethodGet, "/auth/token/lookup-self", token.ClientToken, nil, "").Code)
+		assert.Equal(t, http.StatusBadRequest, call(http.MethodGet, "/auth/token/lookup-self", root, nil, "").Code)
+		assert.Equal(t, http.StatusOK, call(http.MethodPost, "/auth/token/renew-self", token.ClientToken, nil, `{"increment": "30m"}`).Code)
+		assert.Equal(t, http.StatusNoContent, call(http.MethodPost, "/auth/token/revoke-self", token.ClientToken, nil, "").Code)
+		assert.Equal(t, http.StatusUnauthorized, call(http.MethodGet, "/auth/token/lookup-self", token.ClientToken, nil, "").Code)
+
+		decode(call(http.MethodPost, "/auth/token/create", root, nil, ""), &token)
+		assert.Equal(t, http.StatusNoContent, call(http.MethodPost, "/auth/token/revoke", root, nil, `{"token": "`+token.ClientToken+`"}`).Code)
+		assert.Equal(t, http.StatusNotFound, call(http.MethodPost, "/auth/token/revoke", root, nil, `{"token": "`+token.ClientToken+`"}`).Code)
+		assert.Equal(t, http.StatusBadRequest, call(http.MethodPost, "/auth/token/revoke", root, nil, `{}`).Code)
+	})
+
+	t.Run("approle", func(t *testing.T) {
+		rw := call(http.MethodPost, "/auth/approle/role/ci", root, nil, `{"policies": ["ci"], "token_ttl": "10m", "secret_id_num_uses": 1}`)
+		assert.Equal(t, http.StatusOK, rw.Code)
+		var role auth.Role
+		decode(rw, &role)
+		assert.Equal(t, http.StatusBadRequest, call(http.MethodPost, "/auth/approle/role/ci", root, nil, `{"bound_cidrs": ["nope"]}`).Code)
+
+		assert.Equal(t, http.StatusOK, call(http.MethodGet, "/auth/approle/role/ci", root, nil, "").Code)
+		assert.Equal(t, http.StatusNotFound, call(http.MethodGet, "/auth/approle/role/missing", root, nil, "").Code)
+
+		rw = call(http.MethodPost, "/auth/approle/role/ci/secret-id", root, nil, `{"cidr_list": ["192.0.2.0/24"]}`)
+		assert.Equal(t, http.StatusOK, rw.Code)
+		var secret secretIDResponse
+		decode(rw, &secret)
+		assert.Equal(t, http.StatusNotFound, call(http.MethodPost, "/auth/approle/role/missing/secret-id", root, nil, "").Code)
+
+		decode(call(http.MethodPost, "/auth/approle/role/ci/secret-id", root, nil, ""), &secret)
+		login := `{"role_id": "` + role.RoleID + `", "secret_id": "` + secret.Secret + `"}`
+		assert.Equal(t, http.StatusOK, call(http.MethodPost, "/auth/approle/login", "", nil, login).Code)
+		assert.Equal(t, http.StatusUnauthorized, call(http.MethodPost, "/auth/approle/login", "", nil, login).Code)
+		assert.Equal(t, http.StatusBadRequest, call(http.MethodPost, "/auth/approle/login", "", nil, `[]`).Code)
+
+		assert.Equal(t, http.StatusNoContent, call(http.MethodDelete, "/auth/approle/role/ci", root, nil, "").Code)
+		assert.Equal(t, http.StatusNotFound, call(http.MethodDelete, "/auth/approle/role/ci", root, nil, "").Code)
+	})
+
+	t.Run("sys", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, call(http.MethodGet, "/sys/health", "", nil, "").Code)
+		// the token store is only initialized by Start
+		assert.Equal(t, http.StatusServiceUnavailable, call(http.MethodGet, "/sys/ready", "", nil, "").Code)
+		assert.Equal(t, http.StatusBadRequest, call(http.MethodGet, "/sys/ready?fail_code=soon", "", nil, "").Code)
+		assert.Equal(t, http.StatusNotImplemented, call(http.MethodPost, "/sys/reload", root, nil, "").Code)
+		assert.Equal(t, http.StatusOK, call(http.MethodGet, "/metrics", "", nil, "").Code)
+
+		rw := call(http.MethodGet, "/docs/openapi.json", "", nil, "")
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.JSONEq(t, string(openAPIDocument), rw.Body.String())
+	})
+
+	t.Run("every operation is covered", func(t *testing.T) {
+		for _, route := range server.routes {
+			method, path, _ := strings.Cut(route, " ")
+			assert.True(t, covered[method+" "+path], "%s is not tested", route)
+		}
+		assert.True(t, slices.Contains(server.routes, "GET /docs/openapi.json"))
+	})
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"slices"
+)
+
+var (
+	// ReloadNotConfiguredError is returned when the server has no reload
+	// function.
+	ReloadNotConfiguredError = errors.New("reload is not configured")
+	// TLSNotEnabledError is returned when the TLS configuration is swapped on
+	// a server started without TLS.
+	TLSNotEnabledError = errors.New("the api is not served over tls")
+)
+
+// ReloadResult reports what a reload changed.
+type ReloadResult struct {
+	// Changed are the components swapped by the reload.
+	Changed []string `json:"changed"`
+	// RestartRequired are the changed settings which are only read on
+	// startup, they are ignored until the next restart.
+	RestartRequired []string `json:"restart_required,omitempty"`
+}
+
+// ReloadFunc reads the configuration again and swaps the components which
+// changed. It must build every component before swapping any of them, the
+// running ones are kept on error.
+type ReloadFunc func(ctx context.Context) (ReloadResult, error)
+
+// WithReload sets the function run on SIGHUP and by POST /sys/reload.
+func WithReload(fn ReloadFunc) Option {
+	return func(s *Server) {
+		s.reloader = fn
+	}
+}
+
+// reload runs the reload function, the reloads are serialized.
+func (s *Server) reload(ctx context.Context) (ReloadResult, error) {
+	if s.reloader == nil {
+		return ReloadResult{}, ReloadNotConfiguredError
+	}
+
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	res, err := s.reloader(ctx)
+	if err != nil {
+		s.log(ctx).Error("failed to reload the configuration", "error", err.Error())
+		return res, err
+	}
+	if res.Changed == nil {
+		res.Changed = []string{}
+	}
+	s.log(ctx).Info("configuration reloaded", "changed", res.Changed, "restart_required", res.RestartRequired)
+
+	return res, nil
+}
+
+// Reload reloads the configuration and reports what changed.
+func (s *Server) Reload(rw http.ResponseWriter, req *http.Request) {
+	res, err := s.reload(req.Context())
+	if errors.Is(err, ReloadNotConfiguredError) {
+		http.Error(rw, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		http.Error(rw, "failed to reload the configuration: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(rw, http.StatusOK, res)
+}
+
+// SetTLSConfig swaps the TLS configuration of the api, the new connections
+// use it. It reports whether the certificate or the client verification
+// changed.
+func (s *Server) SetTLSConfig(cfg *tls.Config) (bool, error) {
+	cfg = withNextProtos(cfg)
+	for {
+		current := s.tlsConfig.Load()
+		if current == nil {
+			return false, TLSNotEnabledError
+		}
+		if s.tlsConfig.CompareAndSwap(current, cfg) {
+			return tlsChanged(current, cfg), nil
+		}
+	}
+}
+
+// withNextProtos enables HTTP/2, http.Server only does it on the
+// configuration of the listener.
+func withNextProtos(cfg *tls.Config) *tls.Config {
+	cfg = cfg.Clone()
+	if len(cfg.NextProtos) == 0 {
+		cfg.NextProtos = []string{"h2", "http/1.1"}
+	}
+
+	return cfg
+}
+
+// getTLSConfig returns the current TLS configuration of the api.
+func (s *Server) getTLSConfig(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return s.tlsConfig.Load(), nil
+}
+
+// tlsChanged reports whether the certificates or the settings of the
+// configurations differ.
+func tlsChanged(a, b *tls.Config) bool {
+	if a.MinVersion != b.MinVersion || a.ClientAuth != b.ClientAuth || !slices.Equal(a.CipherSuites, b.CipherSuites) {
+		return true
+	}
+	if (a.ClientCAs == nil) != (b.ClientCAs == nil) || a.ClientCAs != nil && !a.ClientCAs.Equal(b.ClientCAs) {
+		return true
+	}
+
+	return !slices.EqualFunc(a.Certificates, b.Certificates, func(x, y tls.Certificate) bool {
+		return slices.EqualFunc(x.Certificate, y.Certificate, bytes.Equal)
+	})
+}
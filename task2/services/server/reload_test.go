@@ -0,0 +1,134 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"enclave-task2/pkg/cluster/clustertest"
+	"enclave-task2/pkg/common"
+	"enclave-task2/pkg/storage"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReload(t *testing.T) {
+	var reloadErr error
+	server := New(WithStorage(storage.NewNamedInMemoryCache("reload")), WithReload(func(ctx context.Context) (ReloadResult, error) {
+		return ReloadResult{Changed: []string{"policies"}, RestartRequired: []string{"addr"}}, reloadErr
+	}))
+	server.logger = slog.New(slog.NewTextHandler(t.Output(), nil))
+
+	t.Run("success", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		server.Reload(rw, httptest.NewRequest(http.MethodPost, "/sys/reload", nil))
+
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.JSONEq(t, `{"changed": ["policies"], "restart_required": ["addr"]}`, rw.Body.String())
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		reloadErr = errors.New("invalid configuration: invalid log_level: loud")
+		defer func() { reloadErr = nil }()
+
+		rw := httptest.NewRecorder()
+		server.Reload(rw, httptest.NewRequest(http.MethodPost, "/sys/reload", nil))
+
+		assert.Equal(t, http.StatusInternalServerError, rw.Code)
+		assert.Equal(t, "failed to reload the configuration: invalid configuration: invalid log_level: loud\n", rw.Body.String())
+	})
+
+	t.Run("not configured", func(t *testing.T) {
+		server := New(WithStorage(storage.NewNamedInMemoryCache("no-reload")))
+
+		rw := httptest.NewRecorder()
+		server.Reload(rw, httptest.NewRequest(http.MethodPost, "/sys/reload", nil))
+
+		assert.Equal(t, http.StatusNotImplemented, rw.Code)
+	})
+}
+
+func TestReloadOnSIGHUP(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(t.Output(), nil))
+	ctx, cancel := context.WithCancel(common.LoggerWithContext(context.Background(), logger))
+	defer cancel()
+
+	var reloads atomic.Int32
+	addr := freeAddr(t)
+	server := New(WithStorage(storage.NewNamedInMemoryCache("sighup")), WithAddr(addr, freeAddr(t)),
+		WithReload(func(ctx context.Context) (ReloadResult, error) {
+			reloads.Add(1)
+			return ReloadResult{}, nil
+		}),
+	)
+
+	done := make(chan error, 1)
+	go func() { done <- server.Start(ctx) }()
+	assert.Eventually(t, func() bool {
+		res, err := http.Get("http://" + addr)
+		if err == nil {
+			res.Body.Close()
+		}
+		return err == nil
+	}, 2*time.Second, 5*time.Millisecond)
+
+	assert.NoError(t, syscall.Kill(syscall.Getpid(), syscall.SIGHUP))
+	assert.Eventually(t, func() bool { return reloads.Load() == 1 }, 2*time.Second, 5*time.Millisecond)
+
+	http.DefaultClient.CloseIdleConnections()
+	cancel()
+	assert.NoError(t, <-done)
+}
+
+func TestSetTLSConfig(t *testing.T) {
+	ca := clustertest.NewCA(t)
+	cfg, err := NewTLSConfig(writeTLSFiles(t, ca))
+	assert.NoError(t, err)
+
+	server := New(WithStorage(storage.NewNamedInMemoryCache("set-tls")), WithTLS(cfg))
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = server.api.TLSConfig
+	srv.StartTLS()
+	defer srv.Close()
+
+	get := func(ca *clustertest.CA) error {
+		roots := x509.NewCertPool()
+		roots.AppendCertsFromPEM(ca.PEM)
+		transport := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}
+		defer transport.CloseIdleConnections()
+
+		res, err := (&http.Client{Transport: transport}).Get(srv.URL)
+		if err != nil {
+			return err
+		}
+		return res.Body.Close()
+	}
+	assert.NoError(t, get(ca))
+
+	changed, err := server.SetTLSConfig(cfg)
+	assert.NoError(t, err)
+	assert.False(t, changed)
+
+	// the certificate is rotated to one of another CA
+	rotated := clustertest.NewCA(t)
+	cfg, err = NewTLSConfig(writeTLSFiles(t, rotated))
+	assert.NoError(t, err)
+
+	changed, err = server.SetTLSConfig(cfg)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+
+	assert.Error(t, get(ca))
+	assert.NoError(t, get(rotated))
+
+	_, err = New(WithStorage(storage.NewNamedInMemoryCache("no-tls"))).SetTLSConfig(cfg)
+	assert.Equal(t, TLSNotEnabledError, err)
+}
@@ -1,64 +1,493 @@
 package server
 
 import (
+	"cmp"
 	"context"
+	"crypto/tls"
+	"enclave-task2/pkg/audit"
+	"enclave-task2/pkg/auth"
+	"enclave-task2/pkg/cluster"
 	"enclave-task2/pkg/common"
 	"enclave-task2/pkg/keys"
+	"enclave-task2/pkg/keys/kyber"
+	"enclave-task2/pkg/metrics"
+	"enclave-task2/pkg/ratelimit"
+	"enclave-task2/pkg/storage"
 	"log/slog"
 	"net"
 	"net/http"
+	"os"
 	"os/signal"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/mailgun/groupcache/v2"
+	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
 )
 
+// tokenInitInterval is the delay between the attempts to initialize the
+// token store on the peers.
+const tokenInitInterval = 100 * time.Millisecond
+
 type Storage interface {
 	Put(ctx context.Context, key keys.Key) error
 	Get(ctx context.Context, key string) (keys.Key, error)
 	Delete(ctx context.Context, key string) error
+
+	// Create stores the key only if it does not exist yet, otherwise
+	// storage.AlreadyExistsError is returned.
+	Create(ctx context.Context, key keys.Key) error
+	// CompareAndSwap replaces the key only if the stored version matches,
+	// otherwise storage.VersionMismatchError is returned.
+	CompareAndSwap(ctx context.Context, key keys.Key, version uint64) error
+	// List returns the sorted names of the live keys.
+	List(ctx context.Context) ([]string, error)
+
+	// the tokens, AppRoles and usage counters are entries stored next to
+	// the keys
+	storage.EntryStorage
+}
+
+// groupStorage is implemented by the storages backed by a groupcache group,
+// the group is served to the peers of the cluster.
+type groupStorage interface {
+	GroupName() string
+}
+
+// collectorStorage is implemented by the storages exporting their own
+// metrics, e.g. the number of live keys of the in memory cache.
+type collectorStorage interface {
+	Collector() prometheus.Collector
+}
+
+// leaderStorage is implemented by the replicated storages, they are only
+// ready once a leader is elected.
+type leaderStorage interface {
+	Leader() string
+}
+
+// peerService is implemented by the storages exposing endpoints to the
+// peers, e.g. the leader forwarding of the raft storage.
+type peerService interface {
+	http.Handler
+	PeerPath() string
 }
 
 type Server struct {
 	api *http.Server
 	mux *http.ServeMux
-	gc  *http.Server
+	// public routes are served without authentication
+	public *http.ServeMux
+	// routes are the patterns registered on mux and public, the OpenAPI
+	// document describes each of them
+	routes []string
+	gc     *http.Server
+	// grpc serves the transit api on grpcAddr when it is set
+	grpc     *grpc.Server
+	grpcAddr string
+
+	pool      *cluster.Pool
+	self      string
+	discovery cluster.Discoverer
+	peerTLS   *cluster.PeerTLS
+
+	storage  Storage
+	usage    *storage.UsageTracker
+	verifier *auth.Verifier
+	tokens   *auth.TokenStore
+	approles *auth.AppRoleStore
+	certAuth *auth.CertAuth
+	// tokenMaxTTL bounds the ttl of the service tokens
+	tokenMaxTTL time.Duration
+	acl         *auth.ACL
+	audit       *audit.Logger
+
+	// defaults of the keys created without headers
+	keyType string
+	keySize string
+	keyTTL  time.Duration
+
+	// keyPool pregenerates the keys, jobs are the keys generated in the
+	// background
+	keyPool *keys.Pool
+	jobs    *jobStore
+
+	// tlsConfig is the configuration of the api listener, it is swapped by
+	// the reloads.
+	tlsConfig atomic.Pointer[tls.Config]
+	reloader  ReloadFunc
+	reloadMu  sync.Mutex
+
+	// limiter takes the tokens of the callers and of the keys, it is shared
+	// by the peers of a cluster
+	limiter  ratelimit.Limiter
+	keyLimit ratelimit.Limit
+	// authLimit caps the logins and the failed authentications of each
+	// client address
+	authLimit ratelimit.Limit
+
+	// the api handler is built once, by Start or Handler
+	handlerOnce sync.Once
+	handlerErr  error
 
-	storage Storage
+	// limits of the api requests, inFlight counts the requests being
+	// served and draining is set on shutdown
+	limits   HTTPLimits
+	inFlight atomic.Int64
+	draining atomic.Bool
+
+	// readiness of the cluster, see Ready
+	healthLimiter *rate.Limiter
+	peersJoined   atomic.Bool
+	peerListening atomic.Bool
 
 	logger *slog.Logger
 }
 
+// Option configures optional features of the Server.
+type Option func(*Server)
+
+// WithStorage sets the storage of the keys, an in-memory cache is used
+// by default.
+func WithStorage(store Storage) Option {
+	return func(s *Server) {
+		s.storage = store
+	}
+}
+
+// WithKeyDefaults sets the type, size and ttl of the keys created without
+// the X-Key-Type, X-Key-Size or X-Key-TTL headers.
+func WithKeyDefaults(keyType, size string, ttl time.Duration) Option {
+	return func(s *Server) {
+		s.keyType = keyType
+		s.keySize = size
+		s.keyTTL = ttl
+	}
+}
+
+// WithKeyPool creates the keys from the pregenerated keys of the pool, its
+// workers run with the server.
+func WithKeyPool(pool *keys.Pool) Option {
+	return func(s *Server) {
+		s.keyPool = pool
+	}
+}
+
+// WithKeyRateLimit limits the encryptions and decryptions per second of
+// each key by the callers without key_rate_limit in their policies, their
+// requests share it. The keys are not limited by default.
+func WithKeyRateLimit(limit ratelimit.Limit) Option {
+	return func(s *Server) {
+		s.keyLimit = limit
+	}
+}
+
+// WithAuthRateLimit limits the logins and the failed authentications per
+// second of each client address, beyond it they are answered 429. The
+// default is 10 per second with bursts of 20.
+func WithAuthRateLimit(limit ratelimit.Limit) Option {
+	return func(s *Server) {
+		s.authLimit = limit
+	}
+}
+
+// WithTokenMaxTTL bounds the ttl of the service tokens, renewals included,
+// auth.DefaultMaxTokenTTL by default.
+func WithTokenMaxTTL(ttl time.Duration) Option {
+	return func(s *Server) {
+		s.tokenMaxTTL = ttl
+	}
+}
+
+// WithAddr sets the listen addresses of the api and groupcache servers.
+func WithAddr(api, gc string) Option {
+	return func(s *Server) {
+		s.api.Addr = api
+		s.gc.Addr = gc
+	}
+}
+
+// WithPeerDiscovery enables the cluster mode. The self argument is the
+// groupcache base URL of this server as seen by the peers.
+func WithPeerDiscovery(self string, discovery cluster.Discoverer) Option {
+	return func(s *Server) {
+		s.self = self
+		s.discovery = discovery
+	}
+}
+
+// WithPeerTLS enables mutual TLS on the peer listener and on the requests
+// to the peers. It is required in cluster mode.
+func WithPeerTLS(peerTLS *cluster.PeerTLS) Option {
+	return func(s *Server) {
+		s.peerTLS = peerTLS
+	}
+}
+
+// WithJWTVerifier sets the verifier of the bearer tokens of the api.
+func WithJWTVerifier(verifier *auth.Verifier) Option {
+	return func(s *Server) {
+		s.verifier = verifier
+	}
+}
+
+// WithTLS serves the api over TLS, see NewTLSConfig. The configuration
+// can be swapped with SetTLSConfig.
+func WithTLS(cfg *tls.Config) Option {
+	return func(s *Server) {
+		s.tlsConfig.Store(withNextProtos(cfg))
+		s.api.TLSConfig = &tls.Config{GetConfigForClient: s.getTLSConfig}
+	}
+}
+
+// WithCertAuth authenticates the callers without bearer token with their
+// client certificate. The TLS configuration of the api must have client CAs.
+func WithCertAuth(certAuth *auth.CertAuth) Option {
+	return func(s *Server) {
+		s.certAuth = certAuth
+	}
+}
+
+// WithAudit records the requests of the api, they are refused when the
+// audit log can not be written.
+func WithAudit(auditor *audit.Logger) Option {
+	return func(s *Server) {
+		s.audit = auditor
+	}
+}
+
+// WithACL sets the policies granted to the callers. Only the root policy is
+// known by default.
+func WithACL(acl *auth.ACL) Option {
+	return func(s *Server) {
+		s.acl = acl
+	}
+}
+
 // NewServer creates a new Server instance.
-func New(storage Storage) *Server {
-	return &Server{
+func New(opts ...Option) *Server {
+	s := &Server{
 		api: &http.Server{
 			Addr: ":8080",
 		},
-		mux: http.NewServeMux(),
+		mux:    http.NewServeMux(),
+		public: http.NewServeMux(),
 		gc: &http.Server{
 			Addr: ":8081",
 		},
-		storage: storage,
+		self:    "http://127.0.0.1:8081",
+		acl:     auth.NewACL(),
+		keyType: kyber.KeyType,
+		keySize: kyber.Size1024,
+		keyTTL:  keys.DefaultKeyTTL,
+
+		tokenMaxTTL: auth.DefaultMaxTokenTTL,
+		jobs:        newJobStore(),
+		limits:      DefaultHTTPLimits,
+
+		authLimit:     ratelimit.Limit{Rate: defaultAuthRate, Burst: defaultAuthBurst},
+		healthLimiter: rate.NewLimiter(defaultHealthRate, defaultHealthBurst),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if s.storage == nil {
+		s.storage = storage.NewInMemoryCache()
+	}
+	s.applyLimits()
+	s.usage = storage.NewUsageTracker(s.storage)
+	s.tokens = auth.NewTokenStore(s.storage)
+	s.tokens.SetMaxTTL(s.tokenMaxTTL)
+	s.approles = auth.NewAppRoleStore(s.storage, s.tokens)
+
+	var poolOpts *cluster.PoolOptions
+	var transport http.RoundTripper
+	if s.peerTLS != nil {
+		transport = s.peerTLS.Transport()
+		poolOpts = &cluster.PoolOptions{
+			Transport: func(context.Context) http.RoundTripper { return transport },
+		}
+		s.gc.TLSConfig = s.peerTLS.Config()
+		s.peerTLS.Configure(s.discovery)
 	}
+	s.pool = cluster.NewPool(s.self, poolOpts)
+
+	s.limiter = ratelimit.NewLocal()
+	if s.clustered() && transport != nil {
+		s.limiter = ratelimit.NewCluster(s.pool.Self(), s.pool.Owner, transport)
+	}
+
+	return s
+}
+
+// log returns the logger of the request, it carries the request id, the
+// route and the identity of the caller.
+func (s *Server) log(ctx context.Context) *slog.Logger {
+	if logger := common.GetLoggerFromContext(ctx); logger != nil {
+		return logger
+	}
+
+	return s.logger
+}
+
+// clustered reports whether the server exchanges data with peers.
+func (s *Server) clustered() bool {
+	_, ok := s.storage.(peerService)
+	return s.discovery != nil || ok
+}
+
+// Handler returns the handler of the api, e.g. to serve it with httptest
+// instead of Start. The routes are registered on the first call. The root
+// token is only generated by Start.
+func (s *Server) Handler(ctx context.Context) (http.Handler, error) {
+	s.handlerOnce.Do(func() {
+		s.handlerErr = s.buildHandler(ctx)
+	})
+
+	return s.api.Handler, s.handlerErr
+}
+
+func (s *Server) buildHandler(ctx context.Context) error {
+	s.logger = cmp.Or(s.logger, common.GetLoggerFromContext(ctx), slog.Default())
+
+	s.handle(s.mux, "GET /transit/keys", http.HandlerFunc(s.ListKeys))
+	s.handle(s.mux, "POST /transit/keys/{name}", requireCapability(s.acl, auth.CapCreate, keyPath, http.HandlerFunc(s.CreateKyberKey)))
+	s.handle(s.mux, "GET /transit/keys/{name}", requireCapability(s.acl, auth.CapRead, keyPath, http.HandlerFunc(s.ReadKey)))
+	s.handle(s.mux, "GET /transit/keys/{name}/jobs/{id}", requireCapability(s.acl, auth.CapRead, keyPath, http.HandlerFunc(s.KeyJob)))
+	s.handle(s.mux, "DELETE /transit/keys/{name}", requireCapability(s.acl, auth.CapDelete, keyPath, http.HandlerFunc(s.RevokeKyberKey)))
+
+	s.handle(s.mux, "POST /transit/encrypt/{name}", requireCapability(s.acl, auth.CapEncrypt, keyPath, limitKey(s.limiter, s.acl, s.keyLimit, http.HandlerFunc(s.Encrypt))))
+	s.handle(s.mux, "POST /transit/decrypt/{name}", requireCapability(s.acl, auth.CapDecrypt, keyPath, limitKey(s.limiter, s.acl, s.keyLimit, http.HandlerFunc(s.Decrypt))))
+
+	s.handle(s.mux, "POST /auth/token/create", requireCapability(s.acl, auth.CapCreate, fixedPath("auth/token/create"), http.HandlerFunc(s.CreateToken)))
+	s.handle(s.mux, "POST /auth/token/revoke", requireCapability(s.acl, auth.CapDelete, fixedPath("auth/token/revoke"), http.HandlerFunc(s.RevokeToken)))
+	s.handle(s.mux, "GET /auth/token/lookup-self", http.HandlerFunc(s.LookupSelfToken))
+	s.handle(s.mux, "POST /auth/token/renew-self", http.HandlerFunc(s.RenewSelfToken))
+	s.handle(s.mux, "POST /auth/token/revoke-self", http.HandlerFunc(s.RevokeSelfToken))
+
+	s.handle(s.mux, "POST /auth/approle/role/{name}", requireCapability(s.acl, auth.CapCreate, rolePath, http.HandlerFunc(s.SetAppRole)))
+	s.handle(s.mux, "GET /auth/approle/role/{name}", requireCapability(s.acl, auth.CapRead, rolePath, http.HandlerFunc(s.GetAppRole)))
+	s.handle(s.mux, "DELETE /auth/approle/role/{name}", requireCapability(s.acl, auth.CapDelete, rolePath, http.HandlerFunc(s.DeleteAppRole)))
+	s.handle(s.mux, "POST /auth/approle/role/{name}/secret-id", requireCapability(s.acl, auth.CapCreate, secretIDPath, http.HandlerFunc(s.GenerateAppRoleSecretID)))
+	s.handle(s.public, "POST /auth/approle/login", limitAddr(s.limiter, s.authLimit, http.HandlerFunc(s.AppRoleLogin)))
+
+	s.handle(s.public, "GET /sys/health", s.limitHealth(http.HandlerFunc(s.Health)))
+	s.handle(s.public, "GET /sys/ready", s.limitHealth(http.HandlerFunc(s.Ready)))
+	s.handle(s.mux, "POST /sys/reload", requireCapability(s.acl, auth.CapCreate, fixedPath("sys/reload"), http.HandlerFunc(s.Reload)))
+
+	var storageCollectors []prometheus.Collector
+	if cs, ok := s.storage.(collectorStorage); ok {
+		storageCollectors = append(storageCollectors, cs.Collector())
+	}
+	registry, err := metrics.NewRegistry(storageCollectors...)
+	if err != nil {
+		s.logger.Error("failed to register the metrics", "error", err.Error())
+		return err
+	}
+	s.handle(s.public, "GET /metrics", metrics.Handler(registry))
+	s.handle(s.public, "GET /docs/openapi.json", http.HandlerFunc(s.OpenAPI))
+
+	muxes := []*http.ServeMux{s.public, s.mux}
+	s.api.Handler = inFlightMiddleware(&s.inFlight, tracingMiddleware(muxes, metricsMiddleware(muxes,
+		initMiddlewares(ctx, s.public, s.mux, s.verifier, s.tokens, s.certAuth, s.audit, authFailures{s.limiter, s.authLimit}, limitCaller(s.limiter, s.acl, s.mux)),
+	)))
+
+	return nil
+}
+
+// initTokens initializes the token store and logs the root token generated
+// on the first start.
+func (s *Server) initTokens(ctx context.Context) error {
+	root, err := s.tokens.Init(ctx)
+	if err != nil {
+		return err
+	}
+	if root != "" {
+		s.logger.Info("Root token generated, it will not be shown again", "token", root)
+	}
+
+	return nil
+}
+
+// initPeerTokens initializes the token store once the peers joined. The
+// owner of the entries may not listen yet, it is retried until it succeeds
+// or the server stops.
+func (s *Server) initPeerTokens(ctx context.Context, joined <-chan struct{}) {
+	select {
+	case <-ctx.Done():
+		return
+	case <-joined:
+	}
+
+	t := time.NewTicker(tokenInitInterval)
+	defer t.Stop()
+	for {
+		err := s.initTokens(ctx)
+		if err == nil {
+			return
+		}
+		s.logger.Warn("failed to initialize the token store", "error", err.Error())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// handle registers the route on the mux.
+func (s *Server) handle(mux *http.ServeMux, pattern string, h http.Handler) {
+	mux.Handle(pattern, h)
+	s.routes = append(s.routes, pattern)
 }
 
 // Start starts the server.
 func (s *Server) Start(ctx context.Context) error {
 	s.logger = common.GetLoggerFromContext(ctx)
 
+	if s.clustered() && s.peerTLS == nil {
+		s.logger.Error("refusing to start without peer mTLS in cluster mode")
+		return cluster.PeerTLSRequiredError
+	}
+
+	if tlsConfig := s.tlsConfig.Load(); s.certAuth != nil && (tlsConfig == nil || tlsConfig.ClientCAs == nil) {
+		s.logger.Error("refusing to start the cert auth without client CAs")
+		return auth.ClientCAsRequiredError
+	}
+
 	ctx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGKILL)
 	defer stop()
 
-	s.mux.Handle("POST /transit/keys/{name}", http.HandlerFunc(s.CreateKyberKey))
-	s.mux.Handle("DELETE /transit/keys/{name}", http.HandlerFunc(s.RevokeKyberKey))
+	// the entries of the token store are owned by the groupcache peers, it
+	// is initialized once they are known
+	_, shared := s.storage.(groupStorage)
+	initOnJoin := shared && s.discovery != nil
+	if !initOnJoin {
+		if err := s.initTokens(ctx); err != nil {
+			s.logger.Error("failed to initialize the token store", "error", err.Error())
+			return err
+		}
+	}
 
-	s.mux.Handle("POST /transit/encrypt/{name}", http.HandlerFunc(s.Encrypt))
-	s.mux.Handle("POST /transit/decrypt/{name}", http.HandlerFunc(s.Decrypt))
+	if _, err := s.Handler(ctx); err != nil {
+		return err
+	}
 
-	s.api.Handler = initMiddlewares(ctx, s.mux)
+	if s.grpcAddr != "" {
+		s.grpc = s.newGRPCServer()
+	}
+
+	if gs, ok := s.storage.(groupStorage); ok {
+		s.pool.Bind(gs.GroupName())
+		defer s.pool.Unbind(gs.GroupName())
+	}
 
 	errWg, errCtx := errgroup.WithContext(ctx)
 
@@ -71,7 +500,6 @@ func (s *Server) Start(ctx context.Context) error {
 			return err
 		}
 		s.logger.Info("server started", "address", s.api.Addr)
-		s.logger.Info("Use the following token to authenticate with server", "token", token)
 		if s.api.TLSConfig != nil {
 			return s.api.ServeTLS(l, "", "")
 		}
@@ -79,10 +507,40 @@ func (s *Server) Start(ctx context.Context) error {
 		return s.api.Serve(l)
 	})
 
+	if s.grpc != nil {
+		errWg.Go(func() error {
+			lc := net.ListenConfig{}
+			l, err := lc.Listen(ctx, "tcp", s.grpcAddr)
+			if err != nil {
+				s.logger.Error("failed to start listener", "error", err.Error())
+				return err
+			}
+			s.logger.Info("grpc server started", "address", s.grpcAddr)
+
+			return s.grpc.Serve(l)
+		})
+	}
+
+	// the peer listener serves the keys by name, it is only exposed when
+	// the server is part of a cluster
 	errWg.Go(func() error {
+		if !s.clustered() {
+			return nil
+		}
+
 		// Start groupcache server
-		pool := groupcache.NewHTTPPoolOpts("http://127.0.0.1:8081", &groupcache.HTTPPoolOptions{})
-		s.gc.Handler = pool
+		gcMux := http.NewServeMux()
+		gcMux.Handle(cluster.BasePath, s.pool)
+		if h, ok := s.discovery.(http.Handler); ok {
+			gcMux.Handle(cluster.GossipPath, h)
+		}
+		if ps, ok := s.storage.(peerService); ok {
+			gcMux.Handle(ps.PeerPath(), ps)
+		}
+		if ps, ok := s.limiter.(peerService); ok {
+			gcMux.Handle(ps.PeerPath(), ps)
+		}
+		s.gc.Handler = gcMux
 
 		lc := net.ListenConfig{}
 		l, err := lc.Listen(ctx, "tcp", s.gc.Addr)
@@ -91,6 +549,8 @@ func (s *Server) Start(ctx context.Context) error {
 			return err
 		}
 		s.logger.Info("groupcache server started", "address", s.gc.Addr)
+		s.peerListening.Store(true)
+		defer s.peerListening.Store(false)
 		if s.gc.TLSConfig != nil {
 			return s.gc.ServeTLS(l, "", "")
 		}
@@ -98,13 +558,50 @@ func (s *Server) Start(ctx context.Context) error {
 		return s.gc.Serve(l)
 	})
 
+	// SIGHUP reloads the configuration instead of stopping the server
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
 	errWg.Go(func() error {
-		<-errCtx.Done()
-		timeoutCtx, cancel := context.WithDeadline(context.Background(), time.Now().Add(5*time.Second))
-		defer cancel()
+		for {
+			select {
+			case <-errCtx.Done():
+				return nil
+			case <-hup:
+				s.reload(errCtx)
+			}
+		}
+	})
 
-		s.api.Shutdown(timeoutCtx)
-		s.gc.Shutdown(timeoutCtx)
+	if s.keyPool != nil {
+		errWg.Go(func() error {
+			return s.keyPool.Run(errCtx)
+		})
+	}
+
+	if s.discovery != nil {
+		joined := make(chan struct{})
+		var joinOnce sync.Once
+		errWg.Go(func() error {
+			return s.discovery.Run(errCtx, func(peers []string) {
+				s.pool.Set(peers...)
+				s.peersJoined.Store(true)
+				joinOnce.Do(func() { close(joined) })
+				s.logger.Info("cluster membership changed", "self", s.pool.Self(), "peers", peers)
+			})
+		})
+
+		if initOnJoin {
+			errWg.Go(func() error {
+				s.initPeerTokens(errCtx, joined)
+				return nil
+			})
+		}
+	}
+
+	errWg.Go(func() error {
+		<-errCtx.Done()
+		s.shutdown()
 
 		return nil
 	})
@@ -20,7 +20,7 @@ func TestServerGracefulStop(t *testing.T) {
 	logger := slog.New(slog.NewTextHandler(t.Output(), &slog.HandlerOptions{Level: slog.LevelDebug}))
 	ctx = common.LoggerWithContext(ctx, logger)
 
-	server := New(cache)
+	server := New(WithStorage(cache))
 
 	go func() {
 		time.Sleep(25 * time.Millisecond)
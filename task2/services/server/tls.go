@@ -0,0 +1,82 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// TLSOptions configures the TLS listener of the api.
+type TLSOptions struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile enables the client certificates, they are verified
+	// against these CAs when given and used by the cert auth.
+	ClientCAFile string
+	// MinVersion is "1.2" or "1.3", defaults to "1.2".
+	MinVersion string
+	// CipherSuites are the names of the TLS 1.2 cipher suites, e.g.
+	// TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256. The secure suites of Go are
+	// used when empty, the TLS 1.3 ones are not configurable.
+	CipherSuites []string
+}
+
+var tlsVersions = map[string]uint16{
+	"":    tls.VersionTLS12,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// NewTLSConfig loads the TLS configuration of the api listener.
+func NewTLSConfig(opts TLSOptions) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tls certificate: %w", err)
+	}
+
+	version, ok := tlsVersions[opts.MinVersion]
+	if !ok {
+		return nil, fmt.Errorf("unsupported tls min version: %s", opts.MinVersion)
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   version,
+	}
+
+	for _, name := range opts.CipherSuites {
+		id, ok := cipherSuite(strings.TrimSpace(name))
+		if !ok {
+			return nil, fmt.Errorf("unsupported cipher suite: %s", name)
+		}
+		cfg.CipherSuites = append(cfg.CipherSuites, id)
+	}
+
+	if opts.ClientCAFile != "" {
+		caPEM, err := os.ReadFile(opts.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client ca: %w", err)
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("invalid client ca: no certificate found")
+		}
+		// bearer tokens are still accepted without client certificate
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return cfg, nil
+}
+
+// cipherSuite returns the id of a secure cipher suite by name.
+func cipherSuite(name string) (uint16, bool) {
+	for _, cs := range tls.CipherSuites() {
+		if cs.Name == name {
+			return cs.ID, true
+		}
+	}
+
+	return 0, false
+}
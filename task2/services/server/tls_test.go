@@ -0,0 +1,162 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"enclave-task2/pkg/auth"
+	"enclave-task2/pkg/cluster/clustertest"
+	"enclave-task2/pkg/common"
+	"enclave-task2/pkg/storage"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTLSFiles writes a CA and a server certificate for 127.0.0.1 signed
+// by it, it returns their paths.
+func writeTLSFiles(t *testing.T, ca *clustertest.CA) TLSOptions {
+	dir := t.TempDir()
+	certPEM, keyPEM := ca.Issue(t, "127.0.0.1")
+
+	opts := TLSOptions{
+		CertFile:     filepath.Join(dir, "cert.pem"),
+		KeyFile:      filepath.Join(dir, "key.pem"),
+		ClientCAFile: filepath.Join(dir, "ca.pem"),
+	}
+	assert.NoError(t, os.WriteFile(opts.CertFile, certPEM, 0o600))
+	assert.NoError(t, os.WriteFile(opts.KeyFile, keyPEM, 0o600))
+	assert.NoError(t, os.WriteFile(opts.ClientCAFile, ca.PEM, 0o600))
+
+	return opts
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	opts := writeTLSFiles(t, clustertest.NewCA(t))
+
+	cfg, err := NewTLSConfig(opts)
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS12), cfg.MinVersion)
+	assert.Equal(t, tls.VerifyClientCertIfGiven, cfg.ClientAuth)
+	assert.NotNil(t, cfg.ClientCAs)
+
+	opts.MinVersion = "1.3"
+	opts.CipherSuites = []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"}
+	cfg, err = NewTLSConfig(opts)
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS13), cfg.MinVersion)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}, cfg.CipherSuites)
+
+	_, err = NewTLSConfig(TLSOptions{CertFile: opts.CertFile, KeyFile: opts.KeyFile, MinVersion: "1.0"})
+	assert.ErrorContains(t, err, "min version")
+
+	// insecure suites are refused
+	_, err = NewTLSConfig(TLSOptions{CertFile: opts.CertFile, KeyFile: opts.KeyFile, CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}})
+	assert.ErrorContains(t, err, "cipher suite")
+
+	_, err = NewTLSConfig(TLSOptions{CertFile: opts.CertFile, KeyFile: opts.KeyFile, ClientCAFile: opts.KeyFile})
+	assert.ErrorContains(t, err, "client ca")
+
+	_, err = NewTLSConfig(TLSOptions{CertFile: "missing.pem", KeyFile: opts.KeyFile})
+	assert.Error(t, err)
+}
+
+func TestCertAuthMiddleware(t *testing.T) {
+	ctx := common.LoggerWithContext(context.Background(), slog.New(slog.NewTextHandler(t.Output(), nil)))
+	ca := clustertest.NewCA(t)
+
+	cfg, err := NewTLSConfig(writeTLSFiles(t, ca))
+	assert.NoError(t, err)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/test", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Join(auth.GetClaimsFromContext(r.Context()).Policies, ",")))
+	})
+	certAuth := auth.NewCertAuth(auth.CertRole{Name: "ci", Policies: []string{"payments"}, AllowedDNSSANs: []string{"*.ci.example.com"}})
+	tokens := auth.NewTokenStore(storage.NewNamedInMemoryCache("cert-auth"))
+
+	srv := httptest.NewUnstartedServer(initMiddlewares(ctx, http.NewServeMux(), mux, nil, tokens, certAuth, nil, authFailures{}, mux))
+	srv.TLS = cfg
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.PEM)
+	get := func(t *testing.T, clientCA *clustertest.CA, host, bearer string) (*http.Response, error) {
+		clientCfg := &tls.Config{RootCAs: roots}
+		if clientCA != nil {
+			certPEM, keyPEM := clientCA.Issue(t, host)
+			cert, err := tls.X509KeyPair(certPEM, keyPEM)
+			assert.NoError(t, err)
+			clientCfg.Certificates = []tls.Certificate{cert}
+		}
+
+		transport := &http.Transport{TLSClientConfig: clientCfg}
+		defer transport.CloseIdleConnections()
+
+		req, err := http.NewRequest(http.MethodGet, srv.URL+"/test", nil)
+		assert.NoError(t, err)
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+
+		return (&http.Client{Transport: transport}).Do(req)
+	}
+
+	t.Run("matching certificate", func(t *testing.T) {
+		res, err := get(t, ca, "runner-1.ci.example.com", "")
+		assert.NoError(t, err)
+		defer res.Body.Close()
+
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		body, err := io.ReadAll(res.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, "payments", string(body))
+	})
+
+	t.Run("certificate without role", func(t *testing.T) {
+		res, err := get(t, ca, "other.example.com", "")
+		assert.NoError(t, err)
+		defer res.Body.Close()
+
+		assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	})
+
+	t.Run("no certificate nor token", func(t *testing.T) {
+		res, err := get(t, nil, "", "")
+		assert.NoError(t, err)
+		defer res.Body.Close()
+
+		assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	})
+
+	t.Run("bearer token without certificate", func(t *testing.T) {
+		raw, _, err := tokens.Create(ctx, "test", []string{"billing"}, 0)
+		assert.NoError(t, err)
+
+		res, err := get(t, nil, "", raw)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+	})
+
+	t.Run("certificate of another CA", func(t *testing.T) {
+		_, err := get(t, clustertest.NewCA(t), "runner-1.ci.example.com", "")
+		assert.Error(t, err)
+	})
+}
+
+func TestServerRequiresClientCAsForCertAuth(t *testing.T) {
+	ctx := common.LoggerWithContext(context.Background(), slog.New(slog.NewTextHandler(t.Output(), nil)))
+
+	server := New(WithStorage(storage.NewNamedInMemoryCache("cert-auth-start")), WithCertAuth(auth.NewCertAuth()))
+	assert.Equal(t, auth.ClientCAsRequiredError, server.Start(ctx))
+}
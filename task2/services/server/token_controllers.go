@@ -0,0 +1,211 @@
+package server
+
+import (
+	"enclave-task2/pkg/auth"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+type createTokenRequest struct {
+	DisplayName string   `json:"display_name"`
+	Policies    []string `json:"policies"`
+	TTL         string   `json:"ttl"`
+}
+
+type createTokenResponse struct {
+	ClientToken string `json:"token"`
+	*auth.Token
+}
+
+type revokeTokenRequest struct {
+	Token string `json:"token"`
+}
+
+type renewTokenRequest struct {
+	Increment string `json:"increment"`
+}
+
+// decodeBody decodes the optional JSON body of a request.
+func decodeBody(req *http.Request, v any) error {
+	err := json.NewDecoder(req.Body).Decode(v)
+	if err == io.EOF {
+		return nil
+	}
+
+	return err
+}
+
+func writeJSON(rw http.ResponseWriter, status int, v any) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(v)
+}
+
+// CreateToken issues a service token. The policies default to the ones of
+// the caller and can not exceed them unless the caller is root. The token
+// does not outlive the one of the caller nor the max ttl, the ttl is
+// clamped.
+func (s *Server) CreateToken(rw http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	claims := auth.GetClaimsFromContext(ctx)
+
+	var body createTokenRequest
+	if err := decodeBody(req, &body); err != nil {
+		http.Error(rw, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var ttl time.Duration
+	if body.TTL != "" {
+		var err error
+		ttl, err = time.ParseDuration(body.TTL)
+		if err != nil || ttl < 0 {
+			http.Error(rw, "invalid ttl", http.StatusBadRequest)
+			return
+		}
+	}
+
+	policies := body.Policies
+	if policies == nil {
+		policies = claims.Policies
+	}
+	if exceedsPolicies(claims, policies) {
+		http.Error(rw, "policies exceed the ones of the caller", http.StatusForbidden)
+		return
+	}
+
+	token, info, err := s.tokens.CreateChild(ctx, claims, body.DisplayName, policies, ttl)
+	if errors.Is(err, auth.InvalidPoliciesError) {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err == auth.InvalidTokenError {
+		http.Error(rw, "the token of the caller expired", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		s.log(ctx).Error("failed to create token", "error", err)
+		http.Error(rw, "failed to create token", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(rw, http.StatusOK, createTokenResponse{ClientToken: token, Token: info})
+}
+
+// RevokeToken revokes the token of the body.
+func (s *Server) RevokeToken(rw http.ResponseWriter, req *http.Request) {
+	var body revokeTokenRequest
+	if err := decodeBody(req, &body); err != nil || body.Token == "" {
+		http.Error(rw, "token is required", http.StatusBadRequest)
+		return
+	}
+
+	s.revokeToken(rw, req, body.Token)
+}
+
+// RevokeSelfToken revokes the token of the caller.
+func (s *Server) RevokeSelfToken(rw http.ResponseWriter, req *http.Request) {
+	token, ok := serviceToken(rw, req)
+	if !ok {
+		return
+	}
+
+	s.revokeToken(rw, req, token)
+}
+
+func (s *Server) revokeToken(rw http.ResponseWriter, req *http.Request, token string) {
+	err := s.tokens.Revoke(req.Context(), token)
+	if err == auth.InvalidTokenError {
+		http.Error(rw, "token not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.log(req.Context()).Error("failed to revoke token", "error", err)
+		http.Error(rw, "failed to revoke token", http.StatusInternalServerError)
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// LookupSelfToken describes the token of the caller.
+func (s *Server) LookupSelfToken(rw http.ResponseWriter, req *http.Request) {
+	token, ok := serviceToken(rw, req)
+	if !ok {
+		return
+	}
+
+	info, err := s.tokens.Lookup(req.Context(), token)
+	if err != nil {
+		s.log(req.Context()).Error("failed to lookup token", "error", err)
+		http.Error(rw, "failed to lookup token", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(rw, http.StatusOK, info)
+}
+
+// RenewSelfToken extends the token of the caller by the increment, bounded
+// by the ttl the token was issued with.
+func (s *Server) RenewSelfToken(rw http.ResponseWriter, req *http.Request) {
+	token, ok := serviceToken(rw, req)
+	if !ok {
+		return
+	}
+
+	var body renewTokenRequest
+	if err := decodeBody(req, &body); err != nil {
+		http.Error(rw, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var increment time.Duration
+	if body.Increment != "" {
+		var err error
+		increment, err = time.ParseDuration(body.Increment)
+		if err != nil || increment < 0 {
+			http.Error(rw, "invalid increment", http.StatusBadRequest)
+			return
+		}
+	}
+
+	info, err := s.tokens.Renew(req.Context(), token, increment)
+	if err != nil {
+		s.log(req.Context()).Error("failed to renew token", "error", err)
+		http.Error(rw, "failed to renew token", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(rw, http.StatusOK, info)
+}
+
+// exceedsPolicies reports whether the policies are not all granted to the
+// caller, root can grant any policy.
+func exceedsPolicies(claims *auth.Claims, policies []string) bool {
+	if slices.Contains(claims.Policies, auth.RootPolicy) {
+		return false
+	}
+	for _, p := range policies {
+		if !slices.Contains(claims.Policies, p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// serviceToken returns the service token the caller authenticated with.
+func serviceToken(rw http.ResponseWriter, req *http.Request) (string, bool) {
+	token, _ := bearerToken(req)
+	if !strings.HasPrefix(token, auth.TokenPrefix) {
+		http.Error(rw, "not authenticated with a service token", http.StatusBadRequest)
+		return "", false
+	}
+
+	return token, true
+}
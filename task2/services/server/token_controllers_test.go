@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"enclave-task2/pkg/auth"
+	"enclave-task2/pkg/storage"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenControllers(t *testing.T) {
+	ctx := context.Background()
+	server := New(WithStorage(storage.NewNamedInMemoryCache("token-controllers")))
+	server.logger = slog.New(slog.NewTextHandler(t.Output(), &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	// request authenticates the caller with the service token
+	request := func(method, target, body, token string) *http.Request {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		info, err := server.tokens.Lookup(ctx, token)
+		if err == nil {
+			ctx = auth.ClaimsWithContext(ctx, info.Claims())
+		}
+
+		return req.WithContext(ctx)
+	}
+
+	root, err := server.tokens.Init(ctx)
+	assert.NoError(t, err)
+
+	var created createTokenResponse
+	t.Run("create", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		server.CreateToken(rw, request(http.MethodPost, "/auth/token/create", `{"display_name": "ci", "policies": ["payments"], "ttl": "1h"}`, root))
+
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.NoError(t, json.NewDecoder(rw.Body).Decode(&created))
+		assert.True(t, strings.HasPrefix(created.ClientToken, auth.TokenPrefix))
+		assert.Equal(t, "ci", created.DisplayName)
+		assert.Equal(t, []string{"payments"}, created.Policies)
+	})
+
+	t.Run("create exceeding the caller policies", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		server.CreateToken(rw, request(http.MethodPost, "/auth/token/create", `{"policies": ["billing"]}`, created.ClientToken))
+
+		assert.Equal(t, http.StatusForbidden, rw.Code)
+	})
+
+	t.Run("create outliving the caller", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		server.CreateToken(rw, request(http.MethodPost, "/auth/token/create", `{"ttl": "10h"}`, created.ClientToken))
+
+		assert.Equal(t, http.StatusOK, rw.Code)
+		var child createTokenResponse
+		assert.NoError(t, json.NewDecoder(rw.Body).Decode(&child))
+		assert.WithinDuration(t, created.ExpireTime, child.ExpireTime, time.Second)
+	})
+
+	t.Run("create with invalid ttl", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		server.CreateToken(rw, request(http.MethodPost, "/auth/token/create", `{"ttl": "soon"}`, root))
+
+		assert.Equal(t, http.StatusBadRequest, rw.Code)
+	})
+
+	t.Run("lookup-self", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		server.LookupSelfToken(rw, request(http.MethodGet, "/auth/token/lookup-self", "", created.ClientToken))
+
+		assert.Equal(t, http.StatusOK, rw.Code)
+		var info auth.Token
+		assert.NoError(t, json.NewDecoder(rw.Body).Decode(&info))
+		assert.Equal(t, created.Accessor, info.Accessor)
+		assert.NotContains(t, rw.Body.String(), created.ClientToken)
+	})
+
+	t.Run("lookup-self with a JWT", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		server.LookupSelfToken(rw, request(http.MethodGet, "/auth/token/lookup-self", "", token))
+
+		assert.Equal(t, http.StatusBadRequest, rw.Code)
+	})
+
+	t.Run("renew-self", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		server.RenewSelfToken(rw, request(http.MethodPost, "/auth/token/renew-self", `{"increment": "10m"}`, created.ClientToken))
+
+		assert.Equal(t, http.StatusOK, rw.Code)
+		var info auth.Token
+		assert.NoError(t, json.NewDecoder(rw.Body).Decode(&info))
+		assert.WithinDuration(t, time.Now().Add(10*time.Minute), info.ExpireTime, time.Second)
+	})
+
+	t.Run("revoke", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		server.RevokeToken(rw, request(http.MethodPost, "/auth/token/revoke", `{"token": "`+created.ClientToken+`"}`, root))
+		assert.Equal(t, http.StatusNoContent, rw.Code)
+
+		rw = httptest.NewRecorder()
+		server.RevokeToken(rw, request(http.MethodPost, "/auth/token/revoke", `{"token": "`+created.ClientToken+`"}`, root))
+		assert.Equal(t, http.StatusNotFound, rw.Code)
+
+		rw = httptest.NewRecorder()
+		server.RevokeToken(rw, request(http.MethodPost, "/auth/token/revoke", `{}`, root))
+		assert.Equal(t, http.StatusBadRequest, rw.Code)
+	})
+
+	t.Run("revoke-self", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		server.RevokeSelfToken(rw, request(http.MethodPost, "/auth/token/revoke-self", "", root))
+		assert.Equal(t, http.StatusNoContent, rw.Code)
+
+		_, err := server.tokens.Lookup(ctx, root)
+		assert.Equal(t, auth.InvalidTokenError, err)
+	})
+}